@@ -3,8 +3,12 @@ module github.com/c4milo/gsync
 go 1.16
 
 require (
+	github.com/cespare/xxhash/v2 v2.1.2
 	github.com/hooklift/assert v0.1.0
+	github.com/klauspost/reedsolomon v1.10.0
 	github.com/minio/sha256-simd v1.0.0
 	github.com/pkg/errors v0.9.1
 	github.com/pkg/profile v1.5.0
+	github.com/zeebo/blake3 v0.2.3
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 )
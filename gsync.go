@@ -3,70 +3,248 @@
 // file, You can obtain one at http://mozilla.org/MPL/2.0/.
 
 // Package gsync implements a rsync-based algorithm for sending delta updates to a remote server.
+//
+// Functions returning channels, such as Signatures and Sync, produce values on them from a new
+// goroutine, which closes the channel once done, after a failure or when the context is cancelled.
+// Callers own those channels and must either read them until closed or cancel the context, or the
+// goroutine leaks, blocked sending. Drain and DrainSignatures read a channel until closed, while
+// CloseAndDrain and CloseAndDrainSignatures cancel the context first, for callers abandoning it.
+//
+// Compatibility: operation streams end with a Done operation, which carries neither data nor
+// an index. This is a breaking change for consumers written against earlier versions, which
+// handled every operation without data as a copy of the block at Index: they would apply the
+// Done operation as an extra copy of block 0, silently corrupting the reconstructed file. Such
+// consumers must skip Done operations, or switch to Apply.
+//
+// Likewise, signature streams end with a Done signature, whose Weak checksum and Index are zero
+// and whose Strong checksum is empty. Consumers that do not check Done index it as block 0, so
+// that a source block whose weak checksum is zero is matched against it. LookUpTable skips it;
+// other consumers must skip Done signatures too.
 package gsync
 
-import "sync"
+import (
+	"hash/crc32"
+	"math"
+	"sync"
+)
 
 const (
 	// DefaultBlockSize is the default block size.
 	DefaultBlockSize = 6 * 1024 // 6kb
 )
 
+// maxIndex returns the largest index of a block whose offset fits in an int64.
+func (o *options) maxIndex() uint64 {
+	return uint64(math.MaxInt64 / o.size)
+}
+
+// blockOffset returns the offset of the block at index, failing with ErrOffsetOverflow if it does
+// not fit in an int64, as happens with crafted indices.
+func (o *options) blockOffset(index uint64) (int64, error) {
+	if index > o.maxIndex() {
+		return 0, &BlockError{Index: index, Kind: ErrOffsetOverflow}
+	}
+	return int64(index) * int64(o.size), nil
+}
+
 // Rolling checksum is up to 16 bit length for simplicity and speed.
 const (
 	mod = 1 << 16
 )
 
 // rollingHash as defined in https://www.samba.org/~tridge/phd_thesis.pdf, based on Adler-32
-// Calculates the hash for an entire block.
-func rollingHash(block []byte) (uint32, uint32, uint32) {
+// Calculates the hash for an entire block. The modulus m must be a power of two no larger
+// than mod, see WithWeakModulus.
+//
+// The second sum weighs every byte by its distance to the end of the block, which is the
+// same as adding up the first sum after every byte, sparing a multiplication per byte.
+func rollingHash(block []byte, m uint32) (uint32, uint32, uint32) {
 	var a, b uint32
-	l := uint32(len(block))
-	for index, value := range block {
+	for _, value := range block {
 		a += uint32(value)
-		b += (l - uint32(index)) * uint32(value)
+		b += a
 	}
-	r1 := a % mod
-	r2 := b % mod
-	r := r1 + (mod * r2)
+	r1 := a & (m - 1)
+	r2 := b & (m - 1)
+	r := r1 + (m * r2)
 
 	return r1, r2, r
 }
 
-// rollingHash2 incrementally calculates rolling checksum.
-func rollingHash2(l, r1, r2, outgoingValue, incomingValue uint32) (uint32, uint32, uint32) {
-	r1 = (r1 - outgoingValue + incomingValue) % mod
-	r2 = (r2 - (l * outgoingValue) + r1) % mod
-	r := r1 + (mod * r2)
+// RollingChecksum returns the weak checksum of block as calculated by Signatures and Sync with
+// WeakAdler and the default modulus, for matching blocks outside of this package. Besides the
+// checksum r, it returns its two halves, r1 and r2, such that r = r1 + r2<<16, which are needed to
+// roll it with RollChecksum. Returning them saves callers from splitting r themselves, which would
+// tie them to how the halves are packed. It is not named WeakHash, as asked for originally, since
+// that names the type selecting weak checksum functions, see WithWeakHash.
+func RollingChecksum(block []byte) (r1, r2, r uint32) {
+	return rollingHash(block, mod)
+}
+
+// RollChecksum rolls the weak checksum of a window of l bytes, given as its two halves r1 and r2,
+// by one byte, removing the outgoing byte from the front of the window and appending the incoming
+// one to its end. It returns the halves and the checksum of the new window, which are the same as
+// RollingChecksum would return for it. The outgoing and incoming bytes are taken as bytes rather
+// than uint32 values, so that values out of the range of a byte can not be passed by mistake.
+func RollChecksum(l, r1, r2 uint32, outgoing, incoming byte) (uint32, uint32, uint32) {
+	return rollingHash2(mod, l, r1, r2, uint32(outgoing), uint32(incoming))
+}
+
+// rollingHash2 incrementally calculates rolling checksum. Since m is a power of two, the
+// modulo is not affected by the subtractions wrapping around.
+func rollingHash2(m, l, r1, r2, outgoingValue, incomingValue uint32) (uint32, uint32, uint32) {
+	r1 = (r1 - outgoingValue + incomingValue) & (m - 1)
+	r2 = (r2 - (l * outgoingValue) + r1) & (m - 1)
+	r := r1 + (m * r2)
+
+	return r1, r2, r
+}
+
+// rollingShrink updates a rolling checksum calculated over a window of l bytes after the
+// outgoing byte is removed from its front, with no byte coming in.
+func rollingShrink(m, l, r1, r2, outgoingValue uint32) (uint32, uint32, uint32) {
+	r1 = (r1 - outgoingValue) & (m - 1)
+	r2 = (r2 - (l * outgoingValue)) & (m - 1)
+	r := r1 + (m * r2)
 
 	return r1, r2, r
 }
 
+// WeakHash identifies the function used to calculate weak block checksums.
+type WeakHash uint8
+
+const (
+	// WeakAdler is the rsync rolling checksum, based on Adler-32. It is the only weak hash
+	// that can be rolled one byte at a time and therefore the default.
+	WeakAdler WeakHash = iota
+	// WeakCRC32C uses the Castagnoli CRC32, which most modern CPUs calculate in hardware
+	// (SSE4.2 on amd64) and which collides far less often than the 16 bit Adler sums.
+	// CRC32C cannot be updated incrementally as the window slides, so it can only be used
+	// where blocks are compared at fixed boundaries, see WithAligned.
+	WeakCRC32C
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// rollable reports whether the weak hash can be incrementally calculated by rollingHash2.
+func (w WeakHash) rollable() bool {
+	return w == WeakAdler
+}
+
+// sum calculates the weak checksum of an entire block, using the modulus m for rolling checksums.
+func (w WeakHash) sum(block []byte, m uint32) uint32 {
+	if w == WeakCRC32C {
+		return crc32.Checksum(block, crc32cTable)
+	}
+	_, _, r := rollingHash(block, m)
+	return r
+}
+
 // BlockSignature contains file block index and checksums.
 type BlockSignature struct {
 	// Index is the block index
 	Index uint64
 	// Strong refers to the strong checksum, it need not to be cryptographic.
 	Strong []byte
+	// Hash identifies the algorithm used to calculate the strong checksum.
+	Hash HashID
 	// Weak refers to the fast rsync rolling checksum
 	Weak uint32
+	// Modulus is the modulus of the rolling checksum, if one was used. Zero means the default
+	// of 1<<16. See WithWeakModulus.
+	Modulus uint32
+	// Count is the number of consecutive blocks covered by the signature, starting at Index.
+	// Both zero and one mean a single block. Signatures covering several blocks are coarse
+	// signatures, see WithCoarseBlocks.
+	Count uint64
+	// Length is the length of the block if shorter than the block size, which only happens
+	// for the last block of a file. Zero means a whole block.
+	Length int
+	// Done marks the end of a signature stream that completed without errors, so that consumers
+	// can tell a complete set of signatures apart from a truncated one. It is sent last by
+	// Signatures, SignaturesAt and SignaturesFS, and carries no other fields.
+	//
+	// Breaking change: consumers that do not check Done take it for the signature of block 0,
+	// with a zero weak checksum and an empty strong one. See the package documentation.
+	Done bool
 	// Error is used to report the error reading the file or calculating checksums.
 	Error error
 }
 
+// blocks returns the number of blocks covered by the signature.
+func (b BlockSignature) blocks() uint64 {
+	if b.Count == 0 {
+		return 1
+	}
+	return b.Count
+}
+
 // BlockOperation represents a file re-construction instruction.
+//
+// Operations refer to two files: the cache, the old version of the file held by the remote end, and
+// the source, the new version being reconstructed. Index always refers to the cache and Offset to
+// the source.
 type BlockOperation struct {
-	// Index is the block index involved.
+	// Index is the index of the first block to copy from the cache, for copy operations. It is
+	// meaningless for any other operation and never refers to a position in the source file.
 	Index uint64
+	// Offset is the position in the source file, and therefore in the reconstructed file, of the
+	// data copied or sent by the operation, as set by Sync. Apply does not need it, since operations
+	// are applied in order, so Encoder only sends it WithWireOffsets.
+	Offset int64
 	// Data is the delta to be applied to the remote file. No data means
 	// the client found a matching checksum for this block, which in turn means
 	// the remote end proceeds to get the block data from its local
-	// copy instead.
+	// copy instead, unless another field, such as Done, marks the operation as something else.
 	Data []byte
+	// Count is the number of consecutive blocks to copy, starting at Index, for operations
+	// without data. Both zero and one mean a single block. See Compact.
+	Count uint64
+	// Done marks the end of the operation stream. Sync always sends it as its last operation, so
+	// that a stream cut short, i.e. by a dropped connection, can be told apart from a complete
+	// one. See WithRequireDone.
+	//
+	// Breaking change: Done operations carry no data and a zero Index, so consumers that do not
+	// check Done apply them as a copy of block 0. See the package documentation.
+	Done bool
+	// BaseDigest, when set, is the SHA-256 digest of the whole cache file the operations
+	// were calculated against. Apply verifies it before applying any other operation.
+	BaseDigest []byte
+	// Checksum, when set, is the checksum of Data, which Apply verifies before writing it.
+	// See WithLiteralChecksums.
+	Checksum []byte
+	// Ref, when not zero, repeats the data of an earlier literal operation, identified by its
+	// position among the literals of the stream, starting at one. See WithDedup.
+	Ref uint64
+	// Strong, when set on a copy operation of a single block, is the strong checksum of the block,
+	// by which Apply can look it up in a BlockStore instead of the cache. See WithCopyHashes.
+	Strong []byte
+	// Length, when not zero on a copy operation, is the length of the last block copied, as recorded
+	// by its signature, which is shorter than the block size for the last block of the cache.
+	// Apply reads exactly that many bytes, failing with ErrReadCache if the cache holds fewer,
+	// instead of as many as the cache returns. Sync sets it from BlockSignature.Length.
+	Length int
+	// Back, when not zero, makes Apply write again a block of the data it reconstructed, starting
+	// Back bytes before its current position, rather than copying from the cache. See
+	// WithBackRefs.
+	Back uint64
 	// Error is used to report any error while sending operations.
 	Error error
 }
 
+// copies reports whether the operation instructs to copy blocks from the cache.
+func (o BlockOperation) copies() bool {
+	return o.Error == nil && len(o.Data) == 0 && o.BaseDigest == nil && !o.Done && o.Ref == 0 && o.Back == 0
+}
+
+// blocks returns the number of blocks copied by the operation.
+func (o BlockOperation) blocks() uint64 {
+	if o.Count == 0 {
+		return 1
+	}
+	return o.Count
+}
+
 var bufferPool = sync.Pool{
 	New: func() interface{} {
 		b := make([]byte, DefaultBlockSize)
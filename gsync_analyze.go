@@ -0,0 +1,86 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"io"
+)
+
+// WeakHashReport describes how the blocks of a file spread over the weak checksum space. Every
+// block of the cache lands in the lookup table bucket of its weak checksum, and Sync compares the
+// strong checksum of every window hitting a bucket against all of its candidates. Some inputs,
+// such as long runs of the same byte, degenerate the weak checksum and pile many blocks into few
+// buckets, which shows as a large MaxBucket, many Collisions or few Buckets for the number of
+// Blocks, and makes syncs slow. Switch weak hashes, see WithWeakHash, when that is the case.
+type WeakHashReport struct {
+	// Blocks is the number of blocks in the file.
+	Blocks uint64
+	// Buckets is the number of distinct weak checksums.
+	Buckets uint64
+	// MaxBucket is the number of blocks in the largest bucket.
+	MaxBucket int
+	// BucketSizes is the distribution of bucket sizes, keyed by the number of blocks in the bucket.
+	BucketSizes map[int]uint64
+	// Collisions is the number of distinct blocks sharing their weak checksum with other distinct
+	// blocks. Identical blocks share their weak checksum too, but are not collisions.
+	Collisions uint64
+}
+
+// AnalyzeWeakHash calculates the signatures of r, as Signatures would with the same options, and
+// reports how they spread over the weak checksum space, in order to detect data sets that are
+// pathological for the weak hash in use. Coarse signatures are not taken into account.
+func AnalyzeWeakHash(ctx context.Context, r io.Reader, opts ...Option) (WeakHashReport, error) {
+	if r == nil {
+		return WeakHashReport{}, ErrNilReader
+	}
+
+	cfg := newOptions(opts)
+	if cfg.err != nil {
+		return WeakHashReport{}, cfg.err
+	}
+
+	s := newSigner(nil, cfg)
+	s.pooled()
+	defer s.release()
+	s.Reset(r)
+
+	sizes := make(map[uint32]int)
+	distinct := make(map[uint32]map[string]struct{})
+	report := WeakHashReport{BucketSizes: make(map[int]uint64)}
+	for {
+		sig, err := s.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return WeakHashReport{}, err
+		}
+
+		if sig.blocks() > 1 {
+			continue
+		}
+
+		report.Blocks++
+		sizes[sig.Weak]++
+		if distinct[sig.Weak] == nil {
+			distinct[sig.Weak] = make(map[string]struct{})
+		}
+		distinct[sig.Weak][string(sig.Strong)] = struct{}{}
+	}
+
+	report.Buckets = uint64(len(sizes))
+	for weak, n := range sizes {
+		report.BucketSizes[n]++
+		if n > report.MaxBucket {
+			report.MaxBucket = n
+		}
+		if d := len(distinct[weak]); d > 1 {
+			report.Collisions += uint64(d)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,49 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestAnalyzeWeakHash(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	report, err := AnalyzeWeakHash(ctx, bytes.NewReader(srand(350, 100*DefaultBlockSize)))
+	assert.Ok(t, err)
+	assert.Equals(t, uint64(100), report.Blocks)
+	assert.Equals(t, uint64(100), report.Buckets)
+	assert.Equals(t, 1, report.MaxBucket)
+	assert.Equals(t, map[int]uint64{1: 100}, report.BucketSizes)
+	assert.Equals(t, uint64(0), report.Collisions)
+
+	// Identical blocks pile up in a single bucket, without colliding.
+	report, err = AnalyzeWeakHash(ctx, bytes.NewReader(make([]byte, 50*DefaultBlockSize)))
+	assert.Ok(t, err)
+	assert.Equals(t, uint64(50), report.Blocks)
+	assert.Equals(t, uint64(1), report.Buckets)
+	assert.Equals(t, 50, report.MaxBucket)
+	assert.Equals(t, uint64(0), report.Collisions)
+
+	// With a modulus of two, moving a byte by an even number of positions keeps both sums,
+	// so distinct blocks land in the same bucket.
+	data := make([]byte, 4*DefaultBlockSize)
+	for i := 0; i < 4; i++ {
+		data[i*DefaultBlockSize+2*i] = 1
+	}
+	report, err = AnalyzeWeakHash(ctx, bytes.NewReader(data), WithWeakModulus(2))
+	assert.Ok(t, err)
+	assert.Equals(t, uint64(1), report.Buckets)
+	assert.Equals(t, uint64(4), report.Collisions)
+
+	_, err = AnalyzeWeakHash(ctx, nil)
+	assert.Equals(t, ErrNilReader, err)
+}
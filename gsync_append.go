@@ -0,0 +1,36 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/minio/sha256-simd"
+)
+
+// stepAppend verifies whether the source starts with the whole base file, in which case
+// the base file is copied with a single operation and the rest of the source is sent as
+// literal data.
+func (s *Syncer) stepAppend() error {
+	size := s.cfg.appendSize
+
+	h := sha256.New()
+	n, err := io.Copy(h, io.NewSectionReader(s.r, 0, size))
+	if err != nil {
+		return s.readError(err)
+	}
+
+	if n != size || !bytes.Equal(h.Sum(nil), s.cfg.appendDigest) {
+		return nil
+	}
+
+	bs := int64(s.cfg.size)
+	blocks := (size + bs - 1) / bs
+	s.emit(BlockOperation{Index: 0, Count: uint64(blocks)})
+	s.offset = size
+	s.literal = true
+	return nil
+}
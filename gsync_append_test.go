@@ -0,0 +1,57 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestAppendOnly(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(190, 100*DefaultBlockSize+123)
+	digest, err := Digest(bytes.NewReader(cache))
+	assert.Ok(t, err)
+
+	appended := append(append([]byte(nil), cache...), srand(191, 5000)...)
+	edited := append([]byte("x"), appended...)
+
+	for _, source := range [][]byte{appended, edited, cache} {
+		sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+		assert.Ok(t, err)
+		cacheSigs, err := LookUpTable(ctx, sigsCh)
+		assert.Ok(t, err)
+
+		opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, WithAppendOnly(int64(len(cache)), digest))
+		assert.Ok(t, err)
+
+		var ops []BlockOperation
+		for op := range opsCh {
+			assert.Ok(t, op.Error)
+			ops = append(ops, op)
+		}
+
+		if !bytes.Equal(source, edited) {
+			assert.Equals(t, BlockOperation{Count: 101}, ops[0])
+			assert.Cond(t, len(ops) <= 3, "expected a copy, a literal and the end of the stream, got %d operations", len(ops))
+		}
+
+		c := make(chan BlockOperation, len(ops))
+		for _, op := range ops {
+			c <- op
+		}
+		close(c)
+
+		target := new(bytes.Buffer)
+		assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), c))
+		assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+	}
+}
@@ -0,0 +1,148 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ApplyAt is Apply for destinations supporting random writes, such as *os.File, writing every
+// operation at its Offset, as set by Sync, by up to workers goroutines at once, or GOMAXPROCS if
+// workers is not positive. Operations write disjoint regions of the file, so they are applied in no
+// particular order, which lets reconstructions from fast caches saturate fast disks. Operations
+// must therefore carry their offsets, which Encoder only sends WithWireOffsets; see Segments to
+// split a reconstruction beforehand instead.
+//
+// BaseDigest operations are still verified before any other operation is applied, and error
+// operations skipped WithSkipErrors, as Apply does. WithDedup, WithTransform, WithRange, WithAudit
+// and WithBackRefs are not supported, since they depend on operations being applied in order. On
+// failure, the destination is left in an undefined state.
+func ApplyAt(ctx context.Context, dst io.WriterAt, cache io.ReaderAt, ops <-chan BlockOperation, workers int, opts ...Option) error {
+	cfg := newOptions(opts)
+	if cfg.err != nil {
+		return cfg.err
+	}
+
+	if cfg.dedup > 0 || cfg.transform != nil || cfg.ranged || cfg.audit != nil || cfg.backWindow > 0 {
+		return errors.New("gsync: ApplyAt does not support WithDedup, WithTransform, WithRange, WithAudit or WithBackRefs")
+	}
+
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	if err := cfg.checkMemory(int64(workers) * int64(cfg.size)); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		once    sync.Once
+		failure error
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			failure = err
+			cancel()
+		})
+	}
+
+	queue := make(chan BlockOperation, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := applyAt(ctx, dst, cache, queue, cfg); err != nil {
+				fail(err)
+			}
+		}()
+	}
+
+	d := &applier{cache: cache, cfg: cfg}
+	done, err := d.dispatchAt(ctx, ops, queue)
+	close(queue)
+	wg.Wait()
+
+	if failure != nil {
+		return failure
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if cfg.requireDone && !done {
+		return ErrTruncatedStream
+	}
+
+	if len(d.skipped) > 0 {
+		return &SkippedError{Failed: d.skipped}
+	}
+	return nil
+}
+
+// dispatchAt queues the data and copy operations of ops for the workers of ApplyAt, handling the
+// rest itself. It reports whether the Done operation was received.
+func (a *applier) dispatchAt(ctx context.Context, ops <-chan BlockOperation, queue chan<- BlockOperation) (bool, error) {
+	for o := range ops {
+		switch {
+		case o.Error != nil && a.cfg.skipErrors:
+			a.skip(o)
+			continue
+		case o.Error != nil:
+			return false, errors.Wrapf(o.Error, "failed applying operation")
+		case o.BaseDigest != nil:
+			if err := verifyBase(a.cache, o.BaseDigest); err != nil {
+				return false, err
+			}
+			continue
+		case o.Done:
+			return true, nil
+		}
+
+		select {
+		case queue <- o:
+		case <-ctx.Done():
+			return false, errors.Wrapf(ctx.Err(), "failed applying block operations")
+		}
+	}
+	return false, nil
+}
+
+// applyAt applies the operations queued by ApplyAt, each at its own offset.
+func applyAt(ctx context.Context, dst io.WriterAt, cache io.ReaderAt, queue <-chan BlockOperation, cfg *options) error {
+	w := &offsetWriter{w: dst}
+	a := &applier{dst: w, cache: cache, read: readFrom(cache, cfg), cfg: cfg}
+
+	bfp := cfg.getBuffer()
+	a.buffer = *bfp
+	defer cfg.putBuffer(bfp)
+
+	for o := range queue {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		w.off, a.offset = o.Offset, o.Offset
+		if err := a.applyOp(o, nil); err != nil {
+			return err
+		}
+	}
+
+	if cfg.fsync > 0 && a.unsynced > 0 {
+		return a.fsync()
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+func TestApplyAt(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(600, 200*DefaultBlockSize+700)
+	source := mutate(cache, 601, 20)
+
+	for _, workers := range []int{0, 1, 8} {
+		sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil, WithDigest())
+		assert.Ok(t, err)
+
+		table, err := LookUpTable(ctx, sigsCh)
+		assert.Ok(t, err)
+
+		ops, err := Sync(ctx, bytes.NewReader(source), nil, table)
+		assert.Ok(t, err)
+
+		dst := make(writerAtBuffer, len(source))
+		err = ApplyAt(ctx, dst, bytes.NewReader(cache), Compact(ctx, ops), workers, WithRequireDone())
+		assert.Ok(t, err)
+		assert.Cond(t, bytes.Equal(source, dst), "source and target files are different")
+	}
+
+	// Operations keep their offsets through the wire format WithWireOffsets.
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	table, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, table)
+	assert.Ok(t, err)
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf, WithWireOffsets())
+	for op := range opsCh {
+		assert.Ok(t, enc.Encode(op))
+	}
+	decoded, err := Decode(ctx, buf)
+	assert.Ok(t, err)
+
+	dst := make(writerAtBuffer, len(source))
+	assert.Ok(t, ApplyAt(ctx, dst, bytes.NewReader(cache), decoded, 8, WithRequireDone()))
+	assert.Cond(t, bytes.Equal(source, dst), "source and target files are different")
+
+	// Streams without a Done operation are rejected when required.
+	ops := make(chan BlockOperation, 1)
+	ops <- BlockOperation{Data: []byte("foo")}
+	close(ops)
+	err = ApplyAt(ctx, make(writerAtBuffer, 3), nil, ops, 2, WithRequireDone())
+	assert.Equals(t, ErrTruncatedStream, err)
+
+	// Failures in any worker stop the reconstruction.
+	ops = make(chan BlockOperation, 1)
+	ops <- BlockOperation{Index: 3}
+	close(ops)
+	err = ApplyAt(ctx, make(writerAtBuffer, DefaultBlockSize), nil, ops, 2)
+	var berr *BlockError
+	assert.Cond(t, errors.As(err, &berr) && berr.Kind == ErrMissingCache, "expected a missing cache error")
+
+	err = ApplyAt(ctx, make(writerAtBuffer, 0), nil, nil, 2, WithDedup(1024))
+	assert.Cond(t, err != nil, "expected WithDedup to be rejected")
+}
@@ -0,0 +1,149 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+)
+
+// backBlock is a block of the source already processed, indexed for back references.
+type backBlock struct {
+	weak uint32
+	off  int64
+}
+
+// backRefs indexes the blocks of the source already processed, at offsets multiple of the block
+// size, by weak checksum, so that Sync can reference them instead of sending their data again.
+// See WithBackRefs.
+type backRefs struct {
+	index map[uint32][]int64
+	// queue holds the blocks indexed in order, so they are dropped once out of the window.
+	queue []backBlock
+	// next is the offset of the next block to index.
+	next int64
+	buf  []byte
+}
+
+func (b *backRefs) reset() {
+	b.index, b.queue, b.next = nil, b.queue[:0], 0
+}
+
+// sourceBlock returns the block of the source at off, from the read-ahead window if still there.
+func (s *Syncer) sourceBlock(off int64) ([]byte, error) {
+	w, size := &s.ahead, s.cfg.size
+	if off >= w.off && off+int64(size) <= w.off+int64(w.n) {
+		start := int(off - w.off)
+		return w.buf[start : start+size], nil
+	}
+
+	b := &s.back
+	if b.buf == nil {
+		b.buf = make([]byte, size)
+	}
+
+	n, err := readAtFull(s.r, b.buf, off)
+	if err != nil {
+		return b.buf[:n], err
+	}
+	return b.buf, nil
+}
+
+// indexBack indexes the blocks of the source processed so far and drops those that are no longer
+// within the window.
+func (s *Syncer) indexBack() error {
+	b := &s.back
+	if b.index == nil {
+		b.index = make(map[uint32][]int64)
+	}
+
+	size := int64(s.cfg.size)
+	for b.next+size <= s.offset {
+		block, err := s.sourceBlock(b.next)
+		if err != nil {
+			return s.readError(err)
+		}
+
+		weak := s.cfg.weak.sum(block, s.mod)
+		b.index[weak] = append(b.index[weak], b.next)
+		b.queue = append(b.queue, backBlock{weak: weak, off: b.next})
+		b.next += size
+	}
+
+	start := s.offset - int64(s.cfg.backWindow)
+	var drop int
+	for drop < len(b.queue) && b.queue[drop].off < start {
+		q := b.queue[drop]
+		if offs := b.index[q.weak][1:]; len(offs) > 0 {
+			b.index[q.weak] = offs
+		} else {
+			delete(b.index, q.weak)
+		}
+		drop++
+	}
+
+	if drop > 0 {
+		b.queue = b.queue[:copy(b.queue, b.queue[drop:])]
+	}
+	return nil
+}
+
+// stepBack references the most recent block of the source already processed that equals block,
+// if any, instead of sending it as literal data. Blocks are compared byte by byte, so there are no
+// false matches.
+func (s *Syncer) stepBack(block []byte) (bool, error) {
+	if err := s.indexBack(); err != nil {
+		return false, err
+	}
+
+	// The block comes from the read-ahead window, which reading candidates never overwrites.
+	offs := s.back.index[s.rhash]
+	for i := len(offs) - 1; i >= 0; i-- {
+		candidate, err := s.sourceBlock(offs[i])
+		if err != nil {
+			return false, s.readError(err)
+		}
+
+		if bytes.Equal(block, candidate) {
+			s.breakRun()
+			s.flush()
+			s.emit(BlockOperation{Back: uint64(s.offset - offs[i]), Offset: s.offset})
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// applyBack writes the block reconstructed o.Back bytes before the current position again.
+func (a *applier) applyBack(o BlockOperation) error {
+	h := a.history
+	size := a.cfg.size
+	if o.Back < uint64(size) || o.Back > uint64(len(h)) {
+		return &BlockError{Index: o.Back, Offset: a.offset, Kind: ErrBackRef}
+	}
+
+	start := len(h) - int(o.Back)
+	n := copy(a.buffer, h[start:start+size])
+	return a.write(o.Index, a.buffer[:n])
+}
+
+// remember keeps the last WithBackRefs window bytes written, for back references.
+func (a *applier) remember(data []byte) {
+	window := a.cfg.backWindow
+	if len(a.history)+len(data) > 2*window {
+		keep := window - len(data)
+		if keep < 0 {
+			keep = 0
+		}
+		if keep > len(a.history) {
+			keep = len(a.history)
+		}
+		a.history = a.history[:copy(a.history, a.history[len(a.history)-keep:])]
+	}
+
+	if len(data) > window {
+		data = data[len(data)-window:]
+	}
+	a.history = append(a.history, data...)
+}
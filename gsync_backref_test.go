@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+func TestSyncBackRefs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	a, b := srand(660, 4*DefaultBlockSize), srand(661, 4*DefaultBlockSize)
+	source := bytes.Join([][]byte{a, b, srand(662, 100), a, b}, nil)
+
+	for _, tt := range []struct {
+		window int
+		backs  int
+	}{
+		{1 << 20, 8},
+		// Repeated blocks are found 8 blocks and 100 bytes back.
+		{8*DefaultBlockSize + 100, 8},
+		{8 * DefaultBlockSize, 0},
+		{DefaultBlockSize - 1, 0},
+	} {
+		opsCh, err := Sync(ctx, bytes.NewReader(source), nil, nil, WithBackRefs(tt.window))
+		assert.Ok(t, err)
+
+		var ops []BlockOperation
+		var backs, literal int
+		for op := range opsCh {
+			assert.Ok(t, op.Error)
+			if op.Back != 0 {
+				backs++
+				assert.Cond(t, op.Back <= uint64(tt.window), "back reference %d out of the window", op.Back)
+			}
+			literal += len(op.Data)
+			ops = append(ops, op)
+		}
+		assert.Equals(t, tt.backs, backs)
+		assert.Equals(t, len(source)-tt.backs*DefaultBlockSize, literal)
+
+		c := make(chan BlockOperation, len(ops))
+		for _, op := range ops {
+			c <- op
+		}
+		close(c)
+
+		target := new(bytes.Buffer)
+		assert.Ok(t, Apply(ctx, target, nil, c, WithBackRefs(tt.window)))
+		assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+	}
+
+	// Back references combine with copies from a cache.
+	cache := srand(663, 20*DefaultBlockSize)
+	edited := append(mutate(cache, 664, 3), a...)
+	edited = append(edited, a...)
+	target := pipeline(t, edited, cache, WithBackRefs(1<<20))
+	assert.Cond(t, bytes.Equal(edited, target), "source and target files are different")
+
+	// Apply only resolves back references within the data it remembers.
+	c := make(chan BlockOperation, 2)
+	c <- BlockOperation{Data: a}
+	c <- BlockOperation{Back: 5 * DefaultBlockSize}
+	close(c)
+	err := Apply(ctx, new(bytes.Buffer), nil, c, WithBackRefs(1<<20))
+	assert.Cond(t, errors.Is(err, ErrBackRef), "expected ErrBackRef, got %v", err)
+}
@@ -0,0 +1,124 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"hash"
+	"io"
+)
+
+// Bitmap tells which blocks of a source file differ from the blocks at the same index of a
+// destination file. Bit i, counting from the least significant bit of Bits[0], is set if block i
+// changed, so Bits holds (Blocks+7)/8 bytes and any bits past Blocks are zero.
+//
+// Blocks are those of the destination's block layout, that is, as long as set WithBlockSize or as
+// split WithBoundaries. The last block of a source whose size is not a multiple of the block size is
+// partial: it is marked as changed unless the destination's block at its index has the same length
+// and content. Destination blocks past the end of the source are not represented, Size tells where
+// to truncate the destination.
+type Bitmap struct {
+	Bits []byte
+	// Blocks is the number of blocks of the source.
+	Blocks uint64
+	// Size is the size of the source.
+	Size int64
+}
+
+// Changed reports whether the block at index changed.
+func (b *Bitmap) Changed(index uint64) bool {
+	return index < b.Blocks && b.Bits[index/8]&(1<<(index%8)) != 0
+}
+
+// Indices returns the indices of the blocks that changed, in increasing order.
+func (b *Bitmap) Indices() []uint64 {
+	var indices []uint64
+	for i := uint64(0); i < b.Blocks; i++ {
+		if b.Changed(i) {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// set marks the block at index as changed, growing the bitmap as needed.
+func (b *Bitmap) set(index uint64, changed bool) {
+	for uint64(len(b.Bits))*8 <= index {
+		b.Bits = append(b.Bits, 0)
+	}
+	if changed {
+		b.Bits[index/8] |= 1 << (index % 8)
+	}
+	b.Blocks = index + 1
+}
+
+// ChangedBlocks compares every block of r against the remote signature of the block at the same
+// index, instead of sending operations as Sync does, for destinations updated in place that
+// already hold most blocks, such as disk images. The caller then transfers only the blocks marked
+// in the returned Bitmap. As with Sync, if shash is nil the one set by WithHash, or else the strong
+// hash of the remote signatures, is used.
+func ChangedBlocks(ctx context.Context, r io.Reader, shash hash.Hash, remote map[uint32][]BlockSignature, opts ...Option) (*Bitmap, error) {
+	if r == nil {
+		return nil, ErrNilReader
+	}
+
+	cfg := newOptions(opts)
+	if cfg.err != nil {
+		return nil, cfg.err
+	}
+
+	if shash == nil {
+		shash = cfg.newHash()
+	}
+	if shash == nil {
+		var err error
+		if shash, err = NewHash(remoteHashID(remote)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkHashes(remote, shash); err != nil {
+		return nil, err
+	}
+
+	byIndex := make(map[uint64]BlockSignature)
+	for _, bs := range remote {
+		for _, b := range bs {
+			if b.diffable() {
+				byIndex[b.Index] = b
+			}
+		}
+	}
+
+	s := newSigner(shash, cfg)
+	s.pooled()
+	defer s.release()
+	s.Reset(r)
+
+	bitmap := new(Bitmap)
+	for {
+		sig, err := s.Next(ctx)
+		if err == io.EOF {
+			return bitmap, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if sig.blocks() > 1 {
+			continue
+		}
+
+		b, ok := byIndex[sig.Index]
+		bitmap.set(sig.Index, !ok || b.Length != sig.Length || !bytes.Equal(b.Strong, sig.Strong))
+		if sig.Length > 0 {
+			bitmap.Size += int64(sig.Length)
+		} else {
+			bitmap.Size += int64(cfg.blockSize(sig.Index))
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestChangedBlocks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dest := srand(640, 20*DefaultBlockSize+100)
+	sigsCh, err := Signatures(ctx, bytes.NewReader(dest), nil)
+	assert.Ok(t, err)
+	table, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	source := append([]byte(nil), dest...)
+	source[2*DefaultBlockSize] ^= 0xff
+	source[9*DefaultBlockSize+10] ^= 0xff
+	// A block moved to another index changed for an in-place destination.
+	copy(source[15*DefaultBlockSize:], dest[16*DefaultBlockSize:17*DefaultBlockSize])
+
+	for _, tt := range []struct {
+		name    string
+		source  []byte
+		changed []uint64
+		bits    []byte
+	}{
+		{"identical", dest, nil, []byte{0, 0, 0}},
+		{"edited", source, []uint64{2, 9, 15}, []byte{0x04, 0x82, 0}},
+		// The partial last block only matches with the same length.
+		{"shorter", dest[:20*DefaultBlockSize+50], []uint64{20}, []byte{0, 0, 0x10}},
+		{"longer", append(dest[:len(dest):len(dest)], 1), []uint64{20}, []byte{0, 0, 0x10}},
+		{"grown", append(dest[:len(dest):len(dest)], srand(641, 2*DefaultBlockSize)...), []uint64{20, 21, 22}, []byte{0, 0, 0x70}},
+	} {
+		bitmap, err := ChangedBlocks(ctx, bytes.NewReader(tt.source), nil, table)
+		assert.Ok(t, err)
+		assert.Equals(t, tt.changed, bitmap.Indices())
+		assert.Equals(t, tt.bits, bitmap.Bits)
+		assert.Equals(t, uint64((len(tt.source)+DefaultBlockSize-1)/DefaultBlockSize), bitmap.Blocks)
+		assert.Equals(t, int64(len(tt.source)), bitmap.Size)
+	}
+}
@@ -0,0 +1,20 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"hash"
+
+	"github.com/zeebo/blake3"
+)
+
+// NewBLAKE3 returns a new BLAKE3 hash with a 32 byte output, identified by HashBLAKE3. It is
+// cryptographically strong like SHA-256, and backed by github.com/zeebo/blake3, which uses AVX2
+// and SSE4.1 when available. It is the recommended strong hash for new deployments; compare
+// BenchmarkBLAKE3 with BenchmarkSHA256 on the target hardware. SHA-256 stays the default for
+// compatibility with signatures that carry no hash identifier.
+func NewBLAKE3() hash.Hash {
+	return blake3.New()
+}
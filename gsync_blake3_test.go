@@ -0,0 +1,54 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestBLAKE3(t *testing.T) {
+	// Test vectors of the BLAKE3 reference implementation, whose inputs repeat the bytes 0 to 250,
+	// covering single blocks, whole chunks and trees of them.
+	tests := []struct {
+		n   int
+		sum string
+	}{
+		{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+		{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+		{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+		{2048, "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a"},
+	}
+
+	h := NewBLAKE3()
+	for _, tt := range tests {
+		in := make([]byte, tt.n)
+		for i := range in {
+			in[i] = byte(i % 251)
+		}
+
+		// Data written in pieces of any size sums up the same.
+		for _, step := range []int{1, 63, 64, 65, 1024, tt.n + 1} {
+			h.Reset()
+			for i := 0; i < len(in); i += step {
+				end := i + step
+				if end > len(in) {
+					end = len(in)
+				}
+				h.Write(in[i:end])
+			}
+			assert.Equals(t, tt.sum, hex.EncodeToString(h.Sum(nil)))
+			assert.Equals(t, tt.sum, hex.EncodeToString(h.Sum(nil)))
+		}
+	}
+
+	h.Reset()
+	h.Write([]byte("abc"))
+	assert.Equals(t, "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85", hex.EncodeToString(h.Sum(nil)))
+	assert.Equals(t, HashBLAKE3, hashIDOf(h))
+}
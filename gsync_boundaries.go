@@ -0,0 +1,72 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"math"
+	"sort"
+)
+
+// blockLayout tells where the blocks of a file split by caller supplied boundaries start, see
+// WithBoundaries.
+type blockLayout struct {
+	// starts holds the offsets of the blocks before the last boundary, and end the last boundary.
+	// Past it, blocks are size long.
+	starts []int64
+	end    int64
+	size   int
+}
+
+// newBlockLayout returns the layout of blocks of up to size bytes split at the given boundaries,
+// which must be increasing and positive.
+func newBlockLayout(bounds []int64, size int) (*blockLayout, error) {
+	l := &blockLayout{size: size}
+	for _, b := range bounds {
+		if b <= l.end {
+			return nil, ErrInvalidBoundaries
+		}
+
+		for off := l.end; off < b; off += int64(size) {
+			l.starts = append(l.starts, off)
+		}
+		l.end = b
+	}
+	return l, nil
+}
+
+// block returns the offset of the block at index and its size, unless the file ends before. The
+// offset is negative if it does not fit in an int64.
+func (l *blockLayout) block(index uint64) (int64, int) {
+	n := uint64(len(l.starts))
+	if index >= n {
+		if index-n > uint64(math.MaxInt64-l.end)/uint64(l.size) {
+			return -1, l.size
+		}
+		return l.end + int64(index-n)*int64(l.size), l.size
+	}
+
+	next := l.end
+	if index+1 < n {
+		next = l.starts[index+1]
+	}
+	return l.starts[index], int(next - l.starts[index])
+}
+
+// index returns the index of the block starting at off, which must be a block boundary.
+func (l *blockLayout) index(off int64) uint64 {
+	if off >= l.end {
+		return uint64(len(l.starts)) + uint64((off-l.end)/int64(l.size))
+	}
+	return uint64(sort.Search(len(l.starts), func(i int) bool { return l.starts[i] >= off }))
+}
+
+// blockSize returns the size of the block at index, which is the block size without boundaries.
+func (o *options) blockSize(index uint64) int {
+	if o.layout == nil {
+		return o.size
+	}
+	_, size := o.layout.block(index)
+	return size
+}
@@ -0,0 +1,130 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestBlockLayout(t *testing.T) {
+	l, err := newBlockLayout([]int64{100, 100 + 2*DefaultBlockSize + 5, 200 + 2*DefaultBlockSize}, DefaultBlockSize)
+	assert.Ok(t, err)
+
+	blocks := []struct {
+		off  int64
+		size int
+	}{
+		{0, 100},
+		{100, DefaultBlockSize},
+		{100 + DefaultBlockSize, DefaultBlockSize},
+		{100 + 2*DefaultBlockSize, 5},
+		{105 + 2*DefaultBlockSize, 95},
+		{200 + 2*DefaultBlockSize, DefaultBlockSize},
+		{200 + 3*DefaultBlockSize, DefaultBlockSize},
+	}
+	for i, b := range blocks {
+		off, size := l.block(uint64(i))
+		assert.Equals(t, b.off, off)
+		assert.Equals(t, b.size, size)
+		assert.Equals(t, uint64(i), l.index(b.off))
+	}
+
+	for _, bounds := range [][]int64{{0}, {-1}, {10, 10}, {10, 5}} {
+		_, err := newBlockLayout(bounds, DefaultBlockSize)
+		assert.Equals(t, ErrInvalidBoundaries, err)
+	}
+}
+
+// records concatenates records, returning the boundaries between them.
+func records(recs ...[]byte) ([]byte, []int64) {
+	var data []byte
+	var bounds []int64
+	for _, r := range recs {
+		if len(data) > 0 {
+			bounds = append(bounds, int64(len(data)))
+		}
+		data = append(data, r...)
+	}
+	return data, bounds
+}
+
+func TestSyncBoundaries(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var recs [][]byte
+	for i, size := range []int{300, 5000, 2*DefaultBlockSize + 17, 1, 700, DefaultBlockSize, 4000} {
+		recs = append(recs, srand(int64(510+i), size))
+	}
+	cache, cacheBounds := records(recs...)
+
+	// Records are reordered, one is changed and another one inserted.
+	changed := srand(520, 800)
+	inserted := srand(521, DefaultBlockSize+10)
+	source, sourceBounds := records(recs[4], recs[2], inserted, recs[0], changed, recs[3], recs[6], recs[5])
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil, WithBoundaries(cacheBounds))
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	for _, opts := range [][]Option{nil, {WithWeakHash(WeakCRC32C)}} {
+		if len(opts) > 0 {
+			sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil, append(opts, WithBoundaries(cacheBounds))...)
+			assert.Ok(t, err)
+			cacheSigs, err = LookUpTable(ctx, sigsCh)
+			assert.Ok(t, err)
+		}
+
+		ops, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, append(opts, WithBoundaries(sourceBounds))...)
+		assert.Ok(t, err)
+
+		var literal int
+		target := new(bytes.Buffer)
+		audit := WithAudit(func(op BlockOperation, offset int64) {
+			literal += len(op.Data)
+		})
+		assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), ops, WithBoundaries(cacheBounds), WithRequireDone(), audit))
+		assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+		assert.Equals(t, len(changed)+len(inserted), literal)
+	}
+
+	_, err = Sync(ctx, bytes.NewReader(source), nil, cacheSigs, WithBoundaries([]int64{10, 5}))
+	assert.Equals(t, ErrInvalidBoundaries, err)
+	_, err = Signatures(ctx, bytes.NewReader(cache), nil, WithBoundaries(cacheBounds), WithRange(0, 100))
+	assert.Equals(t, ErrInvalidBoundaries, err)
+}
+
+func TestSyncBoundariesSmallRecord(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	data := srand(522, 40000)
+
+	// A short first record, such as a header, must not limit the blocks read after it.
+	for _, bounds := range [][]int64{{10, 20000}, {7000, 20000}} {
+		sigsCh, err := Signatures(ctx, bytes.NewReader(data), nil, WithBoundaries(bounds))
+		assert.Ok(t, err)
+		cacheSigs, err := LookUpTable(ctx, sigsCh)
+		assert.Ok(t, err)
+
+		ops, err := Sync(ctx, bytes.NewReader(data), nil, cacheSigs, WithBoundaries(bounds))
+		assert.Ok(t, err)
+
+		var literal int
+		target := new(bytes.Buffer)
+		audit := WithAudit(func(op BlockOperation, offset int64) {
+			literal += len(op.Data)
+		})
+		assert.Ok(t, Apply(ctx, target, bytes.NewReader(data), ops, WithBoundaries(bounds), WithRequireDone(), audit))
+		assert.Cond(t, bytes.Equal(data, target.Bytes()), "source and target files are different")
+		assert.Equals(t, 0, literal)
+	}
+}
@@ -0,0 +1,21 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/minio/sha256-simd"
+)
+
+// literalChecksum returns the checksum of literal data, its CRC-32C followed by its SHA-256.
+// See WithLiteralChecksums.
+func literalChecksum(data []byte) []byte {
+	sum := make([]byte, 4, 4+sha256.Size)
+	binary.BigEndian.PutUint32(sum, crc32.Checksum(data, crc32cTable))
+	strong := sha256.Sum256(data)
+	return append(sum, strong[:]...)
+}
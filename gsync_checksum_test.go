@@ -0,0 +1,63 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+func TestLiteralChecksums(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(250, 100*1024)
+	source := append(srand(251, 2*DefaultBlockSize), cache[:50*1024]...)
+	source = append(source, srand(252, 300)...)
+
+	target := pipeline(t, source, cache, WithLiteralChecksums())
+	assert.Cond(t, bytes.Equal(source, target), "source and target files are different")
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, WithLiteralChecksums())
+	assert.Ok(t, err)
+
+	// Damages the second literal in transit.
+	var ops []BlockOperation
+	var literals int
+	for op := range Compact(ctx, opsCh, WithMaxDelta(DefaultBlockSize)) {
+		if len(op.Data) > 0 {
+			assert.Equals(t, literalChecksum(op.Data), op.Checksum)
+			if literals++; literals == 2 {
+				op.Data = append([]byte(nil), op.Data...)
+				op.Data[10] ^= 1
+			}
+		}
+		ops = append(ops, op)
+	}
+
+	c := make(chan BlockOperation, len(ops))
+	for _, op := range ops {
+		c <- op
+	}
+	close(c)
+
+	err = Apply(ctx, new(bytes.Buffer), bytes.NewReader(cache), c)
+	assert.Cond(t, errors.Is(err, ErrCorruptLiteral), "expected ErrCorruptLiteral, got %v", err)
+
+	var berr *BlockError
+	assert.Cond(t, errors.As(err, &berr), "expected a *BlockError, got %T", err)
+	assert.Equals(t, uint64(1), berr.Index)
+	assert.Equals(t, int64(DefaultBlockSize), berr.Offset)
+}
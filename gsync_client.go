@@ -10,14 +10,22 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"time"
 
-	"github.com/minio/sha256-simd"
 	"github.com/pkg/errors"
 )
 
 // LookUpTable reads up blocks signatures and builds a lookup table for the client to search from when trying to decide
-// wether to send or not a block of data.
-func LookUpTable(ctx context.Context, bc <-chan BlockSignature) (map[uint32][]BlockSignature, error) {
+// wether to send or not a block of data. If configured WithRequireDone, it fails with ErrTruncatedStream when the
+// channel is closed before a Done signature was received. WithMaxBucket caps the signatures kept per weak checksum.
+// WithMemoryLimit makes it fail with ErrMemoryLimit once the table grows beyond the limit, see TableMemory, in which
+// case the caller must cancel the context or DrainSignatures the channel for Signatures to finish. Signatures without a strong
+// checksum are left out, since they can not be told apart from one another.
+func LookUpTable(ctx context.Context, bc <-chan BlockSignature, opts ...Option) (map[uint32][]BlockSignature, error) {
+	cfg := newOptions(opts)
+
+	var done bool
+	var used int64
 	table := make(map[uint32][]BlockSignature)
 	for c := range bc {
 		select {
@@ -31,9 +39,35 @@ func LookUpTable(ctx context.Context, bc <-chan BlockSignature) (map[uint32][]Bl
 			fmt.Printf("gsync: checksum error: %#v\n", c.Error)
 			continue
 		}
-		table[c.Weak] = append(table[c.Weak], c)
+
+		if c.Done {
+			done = true
+			continue
+		}
+
+		// Signatures of empty blocks or without a strong checksum could only match spuriously.
+		if len(c.Strong) == 0 || c.Length < 0 {
+			continue
+		}
+
+		bucket, ok := table[c.Weak]
+		if cfg.maxBucket > 0 && len(bucket) >= cfg.maxBucket {
+			continue
+		}
+
+		used += signatureMemory(c)
+		if !ok {
+			used += bucketSize
+		}
+		if err := cfg.checkMemory(used); err != nil {
+			return nil, err
+		}
+		table[c.Weak] = append(bucket, c)
 	}
 
+	if cfg.requireDone && !done {
+		return table, ErrTruncatedStream
+	}
 	return table, nil
 }
 
@@ -42,176 +76,617 @@ func LookUpTable(ctx context.Context, bc <-chan BlockSignature) (map[uint32][]Bl
 // This function does not block and returns immediately. Also, the remote blocks map is accessed without a mutex,
 // so this function is expected to be called once the remote blocks map is fully populated.
 //
+// The operations channel is closed once the whole file was processed, after a failure or when the context is
+// cancelled. Cancelling the context always stops the goroutine producing operations, even if the caller stopped
+// reading from the channel. Callers abandoning the channel without cancelling the context must Drain it instead.
+//
+// If shash is nil, the one set by WithHash or else the strong hash the remote signatures were
+// calculated with is used, see NewSyncer.
+//
 // The caller must make sure the concrete reader instance is not nil or this function will panic.
-func Sync(ctx context.Context, r io.ReaderAt, shash hash.Hash, remote map[uint32][]BlockSignature) (<-chan BlockOperation, error) {
+func Sync(ctx context.Context, r io.ReaderAt, shash hash.Hash, remote map[uint32][]BlockSignature, opts ...Option) (<-chan BlockOperation, error) {
 	if r == nil {
-		return nil, errors.New("gsync: reader required")
+		return nil, ErrNilReader
 	}
 
-	o := make(chan BlockOperation)
-
-	if shash == nil {
-		shash = sha256.New()
+	s, err := NewSyncer(shash, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.Reset(r, remote)
+	if s.err != nil {
+		return nil, s.err
 	}
 
-	go func() {
-		var (
-			r1, r2, rhash, old uint32
-			offset             int64
-			rolling, match     bool
-		)
+	o := make(chan BlockOperation, s.cfg.channelBuffer)
 
-		delta := make([]byte, 0)
+	go func() {
+		defer close(o)
 
-		defer func() {
-			close(o)
-		}()
+		var failure error
+		ctx, s.trace = s.cfg.startTrace(ctx, "gsync.Sync")
+		defer func() { s.trace.endSync(s.processed(), failure) }()
 
 		for {
-			// Allow for cancellation.
-			select {
-			case <-ctx.Done():
-				o <- BlockOperation{
-					Error: ctx.Err(),
-				}
+			op, err := s.Next(ctx)
+			if err == io.EOF {
 				return
-			default:
-				break
 			}
 
-			bfp := bufferPool.Get().(*[]byte)
-			buffer := *bfp
+			if err != nil {
+				failure = err
+				// return since data corruption in the server is possible and a re-sync is required.
+				op = BlockOperation{Error: err}
+			}
 
-			n, err := r.ReadAt(buffer, offset)
-			if err != nil && err != io.EOF {
-				o <- BlockOperation{
-					Error: errors.Wrapf(err, "failed reading data block"),
-				}
-				bufferPool.Put(bfp)
+			select {
+			case o <- op:
+			case <-ctx.Done():
+				return
+			}
 
-				// return since data corruption in the server is possible and a re-sync is required.
+			if err != nil {
 				return
 			}
+		}
+	}()
 
-			block := buffer[:n]
+	return o, nil
+}
 
-			// If there are no block signatures from remote server, send all data blocks
-			if len(remote) == 0 {
-				if n > 0 {
-					o <- BlockOperation{Data: block}
-					offset += int64(n)
-				}
+// Drain discards all remaining operations until the channel is closed, so that the goroutine
+// producing them can finish. It blocks until then.
+func Drain(ops <-chan BlockOperation) {
+	for range ops {
+	}
+}
 
-				if err == io.EOF {
-					bufferPool.Put(bfp)
-					return
-				}
-				continue
-			}
+// CloseAndDrain abandons ops, calling cancel, which must cancel the context ops were produced
+// with, and discarding the operations sent in the meantime. Once it returns, the goroutine
+// producing them has finished.
+func CloseAndDrain(cancel context.CancelFunc, ops <-chan BlockOperation) {
+	cancel()
+	Drain(ops)
+}
 
-			if rolling {
-				new := uint32(block[n-1])
-				r1, r2, rhash = rollingHash2(uint32(n), r1, r2, old, new)
-			} else {
-				r1, r2, rhash = rollingHash(block)
-			}
+// Syncer produces the operations to re-construct a file, one at a time, on the caller's goroutine.
+// Unlike Sync, it keeps its read buffer, strong hash and internal queues across files, so a
+// single Syncer can be Reset and reused to amortize allocations when syncing many files.
+// A Syncer is not safe for concurrent use.
+type Syncer struct {
+	r      io.ReaderAt
+	remote map[uint32][]BlockSignature
+	shash  hash.Hash
+	cfg    *options
+	buffer []byte
+	// adopt makes the Syncer use the strong hash of the remote signatures.
+	adopt bool
+
+	r1, r2, rhash, old uint32
+	// mod is the modulus of the rolling checksum, as used by the remote signatures.
+	mod uint32
+	// winLen is the length of the window the rolling checksum was calculated over.
+	winLen        int
+	offset        int64
+	rolling, done bool
+
+	// delta accumulates literal data until it is flushed as operations, starting at deltaOffset
+	// of the source.
+	delta       []byte
+	deltaOffset int64
+	// pending holds operations ready to be returned by Next, starting at head.
+	pending []BlockOperation
+	head    int
+	// err holds a failure validating the remote signatures.
+	err error
+
+	// coarse is the number of blocks covered by coarse remote signatures, if any.
+	coarse, fineRun uint64
+	tryCoarse       bool
+	window          []byte
+
+	// literal makes the rest of the source be sent as literal data.
+	literal bool
+
+	// ahead is the window of source data being rolled through.
+	ahead readAhead
+
+	// dict holds recent literals when deduplicating them.
+	dict *literalDict
+
+	// held are copies of the current run, along with their source data, held back until the
+	// run is long enough. See WithMinRun.
+	held      []BlockOperation
+	heldData  []byte
+	runBlocks uint64
+
+	// lastCopy is the index of the first block of the last copy, see WithForwardCopies.
+	lastCopy uint64
+	// index is the index of the source block at offset, when split WithBoundaries.
+	index uint64
+
+	// tail is the signature of the last block of the cache, if shorter than the rest, and atTail
+	// tells whether the block preceding it was just matched. See stepTail.
+	tail   *BlockSignature
+	atTail bool
+
+	// estimate makes literal data be counted into literalBytes instead of being sent.
+	estimate     bool
+	literalBytes int64
+
+	// started and sent account for the time taken and the literal data sent, see WithBudget.
+	started time.Time
+	sent    int64
+
+	// trace times source reads, see WithTracer.
+	trace *trace
+
+	// back indexes the source already processed, see WithBackRefs.
+	back backRefs
+
+	// indexed is set when matching against a signature index that is not empty, see
+	// WithSignatureIndex.
+	indexed bool
+}
 
-			if bs, ok := remote[rhash]; ok {
-				shash.Reset()
-				shash.Write(block)
-				s := shash.Sum(nil)
-
-				for _, b := range bs {
-					if !bytes.Equal(s, b.Strong) {
-						continue
-					}
-
-					match = true
-
-					// We need to send deltas before sending an index token.
-					if len(delta) > 0 {
-						send(ctx, bytes.NewReader(delta), o)
-						delta = make([]byte, 0)
-					}
-
-					// instructs the server to copy block data at offset b.Index
-					// from its own copy of the file.
-					o <- BlockOperation{Index: b.Index}
-					break
-				}
-			}
+// NewSyncer returns a Syncer using shash as the strong hash, or the one set by WithHash. If neither
+// is set, the Syncer adopts the strong hash the remote signatures were calculated with on every
+// Reset, or sha256 if they do not identify it. Unknown algorithms make Next fail with ErrUnsupportedHash, see RegisterHash. It must be Reset
+// before calling Next.
+func NewSyncer(shash hash.Hash, opts ...Option) (*Syncer, error) {
+	cfg := newOptions(opts)
+	if cfg.err != nil {
+		return nil, cfg.err
+	}
 
-			if match {
-				if err == io.EOF {
-					bufferPool.Put(bfp)
-					break
-				}
-
-				rolling, match = false, false
-				old, rhash, r1, r2 = 0, 0, 0, 0
-				offset += int64(n)
-			} else {
-				if err == io.EOF {
-					// If EOF is reached and not match data found, we add trailing data
-					// to delta array.
-					delta = append(delta, block...)
-					if len(delta) > 0 {
-						send(ctx, bytes.NewReader(delta), o)
-					}
-					bufferPool.Put(bfp)
-					break
-				}
-				rolling = true
-				old = uint32(block[0])
-				delta = append(delta, block[0])
-				offset++
-			}
+	if !cfg.weak.rollable() && !cfg.aligned && cfg.layout == nil {
+		return nil, ErrNotRollable
+	}
 
-			// Returning this buffer to the pool here gives us 5x more speed
-			bufferPool.Put(bfp)
-		}
-	}()
+	if err := cfg.checkMemory(cfg.syncerMemory()); err != nil {
+		return nil, err
+	}
 
-	return o, nil
+	if shash == nil {
+		shash = cfg.newHash()
+	}
+
+	return &Syncer{
+		shash:  shash,
+		adopt:  shash == nil,
+		cfg:    cfg,
+		buffer: make([]byte, cfg.size),
+	}, nil
+}
+
+// Reset discards any state and prepares the Syncer to process the source file r against the remote
+// block signatures. Like with Sync, the remote map is expected to be fully populated and is accessed
+// without a mutex. If the remote signatures were not calculated with the Syncer's strong hash,
+// or mix several ones, Next fails with ErrHashMismatch.
+func (s *Syncer) Reset(r io.ReaderAt, remote map[uint32][]BlockSignature) {
+	s.r, s.remote = r, remote
+	if r != nil && s.cfg.eofPolicy == EOFLenient {
+		s.r = lenientReaderAt{r: r}
+	}
+
+	// Signature indices are validated through their summary instead.
+	s.indexed = false
+	if s.cfg.index != nil {
+		remote = s.cfg.index.Summary().remote()
+		s.remote, s.indexed = nil, len(remote) > 0
+	}
+
+	s.err = nil
+	if id := remoteHashID(remote); s.adopt && (s.shash == nil || hashIDOf(s.shash) != id) {
+		s.shash, s.err = NewHash(id)
+	}
+	if s.err == nil {
+		s.err = checkHashes(remote, s.shash)
+	}
+	if s.err == nil {
+		s.mod, s.err = remoteModulus(remote, s.cfg)
+	}
+	if s.err == nil && r != nil && s.cfg.transform != nil {
+		s.r, s.err = normalizeAt(s.r, s.cfg.transform)
+	}
+	if s.r != nil && s.cfg.ranged {
+		s.r = clipReaderAt{r: s.r, end: s.cfg.rangeEnd}
+	}
+	s.coarse = coarseBlocks(remote)
+	s.tail = tailBlock(remote)
+	if s.cfg.layout != nil || s.cfg.stride > 0 {
+		s.coarse, s.tail = 0, nil
+	}
+	if s.err == nil && s.coarse > 1 {
+		s.err = s.cfg.checkMemory(s.cfg.syncerMemory() + int64(s.coarse)*int64(s.cfg.size))
+	}
+	s.atTail = s.tail != nil && s.tail.Index == 0
+	s.tryCoarse, s.fineRun = s.coarse > 1 && !s.cfg.copyHashes, 0
+	s.literal = false
+	s.r1, s.r2, s.rhash, s.old, s.winLen = 0, 0, 0, 0, 0
+	s.offset = 0
+	if s.cfg.ranged {
+		s.offset = s.cfg.rangeStart
+	}
+	s.rolling, s.done = false, false
+	s.delta = nil
+	s.literalBytes = 0
+	s.started, s.sent = time.Now(), 0
+	s.held, s.heldData, s.runBlocks = s.held[:0], s.heldData[:0], 0
+	s.lastCopy = 0
+	s.index = 0
+	s.ahead.reset()
+	s.back.reset()
+	s.dict = nil
+	if s.cfg.dedup > 0 {
+		s.dict = newLiteralDict(s.cfg.dedup, true)
+	}
+	s.pending = s.pending[:0]
+	s.head = 0
+
+	if s.cfg.baseDigest != nil {
+		s.emit(BlockOperation{BaseDigest: s.cfg.baseDigest})
+	}
 }
 
-// send sends all deltas over the channel. Any error is reported back using the
-// same channel.
-func send(ctx context.Context, r io.Reader, o chan<- BlockOperation) {
-	for {
+// Next returns the next operation, or io.EOF once the whole source file was processed. The last operation
+// before io.EOF is always a Done operation. Any other error
+// is fatal and the Syncer must be Reset before being used again. The Data of returned operations is owned
+// by the caller, the Syncer never writes to it again.
+func (s *Syncer) Next(ctx context.Context) (BlockOperation, error) {
+	if s.r == nil {
+		return BlockOperation{}, ErrNilReader
+	}
+
+	if s.err != nil {
+		return BlockOperation{}, s.err
+	}
+
+	// Pausing happens before touching any state, so Next can be called again if the
+	// context is done while paused.
+	if s.cfg.pauser != nil {
+		if err := s.cfg.pauser.Wait(ctx); err != nil {
+			return BlockOperation{}, err
+		}
+	}
+
+	for s.head == len(s.pending) {
+		s.pending, s.head = s.pending[:0], 0
+
+		if s.done {
+			return BlockOperation{}, io.EOF
+		}
+
 		// Allow for cancellation.
 		select {
 		case <-ctx.Done():
-			o <- BlockOperation{
-				Error: ctx.Err(),
-			}
-			return
+			s.done = true
+			return BlockOperation{}, ctx.Err()
 		default:
-			// break out of the select block and continue reading
 			break
 		}
 
-		bfp := bufferPool.Get().(*[]byte)
-		buffer := *bfp
-		defer bufferPool.Put(bfp)
+		if s.cfg.budgetTime > 0 && time.Since(s.started) > s.cfg.budgetTime {
+			s.done = true
+			return BlockOperation{}, ErrBudgetExceeded
+		}
+
+		if err := s.step(); err != nil {
+			s.done = true
+			return BlockOperation{}, err
+		}
+
+		if s.done {
+			s.breakRun()
+			s.flush()
+			// Lets the remote end tell a complete stream apart from a truncated one.
+			s.emit(BlockOperation{Done: true})
+		}
+	}
+
+	op := s.pending[s.head]
+	s.pending[s.head] = BlockOperation{}
+	s.head++
+
+	s.sent += int64(len(op.Data))
+	if s.cfg.budgetBytes > 0 && s.sent > s.cfg.budgetBytes {
+		s.done, s.pending, s.head = true, s.pending[:0], 0
+		return BlockOperation{}, ErrBudgetExceeded
+	}
+
+	// Only literal data counts against the rate limit, copy operations are tiny.
+	if s.cfg.limiter != nil && len(op.Data) > 0 {
+		if err := s.cfg.limiter.WaitN(ctx, len(op.Data)); err != nil {
+			s.done = true
+			return BlockOperation{}, err
+		}
+	}
+
+	return op, nil
+}
+
+// step reads the next window of the source file, queuing any resulting operations.
+func (s *Syncer) step() error {
+	fixed := s.cfg.layout == nil
+	whole := fixed && s.cfg.stride == 0
+	if s.offset == 0 && s.cfg.identical != nil && !s.literal && !s.cfg.copyHashes && whole {
+		if matched, err := s.stepIdentical(); matched || err != nil {
+			return err
+		}
+	}
+
+	if s.offset == 0 && s.cfg.appendSize > 0 && !s.literal && !s.cfg.copyHashes && whole {
+		if err := s.stepAppend(); err != nil {
+			return err
+		}
+	}
+
+	// If there are no block signatures from remote server, send all data blocks
+	if len(s.remote) == 0 && !s.indexed && s.cfg.backWindow < s.cfg.size || s.literal {
+		block := s.buffer
+		if !s.estimate {
+			block = make([]byte, len(s.buffer))
+		}
 
-		n, err := r.Read(buffer)
+		n, err := readAtFull(s.r, block, s.offset)
 		if err != nil && err != io.EOF {
-			o <- BlockOperation{
-				Error: errors.Wrapf(err, "failed reading data block"),
+			return s.readError(err)
+		}
+
+		if n > 0 && s.estimate {
+			s.literalBytes += int64(n)
+		} else if n > 0 {
+			s.emit(BlockOperation{Data: block[:n], Offset: s.offset})
+		}
+		s.offset += int64(n)
+
+		s.done = err == io.EOF
+		return nil
+	}
+
+	if s.tryCoarse && !s.rolling {
+		if matched, err := s.stepCoarse(); matched || err != nil {
+			return err
+		}
+	}
+
+	if s.atTail {
+		if matched, err := s.stepTail(); matched || err != nil {
+			return err
+		}
+	}
+
+	size := len(s.buffer)
+	if !fixed {
+		size = s.cfg.blockSize(s.index)
+		s.index++
+	}
+
+	block, err := s.block(s.offset, size)
+	if err != nil && err != io.EOF {
+		return s.readError(err)
+	}
+
+	n := len(block)
+	if n == 0 {
+		s.flush()
+		s.done = true
+		return nil
+	}
+
+	if s.rolling && n < s.winLen {
+		// Past the end of the file the window only shrinks, so it can still match
+		// the last block of the cache, which is usually shorter than the rest.
+		s.r1, s.r2, s.rhash = rollingShrink(s.mod, uint32(s.winLen), s.r1, s.r2, s.old)
+	} else if s.rolling {
+		new := uint32(block[n-1])
+		s.r1, s.r2, s.rhash = rollingHash2(s.mod, uint32(n), s.r1, s.r2, s.old, new)
+	} else if s.cfg.weak.rollable() {
+		s.r1, s.r2, s.rhash = rollingHash(block, s.mod)
+	} else {
+		s.rhash = s.cfg.weak.sum(block, s.mod)
+	}
+	s.winLen = n
+
+	bs, lerr := s.lookup(s.rhash)
+	if lerr != nil {
+		return lerr
+	}
+
+	var match bool
+	if len(bs) > 0 {
+		s.cfg.stats.weakHit(len(bs))
+
+		s.shash.Reset()
+		s.shash.Write(block)
+		sum := s.shash.Sum(nil)
+
+		for _, b := range bs {
+			if b.blocks() > 1 || !s.copyable(b) {
+				continue
+			}
+
+			equal := s.compare(block, sum, b)
+			s.cfg.stats.strongCompared(equal)
+			if !equal {
+				continue
 			}
-			return
+
+			match = true
+
+			// instructs the server to copy block data at offset b.Index
+			// from its own copy of the file.
+			s.emitCopy(BlockOperation{Index: b.Index, Strong: s.copyHash(b), Length: b.Length}, block)
+			s.atTail = s.tail != nil && b.Index+1 == s.tail.Index
+			break
 		}
 
-		// If we don't guard against 0 bytes reads, an operation with index 0 will be sent
-		// and the server will duplicate block 0 at the end of the reconstructed file.
-		if n > 0 {
-			block := buffer[:n]
-			o <- BlockOperation{Data: block}
+		if !match {
+			s.cfg.stats.weakOnlyHit()
 		}
+	}
 
+	if !match && s.cfg.backWindow >= s.cfg.size && fixed && n == s.cfg.size {
+		matched, berr := s.stepBack(block)
+		if berr != nil {
+			return berr
+		}
+		match = matched
+	}
+
+	if match {
 		if err == io.EOF {
-			break
+			s.offset += int64(n)
+			s.done = true
+			return nil
+		}
+
+		s.fineRun++
+		if s.coarse > 1 && !s.cfg.copyHashes && s.fineRun >= s.coarse {
+			s.tryCoarse, s.fineRun = true, 0
+		}
+
+		s.rolling = false
+		s.old, s.rhash, s.r1, s.r2 = 0, 0, 0, 0
+		s.offset += int64(n)
+		return nil
+	}
+
+	s.fineRun = 0
+	if n < len(s.buffer) && fixed {
+		// Short windows are only found at the end of the source, such as when it is shorter
+		// than a block, and only shrink from there on.
+		s.stepShort(block)
+		return nil
+	}
+
+	if s.cfg.aligned || !fixed {
+		// In aligned mode the whole block becomes literal data and the search
+		// resumes at the next block boundary.
+		s.addDelta(block)
+		s.offset += int64(n)
+	} else {
+		s.rolling = true
+		s.old = uint32(block[0])
+		s.addDelta(block[:1])
+		s.offset++
+	}
+
+	// Flushes literal data early when the caller favors latency over
+	// fewer and larger operations.
+	if max := s.maxDelta(); max > 0 && len(s.delta) >= max {
+		s.flush()
+	}
+
+	return nil
+}
+
+// Comparator decides whether a source block matches a remote block signature found in the
+// lookup table under the same weak checksum, in which case the remote end copies its own
+// block instead of receiving the source block as literal data. strong is the strong checksum
+// of the source block, calculated with the same hash as the remote signatures. The block is
+// only valid during the call.
+//
+// The default comparator accepts candidates whose strong checksum equals strong. Custom
+// comparators may implement similarity matching, i.e. for media files, but there is no way
+// to send a residual: a block accepted without being identical makes the reconstructed
+// file differ from the source, so the reconstruction becomes lossy.
+type Comparator func(block, strong []byte, candidate BlockSignature) bool
+
+// strongEqual is the default Comparator.
+func strongEqual(block, strong []byte, candidate BlockSignature) bool {
+	return bytes.Equal(strong, candidate.Strong)
+}
+
+// emit queues an operation to be returned by Next.
+func (s *Syncer) emit(op BlockOperation) {
+	s.trace.sent(len(op.Data))
+	if s.dict != nil && len(op.Data) > 0 {
+		if id := s.dict.dedup(op.Data); id != 0 {
+			op = BlockOperation{Ref: id, Offset: op.Offset}
+		}
+	}
+
+	if s.cfg.literalChecksums && len(op.Data) > 0 {
+		op.Checksum = literalChecksum(op.Data)
+	}
+	s.pending = append(s.pending, op)
+}
+
+// addDelta accumulates literal data, which is only counted when estimating.
+func (s *Syncer) addDelta(b []byte) {
+	s.breakRun()
+	if s.estimate {
+		s.literalBytes += int64(len(b))
+		return
+	}
+
+	if len(s.delta) == 0 {
+		s.deltaOffset = s.offset
+	}
+	s.delta = append(s.delta, b...)
+}
+
+// emitCopy queues a copy operation of the given source data, after any pending literal data.
+// Copies are held back until the run of consecutive copied blocks reaches the minimum set by
+// WithMinRun, so shorter runs can still be turned into literal data.
+func (s *Syncer) emitCopy(op BlockOperation, data []byte) {
+	s.flush()
+	op.Offset = s.offset
+	s.lastCopy = op.Index
+
+	s.runBlocks += op.blocks()
+	if s.runBlocks < s.cfg.minRun {
+		s.held = append(s.held, op)
+		s.heldData = append(s.heldData, data...)
+		return
+	}
+
+	for _, h := range s.held {
+		s.emit(h)
+	}
+	s.held, s.heldData = s.held[:0], s.heldData[:0]
+	s.emit(op)
+}
+
+// breakRun ends the current run of copies, turning any held back copies into literal data.
+func (s *Syncer) breakRun() {
+	s.runBlocks = 0
+	if len(s.held) == 0 {
+		return
+	}
+
+	data, offset := s.heldData, s.held[0].Offset
+	s.held, s.heldData = s.held[:0], nil
+	s.addDelta(data)
+	s.heldData = data[:0]
+	s.deltaOffset = offset
+}
+
+// flush queues pending literal data as operations of at most one block each. The
+// delta buffer is handed over to those operations and never written to again.
+func (s *Syncer) flush() {
+	// If we don't guard against 0 bytes reads, an operation with index 0 will be sent
+	// and the server will duplicate block 0 at the end of the reconstructed file.
+	for len(s.delta) > 0 {
+		n := len(s.delta)
+		if n > len(s.buffer) {
+			n = len(s.buffer)
 		}
+
+		s.emit(BlockOperation{Data: s.delta[:n:n], Offset: s.deltaOffset})
+		s.delta = s.delta[n:]
+		s.deltaOffset += int64(n)
+	}
+	s.delta = nil
+}
+
+// readError describes a failure reading the source file at the current offset.
+func (s *Syncer) readError(err error) error {
+	return &BlockError{
+		Index:  uint64(s.offset / int64(s.cfg.size)),
+		Offset: s.offset,
+		Kind:   ErrReadBlock,
+		Err:    err,
 	}
 }
@@ -0,0 +1,116 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import "io"
+
+// addCoarse accumulates a block into the current coarse group, queuing the coarse
+// signature once the group is complete. Short blocks break the group, since coarse
+// signatures only cover runs of full blocks.
+func (s *Signer) addCoarse(block []byte, index uint64) {
+	k := s.cfg.coarse
+	if k < 2 {
+		return
+	}
+
+	if len(block) != len(s.buffer) {
+		s.group = s.group[:0]
+		return
+	}
+
+	size := int(k) * len(s.buffer)
+	if s.group == nil {
+		s.group = make([]byte, 0, size)
+	}
+
+	s.group = append(s.group, block...)
+	if len(s.group) < size {
+		return
+	}
+
+	s.shash.Reset()
+	s.shash.Write(s.group)
+
+	s.pending = &BlockSignature{
+		Index:   index + 1 - k,
+		Count:   k,
+		Weak:    s.cfg.weak.sum(s.group, s.cfg.modulus),
+		Modulus: s.modulus(),
+		Strong:  s.shash.Sum(nil),
+		Hash:    s.hashID,
+	}
+	s.group = s.group[:0]
+}
+
+// coarseBlocks returns the number of blocks covered by the coarse signatures in remote,
+// or zero if there are none.
+func coarseBlocks(remote map[uint32][]BlockSignature) uint64 {
+	var k uint64
+	for _, bs := range remote {
+		for _, b := range bs {
+			if b.Count > k {
+				k = b.Count
+			}
+		}
+	}
+
+	if k < 2 {
+		return 0
+	}
+	return k
+}
+
+// stepCoarse tries to match the coarse window at the current offset, queuing a copy of
+// the whole run of blocks if it does. Otherwise, coarse matching is suspended until
+// enough blocks match in a row.
+func (s *Syncer) stepCoarse() (bool, error) {
+	s.tryCoarse = false
+
+	size := int(s.coarse) * len(s.buffer)
+	if len(s.window) != size {
+		s.window = make([]byte, size)
+	}
+
+	n, err := readAtFull(s.r, s.window, s.offset)
+	if err != nil && err != io.EOF {
+		return false, s.readError(err)
+	}
+
+	if n < size {
+		return false, nil
+	}
+
+	bs, lerr := s.lookup(s.cfg.weak.sum(s.window, s.mod))
+	if len(bs) == 0 || lerr != nil {
+		return false, lerr
+	}
+	s.cfg.stats.weakHit(len(bs))
+
+	s.shash.Reset()
+	s.shash.Write(s.window)
+	sum := s.shash.Sum(nil)
+
+	for _, b := range bs {
+		if b.Count != s.coarse || !s.copyable(b) {
+			continue
+		}
+
+		equal := s.compare(s.window, sum, b)
+		s.cfg.stats.strongCompared(equal)
+		if !equal {
+			continue
+		}
+
+		s.emitCopy(BlockOperation{Index: b.Index, Count: b.Count}, s.window)
+		s.offset += int64(size)
+		s.atTail = s.tail != nil && b.Index+b.Count == s.tail.Index
+		s.tryCoarse = true
+		s.done = err == io.EOF
+		return true, nil
+	}
+
+	s.cfg.stats.weakOnlyHit()
+	return false, nil
+}
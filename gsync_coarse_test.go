@@ -0,0 +1,69 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestCoarseBlocks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(170, 100*DefaultBlockSize+10)
+	source := append([]byte(nil), cache[:40*DefaultBlockSize]...)
+	source = append(source, srand(171, 777)...)
+	source = append(source, cache[40*DefaultBlockSize:]...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil, WithCoarseBlocks(8))
+	assert.Ok(t, err)
+
+	var fine, coarse int
+	table := make(map[uint32][]BlockSignature)
+	for sig := range sigsCh {
+		assert.Ok(t, sig.Error)
+		if sig.Done {
+			continue
+		}
+		if sig.Count == 8 {
+			coarse++
+		} else {
+			fine++
+		}
+		table[sig.Weak] = append(table[sig.Weak], sig)
+	}
+	assert.Equals(t, 101, fine)
+	assert.Equals(t, 12, coarse)
+
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, table)
+	assert.Ok(t, err)
+
+	var runs int
+	var ops []BlockOperation
+	for op := range opsCh {
+		assert.Ok(t, op.Error)
+		if op.Count > 1 {
+			runs++
+		}
+		ops = append(ops, op)
+	}
+	assert.Cond(t, runs >= 10, "expected unchanged regions to be copied in runs, got %d", runs)
+	assert.Cond(t, len(ops) < 40, "expected fewer operations, got %d", len(ops))
+
+	c := make(chan BlockOperation, len(ops))
+	for _, op := range ops {
+		c <- op
+	}
+	close(c)
+
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), c))
+	assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+}
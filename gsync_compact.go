@@ -0,0 +1,106 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import "context"
+
+// compactLiteralSize is the default maximum size of literals merged by Compact.
+const compactLiteralSize = 1024 * 1024 // 1mb
+
+// Compact merges adjacent literal operations read from ops into larger ones and collapses
+// copies of consecutive cache blocks into a single operation copying a run of blocks, see
+// BlockOperation.Count. It is an optional pass over operation streams with many small
+// operations, such as those produced by older or simpler encoders, or by Sync with
+// WithMaxDelta. Applying the compacted stream reconstructs exactly the same file.
+//
+// Merged literals grow up to the size set by WithMaxDelta, or up to 1mb by default. Any
+// other operation is passed through untouched, after flushing what was pending.
+func Compact(ctx context.Context, ops <-chan BlockOperation, opts ...Option) <-chan BlockOperation {
+	cfg := newOptions(opts)
+	max := cfg.maxDelta
+	if max <= 0 {
+		max = compactLiteralSize
+	}
+
+	o := make(chan BlockOperation, cfg.channelBuffer)
+
+	go func() {
+		defer close(o)
+
+		var pending *BlockOperation
+
+		send := func(op BlockOperation) bool {
+			select {
+			case o <- op:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		flush := func() bool {
+			if pending == nil {
+				return true
+			}
+
+			op := *pending
+			pending = nil
+			if op.Checksum != nil {
+				op.Checksum = literalChecksum(op.Data)
+			}
+			return send(op)
+		}
+
+		for op := range ops {
+			switch {
+			case op.Error == nil && len(op.Data) > 0:
+				if pending != nil && len(pending.Data) > 0 && len(pending.Data)+len(op.Data) <= max {
+					pending.Data = append(pending.Data, op.Data...)
+					if op.Checksum != nil {
+						pending.Checksum = op.Checksum
+					}
+					continue
+				}
+
+				if !flush() {
+					return
+				}
+
+				// Literal data is copied since it is going to be appended to.
+				pending = &BlockOperation{
+					Data:     append(make([]byte, 0, len(op.Data)), op.Data...),
+					Checksum: op.Checksum,
+					Offset:   op.Offset,
+				}
+
+			case op.copies():
+				// Copies carrying strong checksums are looked up block by block, and only the last
+				// block of a run can be shorter than the rest.
+				if pending != nil && pending.copies() && pending.Strong == nil && op.Strong == nil &&
+					pending.Length == 0 && pending.Index+pending.blocks() == op.Index {
+					pending.Count = pending.blocks() + op.blocks()
+					pending.Length = op.Length
+					continue
+				}
+
+				if !flush() {
+					return
+				}
+
+				op := op
+				pending = &op
+
+			default:
+				if !flush() || !send(op) {
+					return
+				}
+			}
+		}
+
+		flush()
+	}()
+
+	return o
+}
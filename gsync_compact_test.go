@@ -0,0 +1,78 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestCompact(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(160, 256*1024)
+	source := append(srand(161, 10*1024), cache[:21*DefaultBlockSize]...)
+	source = append(source, srand(162, 10*1024)...)
+	source = append(source, cache[21*DefaultBlockSize:]...)
+
+	run := func(opts ...Option) (int, []byte) {
+		sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+		assert.Ok(t, err)
+		cacheSigs, err := LookUpTable(ctx, sigsCh)
+		assert.Ok(t, err)
+
+		opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, WithMaxDelta(100))
+		assert.Ok(t, err)
+
+		var ops []BlockOperation
+		for op := range Compact(ctx, opsCh, opts...) {
+			ops = append(ops, op)
+		}
+
+		c := make(chan BlockOperation, len(ops))
+		for _, op := range ops {
+			c <- op
+		}
+		close(c)
+
+		target := new(bytes.Buffer)
+		assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), c))
+		return len(ops), target.Bytes()
+	}
+
+	// Two literals, two runs of copies and the end of the stream.
+	n, target := run()
+	assert.Equals(t, 5, n)
+	assert.Cond(t, bytes.Equal(source, target), "source and target files are different")
+
+	n, target = run(WithMaxDelta(4096))
+	assert.Equals(t, 2+3+3+1, n)
+	assert.Cond(t, bytes.Equal(source, target), "source and target files are different")
+}
+
+func TestApplyRuns(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(163, 10*DefaultBlockSize+100)
+	ops := []BlockOperation{{Index: 2, Count: 9}, {Index: 0, Count: 2}}
+
+	for _, opts := range [][]Option{nil, {WithPrefetch(4, 8)}} {
+		c := make(chan BlockOperation, len(ops))
+		for _, op := range ops {
+			c <- op
+		}
+		close(c)
+
+		target := new(bytes.Buffer)
+		assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), c, opts...))
+		assert.Cond(t, bytes.Equal(append(append([]byte(nil), cache[2*DefaultBlockSize:]...), cache[:2*DefaultBlockSize]...), target.Bytes()), "unexpected reconstruction")
+	}
+}
@@ -0,0 +1,317 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// heartbeatMisses is the number of heartbeat intervals without frames after which a connection is
+// considered dead, see WithHeartbeat.
+const heartbeatMisses = 3
+
+// ServeOverConn reads operations sent by SendOverConn off conn and applies them with Apply, then
+// sends back the result: a Done operation on success, or an operation carrying the error. Reading
+// stops after a Done operation, or when the other end closes its side of the connection. Both
+// directions use the wire format of Encoder and Decoder, and options are passed on to them and to
+// Apply.
+//
+// With WithHeartbeat, heartbeats are sent while operations are read and applied, and the
+// connection is abandoned with ErrConnTimeout if the other end goes quiet. Cancelling ctx abandons
+// it as well. conn is not closed, and its deadlines are left set on failure.
+func ServeOverConn(ctx context.Context, conn net.Conn, dst io.Writer, cache io.ReaderAt, opts ...Option) error {
+	cfg := newOptions(opts)
+	if cfg.err != nil {
+		return cfg.err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer watchConn(ctx, conn)()
+
+	w := newConnWriter(conn, cfg, opts)
+	defer w.beat(cfg.heartbeat)()
+
+	ops := make(chan BlockOperation)
+	go receiveOps(ctx, NewDecoder(&deadlineReader{conn: conn, timeout: w.timeout}, opts...), ops)
+
+	err := Apply(ctx, dst, cache, ops, opts...)
+	result := BlockOperation{Done: true}
+	if err != nil {
+		result = BlockOperation{Error: err}
+	}
+
+	if werr := w.encode(result); err == nil {
+		err = werr
+	}
+	if err != nil {
+		// Operations may still be being read, which is abandoned.
+		conn.SetReadDeadline(time.Unix(1, 0))
+	}
+	return connErr(ctx, err)
+}
+
+// receiveOps decodes operations into ops until a Done operation, the end of the stream or a
+// failure, which is sent as an operation carrying the error.
+func receiveOps(ctx context.Context, dec *Decoder, ops chan<- BlockOperation) {
+	defer close(ops)
+
+	for {
+		op, err := dec.Decode()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			op = BlockOperation{Error: err}
+		}
+
+		select {
+		case ops <- op:
+		case <-ctx.Done():
+			return
+		}
+
+		if err != nil || op.Done {
+			return
+		}
+	}
+}
+
+// SendOverConn sends the operations read from ops, as returned by Sync, over conn to the other end,
+// running ServeOverConn, and returns the result of applying them there. Sending stops after a Done
+// operation, or when ops is closed, in which case the sending side of conn is closed if it supports
+// it, as TCP connections do. Errors carried by operations are sent to the other end, making it
+// fail, and returned. Options are passed on to Encoder and Decoder.
+//
+// With WithHeartbeat, heartbeats are sent while waiting for operations, and the connection is
+// abandoned with ErrConnTimeout if the other end goes quiet. Cancelling ctx abandons it as well.
+// conn is not closed, and its deadlines are left set on failure.
+func SendOverConn(ctx context.Context, conn net.Conn, ops <-chan BlockOperation, opts ...Option) error {
+	cfg := newOptions(opts)
+	if cfg.err != nil {
+		return cfg.err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer watchConn(ctx, conn)()
+
+	w := newConnWriter(conn, cfg, opts)
+	stop := w.beat(cfg.heartbeat)
+	defer stop()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- awaitResult(NewDecoder(&deadlineReader{conn: conn, timeout: w.timeout}, opts...))
+	}()
+
+	done, err := sendOps(ctx, w, ops, result)
+	stop()
+
+	if c, ok := conn.(interface{ CloseWrite() error }); ok && err == nil && !done {
+		err = errors.Wrapf(c.CloseWrite(), "failed closing connection")
+	}
+
+	if err == nil {
+		select {
+		case err = <-result:
+			return connErr(ctx, err)
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	// The result may still be being waited for, which is abandoned.
+	conn.SetReadDeadline(time.Unix(1, 0))
+	return connErr(ctx, err)
+}
+
+// sendOps encodes the operations read from ops until a Done operation, which it reports, or until
+// ops is closed. The result of the other end, if received before, is returned as a failure.
+func sendOps(ctx context.Context, w *connWriter, ops <-chan BlockOperation, result <-chan error) (bool, error) {
+	for {
+		select {
+		case op, ok := <-ops:
+			if !ok {
+				return false, nil
+			}
+
+			if err := w.encode(op); err != nil {
+				return false, err
+			}
+			if op.Error != nil {
+				return false, op.Error
+			}
+			if op.Done {
+				return true, nil
+			}
+		case err := <-result:
+			if err == nil {
+				err = errors.Wrapf(ErrMalformedStream, "result received before completion")
+			}
+			return false, err
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// awaitResult reads the result sent back by ServeOverConn.
+func awaitResult(dec *Decoder) error {
+	op, err := dec.Decode()
+	switch {
+	case err == io.EOF:
+		return errors.Wrapf(io.ErrUnexpectedEOF, "connection closed without result")
+	case err != nil:
+		return err
+	case op.Error != nil:
+		return errors.Wrapf(op.Error, "remote end failed applying operations")
+	case !op.Done:
+		return errors.Wrapf(ErrMalformedStream, "unexpected result")
+	}
+	return nil
+}
+
+// connWriter serializes the frames written to a connection, operations and heartbeats, setting a
+// write deadline before each one if heartbeats are enabled.
+type connWriter struct {
+	mu   sync.Mutex
+	conn net.Conn
+	enc  *Encoder
+	// timeout is how long the other end may go quiet, zero without heartbeats.
+	timeout time.Duration
+	// final is set once a Done or error operation was written, after which no heartbeats are sent.
+	final bool
+}
+
+func newConnWriter(conn net.Conn, cfg *options, opts []Option) *connWriter {
+	return &connWriter{conn: conn, enc: NewEncoder(conn, opts...), timeout: heartbeatMisses * cfg.heartbeat}
+}
+
+// encode writes op to the connection.
+func (w *connWriter) encode(op BlockOperation) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.final = op.Done || op.Error != nil
+	if err := w.deadline(); err != nil {
+		return err
+	}
+	return w.enc.Encode(op)
+}
+
+// heartbeat writes a heartbeat to the connection, unless the last frame was already written.
+func (w *connWriter) heartbeat() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.final {
+		return io.EOF
+	}
+	if err := w.deadline(); err != nil {
+		return err
+	}
+	return w.enc.Heartbeat()
+}
+
+// deadline sets the deadline of the next write, if heartbeats are enabled.
+func (w *connWriter) deadline() error {
+	if w.timeout == 0 {
+		return nil
+	}
+	return errors.Wrapf(w.conn.SetWriteDeadline(time.Now().Add(w.timeout)), "failed setting write deadline")
+}
+
+// beat sends heartbeats every interval, if not zero, until the returned function is called or a
+// heartbeat fails. Failures are left for the next operation written or read to find out.
+func (w *connWriter) beat(interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if w.heartbeat() != nil {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+// deadlineReader reads from a connection, failing with ErrConnTimeout if nothing arrives for
+// timeout, when not zero. As heartbeats are frames, anything read counts.
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if r.timeout > 0 {
+		if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+			return 0, errors.Wrapf(err, "failed setting read deadline")
+		}
+	}
+
+	n, err := r.conn.Read(p)
+	var nerr net.Error
+	if r.timeout > 0 && errors.As(err, &nerr) && nerr.Timeout() {
+		err = errors.Wrapf(ErrConnTimeout, "nothing read for %v", r.timeout)
+	}
+	return n, err
+}
+
+// watchConn abandons all pending I/O on conn once ctx is cancelled, until the returned function is
+// called.
+func watchConn(ctx context.Context, conn net.Conn) func() {
+	stop, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-exited
+	}
+}
+
+// connErr returns the error of an abandoned connection: the reason it was abandoned, if ctx was
+// cancelled, or err.
+func connErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+// connPair returns both ends of a TCP connection over the loopback interface.
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	assert.Ok(t, err)
+	server := <-accepted
+	assert.Cond(t, server != nil, "failed accepting connection")
+	return client, server
+}
+
+func TestOverConn(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(520, 20*DefaultBlockSize+100)
+	source := mutate(cache, 521, 5)
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	opts := []Option{WithHeartbeat(10 * time.Millisecond), WithFrameChecksums()}
+	client, server := connPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	// Operations are held back for longer than the connection may go quiet, which the heartbeats
+	// make up for.
+	ops, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs)
+	assert.Ok(t, err)
+	slow := make(chan BlockOperation)
+	go func() {
+		defer close(slow)
+		for op := range ops {
+			if op.Done {
+				time.Sleep(100 * time.Millisecond)
+			}
+			slow <- op
+		}
+	}()
+
+	served := make(chan error, 1)
+	target := new(bytes.Buffer)
+	go func() {
+		served <- ServeOverConn(ctx, server, target, bytes.NewReader(cache), opts...)
+	}()
+
+	assert.Ok(t, SendOverConn(ctx, client, slow, opts...))
+	assert.Ok(t, <-served)
+	assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+
+	// Failures applying operations are reported back, here a stream closed without completion.
+	client, server = connPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	truncated := make(chan BlockOperation, 1)
+	truncated <- BlockOperation{Data: []byte("data")}
+	close(truncated)
+	go func() {
+		served <- ServeOverConn(ctx, server, new(bytes.Buffer), nil, append(opts, WithRequireDone())...)
+	}()
+
+	err = SendOverConn(ctx, client, truncated, opts...)
+	assert.Cond(t, err != nil && errors.Is(<-served, ErrTruncatedStream), "unexpected error: %v", err)
+}
+
+func TestOverConnTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// An end that goes quiet is detected by the other one, on either side.
+	client, server := connPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	err := ServeOverConn(ctx, server, new(bytes.Buffer), nil, WithHeartbeat(10*time.Millisecond))
+	assert.Cond(t, errors.Is(err, ErrConnTimeout), "unexpected error: %v", err)
+
+	client, server = connPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	err = SendOverConn(ctx, client, make(chan BlockOperation), WithHeartbeat(10*time.Millisecond))
+	assert.Cond(t, errors.Is(err, ErrConnTimeout), "unexpected error: %v", err)
+
+	// Cancelling the context abandons the connection, with or without heartbeats.
+	client, server = connPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	cctx, ccancel := context.WithCancel(ctx)
+	time.AfterFunc(50*time.Millisecond, ccancel)
+	err = ServeOverConn(cctx, server, new(bytes.Buffer), nil)
+	assert.Equals(t, context.Canceled, err)
+}
@@ -0,0 +1,308 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"hash"
+	"io"
+
+	"github.com/minio/sha256-simd"
+	"github.com/pkg/errors"
+)
+
+// Encrypted streams start with an operation whose data is the stream header, which is not sealed:
+//
+//	magic:   "GSEC"
+//	version: 1 byte, cryptoVersion
+//	id:      cryptoIDSize random bytes identifying the stream
+//
+// Sealed frames follow in the data of literal operations, as nonce followed by the ciphertext of
+// the frame kind byte and its payload, which is the literal data for frameLiteral and a single
+// byte telling whether a Done operation follows for frameEnd.
+const (
+	cryptoMagic   = "GSEC"
+	cryptoVersion = 1
+	cryptoIDSize  = 16
+
+	frameLiteral = 0
+	frameEnd     = 1
+)
+
+// cryptoRand is the source of stream identifiers and nonces.
+var cryptoRand = rand.Reader
+
+// Encrypt seals the data of literal operations read from ops using aead, for syncing
+// sensitive files over untrusted transports. Any AEAD cipher can be plugged in, such as
+// AES-GCM from crypto/cipher or ChaCha20-Poly1305 from golang.org/x/crypto. The key
+// is managed by the caller and must be shared with the end running Decrypt.
+//
+// The stream starts with an operation carrying a random stream identifier, and ends with a sealed
+// end marker, before the Done operation if any. Every literal is sealed with a random nonce, which
+// is prepended to its data. The additional data of every sealed literal and of the end marker binds
+// the stream identifier, its position among them, and a digest of all operations before it, copy
+// operations included. Decrypt thus detects literals that were altered, reordered, dropped or
+// replayed from other streams under the same key, copy operations that were altered, reordered,
+// inserted or dropped, and streams cut short. Since random nonces are used, a single key should
+// not seal more than 2^32 literals in the case of AES-GCM. Failures to seal are reported as an
+// operation with an ErrEncrypt error, after which no more operations are sent.
+//
+// Stages changing operations, such as Compact, must run before Encrypt, since the operations
+// reaching Decrypt must be those Encrypt sent. Offsets are not authenticated, even if sent
+// WithWireOffsets.
+//
+// Only literal data is encrypted. An eavesdropper still learns the number and order of
+// operations, the length of every literal, the cache block indices being copied, which
+// reveals what parts of the file did not change, and the base digest, if any. Literal
+// checksums are dropped, since they would reveal the plaintext of short literals and sealing
+// already authenticates them.
+func Encrypt(ctx context.Context, ops <-chan BlockOperation, aead cipher.AEAD) <-chan BlockOperation {
+	o := make(chan BlockOperation)
+
+	go func() {
+		defer close(o)
+
+		send := func(op BlockOperation) bool {
+			select {
+			case o <- op:
+				return op.Error == nil
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		id := make([]byte, cryptoIDSize)
+		if _, err := io.ReadFull(cryptoRand, id); err != nil {
+			send(BlockOperation{Error: &BlockError{Kind: ErrEncrypt, Err: err}})
+			return
+		}
+		s := newSealer(aead, id)
+		header := append(append([]byte(cryptoMagic), cryptoVersion), id...)
+		if !send(BlockOperation{Data: header}) {
+			return
+		}
+
+		end := func(done bool) bool {
+			payload := []byte{0}
+			if done {
+				payload[0] = 1
+			}
+			seq := s.seq
+			data, err := s.seal(frameEnd, payload)
+			if err != nil {
+				return send(BlockOperation{Error: &BlockError{Index: seq, Kind: ErrEncrypt, Err: err}})
+			}
+			return send(BlockOperation{Data: data})
+		}
+
+		for op := range ops {
+			switch {
+			case op.Error != nil:
+				send(op)
+				return
+			case op.Done:
+				if end(true) {
+					send(op)
+				}
+				return
+			case len(op.Data) > 0:
+				seq := s.seq
+				data, err := s.seal(frameLiteral, op.Data)
+				if err != nil {
+					op = BlockOperation{Error: &BlockError{Index: seq, Kind: ErrEncrypt, Err: err}}
+				} else {
+					op.Data, op.Checksum = data, nil
+				}
+			default:
+				s.frame(op)
+			}
+
+			if !send(op) {
+				return
+			}
+		}
+		end(false)
+	}()
+
+	return o
+}
+
+// Decrypt opens the data of literal operations sealed by Encrypt, verifying the stream as
+// described there. Literals failing to authenticate, streams without a valid header, and
+// operations missing or following the end marker are reported as an operation with an
+// ErrDecrypt error, after which no more operations are sent. The Index of the accompanying
+// *BlockError is the position of the sealed frame the failure was found at.
+func Decrypt(ctx context.Context, ops <-chan BlockOperation, aead cipher.AEAD) <-chan BlockOperation {
+	o := make(chan BlockOperation)
+
+	go func() {
+		defer close(o)
+
+		send := func(op BlockOperation) bool {
+			select {
+			case o <- op:
+				return op.Error == nil
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		var (
+			s *sealer
+			// ended is set once the end marker was opened, and done while it announces a
+			// Done operation not received yet.
+			ended, done bool
+		)
+		fail := func(err error) {
+			var seq uint64
+			if s != nil {
+				seq = s.seq
+			}
+			send(BlockOperation{Error: &BlockError{Index: seq, Kind: ErrDecrypt, Err: err}})
+		}
+
+		for op := range ops {
+			switch {
+			case op.Error != nil:
+				send(op)
+				return
+			case s == nil:
+				id, err := streamID(op)
+				if err != nil {
+					fail(err)
+					return
+				}
+				s = newSealer(aead, id)
+				continue
+			case ended && !(op.Done && done):
+				fail(errors.New("operation after the end of the stream"))
+				return
+			case op.Done:
+				if !ended {
+					fail(io.ErrUnexpectedEOF)
+					return
+				}
+				done = false
+			case len(op.Data) > 0:
+				kind, payload, err := s.open(op.Data)
+				if err != nil {
+					fail(err)
+					return
+				}
+
+				if kind == frameEnd {
+					ended, done = true, len(payload) == 1 && payload[0] == 1
+					continue
+				}
+				op.Data = payload
+			default:
+				s.frame(op)
+			}
+
+			if !send(op) {
+				return
+			}
+		}
+
+		if !ended || done {
+			fail(io.ErrUnexpectedEOF)
+		}
+	}()
+
+	return o
+}
+
+// streamID returns the stream identifier carried by the header operation of an encrypted stream.
+func streamID(op BlockOperation) ([]byte, error) {
+	header := op.Data
+	switch {
+	case len(header) != len(cryptoMagic)+1+cryptoIDSize || string(header[:len(cryptoMagic)]) != cryptoMagic:
+		return nil, errors.New("missing stream header")
+	case header[len(cryptoMagic)] != cryptoVersion:
+		return nil, errors.Wrapf(ErrUnsupportedVersion, "version %d", header[len(cryptoMagic)])
+	}
+	return header[len(cryptoMagic)+1:], nil
+}
+
+// sealer seals and opens the frames of an encrypted stream, keeping the digest of its operations.
+type sealer struct {
+	aead cipher.AEAD
+	id   []byte
+	// seq is the number of frames sealed or opened so far.
+	seq uint64
+	// transcript digests the operations of the stream, with the frames being sealed or opened.
+	transcript hash.Hash
+	scratch    []byte
+}
+
+func newSealer(aead cipher.AEAD, id []byte) *sealer {
+	return &sealer{aead: aead, id: id, transcript: sha256.New()}
+}
+
+// frame adds an operation without data to the transcript, encoding the fields Encoder sends.
+func (s *sealer) frame(op BlockOperation) {
+	b := s.scratch[:0]
+	switch {
+	case op.BaseDigest != nil:
+		b = appendBytes(append(b, tagBaseDigest), op.BaseDigest)
+	case op.Ref != 0:
+		b = appendUvarint(append(b, tagRef), op.Ref)
+	case op.Back != 0:
+		b = appendUvarint(append(b, tagBack), op.Back)
+	default:
+		b = appendUvarint(append(b, tagSizedCopy), op.Index)
+		b = appendUvarint(b, op.blocks())
+		b = appendUvarint(b, uint64(op.Length))
+		b = appendBytes(b, op.Strong)
+	}
+	s.transcript.Write(b)
+	s.scratch = b
+}
+
+// ad adds a sealed frame to the transcript and returns its additional data: the stream identifier,
+// the position of the frame and the digest of the transcript.
+func (s *sealer) ad() []byte {
+	s.transcript.Write([]byte{tagData})
+
+	ad := make([]byte, 0, len(s.id)+8+sha256.Size)
+	ad = append(ad, s.id...)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], s.seq)
+	ad = append(ad, seq[:]...)
+	s.seq++
+	return s.transcript.Sum(ad)
+}
+
+// seal returns a frame of the given kind and payload, sealed with a random nonce prepended.
+func (s *sealer) seal(kind byte, payload []byte) ([]byte, error) {
+	size := s.aead.NonceSize()
+	nonce := make([]byte, size, size+1+len(payload)+s.aead.Overhead())
+	if _, err := io.ReadFull(cryptoRand, nonce); err != nil {
+		return nil, err
+	}
+
+	plaintext := append([]byte{kind}, payload...)
+	return s.aead.Seal(nonce, nonce, plaintext, s.ad()), nil
+}
+
+// open returns the kind and payload of a frame sealed by seal.
+func (s *sealer) open(data []byte) (byte, []byte, error) {
+	size := s.aead.NonceSize()
+	if len(data) < size {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+
+	plaintext, err := s.aead.Open(nil, data[:size], data[size:], s.ad())
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(plaintext) == 0 || plaintext[0] > frameEnd {
+		return 0, nil, errors.New("unknown frame")
+	}
+	return plaintext[0], plaintext[1:], nil
+}
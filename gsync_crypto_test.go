@@ -0,0 +1,116 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	block, err := aes.NewCipher(bytes.Repeat([]byte{7}, 32))
+	assert.Ok(t, err)
+	aead, err := cipher.NewGCM(block)
+	assert.Ok(t, err)
+
+	cache := srand(130, 64*1024)
+	source := append(srand(131, 10*1024), mutate(cache, 132, 5)...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs)
+	assert.Ok(t, err)
+
+	var sealed []BlockOperation
+	for op := range Encrypt(ctx, opsCh, aead) {
+		assert.Ok(t, op.Error)
+		if len(op.Data) > 0 {
+			assert.Cond(t, !bytes.Contains(source, op.Data[aead.NonceSize():]), "literal data was not encrypted")
+		}
+		sealed = append(sealed, op)
+	}
+
+	replay := func(ops []BlockOperation) <-chan BlockOperation {
+		c := make(chan BlockOperation, len(ops))
+		for _, op := range ops {
+			c <- op
+		}
+		close(c)
+		return c
+	}
+
+	target := new(bytes.Buffer)
+	err = Apply(ctx, target, bytes.NewReader(cache), Decrypt(ctx, replay(sealed), aead), WithRequireDone())
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+
+	// The same operations sealed again make up another stream.
+	opsCh, err = Sync(ctx, bytes.NewReader(source), nil, cacheSigs)
+	assert.Ok(t, err)
+	var other []BlockOperation
+	for op := range Encrypt(ctx, opsCh, aead) {
+		other = append(other, op)
+	}
+
+	var literals, copies []int
+	for i, op := range sealed[1 : len(sealed)-2] {
+		if len(op.Data) > 0 {
+			literals = append(literals, i+1)
+		} else {
+			copies = append(copies, i+1)
+		}
+	}
+	assert.Cond(t, len(literals) > 1 && len(copies) > 0, "expected literals and copies")
+
+	tamper := func(fn func(ops []BlockOperation) []BlockOperation) []BlockOperation {
+		return fn(append([]BlockOperation(nil), sealed...))
+	}
+	for _, ops := range [][]BlockOperation{
+		// Literals swapped, or replayed from another stream.
+		tamper(func(ops []BlockOperation) []BlockOperation {
+			ops[literals[0]], ops[literals[1]] = ops[literals[1]], ops[literals[0]]
+			return ops
+		}),
+		tamper(func(ops []BlockOperation) []BlockOperation {
+			ops[literals[1]] = other[literals[1]]
+			return ops
+		}),
+		// A copy operation altered or dropped.
+		tamper(func(ops []BlockOperation) []BlockOperation {
+			ops[copies[0]].Index++
+			return ops
+		}),
+		tamper(func(ops []BlockOperation) []BlockOperation {
+			return append(ops[:copies[0]], ops[copies[0]+1:]...)
+		}),
+		// The stream cut short, before or after the end marker, or missing its header.
+		tamper(func(ops []BlockOperation) []BlockOperation { return ops[:len(ops)-3] }),
+		tamper(func(ops []BlockOperation) []BlockOperation { return ops[:len(ops)-1] }),
+		tamper(func(ops []BlockOperation) []BlockOperation { return ops[1:] }),
+	} {
+		err = Apply(ctx, new(bytes.Buffer), bytes.NewReader(cache), Decrypt(ctx, replay(ops), aead))
+		assert.Cond(t, errors.Is(err, ErrDecrypt), "expected ErrDecrypt, got %v", err)
+	}
+
+	// Failures to seal are told apart from failures to open.
+	cryptoRand = failingReader{errors.New("no entropy")}
+	defer func() { cryptoRand = rand.Reader }()
+	op := <-Encrypt(ctx, replay(sealed), aead)
+	assert.Cond(t, errors.Is(op.Error, ErrEncrypt), "expected ErrEncrypt, got %v", op.Error)
+}
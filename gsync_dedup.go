@@ -0,0 +1,92 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"container/list"
+
+	"github.com/minio/sha256-simd"
+)
+
+// literalDict is the dictionary of recent literals kept by both Sync and Apply when deduplicating
+// literal data. Every literal is assigned the next identifier, starting at one, and both ends
+// evict the least recently used literals in lockstep, so they always agree on what identifiers
+// can be referenced.
+type literalDict struct {
+	max, size int
+	// lru holds *dictEntry, most recently used first.
+	lru  *list.List
+	byID map[uint64]*list.Element
+	// byKey maps digests of literal data to their identifiers, only kept by Sync.
+	byKey map[[sha256.Size]byte]uint64
+	next  uint64
+}
+
+type dictEntry struct {
+	id   uint64
+	key  [sha256.Size]byte
+	data []byte
+	size int
+}
+
+func newLiteralDict(max int, sender bool) *literalDict {
+	d := &literalDict{
+		max:  max,
+		lru:  list.New(),
+		byID: make(map[uint64]*list.Element),
+	}
+	if sender {
+		d.byKey = make(map[[sha256.Size]byte]uint64)
+	}
+	return d
+}
+
+// dedup returns the identifier of an earlier literal with the same data, if any. Otherwise, it
+// adds data to the dictionary and returns zero.
+func (d *literalDict) dedup(data []byte) uint64 {
+	key := sha256.Sum256(data)
+	if id, ok := d.byKey[key]; ok {
+		d.lru.MoveToFront(d.byID[id])
+		return id
+	}
+
+	e := d.add(&dictEntry{key: key, size: len(data)})
+	d.byKey[key] = e.id
+	return 0
+}
+
+// add assigns the next identifier to a literal and adds it to the dictionary, evicting the least
+// recently used literals to stay within the maximum size.
+func (d *literalDict) add(e *dictEntry) *dictEntry {
+	d.next++
+	e.id = d.next
+	d.byID[e.id] = d.lru.PushFront(e)
+	d.size += e.size
+
+	for d.size > d.max {
+		old := d.lru.Remove(d.lru.Back()).(*dictEntry)
+		delete(d.byID, old.id)
+		if d.byKey != nil {
+			delete(d.byKey, old.key)
+		}
+		d.size -= old.size
+	}
+	return e
+}
+
+// get returns the data of the literal identified by id.
+func (d *literalDict) get(id uint64) ([]byte, bool) {
+	if d == nil {
+		return nil, false
+	}
+
+	el, ok := d.byID[id]
+	if !ok {
+		return nil, false
+	}
+
+	d.lru.MoveToFront(el)
+	return el.Value.(*dictEntry).data, true
+}
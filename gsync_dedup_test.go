@@ -0,0 +1,62 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+func TestSyncDedup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	a, b := srand(330, 4*DefaultBlockSize), srand(331, 4*DefaultBlockSize)
+	source := bytes.Join([][]byte{a, b, a, a, b}, nil)
+
+	for _, tt := range []struct {
+		size int
+		refs int
+	}{
+		{1 << 20, 12},
+		// Only a's blocks fit, which are evicted by b's before being repeated.
+		{4 * DefaultBlockSize, 4},
+	} {
+		opsCh, err := Sync(ctx, bytes.NewReader(source), nil, nil, WithDedup(tt.size))
+		assert.Ok(t, err)
+
+		var ops []BlockOperation
+		var refs int
+		for op := range opsCh {
+			assert.Ok(t, op.Error)
+			if op.Ref != 0 {
+				refs++
+			}
+			ops = append(ops, op)
+		}
+		assert.Equals(t, tt.refs, refs)
+
+		c := make(chan BlockOperation, len(ops))
+		for _, op := range ops {
+			c <- op
+		}
+		close(c)
+
+		target := new(bytes.Buffer)
+		assert.Ok(t, Apply(ctx, target, nil, c, WithDedup(tt.size)))
+		assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+	}
+
+	c := make(chan BlockOperation, 1)
+	c <- BlockOperation{Ref: 1}
+	close(c)
+	err := Apply(ctx, new(bytes.Buffer), nil, c)
+	assert.Cond(t, errors.Is(err, ErrUnknownRef), "expected ErrUnknownRef, got %v", err)
+}
@@ -0,0 +1,42 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"io"
+	"math"
+
+	"github.com/minio/sha256-simd"
+	"github.com/pkg/errors"
+)
+
+// Digest calculates the SHA-256 digest of all data in r. It is meant to identify a base
+// file, so that Apply can verify it was given the same cache signatures were calculated
+// from. See WithBaseDigest and WithDigest.
+func Digest(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, errors.Wrapf(err, "failed calculating digest")
+	}
+	return h.Sum(nil), nil
+}
+
+// verifyBase reads the whole cache and verifies its digest.
+func verifyBase(cache io.ReaderAt, digest []byte) error {
+	if cache == nil {
+		return ErrBaseMismatch
+	}
+
+	d, err := Digest(io.NewSectionReader(cache, 0, math.MaxInt64))
+	if err != nil {
+		return &BlockError{Kind: ErrReadCache, Err: err}
+	}
+
+	if !bytes.Equal(d, digest) {
+		return ErrBaseMismatch
+	}
+	return nil
+}
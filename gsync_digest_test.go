@@ -0,0 +1,63 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestBaseDigest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(110, 64*1024)
+	source := append(srand(111, 100), cache...)
+
+	signer := NewSigner(nil, WithDigest())
+	signer.Reset(bytes.NewReader(cache))
+	table := make(map[uint32][]BlockSignature)
+	for {
+		sig, err := signer.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		assert.Ok(t, err)
+		table[sig.Weak] = append(table[sig.Weak], sig)
+	}
+
+	digest, err := Digest(bytes.NewReader(cache))
+	assert.Ok(t, err)
+	assert.Equals(t, digest, signer.Digest())
+
+	apply := func(base []byte, opts ...Option) ([]byte, error) {
+		opsCh, err := Sync(ctx, bytes.NewReader(source), nil, table, WithBaseDigest(digest))
+		assert.Ok(t, err)
+
+		target := new(bytes.Buffer)
+		err = Apply(ctx, target, bytes.NewReader(base), opsCh, opts...)
+		return target.Bytes(), err
+	}
+
+	target, err := apply(cache)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(source, target), "source and target files are different")
+
+	target, err = apply(cache, WithPrefetch(4, 8))
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(source, target), "source and target files are different")
+
+	wrong := append([]byte(nil), cache...)
+	wrong[len(wrong)-1]++
+	target, err = apply(wrong)
+	assert.Cond(t, errors.Is(err, ErrBaseMismatch), "expected ErrBaseMismatch, got %v", err)
+	assert.Equals(t, 0, len(target))
+}
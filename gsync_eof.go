@@ -0,0 +1,75 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import "io"
+
+// EOFPolicy is how files whose reader fails with io.ErrUnexpectedEOF, as readers of truncated
+// network streams do, are handled by Signatures and Sync. See WithEOFPolicy.
+type EOFPolicy uint8
+
+const (
+	// EOFStrict reports io.ErrUnexpectedEOF as a read error, like any other. It is the default.
+	EOFStrict EOFPolicy = iota
+	// EOFLenient takes io.ErrUnexpectedEOF as the end of the file, so the data read up to then is
+	// signed or synced as if it was the whole file, i.e. to sync partially downloaded files on a
+	// best effort basis.
+	EOFLenient
+)
+
+// lenientReader is an io.Reader returning io.EOF instead of io.ErrUnexpectedEOF.
+type lenientReader struct {
+	r io.Reader
+}
+
+func (l lenientReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// lenientReaderAt is an io.ReaderAt returning io.EOF instead of io.ErrUnexpectedEOF.
+type lenientReaderAt struct {
+	r io.ReaderAt
+}
+
+func (l lenientReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := l.r.ReadAt(p, off)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// maxEmptyReads is the number of reads in a row returning no data nor error after which readFull
+// gives up, as bufio does.
+const maxEmptyReads = 100
+
+// readFull is io.ReadFull returning io.EOF, rather than io.ErrUnexpectedEOF, when r runs out of
+// data before filling p, so that readers failing with io.ErrUnexpectedEOF can be told apart. Readers
+// returning no data nor error maxEmptyReads times in a row fail with io.ErrNoProgress.
+func readFull(r io.Reader, p []byte) (int, error) {
+	var n, empty int
+	for n < len(p) {
+		m, err := r.Read(p[n:])
+		n += m
+		if err != nil {
+			if err == io.EOF && n == len(p) {
+				err = nil
+			}
+			return n, err
+		}
+
+		if empty = empty + 1; m > 0 {
+			empty = 0
+		}
+		if empty >= maxEmptyReads {
+			return n, io.ErrNoProgress
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,86 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+// truncatedReaderAt is a reader of data failing with io.ErrUnexpectedEOF past its end, as
+// readers of streams cut short do.
+type truncatedReaderAt []byte
+
+func (t truncatedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(t)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, t[off:])
+	if n < len(p) {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+func TestEOFPolicy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	data := srand(470, 5*DefaultBlockSize+100)
+	truncated := func() io.Reader {
+		return io.MultiReader(bytes.NewReader(data), failingReader{io.ErrUnexpectedEOF})
+	}
+
+	sign := func(r io.Reader, opts ...Option) ([]BlockSignature, error) {
+		s := NewSigner(nil, opts...)
+		s.Reset(r)
+		var sigs []BlockSignature
+		for {
+			sig, err := s.Next(ctx)
+			if err != nil {
+				return sigs, err
+			}
+			sigs = append(sigs, sig)
+		}
+	}
+
+	expected, err := sign(bytes.NewReader(data))
+	assert.Equals(t, io.EOF, err)
+
+	// By default, truncated streams fail.
+	for _, opts := range [][]Option{nil, {WithEOFPolicy(EOFStrict)}} {
+		sigs, err := sign(truncated(), opts...)
+		assert.Cond(t, errors.Is(err, io.ErrUnexpectedEOF), "expected io.ErrUnexpectedEOF, got %v", err)
+		assert.Equals(t, expected[:5], sigs)
+
+		ops, err := Sync(ctx, truncatedReaderAt(data), nil, nil, opts...)
+		assert.Ok(t, err)
+		err = Apply(ctx, new(bytes.Buffer), nil, ops)
+		assert.Cond(t, errors.Is(err, io.ErrUnexpectedEOF), "expected io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	// Lenient syncs take whatever was read as the whole file.
+	sigs, err := sign(truncated(), WithEOFPolicy(EOFLenient))
+	assert.Equals(t, io.EOF, err)
+	assert.Equals(t, expected, sigs)
+
+	cache := srand(471, 3*DefaultBlockSize)
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	ops, err := Sync(ctx, truncatedReaderAt(data), nil, cacheSigs, WithEOFPolicy(EOFLenient))
+	assert.Ok(t, err)
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), ops, WithRequireDone()))
+	assert.Cond(t, bytes.Equal(data, target.Bytes()), "source and target files are different")
+}
@@ -0,0 +1,454 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/pkg/errors"
+)
+
+// ErasureCoder computes parity shards over groups of equally sized data shards and rebuilds lost
+// shards from the rest, for ShardWriter and ShardReader. Shards are laid out data first, parity
+// last. How many lost shards of a group can be rebuilt depends on the coder, not only on the
+// number of parity shards:
+//
+//   - XORParity recovers from the loss of exactly one shard per group, and only works with a
+//     single parity shard.
+//   - Reed-Solomon coders, as returned by NewReedSolomon, recover from the loss of any shards of a
+//     group, data or parity, as long as no more than the number of parity shards are lost.
+//
+// Encoders of github.com/klauspost/reedsolomon satisfy it.
+type ErasureCoder interface {
+	// Encode calculates the parity shards from the data shards, all of the same size.
+	Encode(shards [][]byte) error
+	// Reconstruct rebuilds the missing shards, which are nil, from those present.
+	Reconstruct(shards [][]byte) error
+}
+
+// XORParity is an ErasureCoder calculating a single parity shard, the XOR of the data shards, which
+// recovers from the loss of any one shard of a group and no more. ShardWriter and ShardReader
+// reject it with more than one parity shard. Use NewReedSolomon to recover from more losses.
+type XORParity struct{}
+
+// NewReedSolomon returns a Reed-Solomon ErasureCoder for groups of data and parity shards, backed
+// by github.com/klauspost/reedsolomon, which recovers from the loss of up to parity shards per
+// group. The overhead is parity packets per data frames, so parity trades bandwidth for the number
+// of losses survived.
+func NewReedSolomon(data, parity int) (ErasureCoder, error) {
+	enc, err := reedsolomon.New(data, parity)
+	return enc, errors.Wrapf(err, "failed creating Reed-Solomon coder")
+}
+
+// Encode implements ErasureCoder.
+func (XORParity) Encode(shards [][]byte) error {
+	parity := shards[len(shards)-1]
+	for i := range parity {
+		parity[i] = 0
+	}
+	for _, shard := range shards[:len(shards)-1] {
+		for i, b := range shard {
+			parity[i] ^= b
+		}
+	}
+	return nil
+}
+
+// Reconstruct implements ErasureCoder.
+func (XORParity) Reconstruct(shards [][]byte) error {
+	missing, size := -1, 0
+	for i, shard := range shards {
+		if shard == nil && missing >= 0 {
+			return ErrFrameLost
+		}
+		if shard == nil {
+			missing = i
+			continue
+		}
+		size = len(shard)
+	}
+
+	if missing < 0 {
+		return nil
+	}
+
+	rebuilt := make([]byte, size)
+	for _, shard := range shards {
+		for i, b := range shard {
+			rebuilt[i] ^= b
+		}
+	}
+	shards[missing] = rebuilt
+	return nil
+}
+
+// Frames are sent as packets, each one starting with a header of shardHeaderSize bytes:
+//
+//	group:  4 bytes, the number of the group of frames, starting at zero
+//	shard:  1 byte, the position of the shard in its group, parity shards coming last
+//	frames: 1 byte, the number of frames in the group, on parity shards only, and zero otherwise
+//	parity: 1 byte, the number of parity shards per group
+//	-:      1 byte, zero
+//	crc:    4 bytes, the CRC-32C of the packet, with this field set to zero
+//
+// Data shards carry the length of the frame, as 4 bytes, followed by the frame itself. Parity
+// shards are calculated over the data shards of the group zero padded to the longest of them, and
+// over zeroed shards in place of those missing from the last group, if shorter than the rest.
+// All integers are big-endian.
+const shardHeaderSize = 12
+
+// maxShardPacket is the largest packet ShardReader reads.
+const maxShardPacket = 1 << 16
+
+// MaxShardFrame is the length of the longest frame ShardWriter sends, so that its packets, header
+// and frame length included, can be read by ShardReader.
+const MaxShardFrame = maxShardPacket - shardHeaderSize - 4
+
+// ShardWriter protects a stream of frames, such as the operations written by an Encoder, against
+// the loss of frames in transports that do not retransmit them, such as UDP or satellite links.
+// Every Write is taken as a frame and sent right away as a packet, in a single Write call to the
+// underlying writer. Every group of frames is followed by parity packets, which ShardReader uses
+// to rebuild the frames of the group lost or corrupted on the way.
+//
+// Frames longer than MaxShardFrame are rejected with ErrFrameTooLarge. Since Encoder writes every
+// operation as a frame, literals sent through it must be kept shorter, i.e. WithMaxDelta on Sync.
+type ShardWriter struct {
+	w      io.Writer
+	coder  ErasureCoder
+	data   int
+	parity int
+	group  uint32
+	shards [][]byte
+	packet []byte
+}
+
+// NewShardWriter returns a ShardWriter sending data frames per group followed by parity packets,
+// as calculated by coder, which must have been configured with the same numbers of data and parity
+// shards. The overhead is parity packets per data frames, each as long as the longest frame of its
+// group. At most 255 shards per group are supported.
+func NewShardWriter(w io.Writer, coder ErasureCoder, data, parity int) (*ShardWriter, error) {
+	if err := checkShards(coder, data, parity); err != nil {
+		return nil, err
+	}
+	return &ShardWriter{w: w, coder: coder, data: data, parity: parity}, nil
+}
+
+// checkShards validates the numbers of data and parity shards given for coder.
+func checkShards(coder ErasureCoder, data, parity int) error {
+	if data < 1 || parity < 1 || data+parity > 255 {
+		return errors.New("gsync: invalid number of data or parity shards")
+	}
+	if _, ok := coder.(XORParity); ok && parity != 1 {
+		return errors.New("gsync: XORParity only calculates a single parity shard")
+	}
+	return nil
+}
+
+// Write sends p as a frame, followed by the parity of its group if it is the last frame of it.
+// Frames longer than MaxShardFrame are rejected with ErrFrameTooLarge, and nothing is sent.
+func (s *ShardWriter) Write(p []byte) (int, error) {
+	if len(p) > MaxShardFrame {
+		return 0, errors.Wrapf(ErrFrameTooLarge, "frame of %d bytes", len(p))
+	}
+
+	shard := make([]byte, 4+len(p))
+	binary.BigEndian.PutUint32(shard, uint32(len(p)))
+	copy(shard[4:], p)
+
+	if err := s.send(len(s.shards), 0, shard); err != nil {
+		return 0, err
+	}
+
+	s.shards = append(s.shards, shard)
+	if len(s.shards) == s.data {
+		if err := s.flush(); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Close sends the parity of the last group of frames, if incomplete. It does not close the
+// underlying writer.
+func (s *ShardWriter) Close() error {
+	if len(s.shards) == 0 {
+		return nil
+	}
+	return s.flush()
+}
+
+// flush sends the parity shards of the current group and starts the next one.
+func (s *ShardWriter) flush() error {
+	frames := len(s.shards)
+	shards := padShards(s.shards, s.data+s.parity)
+	size := len(shards[0])
+	for i := frames; i < len(shards); i++ {
+		shards[i] = make([]byte, size)
+	}
+
+	if err := s.coder.Encode(shards); err != nil {
+		return errors.Wrapf(err, "failed calculating parity")
+	}
+
+	for i := s.data; i < len(shards); i++ {
+		if err := s.send(i, frames, shards[i]); err != nil {
+			return err
+		}
+	}
+
+	s.group++
+	s.shards = s.shards[:0]
+	return nil
+}
+
+// send writes a shard of the current group as a packet.
+func (s *ShardWriter) send(index, frames int, shard []byte) error {
+	b := append(s.packet[:0], make([]byte, shardHeaderSize)...)
+	binary.BigEndian.PutUint32(b, s.group)
+	b[4], b[5], b[6] = byte(index), byte(frames), byte(s.parity)
+	b = append(b, shard...)
+	binary.BigEndian.PutUint32(b[8:], crc32.Checksum(b, crc32cTable))
+	s.packet = b
+
+	_, err := s.w.Write(b)
+	return errors.Wrapf(err, "failed sending frame")
+}
+
+// padShards returns n shards: those given, zero padded to the longest of them, followed by nil
+// ones. Shards are copied if padded.
+func padShards(shards [][]byte, n int) [][]byte {
+	var size int
+	for _, shard := range shards {
+		if len(shard) > size {
+			size = len(shard)
+		}
+	}
+
+	padded := make([][]byte, n)
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if len(shard) < size {
+			shard = append(append(make([]byte, 0, size), shard...), make([]byte, size-len(shard))...)
+		}
+		padded[i] = shard
+	}
+	return padded
+}
+
+// shardGroup collects the shards of a group of frames received by ShardReader.
+type shardGroup struct {
+	shards [][]byte
+	// frames is the number of frames of the group, once known from a parity shard.
+	frames   int
+	received int
+}
+
+// ShardReader reads the frames sent by a ShardWriter, rebuilding those lost or corrupted from the
+// parity of their group. Every Read of the underlying reader must return a single whole packet, as
+// reads of UDP connections do. Packets may arrive out of order, as long as they are not delayed
+// past the packets of the group after the next one.
+//
+// With a coder recovering from the loss of any parity shards, such as Reed-Solomon, every frame is
+// recovered as long as no more than parity packets of its group are lost, corrupted packets
+// counting as lost. Otherwise, Read fails with ErrFrameLost. The loss of a whole group at the end
+// of the stream can not be told apart from its end, which WithRequireDone detects.
+type ShardReader struct {
+	r      io.Reader
+	coder  ErasureCoder
+	data   int
+	parity int
+	groups map[uint32]*shardGroup
+	// next is the group to be read next and frames holds the frames ready to be read.
+	next   uint32
+	frames []byte
+	packet []byte
+	eof    bool
+}
+
+// NewShardReader returns a ShardReader reading groups of data frames and parity packets, as sent
+// by a ShardWriter with the same numbers and coder.
+func NewShardReader(r io.Reader, coder ErasureCoder, data, parity int) (*ShardReader, error) {
+	if err := checkShards(coder, data, parity); err != nil {
+		return nil, err
+	}
+	return &ShardReader{r: r, coder: coder, data: data, parity: parity, groups: make(map[uint32]*shardGroup)}, nil
+}
+
+// Read reads the frames received, in order, as a stream.
+func (s *ShardReader) Read(p []byte) (int, error) {
+	for len(s.frames) == 0 {
+		if err := s.fill(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.frames)
+	s.frames = s.frames[n:]
+	return n, nil
+}
+
+// fill receives packets until the next group can be read.
+func (s *ShardReader) fill() error {
+	for {
+		g := s.groups[s.next]
+		if g != nil && s.complete(g) {
+			return s.decode(g)
+		}
+
+		if s.eof {
+			if g == nil && len(s.groups) == 0 {
+				return io.EOF
+			}
+			return s.decode(s.groupOf(s.next))
+		}
+
+		if err := s.receive(); err == io.EOF {
+			s.eof = true
+		} else if err != nil {
+			return err
+		}
+		if len(s.frames) > 0 {
+			return nil
+		}
+	}
+}
+
+// complete reports whether the group can be decoded, since all its frames, or enough shards to
+// rebuild them, were received.
+func (s *ShardReader) complete(g *shardGroup) bool {
+	if g.frames > 0 {
+		return g.received >= g.frames
+	}
+
+	for _, shard := range g.shards[:s.data] {
+		if shard == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// receive reads a packet, dropping it if corrupt. Packets of groups after the next one make it
+// give up on the group being read, which is decoded with whatever shards were received.
+func (s *ShardReader) receive() error {
+	if s.packet == nil {
+		s.packet = make([]byte, maxShardPacket)
+	}
+
+	n, err := s.r.Read(s.packet)
+	if n < shardHeaderSize+4 {
+		return err
+	}
+
+	b := s.packet[:n]
+	sum := binary.BigEndian.Uint32(b[8:])
+	binary.BigEndian.PutUint32(b[8:], 0)
+	index, frames, group := int(b[4]), int(b[5]), binary.BigEndian.Uint32(b)
+	if sum != crc32.Checksum(b, crc32cTable) || int(b[6]) != s.parity || index >= s.data+s.parity ||
+		frames > s.data || group < s.next {
+		return err
+	}
+
+	g := s.groups[group]
+	if g == nil {
+		g = &shardGroup{shards: make([][]byte, s.data+s.parity)}
+		s.groups[group] = g
+	}
+
+	if g.shards[index] == nil {
+		g.shards[index] = append([]byte(nil), b[shardHeaderSize:]...)
+		g.received++
+	}
+	if frames > 0 {
+		g.frames = frames
+	}
+
+	if group > s.next+1 && !s.complete(s.groupOf(s.next)) {
+		return s.decode(s.groupOf(s.next))
+	}
+	return err
+}
+
+// groupOf returns the group numbered n, empty if none of its shards were received.
+func (s *ShardReader) groupOf(n uint32) *shardGroup {
+	if g := s.groups[n]; g != nil {
+		return g
+	}
+	return &shardGroup{shards: make([][]byte, s.data+s.parity)}
+}
+
+// decode queues the frames of g, the next group, rebuilding them from its parity if needed.
+func (s *ShardReader) decode(g *shardGroup) error {
+	delete(s.groups, s.next)
+	s.next++
+
+	if g.received == 0 {
+		return ErrFrameLost
+	}
+
+	frames := g.frames
+	if frames == 0 {
+		// Without parity, only the frames received in a row can be read, which is the whole
+		// group unless its end was lost.
+		for frames < s.data && g.shards[frames] != nil {
+			frames++
+		}
+		for _, shard := range g.shards[frames:s.data] {
+			if shard != nil {
+				return ErrFrameLost
+			}
+		}
+	}
+
+	shards := g.shards
+	if hasGaps(g.shards[:frames]) {
+		var size int
+		for _, shard := range g.shards[s.data:] {
+			if len(shard) > size {
+				size = len(shard)
+			}
+		}
+		if size == 0 {
+			return ErrFrameLost
+		}
+
+		shards = padShards(g.shards, s.data+s.parity)
+		for i := frames; i < s.data; i++ {
+			shards[i] = make([]byte, size)
+		}
+		for i := range shards {
+			if shards[i] != nil && len(shards[i]) != size {
+				return ErrFrameLost
+			}
+		}
+
+		if err := s.coder.Reconstruct(shards); err != nil {
+			return ErrFrameLost
+		}
+	}
+
+	for _, shard := range shards[:frames] {
+		if len(shard) < 4 || int(binary.BigEndian.Uint32(shard)) > len(shard)-4 {
+			return ErrFrameLost
+		}
+		s.frames = append(s.frames, shard[4:4+binary.BigEndian.Uint32(shard)]...)
+	}
+	return nil
+}
+
+// hasGaps reports whether any of the shards is missing.
+func hasGaps(shards [][]byte) bool {
+	for _, shard := range shards {
+		if shard == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+// packets keeps the packets written to it and reads them back one per Read, like a datagram
+// socket.
+type packets [][]byte
+
+func (p *packets) Write(b []byte) (int, error) {
+	*p = append(*p, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (p *packets) Read(b []byte) (int, error) {
+	if len(*p) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, (*p)[0])
+	*p = (*p)[1:]
+	return n, nil
+}
+
+func TestShards(t *testing.T) {
+	var ops []BlockOperation
+	for i := 0; i < 10; i++ {
+		ops = append(ops, BlockOperation{Index: uint64(i)}, BlockOperation{Data: srand(int64(300+i), 50+i*40)})
+	}
+	ops = append(ops, BlockOperation{Done: true})
+
+	// With 4 data and 1 parity shards, the 21 frames are sent in 6 groups of 5 packets, the last
+	// one holding a single frame and its parity.
+	sent := new(packets)
+	w, err := NewShardWriter(sent, XORParity{}, 4, 1)
+	assert.Ok(t, err)
+	enc := NewEncoder(w, WithFrameChecksums())
+	for _, op := range ops {
+		assert.Ok(t, enc.Encode(op))
+	}
+	assert.Ok(t, w.Close())
+	assert.Equals(t, 27, len(*sent))
+
+	tests := []struct {
+		desc  string
+		alter func(p packets) packets
+		err   error
+	}{
+		{"intact", func(p packets) packets { return p }, nil},
+		{"one lost per group", func(p packets) packets {
+			var kept packets
+			for i, b := range p {
+				if i%5 != i/5%5 {
+					kept = append(kept, b)
+				}
+			}
+			return kept
+		}, nil},
+		{"corrupt", func(p packets) packets {
+			p[7][20] ^= 0xff
+			return p
+		}, nil},
+		{"reordered", func(p packets) packets {
+			p[3], p[6] = p[6], p[3]
+			p[10], p[11] = p[11], p[10]
+			return p
+		}, nil},
+		{"last parity lost", func(p packets) packets { return p[:len(p)-1] }, nil},
+		{"all parity lost", func(p packets) packets {
+			var kept packets
+			for i, b := range p {
+				if i%5 != 4 && i != len(p)-1 {
+					kept = append(kept, b)
+				}
+			}
+			return kept
+		}, nil},
+		{"two lost in a group", func(p packets) packets { return append(p[:1], p[3:]...) }, ErrFrameLost},
+		{"group lost", func(p packets) packets { return append(p[:5], p[10:]...) }, ErrFrameLost},
+		{"data lost without parity", func(p packets) packets { return append(p[:1], p[2:4]...) }, ErrFrameLost},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			received := tt.alter(append(packets(nil), cloneShards(*sent)...))
+			decoded, err := receiveShards(t, &received, XORParity{}, 4, 1)
+			assert.Cond(t, errors.Is(err, tt.err), "expected %v, got %v", tt.err, err)
+			if err == nil {
+				assert.Equals(t, ops, decoded)
+			}
+		})
+	}
+}
+
+// receiveShards decodes the operations read off received by a ShardReader, until the end of the
+// stream or the first error.
+func receiveShards(t *testing.T, received *packets, coder ErasureCoder, data, parity int) ([]BlockOperation, error) {
+	r, err := NewShardReader(received, coder, data, parity)
+	assert.Ok(t, err)
+
+	dec := NewDecoder(r, WithFrameChecksums())
+	var decoded []BlockOperation
+	for {
+		op, err := dec.Decode()
+		if err == io.EOF {
+			return decoded, nil
+		}
+		if err != nil {
+			return decoded, err
+		}
+		decoded = append(decoded, op)
+	}
+}
+
+// TestShardsReedSolomon tests that Reed-Solomon parity recovers from the loss of as many packets
+// of a group, data or parity, as there are parity shards, and no more.
+func TestShardsReedSolomon(t *testing.T) {
+	var ops []BlockOperation
+	for i := 0; i < 12; i++ {
+		ops = append(ops, BlockOperation{Data: srand(int64(320+i), 100+i*300)})
+	}
+	ops = append(ops, BlockOperation{Done: true})
+
+	coder, err := NewReedSolomon(4, 3)
+	assert.Ok(t, err)
+	sent := new(packets)
+	w, err := NewShardWriter(sent, coder, 4, 3)
+	assert.Ok(t, err)
+	enc := NewEncoder(w, WithFrameChecksums())
+	for _, op := range ops {
+		assert.Ok(t, enc.Encode(op))
+	}
+	assert.Ok(t, w.Close())
+
+	// Drops the packets of every group at the given positions.
+	drop := func(positions ...int) packets {
+		var kept packets
+		for i, b := range cloneShards(*sent) {
+			lost := false
+			for _, p := range positions {
+				lost = lost || i%7 == p
+			}
+			if !lost {
+				kept = append(kept, b)
+			}
+		}
+		return kept
+	}
+
+	for _, positions := range [][]int{{0, 1, 2}, {1, 3, 5}, {4, 5, 6}, {0, 2, 3}} {
+		received := drop(positions...)
+		decoded, err := receiveShards(t, &received, coder, 4, 3)
+		assert.Ok(t, err)
+		assert.Equals(t, ops, decoded)
+	}
+
+	received := drop(0, 1, 2, 3)
+	_, err = receiveShards(t, &received, coder, 4, 3)
+	assert.Cond(t, errors.Is(err, ErrFrameLost), "expected ErrFrameLost, got %v", err)
+
+	_, err = NewReedSolomon(0, 3)
+	assert.Cond(t, err != nil, "expected no data shards to be rejected")
+}
+
+// TestShardFrameTooLarge tests that frames ShardReader could not read are rejected when written.
+func TestShardFrameTooLarge(t *testing.T) {
+	sent := new(packets)
+	w, err := NewShardWriter(sent, XORParity{}, 2, 1)
+	assert.Ok(t, err)
+
+	_, err = w.Write(make([]byte, MaxShardFrame+1))
+	assert.Cond(t, errors.Is(err, ErrFrameTooLarge), "expected ErrFrameTooLarge, got %v", err)
+	assert.Equals(t, 0, len(*sent))
+
+	frame := srand(330, MaxShardFrame)
+	n, err := w.Write(frame)
+	assert.Ok(t, err)
+	assert.Equals(t, len(frame), n)
+	assert.Ok(t, w.Close())
+
+	// The frame is read back even when its own packet is lost.
+	received := append(packets(nil), (*sent)[1:]...)
+	r, err := NewShardReader(&received, XORParity{}, 2, 1)
+	assert.Ok(t, err)
+	read, err := ioutil.ReadAll(r)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(frame, read), "frame read back is different")
+}
+
+func cloneShards(p [][]byte) [][]byte {
+	clone := make([][]byte, len(p))
+	for i, b := range p {
+		clone[i] = append([]byte(nil), b...)
+	}
+	return clone
+}
+
+func TestXORParity(t *testing.T) {
+	shards := [][]byte{[]byte("abc"), []byte("def"), []byte("ghi"), make([]byte, 3)}
+	assert.Ok(t, XORParity{}.Encode(shards))
+
+	for i := range shards {
+		lost := cloneShards(shards)
+		lost[i] = nil
+		assert.Ok(t, XORParity{}.Reconstruct(lost))
+		assert.Equals(t, shards, lost)
+	}
+
+	lost := cloneShards(shards)
+	lost[0], lost[2] = nil, nil
+	assert.Equals(t, ErrFrameLost, XORParity{}.Reconstruct(lost))
+
+	_, err := NewShardWriter(new(packets), XORParity{}, 200, 100)
+	assert.Cond(t, err != nil, "expected too many shards to be rejected")
+	_, err = NewShardReader(new(packets), XORParity{}, 4, 2)
+	assert.Cond(t, err != nil, "expected XORParity with two parity shards to be rejected")
+}
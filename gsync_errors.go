@@ -0,0 +1,171 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Sentinel errors returned by this package. Errors involving a particular block are
+// reported as *BlockError, which matches its sentinel through errors.Is.
+var (
+	// ErrNilReader is returned when Signatures or Sync are given a nil reader.
+	ErrNilReader = errors.New("gsync: reader required")
+	// ErrNotRollable is returned when Sync is asked to roll a weak hash that does not support it.
+	ErrNotRollable = errors.New("gsync: weak hash can not be rolled, aligned mode required")
+	// ErrHashMismatch is returned by Sync when the remote signatures were not all calculated
+	// with the strong hash in use.
+	ErrHashMismatch = errors.New("gsync: strong hash algorithm mismatch")
+	// ErrUnsupportedHash is returned when a strong hash identifier is not known, see RegisterHash.
+	ErrUnsupportedHash = errors.New("gsync: unsupported strong hash algorithm")
+	// ErrInvalidModulus is returned when the modulus set by WithWeakModulus is not valid.
+	ErrInvalidModulus = errors.New("gsync: weak modulus must be a power of two between 2 and 1<<16")
+	// ErrModulusMismatch is returned by Sync when the remote signatures do not all use the same
+	// rolling checksum modulus.
+	ErrModulusMismatch = errors.New("gsync: weak modulus mismatch")
+	// ErrInvalidRange is returned when the range set by WithRange is not valid.
+	ErrInvalidRange = errors.New("gsync: range must start at a block boundary and not end before it starts")
+	// ErrInvalidBoundaries is returned when the block boundaries set by WithBoundaries are not valid.
+	ErrInvalidBoundaries = errors.New("gsync: block boundaries must be increasing, positive and without WithRange")
+	// ErrInvalidStride is returned when the stride set by WithStride is not valid.
+	ErrInvalidStride = errors.New("gsync: stride must divide the block size and can not be combined with WithBoundaries, WithRange, WithCoarseBlocks or WithFollow")
+	// ErrInvalidBlockSize is returned when the block size set by WithBlockSize is not valid.
+	ErrInvalidBlockSize = errors.New("gsync: block size must be positive and up to 64 MiB")
+	// ErrInvalidCompression is returned when the level set by WithCompression is not valid.
+	ErrInvalidCompression = errors.New("gsync: compression level must be between flate.HuffmanOnly and flate.BestCompression")
+	// ErrOffsetOverflow is returned when the offset of a block index, i.e. of a crafted operation or
+	// signature, does not fit in an int64.
+	ErrOffsetOverflow = errors.New("gsync: block offset overflows")
+	// ErrReadBlock is reported when reading a data block from the source fails.
+	ErrReadBlock = errors.New("gsync: failed reading block")
+	// ErrMissingCache is returned by Apply when it gets an index operation but no cache was provided.
+	ErrMissingCache = errors.New("gsync: index operation, but cached file was not found")
+	// ErrReadCache is returned by Apply when reading a block from the cache fails.
+	ErrReadCache = errors.New("gsync: failed reading cached block")
+	// ErrBaseMismatch is returned by Apply when the cache is not the base file the operations were
+	// calculated against.
+	ErrBaseMismatch = errors.New("gsync: cache does not match the expected base file")
+	// ErrDecrypt is reported by Decrypt when literal data fails to authenticate. The Index of the
+	// accompanying *BlockError is the position of the literal in the stream.
+	ErrDecrypt = errors.New("gsync: failed decrypting literal data")
+	// ErrEncrypt is reported by Encrypt when literal data can not be sealed, i.e. because no random
+	// nonce could be read. The Index of the accompanying *BlockError is the position of the literal.
+	ErrEncrypt = errors.New("gsync: failed encrypting literal data")
+	// ErrTruncatedStream is returned by Apply and LookUpTable, when configured WithRequireDone, if
+	// the operations or signatures channel is closed without a Done operation or signature.
+	ErrTruncatedStream = errors.New("gsync: operation stream ended before completion")
+	// ErrApplyWrite is returned by Apply when writing a block to the destination fails.
+	ErrApplyWrite = errors.New("gsync: failed writing block to destination")
+	// ErrCorruptLiteral is returned by Apply when literal data does not match its checksum. The Index
+	// of the accompanying *BlockError is the position of the literal in the stream and its Offset the
+	// position in the destination where it was going to be written.
+	ErrCorruptLiteral = errors.New("gsync: literal data does not match its checksum")
+	// ErrUnknownRef is returned by Apply when an operation references a literal it does not remember.
+	// See WithDedup.
+	ErrUnknownRef = errors.New("gsync: reference to an unknown literal")
+	// ErrBackRef is returned by Apply when a back reference reaches data it does not remember. The
+	// Index of the accompanying *BlockError is the distance referenced. See WithBackRefs.
+	ErrBackRef = errors.New("gsync: back reference out of the window")
+	// ErrBudgetExceeded is returned by Sync when it sends more literal data, or takes longer, than
+	// allowed by WithBudget.
+	ErrBudgetExceeded = errors.New("gsync: sync budget exceeded")
+	// ErrFrameCorrupt is returned by Decoder, on streams whose frames carry checksums, if an operation
+	// read does not match its checksum.
+	ErrFrameCorrupt = errors.New("gsync: operation does not match its frame checksum")
+	// ErrPoolClosed is returned when submitting jobs to a closed Pool.
+	ErrPoolClosed = errors.New("gsync: pool closed")
+	// ErrMemoryLimit is returned when a call would use more memory than allowed by WithMemoryLimit.
+	ErrMemoryLimit = errors.New("gsync: memory limit exceeded")
+	// ErrWriterClosed is returned when using a closed SyncWriter.
+	ErrWriterClosed = errors.New("gsync: sync writer closed")
+	// ErrBackwardRead is returned when a forward-only stream, see SyncStream and ApplyStream, is read
+	// before data already discarded.
+	ErrBackwardRead = errors.New("gsync: stream read backwards")
+	// ErrSkipped is reported for error operations skipped by Apply, see WithSkipErrors.
+	ErrSkipped = errors.New("gsync: failed operation skipped")
+	// ErrMissingOffset is returned by Apply, configured WithSkipErrors, when the operation following
+	// a skipped one has an Offset before it, as happens with operations that went through Encoder
+	// without WithWireOffsets.
+	ErrMissingOffset = errors.New("gsync: operation offset missing after a skipped operation")
+	// ErrMalformedIndex is returned when a signature index is corrupt or can not be read, see
+	// OpenSignatureIndex.
+	ErrMalformedIndex = errors.New("gsync: malformed signature index")
+	// ErrMalformedStream is returned by Decoder when the data read is not a valid operation.
+	ErrMalformedStream = errors.New("gsync: malformed operation stream")
+	// ErrUnsupportedVersion is returned by Decoder when the stream was written with a version of the
+	// wire format it does not know.
+	ErrUnsupportedVersion = errors.New("gsync: unsupported wire format version")
+	// ErrMalformedDelta is returned by ReadSignatureDelta when the data read is not a valid signature
+	// delta.
+	ErrMalformedDelta = errors.New("gsync: malformed signature delta")
+	// ErrMalformedPatch is returned when a patch file is corrupt or can not be applied, see
+	// NewPatchReader.
+	ErrMalformedPatch = errors.New("gsync: malformed patch file")
+	// ErrConnTimeout is returned by ServeOverConn and SendOverConn when the other end goes quiet for
+	// longer than allowed by WithHeartbeat.
+	ErrConnTimeout = errors.New("gsync: connection timed out")
+	// ErrFrameLost is returned by ShardReader when frames were lost and can not be rebuilt from the
+	// parity received.
+	ErrFrameLost = errors.New("gsync: lost frames can not be recovered")
+	// ErrFrameTooLarge is returned by ShardWriter for frames longer than MaxShardFrame.
+	ErrFrameTooLarge = errors.New("gsync: frame too large for a shard packet")
+)
+
+// BlockError describes a failure involving a specific block.
+type BlockError struct {
+	// Index is the index of the block involved.
+	Index uint64
+	// Offset is the byte offset where the failure took place, if known.
+	Offset int64
+	// Kind is the sentinel error describing the failure, i.e. ErrReadBlock.
+	Kind error
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *BlockError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%v (block %d, offset %d)", e.Kind, e.Index, e.Offset)
+	}
+	return fmt.Sprintf("%v (block %d, offset %d): %v", e.Kind, e.Index, e.Offset, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the sentinel describing this error.
+func (e *BlockError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// SkippedError is returned by Apply, configured WithSkipErrors, when it skipped error operations.
+// It matches ErrSkipped through errors.Is.
+type SkippedError struct {
+	// Failed describes the skipped operations in the order received, each with the Index and
+	// Offset of its operation and the error it carried.
+	Failed []*BlockError
+}
+
+func (e *SkippedError) Error() string {
+	return fmt.Sprintf("%v: %d operations, first: %v", ErrSkipped, len(e.Failed), e.Failed[0])
+}
+
+// Indices returns the block indices of the skipped operations.
+func (e *SkippedError) Indices() []uint64 {
+	indices := make([]uint64, len(e.Failed))
+	for i, f := range e.Failed {
+		indices[i] = f.Index
+	}
+	return indices
+}
+
+// Is reports whether target is ErrSkipped.
+func (e *SkippedError) Is(target error) bool {
+	return target == ErrSkipped
+}
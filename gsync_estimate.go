@@ -0,0 +1,49 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"hash"
+	"io"
+)
+
+// EstimateDelta runs the matching done by Sync of r against the remote block signatures, only
+// counting how many bytes of r would be copied from the cache and how many would be sent as
+// literal data, without producing the delta. Literal data is not copied around nor are operations
+// sent over a channel, so it is cheaper than a full Sync and suits deciding, per file, whether to
+// sync a delta or send the file whole. It takes the same options as Sync.
+func EstimateDelta(ctx context.Context, remote []BlockSignature, r io.ReaderAt, shash hash.Hash, opts ...Option) (matched, literal int64, err error) {
+	if r == nil {
+		return 0, 0, ErrNilReader
+	}
+
+	table := make(map[uint32][]BlockSignature)
+	for _, sig := range remote {
+		if sig.Done {
+			continue
+		}
+		table[sig.Weak] = append(table[sig.Weak], sig)
+	}
+
+	s, err := NewSyncer(shash, opts...)
+	if err != nil {
+		return 0, 0, err
+	}
+	s.estimate = true
+	s.Reset(r, table)
+
+	for {
+		_, err := s.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return s.offset - s.literalBytes, s.literalBytes, nil
+}
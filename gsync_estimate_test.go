@@ -0,0 +1,65 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestEstimateDelta(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(310, 300*1024+17)
+	source := append(srand(311, 1234), cache[:100*1024]...)
+	source = append(source, srand(312, 4321)...)
+	source = append(source, cache[200*1024:]...)
+
+	var sigs []BlockSignature
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	for sig := range sigsCh {
+		assert.Ok(t, sig.Error)
+		sigs = append(sigs, sig)
+	}
+
+	for _, opts := range [][]Option{nil, {WithAligned()}, {WithMaxDelta(100)}} {
+		cacheSigs, err := LookUpTable(ctx, sliceSigs(sigs))
+		assert.Ok(t, err)
+
+		opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, opts...)
+		assert.Ok(t, err)
+
+		var exp int64
+		for op := range opsCh {
+			assert.Ok(t, op.Error)
+			exp += int64(len(op.Data))
+		}
+
+		matched, literal, err := EstimateDelta(ctx, sigs, bytes.NewReader(source), nil, opts...)
+		assert.Ok(t, err)
+		assert.Equals(t, exp, literal)
+		assert.Equals(t, int64(len(source)), matched+literal)
+	}
+
+	matched, literal, err := EstimateDelta(ctx, nil, bytes.NewReader(source), nil)
+	assert.Ok(t, err)
+	assert.Equals(t, int64(0), matched)
+	assert.Equals(t, int64(len(source)), literal)
+}
+
+func sliceSigs(sigs []BlockSignature) <-chan BlockSignature {
+	c := make(chan BlockSignature, len(sigs))
+	for _, sig := range sigs {
+		c <- sig
+	}
+	close(c)
+	return c
+}
@@ -0,0 +1,52 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ApplyFunc is Apply getting the cached blocks copied from fetch, on demand, instead of reading
+// them from a cache file, so they can come from a network service, a caching layer or be
+// generated. Apply itself adapts its cache into such a function, so both share a single path.
+//
+// fetch returns the block at index, which must be a whole block long, as set by WithBlockSize or
+// WithBoundaries, if set, except for the last block of the cache, which may be shorter. Empty
+// blocks and blocks longer than that are rejected with a *BlockError of kind ErrReadCache, as are
+// blocks shorter than the Length of the copy operation they are for.
+//
+// Buffer ownership: Apply does not modify the returned block and does not retain it once written,
+// which happens before fetch is called again, so fetch may return the same buffer every time.
+// WithPrefetch makes Apply call fetch concurrently and hold up to the prefetch window blocks at
+// once, which must then be distinct buffers.
+//
+// Base digests can not be verified, since there is no cache file to hash, so streams carrying them
+// fail with ErrBaseMismatch. WithTransform is not supported either.
+func ApplyFunc(ctx context.Context, dst io.Writer, fetch func(index uint64) ([]byte, error), ops <-chan BlockOperation, opts ...Option) error {
+	if fetch == nil {
+		return &BlockError{Kind: ErrMissingCache}
+	}
+	return applyWith(ctx, dst, nil, fetch, ops, opts)
+}
+
+// fetchFrom returns a blockReader getting blocks from fetch, checking their length.
+func fetchFrom(fetch func(index uint64) ([]byte, error), cfg *options) blockReader {
+	return func(_ []byte, index uint64) ([]byte, error) {
+		block, err := fetch(index)
+		if err != nil {
+			return nil, &BlockError{Index: index, Kind: ErrReadCache, Err: err}
+		}
+
+		size := cfg.blockSize(index)
+		if len(block) == 0 || len(block) > size {
+			err := errors.Errorf("fetched %d bytes, expected up to %d", len(block), size)
+			return nil, &BlockError{Index: index, Kind: ErrReadCache, Err: err}
+		}
+		return block, nil
+	}
+}
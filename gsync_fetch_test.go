@@ -0,0 +1,89 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+func TestApplyFunc(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(680, 40*DefaultBlockSize+123)
+	source := mutate(cache, 681, 4)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	table, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	var fetches int64
+	fetch := func(index uint64) ([]byte, error) {
+		atomic.AddInt64(&fetches, 1)
+		// Blocks are handed out in distinct buffers, as prefetching requires.
+		return append([]byte(nil), cachedBlock(cache, index)...), nil
+	}
+
+	for _, opts := range [][]Option{nil, {WithPrefetch(4, 8)}} {
+		ops, err := Sync(ctx, bytes.NewReader(source), nil, table)
+		assert.Ok(t, err)
+
+		atomic.StoreInt64(&fetches, 0)
+		target := new(bytes.Buffer)
+		assert.Ok(t, ApplyFunc(ctx, target, fetch, ops, opts...))
+		assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+		assert.Cond(t, atomic.LoadInt64(&fetches) > 30, "expected blocks to be fetched, got %d", fetches)
+	}
+
+	failure := errors.New("backend down")
+	ops := make(chan BlockOperation, 1)
+	ops <- BlockOperation{Index: 2}
+	close(ops)
+	err = ApplyFunc(ctx, new(bytes.Buffer), func(uint64) ([]byte, error) { return nil, failure }, ops)
+	assert.Cond(t, errors.Is(err, ErrReadCache), "expected ErrReadCache, got %v", err)
+	assert.Equals(t, failure, errors.Unwrap(err))
+}
+
+// TestApplyFuncBlockLength tests that fetched blocks of the wrong length are rejected rather than
+// written.
+func TestApplyFuncBlockLength(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		desc  string
+		op    BlockOperation
+		block []byte
+		opts  []Option
+	}{
+		{"empty", BlockOperation{Index: 1}, nil, nil},
+		{"oversized", BlockOperation{Index: 1}, make([]byte, DefaultBlockSize+1), nil},
+		{"shorter than the operation length", BlockOperation{Index: 1, Length: 100}, make([]byte, 99), nil},
+		{"longer than its boundaries", BlockOperation{Index: 0}, make([]byte, 101), []Option{WithBoundaries([]int64{100})}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			ops := make(chan BlockOperation, 1)
+			ops <- tt.op
+			close(ops)
+
+			target := new(bytes.Buffer)
+			fetch := func(uint64) ([]byte, error) { return tt.block, nil }
+			err := ApplyFunc(ctx, target, fetch, ops, tt.opts...)
+			var berr *BlockError
+			assert.Cond(t, errors.As(err, &berr) && berr.Kind == ErrReadCache, "expected ErrReadCache, got %v", err)
+			assert.Equals(t, 0, target.Len())
+		})
+	}
+}
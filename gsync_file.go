@@ -0,0 +1,93 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// syncer is implemented by destinations that can be flushed to stable storage, such as *os.File.
+type syncer interface {
+	Sync() error
+}
+
+// fsync flushes the data written so far to stable storage, see WithFsync.
+func (a *applier) fsync() error {
+	a.unsynced = 0
+	if s, ok := a.dst.(syncer); ok {
+		if err := s.Sync(); err != nil {
+			return &BlockError{Offset: a.offset, Kind: ErrApplyWrite, Err: err}
+		}
+	}
+	return nil
+}
+
+// ApplyFile reconstructs the file at name with Apply, creating it if it does not exist. New files
+// get mode 0644 and existing ones keep theirs. The cache must not be the file at name itself, see
+// ApplyInPlace for that.
+//
+// By default, the file is written over: a failure or a crash leaves it partially written, while
+// WithFsync bounds the amount of data lost. WithAtomicRename makes ApplyFile write a temporary file
+// in the same directory instead, flushed to stable storage and renamed over name once complete, so
+// name holds either its old content or the new one, as with ApplyInPlace. A crash may leave the
+// temporary file behind.
+//
+// WithRange writes the range over the file without truncating it, and can not be combined with
+// WithAtomicRename.
+func ApplyFile(ctx context.Context, name string, cache io.ReaderAt, ops <-chan BlockOperation, opts ...Option) error {
+	cfg := newOptions(opts)
+	if cfg.err != nil {
+		return cfg.err
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(name); err == nil {
+		mode = info.Mode()
+	}
+
+	if !cfg.atomic {
+		flag := os.O_WRONLY | os.O_CREATE
+		if !cfg.ranged {
+			flag |= os.O_TRUNC
+		}
+
+		f, err := os.OpenFile(name, flag, mode)
+		if err != nil {
+			return errors.Wrapf(err, "failed opening %s", name)
+		}
+
+		if err := Apply(ctx, f, cache, ops, opts...); err != nil {
+			f.Close()
+			return err
+		}
+		return errors.Wrapf(f.Close(), "failed closing %s", name)
+	}
+
+	if cfg.ranged {
+		return errors.New("gsync: WithAtomicRename can not be combined with WithRange")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".gsync-")
+	if err != nil {
+		return errors.Wrapf(err, "failed creating temporary file")
+	}
+
+	if err := applyTemp(ctx, tmp, cache, mode, ops, opts); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "failed replacing %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+// syncCounter is a destination counting how many times it was flushed.
+type syncCounter struct {
+	bytes.Buffer
+	syncs int
+}
+
+func (s *syncCounter) Sync() error {
+	s.syncs++
+	return nil
+}
+
+func TestApplyFsync(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	source := srand(500, 10*DefaultBlockSize+100)
+	for _, tt := range []struct {
+		every int64
+		syncs int
+	}{
+		{0, 0},
+		{2 * DefaultBlockSize, 6},
+		{1 << 30, 1},
+	} {
+		ops, err := Sync(ctx, bytes.NewReader(source), nil, nil)
+		assert.Ok(t, err)
+
+		dst := new(syncCounter)
+		assert.Ok(t, Apply(ctx, dst, nil, ops, WithFsync(tt.every)))
+		assert.Equals(t, tt.syncs, dst.syncs)
+		assert.Cond(t, bytes.Equal(source, dst.Bytes()), "source and target files are different")
+	}
+}
+
+func TestApplyFile(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "gsync")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	cache := srand(501, 20*DefaultBlockSize)
+	source := mutate(cache, 502, 5)
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	name := filepath.Join(dir, "file")
+	assert.Ok(t, ioutil.WriteFile(name, srand(503, 30*DefaultBlockSize), 0600))
+
+	for _, opts := range [][]Option{nil, {WithAtomicRename()}, {WithAtomicRename(), WithFsync(DefaultBlockSize)}} {
+		ops, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs)
+		assert.Ok(t, err)
+		assert.Ok(t, ApplyFile(ctx, name, bytes.NewReader(cache), ops, opts...))
+
+		data, err := ioutil.ReadFile(name)
+		assert.Ok(t, err)
+		assert.Cond(t, bytes.Equal(source, data), "source and target files are different")
+
+		info, err := os.Stat(name)
+		assert.Ok(t, err)
+		assert.Equals(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	// Failed atomic reconstructions leave the file untouched, and no temporary files behind.
+	failing := make(chan BlockOperation, 2)
+	failing <- BlockOperation{Data: []byte("partial")}
+	failing <- BlockOperation{Error: errors.New("boom")}
+	close(failing)
+	assert.Cond(t, ApplyFile(ctx, name, nil, failing, WithAtomicRename()) != nil, "expected failure")
+
+	data, err := ioutil.ReadFile(name)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(source, data), "file was modified")
+	entries, err := ioutil.ReadDir(dir)
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(entries))
+
+	// New files are created.
+	ops, err := Sync(ctx, bytes.NewReader(source), nil, nil)
+	assert.Ok(t, err)
+	created := filepath.Join(dir, "created")
+	assert.Ok(t, ApplyFile(ctx, created, nil, ops))
+	data, err = ioutil.ReadFile(created)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(source, data), "source and target files are different")
+}
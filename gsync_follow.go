@@ -0,0 +1,40 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// followReader reads from r, waiting for more data to be appended instead of returning io.EOF,
+// until ctx is done. See WithFollow.
+type followReader struct {
+	r        io.Reader
+	interval time.Duration
+	ctx      context.Context
+}
+
+func (f *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := f.r.Read(p)
+		if n > 0 {
+			return n, nil
+		}
+
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		t := time.NewTimer(f.interval)
+		select {
+		case <-f.ctx.Done():
+			t.Stop()
+			return 0, f.ctx.Err()
+		case <-t.C:
+		}
+	}
+}
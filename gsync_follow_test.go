@@ -0,0 +1,116 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+// growingFile is a file being appended to while read.
+type growingFile struct {
+	mu   sync.Mutex
+	data []byte
+	off  int
+}
+
+func (g *growingFile) Read(p []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.off == len(g.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, g.data[g.off:])
+	g.off += n
+	return n, nil
+}
+
+func (g *growingFile) Write(p []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.data = append(g.data, p...)
+	return len(p), nil
+}
+
+func TestSignaturesFollow(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	data := srand(330, 3*DefaultBlockSize)
+	sigsCh, err := Signatures(ctx, bytes.NewReader(data), nil)
+	assert.Ok(t, err)
+	var exp []BlockSignature
+	for sig := range sigsCh {
+		if !sig.Done {
+			exp = append(exp, sig)
+		}
+	}
+
+	fctx, stop := context.WithCancel(ctx)
+	f := new(growingFile)
+	f.Write(data[:2*DefaultBlockSize+100])
+
+	sigsCh, err = Signatures(fctx, f, nil, WithFollow(time.Millisecond))
+	assert.Ok(t, err)
+
+	var got []BlockSignature
+	for len(got) < 2 {
+		got = append(got, <-sigsCh)
+	}
+
+	// The trailing block is incomplete and must not be signed yet.
+	select {
+	case sig := <-sigsCh:
+		t.Fatalf("unexpected signature of an incomplete block: %+v", sig)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	f.Write(data[2*DefaultBlockSize+100:])
+	got = append(got, <-sigsCh)
+	assert.Equals(t, exp, got)
+
+	stop()
+	for sig := range sigsCh {
+		assert.Equals(t, context.Canceled, sig.Error)
+	}
+}
+
+func TestSignerFollowResume(t *testing.T) {
+	data := srand(331, 2*DefaultBlockSize)
+	f := new(growingFile)
+	f.Write(data[:DefaultBlockSize+10])
+
+	s := NewSigner(nil, WithFollow(time.Millisecond))
+	s.Reset(f)
+
+	sig, err := s.Next(context.Background())
+	assert.Ok(t, err)
+	assert.Equals(t, uint64(0), sig.Index)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = s.Next(ctx)
+	assert.Equals(t, context.DeadlineExceeded, err)
+
+	// The part of the block read before giving up is not lost.
+	f.Write(data[DefaultBlockSize+10:])
+	sig, err = s.Next(context.Background())
+	assert.Ok(t, err)
+
+	exp := NewSigner(nil)
+	exp.Reset(bytes.NewReader(data))
+	exp.Next(context.Background())
+	expSig, err := exp.Next(context.Background())
+	assert.Ok(t, err)
+	assert.Equals(t, expSig, sig)
+}
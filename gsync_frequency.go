@@ -0,0 +1,99 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// BlockFrequency describes how often a block shows up across a corpus of files.
+type BlockFrequency struct {
+	// Weak and Strong are the checksums identifying the block.
+	Weak   uint32
+	Strong []byte
+	// Count is the number of times the block was seen and Files the number of files it was seen in.
+	Count int
+	Files int
+	// Name and Index locate the first occurrence of the block, so its data can be read back.
+	Name  string
+	Index uint64
+
+	// last is the name of the last file the block was seen in.
+	last string
+}
+
+// BlockCounter tallies block signatures across files, in order to find blocks shared by many of
+// them. Such blocks make good samples for training compression dictionaries, i.e. zstd ones, for
+// corpora of small and similar files. The zero value is ready to use. A BlockCounter is not safe
+// for concurrent use.
+type BlockCounter struct {
+	blocks map[string]*BlockFrequency
+}
+
+// Add tallies the signatures of the file with the given name, as returned by Signatures, until the
+// channel is closed. Blocks are told apart by their strong checksum, so all files must be signed with
+// the same strong hash. Coarse signatures are ignored. The first signature error is returned, once
+// the channel is closed.
+func (c *BlockCounter) Add(ctx context.Context, name string, sigs <-chan BlockSignature) error {
+	if c.blocks == nil {
+		c.blocks = make(map[string]*BlockFrequency)
+	}
+
+	var err error
+	for sig := range sigs {
+		if sig.Error != nil {
+			if err == nil {
+				err = sig.Error
+			}
+			continue
+		}
+
+		if sig.Done || sig.blocks() > 1 {
+			continue
+		}
+
+		b, ok := c.blocks[string(sig.Strong)]
+		if !ok {
+			b = &BlockFrequency{Weak: sig.Weak, Strong: sig.Strong, Name: name, Index: sig.Index}
+			c.blocks[string(sig.Strong)] = b
+		}
+
+		b.Count++
+		if !ok || b.last != name {
+			b.Files++
+			b.last = name
+		}
+	}
+
+	if err == nil && ctx.Err() != nil {
+		err = errors.Wrapf(ctx.Err(), "failed counting blocks of %s", name)
+	}
+	return err
+}
+
+// Frequent returns the blocks seen in at least files files, the ones seen in the most files first
+// and, among those, the ones seen the most times first.
+func (c *BlockCounter) Frequent(files int) []BlockFrequency {
+	var freq []BlockFrequency
+	for _, b := range c.blocks {
+		if b.Files >= files {
+			freq = append(freq, *b)
+		}
+	}
+
+	sort.Slice(freq, func(i, j int) bool {
+		if freq[i].Files != freq[j].Files {
+			return freq[i].Files > freq[j].Files
+		}
+		if freq[i].Count != freq[j].Count {
+			return freq[i].Count > freq[j].Count
+		}
+		return freq[i].Name < freq[j].Name || freq[i].Name == freq[j].Name && freq[i].Index < freq[j].Index
+	})
+	return freq
+}
@@ -0,0 +1,44 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestBlockCounter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	shared := srand(320, DefaultBlockSize)
+	files := map[string][]byte{
+		"a": append(append([]byte(nil), shared...), shared...),
+		"b": append(srand(321, DefaultBlockSize), shared...),
+		"c": srand(322, 2*DefaultBlockSize),
+	}
+
+	var c BlockCounter
+	for _, name := range []string{"a", "b", "c"} {
+		sigsCh, err := Signatures(ctx, bytes.NewReader(files[name]), nil)
+		assert.Ok(t, err)
+		assert.Ok(t, c.Add(ctx, name, sigsCh))
+	}
+
+	freq := c.Frequent(2)
+	assert.Equals(t, 1, len(freq))
+	assert.Equals(t, 3, freq[0].Count)
+	assert.Equals(t, 2, freq[0].Files)
+	assert.Equals(t, "a", freq[0].Name)
+	assert.Equals(t, uint64(0), freq[0].Index)
+
+	all := c.Frequent(1)
+	assert.Equals(t, 4, len(all))
+	assert.Equals(t, freq[0].Strong, all[0].Strong)
+}
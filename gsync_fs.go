@@ -0,0 +1,106 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"hash"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ReaderAtCloser is an io.ReaderAt that must be closed when no longer needed.
+type ReaderAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// SignaturesFS opens name from fsys and pipes out its block signatures just like Signatures,
+// closing the file once done reading or when the context is cancelled.
+func SignaturesFS(ctx context.Context, fsys fs.FS, name string, shash hash.Hash, opts ...Option) (<-chan BlockSignature, error) {
+	cfg := newOptions(opts)
+	if cfg.err != nil {
+		return nil, cfg.err
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed opening %s", name)
+	}
+
+	s := newSigner(shash, cfg)
+	s.pooled()
+	s.Reset(f)
+
+	return signatures(ctx, s, f), nil
+}
+
+// OpenFS opens name from fsys for random access, so it can be used as the source file of Sync
+// or as the cache of Apply. Files implementing io.ReaderAt, such as those from os.DirFS, embed.FS
+// or testing/fstest.MapFS, are used directly. Files implementing io.Seeker, such as those from
+// archive/zip stored entries, are read by seeking under a mutex. Any other file is read whole
+// into memory.
+func OpenFS(fsys fs.FS, name string) (ReaderAtCloser, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed opening %s", name)
+	}
+
+	switch r := f.(type) {
+	case ReaderAtCloser:
+		return r, nil
+	case io.ReadSeeker:
+		return &seekReaderAt{f: f, r: r}, nil
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed reading %s", name)
+	}
+
+	return &memReaderAt{Reader: bytes.NewReader(data), f: f}, nil
+}
+
+// seekReaderAt implements io.ReaderAt on top of an io.ReadSeeker.
+type seekReaderAt struct {
+	mu sync.Mutex
+	f  fs.File
+	r  io.ReadSeeker
+}
+
+func (s *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(s.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *seekReaderAt) Close() error {
+	return s.f.Close()
+}
+
+// memReaderAt serves reads from a file loaded in memory.
+type memReaderAt struct {
+	*bytes.Reader
+	f fs.File
+}
+
+func (m *memReaderAt) Close() error {
+	return m.f.Close()
+}
@@ -0,0 +1,68 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+// streamFS hides everything but fs.File from the files it opens.
+type streamFS struct {
+	fs.FS
+}
+
+type streamFile struct {
+	fs.File
+}
+
+func (s streamFS) Open(name string) (fs.File, error) {
+	f, err := s.FS.Open(name)
+	return streamFile{f}, err
+}
+
+func TestFS(t *testing.T) {
+	cache := srand(120, 100*1024)
+	source := append(srand(121, 3000), cache...)
+
+	fsys := fstest.MapFS{
+		"cache":  &fstest.MapFile{Data: cache},
+		"source": &fstest.MapFile{Data: source},
+	}
+
+	for _, fsys := range []fs.FS{fsys, streamFS{fsys}} {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		sigsCh, err := SignaturesFS(ctx, fsys, "cache", nil)
+		assert.Ok(t, err)
+		cacheSigs, err := LookUpTable(ctx, sigsCh)
+		assert.Ok(t, err)
+
+		src, err := OpenFS(fsys, "source")
+		assert.Ok(t, err)
+		defer src.Close()
+
+		opsCh, err := Sync(ctx, src, nil, cacheSigs)
+		assert.Ok(t, err)
+
+		base, err := OpenFS(fsys, "cache")
+		assert.Ok(t, err)
+		defer base.Close()
+
+		target := new(bytes.Buffer)
+		assert.Ok(t, Apply(ctx, target, base, opsCh))
+		assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+	}
+
+	_, err := SignaturesFS(context.Background(), fsys, "missing", nil)
+	assert.Cond(t, err != nil, "expected an error opening a missing file")
+}
@@ -0,0 +1,212 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	stdsha256 "crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"math"
+	"reflect"
+	"sync"
+
+	"github.com/minio/sha256-simd"
+)
+
+// HashID identifies the algorithm used to calculate strong checksums, so that
+// signatures calculated with different algorithms can be told apart.
+type HashID uint8
+
+const (
+	// HashUnknown is used for strong hashes this package does not know about.
+	HashUnknown HashID = iota
+	// HashSHA256 identifies SHA-256, the default strong hash.
+	HashSHA256
+	// HashMD5 identifies MD5.
+	HashMD5
+	// HashSHA1 identifies SHA-1.
+	HashSHA1
+	// HashSHA512 identifies SHA-512.
+	HashSHA512
+	// HashMD4 identifies MD4, for interoperability with rsync only. See NewMD4.
+	HashMD4
+	// HashBLAKE3 identifies BLAKE3, the recommended strong hash. See NewBLAKE3.
+	HashBLAKE3
+	// HashUser is the first identifier available for algorithms registered by applications.
+	HashUser HashID = 128
+)
+
+var hashNames = map[HashID]string{
+	HashSHA256: "sha256",
+	HashMD5:    "md5",
+	HashSHA1:   "sha1",
+	HashSHA512: "sha512",
+	HashMD4:    "md4",
+	HashBLAKE3: "blake3",
+}
+
+// String returns the name of the algorithm.
+func (id HashID) String() string {
+	if name, ok := hashNames[id]; ok {
+		return name
+	}
+	if id == HashUnknown {
+		return "unknown"
+	}
+	return fmt.Sprintf("hash(%d)", uint8(id))
+}
+
+// hashKind tells hash implementations apart. The size is needed since some implementations
+// share their concrete type across variants, i.e. SHA-224 and SHA-256.
+type hashKind struct {
+	typ  reflect.Type
+	size int
+}
+
+func kindOf(h hash.Hash) hashKind {
+	return hashKind{reflect.TypeOf(h), h.Size()}
+}
+
+var (
+	hashesMu sync.RWMutex
+	// hashIDs maps known hash implementations to their identifiers. Both the standard library
+	// and the SIMD SHA-256 implementations are recognized since they produce the same sums.
+	hashIDs = map[hashKind]HashID{
+		kindOf(sha256.New()):    HashSHA256,
+		kindOf(stdsha256.New()): HashSHA256,
+		kindOf(md5.New()):       HashMD5,
+		kindOf(sha1.New()):      HashSHA1,
+		kindOf(sha512.New()):    HashSHA512,
+		kindOf(NewMD4()):        HashMD4,
+		kindOf(NewBLAKE3()):     HashBLAKE3,
+	}
+	// hashes maps identifiers to constructors of their algorithms.
+	hashes = map[HashID]func() hash.Hash{
+		HashSHA256: sha256.New,
+		HashMD5:    md5.New,
+		HashSHA1:   sha1.New,
+		HashSHA512: sha512.New,
+		HashMD4:    NewMD4,
+		HashBLAKE3: NewBLAKE3,
+	}
+)
+
+// hashIDOf returns the identifier of the algorithm implemented by h.
+func hashIDOf(h hash.Hash) HashID {
+	hashesMu.RLock()
+	defer hashesMu.RUnlock()
+	return hashIDs[kindOf(h)]
+}
+
+// RegisterHash makes the strong hash algorithm returned by newHash known under id, which should be
+// HashUser or above, replacing any previous registration. Signatures calculated with it then carry
+// id, so Sync can adopt the algorithm from them. Both ends must register the same algorithms under
+// the same identifiers, typically from init functions.
+func RegisterHash(id HashID, newHash func() hash.Hash) {
+	hashesMu.Lock()
+	defer hashesMu.Unlock()
+
+	hashes[id] = newHash
+	hashIDs[kindOf(newHash())] = id
+}
+
+// NewHash returns a new instance of the strong hash algorithm identified by id, failing with
+// ErrUnsupportedHash if it is not known.
+func NewHash(id HashID) (hash.Hash, error) {
+	hashesMu.RLock()
+	newHash, ok := hashes[id]
+	hashesMu.RUnlock()
+
+	if !ok {
+		return nil, ErrUnsupportedHash
+	}
+	return newHash(), nil
+}
+
+// remoteHashID returns the identifier of the strong hash algorithm the remote signatures were
+// calculated with, or SHA-256 if they do not identify it.
+func remoteHashID(remote map[uint32][]BlockSignature) HashID {
+	for _, bs := range remote {
+		for _, b := range bs {
+			if b.Hash != HashUnknown {
+				return b.Hash
+			}
+		}
+	}
+	return HashSHA256
+}
+
+// checkHashes verifies that all remote signatures were calculated with the same strong
+// hash as shash. Strong checksums of different algorithms never compare equal, so a mixed
+// or mismatching signature set would silently turn the whole file into literal data.
+// When an algorithm is unknown, the length of the strong checksums is verified instead.
+func checkHashes(remote map[uint32][]BlockSignature, shash hash.Hash) error {
+	id, size := hashIDOf(shash), shash.Size()
+	for _, bs := range remote {
+		for _, b := range bs {
+			if b.Hash != HashUnknown && id != HashUnknown && b.Hash != id {
+				return &BlockError{Index: b.Index, Kind: ErrHashMismatch}
+			}
+
+			if len(b.Strong) != size {
+				return &BlockError{Index: b.Index, Kind: ErrHashMismatch}
+			}
+		}
+	}
+	return nil
+}
+
+// remoteModulus returns the modulus of the rolling checksum used by the remote signatures, or the
+// configured one if the signatures do not record it.
+func remoteModulus(remote map[uint32][]BlockSignature, cfg *options) (uint32, error) {
+	m := cfg.modulus
+	found := false
+	for _, bs := range remote {
+		for _, b := range bs {
+			if b.Modulus == 0 {
+				continue
+			}
+
+			if (found || cfg.explicitModulus) && b.Modulus != m {
+				return 0, &BlockError{Index: b.Index, Kind: ErrModulusMismatch}
+			}
+			m, found = b.Modulus, true
+		}
+	}
+	return m, nil
+}
+
+// MinStrongHashLen returns the minimum number of bytes of a strong checksum, such as those
+// truncated by a custom hash.Hash, that keep the probability of any two out of blockCount blocks
+// sharing the same checksum under targetCollisionProb, as given by the birthday bound
+// n(n-1)/2 / 2^bits. It assumes the strong hash is uniformly distributed and blocks are
+// independent, which does not hold for files with many repeated blocks, whose checksums collide
+// by design, harmlessly. The result is at least one byte and at most sha256.Size, which is also
+// returned for targets of zero or less.
+func MinStrongHashLen(blockCount uint64, targetCollisionProb float64) int {
+	if targetCollisionProb <= 0 {
+		return sha256.Size
+	}
+
+	n := float64(blockCount)
+	pairs := n * (n - 1) / 2
+	if pairs <= targetCollisionProb {
+		return 1
+	}
+
+	// The ratio overflows to infinity for tiny targets, so bits are clamped before converting.
+	bits := math.Log2(pairs / targetCollisionProb)
+	if bits > 8*sha256.Size {
+		return sha256.Size
+	}
+	size := int(math.Ceil(bits / 8))
+	if size < 1 {
+		return 1
+	}
+	return size
+}
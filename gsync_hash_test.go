@@ -0,0 +1,189 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/fnv"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestHashMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(100, 64*1024)
+
+	table := func(h hash.Hash) map[uint32][]BlockSignature {
+		sigsCh, err := Signatures(ctx, bytes.NewReader(cache), h)
+		assert.Ok(t, err)
+		table, err := LookUpTable(ctx, sigsCh)
+		assert.Ok(t, err)
+		return table
+	}
+
+	md5Sigs := table(md5.New())
+	for _, bs := range md5Sigs {
+		assert.Equals(t, HashMD5, bs[0].Hash)
+	}
+
+	_, err := Sync(ctx, bytes.NewReader(cache), sha256.New(), md5Sigs)
+	assert.Cond(t, errors.Is(err, ErrHashMismatch), "expected ErrHashMismatch, got %v", err)
+
+	// Both SHA-256 implementations are interchangeable.
+	_, err = Sync(ctx, bytes.NewReader(cache), sha256.New(), table(nil))
+	assert.Ok(t, err)
+
+	// Signature sets built from different algorithms are rejected.
+	mixed := table(sha256.New())
+	for weak, bs := range md5Sigs {
+		mixed[weak] = append(mixed[weak], bs...)
+	}
+	_, err = Sync(ctx, bytes.NewReader(cache), nil, mixed)
+	assert.Cond(t, errors.Is(err, ErrHashMismatch), "expected ErrHashMismatch, got %v", err)
+}
+
+func TestWeakModulus(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(270, 200*1024)
+	source := append(srand(271, 500), cache[:150*1024]...)
+
+	_, err := Signatures(ctx, bytes.NewReader(cache), nil, WithWeakModulus(1000))
+	assert.Equals(t, ErrInvalidModulus, err)
+	_, err = NewSyncer(nil, WithWeakModulus(1<<17))
+	assert.Equals(t, ErrInvalidModulus, err)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil, WithWeakModulus(1<<12))
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	for _, bs := range cacheSigs {
+		for _, b := range bs {
+			assert.Equals(t, uint32(1<<12), b.Modulus)
+			assert.Cond(t, b.Weak < 1<<24, "weak checksum %#x exceeds 24 bits", b.Weak)
+		}
+	}
+
+	// Sync picks up the modulus from the signatures.
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs)
+	assert.Ok(t, err)
+
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), opsCh))
+	assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+
+	_, err = Sync(ctx, bytes.NewReader(source), nil, cacheSigs, WithWeakModulus(1<<16))
+	assert.Cond(t, errors.Is(err, ErrModulusMismatch), "expected ErrModulusMismatch, got %v", err)
+}
+
+func TestHashNegotiation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	RegisterHash(HashUser, fnv.New128a)
+
+	cache := srand(320, 100*1024)
+	source := append(srand(321, 100), cache...)
+
+	for _, h := range []func() hash.Hash{md5.New, NewMD4, NewBLAKE3, fnv.New128a} {
+		sigsCh, err := Signatures(ctx, bytes.NewReader(cache), h())
+		assert.Ok(t, err)
+		cacheSigs, err := LookUpTable(ctx, sigsCh)
+		assert.Ok(t, err)
+
+		// Sync adopts the strong hash advertised by the signatures.
+		opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs)
+		assert.Ok(t, err)
+
+		var literal int
+		target := new(bytes.Buffer)
+		c := make(chan BlockOperation)
+		go func() {
+			defer close(c)
+			for op := range opsCh {
+				literal += len(op.Data)
+				c <- op
+			}
+		}()
+		assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), c))
+		assert.Equals(t, 100, literal)
+		assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+	}
+
+	_, err := NewHash(HashUser + 1)
+	assert.Equals(t, ErrUnsupportedHash, err)
+
+	remote := map[uint32][]BlockSignature{1: {{Hash: HashUser + 1, Strong: make([]byte, 16)}}}
+	_, err = Sync(ctx, bytes.NewReader(source), nil, remote)
+	assert.Equals(t, ErrUnsupportedHash, err)
+}
+
+func TestMD4(t *testing.T) {
+	// Test suite of RFC 1320.
+	tests := []struct {
+		in, sum string
+	}{
+		{"", "31d6cfe0d16ae931b73c59d7e0c089c0"},
+		{"a", "bde52cb31de33e46245e05fbdbd6fb24"},
+		{"abc", "a448017aaf21d8525fc10ae87aa6729d"},
+		{"message digest", "d9130a8164549fe818874806e1c7014b"},
+		{"abcdefghijklmnopqrstuvwxyz", "d79e1c308aa5bbcdeea8ed63df412da9"},
+		{"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789", "043f8582f241db351ce627e153e7f0e4"},
+		{"12345678901234567890123456789012345678901234567890123456789012345678901234567890", "e33b4ddc9c38f2199c3e7b164fcc0536"},
+	}
+
+	h := NewMD4()
+	for _, tt := range tests {
+		// Data written in pieces of every size sums up the same.
+		for step := 1; step <= len(tt.in)+1; step++ {
+			h.Reset()
+			for i := 0; i < len(tt.in); i += step {
+				end := i + step
+				if end > len(tt.in) {
+					end = len(tt.in)
+				}
+				h.Write([]byte(tt.in[i:end]))
+			}
+			assert.Equals(t, tt.sum, hex.EncodeToString(h.Sum(nil)))
+			assert.Equals(t, tt.sum, hex.EncodeToString(h.Sum(nil)))
+		}
+	}
+	assert.Equals(t, HashMD4, hashIDOf(h))
+}
+
+func TestMinStrongHashLen(t *testing.T) {
+	for _, tt := range []struct {
+		blocks uint64
+		prob   float64
+		size   int
+	}{
+		{0, 1e-9, 1},
+		{1, 1e-9, 1},
+		{1 << 16, 0.5, 4},
+		{1 << 20, 1e-9, 9},
+		{1 << 32, math.Pow(2, -64), 16},
+		// Targets of zero or less can not be met by any length.
+		{1 << 40, 0, 32},
+		{1 << 10, -1, 32},
+		// Lengths saturate at the size of SHA-256.
+		{1 << 63, 1e-300, 32},
+		{math.MaxUint64, math.SmallestNonzeroFloat64, 32},
+	} {
+		assert.Equals(t, tt.size, MinStrongHashLen(tt.blocks, tt.prob))
+	}
+}
@@ -0,0 +1,96 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/minio/sha256-simd"
+)
+
+// stepIdentical verifies whether the source is identical to the base file, in which case the
+// whole base file is copied with a single operation. The first and last blocks and the size
+// are checked against the remote signatures first, so that most differing sources are told
+// apart without reading them whole.
+func (s *Syncer) stepIdentical() (bool, error) {
+	var first, last *BlockSignature
+	for _, bs := range s.remote {
+		for i, b := range bs {
+			if b.blocks() > 1 {
+				continue
+			}
+			if b.Index == 0 {
+				first = &bs[i]
+			}
+			if last == nil || b.Index > last.Index {
+				last = &bs[i]
+			}
+		}
+	}
+
+	if first == nil {
+		return false, nil
+	}
+
+	block := make([]byte, len(s.buffer))
+	var size int64
+	for _, b := range []*BlockSignature{first, last} {
+		off, err := s.cfg.blockOffset(b.Index)
+		if err != nil {
+			return false, nil
+		}
+
+		n, err := readAtFull(s.r, block, off)
+		if err != nil && err != io.EOF {
+			return false, s.readError(err)
+		}
+
+		if n == 0 || !s.matches(block[:n], *b) {
+			return false, nil
+		}
+		size = off + int64(n)
+	}
+
+	// A full last block may still be followed by more data.
+	if n, _ := s.r.ReadAt(block[:1], size); n != 0 {
+		return false, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(s.r, 0, size)); err != nil {
+		return false, s.readError(err)
+	}
+
+	if !bytes.Equal(h.Sum(nil), s.cfg.identical) {
+		return false, nil
+	}
+
+	s.emit(BlockOperation{Index: 0, Count: last.Index + 1})
+	s.offset = size
+	s.done = true
+	return true, nil
+}
+
+// matches reports whether block matches the remote signature b.
+func (s *Syncer) matches(block []byte, b BlockSignature) bool {
+	if s.cfg.weak.sum(block, s.mod) != b.Weak {
+		return false
+	}
+
+	s.shash.Reset()
+	s.shash.Write(block)
+	return s.compare(block, s.shash.Sum(nil), b)
+}
+
+// compare reports whether block, whose strong checksum is strong, matches the remote signature b,
+// as decided by the comparator. Empty blocks and signatures without a strong checksum never match,
+// since any two of them would.
+func (s *Syncer) compare(block, strong []byte, b BlockSignature) bool {
+	if len(block) == 0 || len(b.Strong) == 0 {
+		return false
+	}
+	return s.cfg.compare(block, strong, b)
+}
@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestIdentical(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(192, 100*DefaultBlockSize+123)
+	digest, err := Digest(bytes.NewReader(cache))
+	assert.Ok(t, err)
+
+	middle := append([]byte(nil), cache...)
+	middle[50*DefaultBlockSize] ^= 0xff
+	appended := append(append([]byte(nil), cache...), srand(193, 10)...)
+
+	for _, source := range [][]byte{cache, middle, appended, cache[:len(cache)-1]} {
+		sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+		assert.Ok(t, err)
+		cacheSigs, err := LookUpTable(ctx, sigsCh)
+		assert.Ok(t, err)
+
+		opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, WithIdentical(digest))
+		assert.Ok(t, err)
+
+		var ops []BlockOperation
+		for op := range opsCh {
+			assert.Ok(t, op.Error)
+			ops = append(ops, op)
+		}
+
+		if bytes.Equal(source, cache) {
+			assert.Equals(t, 2, len(ops))
+			assert.Equals(t, BlockOperation{Count: 101}, ops[0])
+		} else {
+			assert.Cond(t, len(ops) > 2, "expected regular matching, got %d operations", len(ops))
+		}
+
+		c := make(chan BlockOperation, len(ops))
+		for _, op := range ops {
+			c <- op
+		}
+		close(c)
+
+		target := new(bytes.Buffer)
+		assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), c))
+		assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+	}
+}
@@ -0,0 +1,276 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ApplyInPlace reconstructs the new version of file using its current content as the cache
+// for index operations, so that no separate destination needs to be managed by the caller.
+//
+// Since index operations may refer to any block of the old version, in any order, the new
+// version can not be safely written over the old one while it is being read. Instead, it is
+// written to a temporary file in the same directory, flushed to stable storage and then
+// renamed over the original path. Disk space for both versions is required until the rename,
+// see ApplyOverwrite for writing over the old version instead.
+//
+// Atomicity: on POSIX systems the rename is atomic, so other processes opening the path
+// observe either the old or the new version, never a mix of both. If an error occurs or the
+// context is cancelled, the temporary file is removed and the original file is left untouched.
+// A crash may leave the temporary file behind, but never a partially written original.
+//
+// Once this function returns successfully, file still refers to the old version, the caller
+// is expected to close it and re-open the path to access the new content.
+func ApplyInPlace(ctx context.Context, file *os.File, ops <-chan BlockOperation, opts ...Option) error {
+	if file == nil {
+		return ErrMissingCache
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "failed getting file information")
+	}
+
+	name := file.Name()
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".gsync-")
+	if err != nil {
+		return errors.Wrapf(err, "failed creating temporary file")
+	}
+
+	if err := applyTemp(ctx, tmp, file, info.Mode(), ops, opts); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "failed replacing %s", name)
+	}
+
+	return nil
+}
+
+// applyTemp applies operations into tmp, flushing and closing it when done.
+func applyTemp(ctx context.Context, tmp *os.File, cache io.ReaderAt, mode os.FileMode, ops <-chan BlockOperation, opts []Option) error {
+	if err := Apply(ctx, tmp, cache, ops, opts...); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed setting file mode")
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed flushing temporary file")
+	}
+
+	return errors.Wrapf(tmp.Close(), "failed closing temporary file")
+}
+
+// ApplyOverwrite is ApplyInPlace writing the new version of file over the old one, for files too
+// large to keep both versions on disk. file must be opened for reading and writing.
+//
+// Operations are collected and applied twice. The first pass writes nothing; it only records
+// the last point of the reconstruction at which every block of the old version is read. The
+// second pass writes the new version over the old one. Before a block that is still to be read
+// gets overwritten, it is copied to memory and kept there until it is read for the last time.
+// Besides the literal data of the operations, memory use is therefore limited to the blocks
+// copied backwards across the point being written. For files edited in place, with blocks that
+// mostly keep their offsets, that is only a few blocks. A file whose blocks were reordered
+// wholesale may need most of it. A table of 8 bytes per block of the old version is also kept.
+//
+// Atomicity: unlike ApplyInPlace, nothing is atomic. The first pass catches failures coming from
+// the operations themselves, such as error operations, a base digest mismatch or a stream missing
+// its Done operation with WithRequireDone, and leaves the file untouched in that case. A failure to
+// read or write the file, a cancelled context or a crash during the second pass leaves the file
+// holding a mix of both versions, which can only be repaired from another copy, i.e. by syncing it
+// again against the source. The file is truncated to the length of the new version and flushed
+// to stable storage before returning.
+//
+// WithRange, WithSkipErrors and WithTransform are not supported.
+func ApplyOverwrite(ctx context.Context, file *os.File, ops <-chan BlockOperation, opts ...Option) error {
+	if file == nil {
+		return ErrMissingCache
+	}
+
+	cfg := newOptions(opts)
+	if cfg.err != nil {
+		return cfg.err
+	}
+	if cfg.ranged || cfg.skipErrors || cfg.transform != nil {
+		return errors.New("gsync: ApplyOverwrite does not support WithRange, WithSkipErrors or WithTransform")
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "failed getting file information")
+	}
+	size := info.Size()
+
+	var collected []BlockOperation
+	for op := range ops {
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "failed collecting block operations")
+		default:
+		}
+		collected = append(collected, op)
+	}
+
+	// The first pass runs without side effects, in order, so reads are recorded where they belong.
+	plan := newOverwritePlan(file, size)
+	dry := *cfg
+	dry.audit, dry.tracer, dry.fsync, dry.prefetchWorkers = nil, nil, 0, 0
+	if err := apply(ctx, plan, plan, readFrom(plan, &dry), replayOps(collected), &dry); err != nil {
+		return err
+	}
+
+	w := &overwriter{plan: plan}
+	if err := apply(ctx, w, w, readFrom(w, cfg), replayOps(collected), cfg); err != nil {
+		return err
+	}
+
+	if err := file.Truncate(w.off); err != nil {
+		return errors.Wrapf(err, "failed truncating file")
+	}
+	return errors.Wrapf(file.Sync(), "failed flushing file")
+}
+
+// replayOps returns a closed channel holding ops.
+func replayOps(ops []BlockOperation) <-chan BlockOperation {
+	c := make(chan BlockOperation, len(ops))
+	for _, op := range ops {
+		c <- op
+	}
+	close(c)
+	return c
+}
+
+// overwritePlan is the destination and cache of the first pass of ApplyOverwrite. It discards
+// the data written, and records in last the amount written when each block of the cache was
+// last read, or -1 for blocks never read. Blocks here are pages of DefaultBlockSize bytes,
+// whatever the block size of the operations, since only the ranges read matter.
+type overwritePlan struct {
+	file *os.File
+	size int64
+	off  int64
+	last []int64
+}
+
+func newOverwritePlan(file *os.File, size int64) *overwritePlan {
+	last := make([]int64, (size+DefaultBlockSize-1)/DefaultBlockSize)
+	for i := range last {
+		last[i] = -1
+	}
+	return &overwritePlan{file: file, size: size, last: last}
+}
+
+func (p *overwritePlan) Write(b []byte) (int, error) {
+	p.off += int64(len(b))
+	return len(b), nil
+}
+
+func (p *overwritePlan) ReadAt(b []byte, off int64) (int, error) {
+	n, err := clipReaderAt{r: p.file, end: p.size}.ReadAt(b, off)
+	if n > 0 {
+		for i := off / DefaultBlockSize; i <= (off+int64(n)-1)/DefaultBlockSize; i++ {
+			p.last[i] = p.off
+		}
+	}
+	return n, err
+}
+
+// overwriter is the destination and cache of the second pass of ApplyOverwrite, writing over
+// the cache it reads from. saved holds the blocks of the old version already overwritten that
+// are still to be read.
+type overwriter struct {
+	plan  *overwritePlan
+	mu    sync.Mutex
+	off   int64
+	saved map[int64][]byte
+}
+
+func (w *overwriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Every read happens before the data read is written, so blocks last read at or before the
+	// current point are not needed anymore. The others are saved before being overwritten.
+	for i := range w.saved {
+		if w.plan.last[i] <= w.off {
+			delete(w.saved, i)
+		}
+	}
+
+	cache := clipReaderAt{r: w.plan.file, end: w.plan.size}
+	end := (w.off + int64(len(b)) + DefaultBlockSize - 1) / DefaultBlockSize
+	for i := w.off / DefaultBlockSize; i < end && i < int64(len(w.plan.last)); i++ {
+		if _, ok := w.saved[i]; ok || w.plan.last[i] <= w.off {
+			continue
+		}
+
+		block := make([]byte, DefaultBlockSize)
+		n, err := cache.ReadAt(block, i*DefaultBlockSize)
+		if err != nil && err != io.EOF {
+			return 0, errors.Wrapf(err, "failed saving block %d", i)
+		}
+		if w.saved == nil {
+			w.saved = make(map[int64][]byte)
+		}
+		w.saved[i] = block[:n]
+	}
+
+	n, err := w.plan.file.WriteAt(b, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+func (w *overwriter) ReadAt(b []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	cache := clipReaderAt{r: w.plan.file, end: w.plan.size}
+	var n int
+	for n < len(b) && off < w.plan.size {
+		i := off / DefaultBlockSize
+		chunk := b[n:]
+		if rest := (i+1)*DefaultBlockSize - off; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+
+		var c int
+		if block, ok := w.saved[i]; ok {
+			if within := int(off - i*DefaultBlockSize); within < len(block) {
+				c = copy(chunk, block[within:])
+			}
+		} else {
+			var err error
+			if c, err = cache.ReadAt(chunk, off); err != nil && err != io.EOF {
+				return n + c, err
+			}
+		}
+		if c == 0 {
+			break
+		}
+		n += c
+		off += int64(c)
+	}
+
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,186 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+func TestApplyInPlace(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "gsync")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	cache := srand(50, 256*1024)
+	// Reverses the order of the first blocks so copies overlap with the regions they land on.
+	source := append(append(append([]byte(nil), cache[DefaultBlockSize:2*DefaultBlockSize]...), cache[:DefaultBlockSize]...), cache[2*DefaultBlockSize:]...)
+	source = append(source, srand(51, 3000)...)
+
+	name := filepath.Join(dir, "file")
+	assert.Ok(t, ioutil.WriteFile(name, cache, 0600))
+
+	f, err := os.Open(name)
+	assert.Ok(t, err)
+	defer f.Close()
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs)
+	assert.Ok(t, err)
+
+	assert.Ok(t, ApplyInPlace(ctx, f, opsCh))
+
+	target, err := ioutil.ReadFile(name)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(source, target), "source and target files are different")
+
+	entries, err := ioutil.ReadDir(dir)
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(entries))
+}
+
+// TestApplyInPlaceShrinking tests that a file reconstructed in place into a shorter version
+// does not keep any of its old trailing data.
+func TestApplyInPlaceShrinking(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "gsync")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	cache := srand(184, 50*DefaultBlockSize+700)
+	source := cache[5*DefaultBlockSize : 20*DefaultBlockSize+3]
+
+	name := filepath.Join(dir, "file")
+	assert.Ok(t, ioutil.WriteFile(name, cache, 0600))
+	f, err := os.Open(name)
+	assert.Ok(t, err)
+	defer f.Close()
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs)
+	assert.Ok(t, err)
+	assert.Ok(t, ApplyInPlace(ctx, f, opsCh))
+
+	target, err := ioutil.ReadFile(name)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(source, target), "expected %d bytes, got %d", len(source), len(target))
+}
+
+// overwrite syncs the file name from its current content to source with ApplyOverwrite. All stages
+// are configured with the given options.
+func overwrite(ctx context.Context, t *testing.T, name string, source []byte, opts ...Option) error {
+	cache, err := ioutil.ReadFile(name)
+	assert.Ok(t, err)
+
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	assert.Ok(t, err)
+	defer f.Close()
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil, opts...)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, opts...)
+	assert.Ok(t, err)
+	return ApplyOverwrite(ctx, f, opsCh, opts...)
+}
+
+// TestApplyOverwrite tests that files are reconstructed over themselves even when blocks are
+// copied backwards and forwards across the point being written.
+func TestApplyOverwrite(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "gsync")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	cache := srand(185, 40*DefaultBlockSize+300)
+	var reversed []byte
+	for i := 39; i >= 0; i-- {
+		reversed = append(reversed, cache[i*DefaultBlockSize:(i+1)*DefaultBlockSize]...)
+	}
+
+	tests := []struct {
+		desc   string
+		source []byte
+	}{
+		{"edited", mutate(cache, 186, 20)},
+		{"reversed", reversed},
+		{"grown", append(srand(187, 3*DefaultBlockSize+5), cache...)},
+		{"shrunk", cache[7*DefaultBlockSize+11 : 30*DefaultBlockSize]},
+		{"tail moved to the front", append(append([]byte(nil), cache[20*DefaultBlockSize:]...), cache[:20*DefaultBlockSize]...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// Blocks spanning several of the pages saved are overwritten all the same.
+			for _, opt := range []Option{WithPrefetch(4, 8), WithBlockSize(3*DefaultBlockSize + 1)} {
+				name := filepath.Join(dir, "file")
+				assert.Ok(t, ioutil.WriteFile(name, cache, 0600))
+
+				assert.Ok(t, overwrite(ctx, t, name, tt.source, opt))
+
+				target, err := ioutil.ReadFile(name)
+				assert.Ok(t, err)
+				assert.Cond(t, bytes.Equal(tt.source, target), "expected %d bytes, got %d", len(tt.source), len(target))
+
+				entries, err := ioutil.ReadDir(dir)
+				assert.Ok(t, err)
+				assert.Equals(t, 1, len(entries))
+			}
+		})
+	}
+}
+
+// TestApplyOverwriteUntouched tests that a stream failing before the end leaves the file as it was.
+func TestApplyOverwriteUntouched(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "gsync")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	cache := srand(188, 20*DefaultBlockSize)
+	name := filepath.Join(dir, "file")
+	assert.Ok(t, ioutil.WriteFile(name, cache, 0600))
+
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	assert.Ok(t, err)
+	defer f.Close()
+
+	failure := errors.New("connection reset")
+	ops := make(chan BlockOperation, 3)
+	ops <- BlockOperation{Data: srand(189, 2*DefaultBlockSize)}
+	ops <- BlockOperation{Index: 3}
+	ops <- BlockOperation{Error: failure}
+	close(ops)
+	err = ApplyOverwrite(ctx, f, ops)
+	assert.Equals(t, failure, errors.Cause(err))
+
+	target, err := ioutil.ReadFile(name)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(cache, target), "file was modified")
+}
@@ -0,0 +1,93 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// JSONWriter writes block signatures and operations as line-delimited JSON, one object per line,
+// for inspecting what a sync did, i.e. with jq. Checksums are hex-encoded and literal data is only
+// described by its size. It is meant for debugging, use Encoder to send operations over the wire.
+type JSONWriter struct {
+	enc *json.Encoder
+}
+
+// NewJSONWriter returns a JSONWriter writing to w.
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	return &JSONWriter{enc: json.NewEncoder(w)}
+}
+
+type jsonSignature struct {
+	Index   uint64 `json:"index"`
+	Count   uint64 `json:"count,omitempty"`
+	Length  int    `json:"length,omitempty"`
+	Weak    uint32 `json:"weak"`
+	Modulus uint32 `json:"modulus,omitempty"`
+	Strong  string `json:"strong"`
+	Hash    string `json:"hash"`
+	Done    bool   `json:"done,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// WriteSignature writes sig as a JSON line.
+func (j *JSONWriter) WriteSignature(sig BlockSignature) error {
+	v := jsonSignature{
+		Index:   sig.Index,
+		Count:   sig.Count,
+		Length:  sig.Length,
+		Weak:    sig.Weak,
+		Modulus: sig.Modulus,
+		Strong:  hex.EncodeToString(sig.Strong),
+		Hash:    sig.Hash.String(),
+		Done:    sig.Done,
+	}
+	if sig.Error != nil {
+		v.Error = sig.Error.Error()
+	}
+	return errors.Wrapf(j.enc.Encode(v), "failed writing signature")
+}
+
+type jsonOperation struct {
+	Op       string `json:"op"`
+	Offset   int64  `json:"offset,omitempty"`
+	Index    uint64 `json:"index,omitempty"`
+	Count    uint64 `json:"count,omitempty"`
+	Length   int    `json:"length,omitempty"`
+	Size     int    `json:"size,omitempty"`
+	Ref      uint64 `json:"ref,omitempty"`
+	Back     uint64 `json:"back,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+	Strong   string `json:"strong,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// WriteOperation writes op as a JSON line. The op field is one of copy, literal, ref, back, base,
+// done or error.
+func (j *JSONWriter) WriteOperation(op BlockOperation) error {
+	var v jsonOperation
+	switch {
+	case op.Error != nil:
+		v = jsonOperation{Op: "error", Error: op.Error.Error()}
+	case op.BaseDigest != nil:
+		v = jsonOperation{Op: "base", Digest: hex.EncodeToString(op.BaseDigest)}
+	case op.Done:
+		v = jsonOperation{Op: "done"}
+	case op.Ref != 0:
+		v = jsonOperation{Op: "ref", Offset: op.Offset, Ref: op.Ref}
+	case op.Back != 0:
+		v = jsonOperation{Op: "back", Offset: op.Offset, Back: op.Back}
+	case len(op.Data) > 0:
+		v = jsonOperation{Op: "literal", Offset: op.Offset, Size: len(op.Data), Checksum: hex.EncodeToString(op.Checksum)}
+	default:
+		v = jsonOperation{Op: "copy", Offset: op.Offset, Index: op.Index, Count: op.blocks(), Length: op.Length, Strong: hex.EncodeToString(op.Strong)}
+	}
+	return errors.Wrapf(j.enc.Encode(v), "failed writing operation")
+}
@@ -0,0 +1,43 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+func TestJSONWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewJSONWriter(buf)
+
+	assert.Ok(t, w.WriteSignature(BlockSignature{Index: 2, Weak: 10, Strong: []byte{0xab, 0xcd}, Hash: HashMD5}))
+	assert.Ok(t, w.WriteOperation(BlockOperation{Index: 3, Count: 4, Offset: 100}))
+	assert.Ok(t, w.WriteOperation(BlockOperation{Data: []byte("hello")}))
+	assert.Ok(t, w.WriteOperation(BlockOperation{Error: errors.New("boom")}))
+	assert.Ok(t, w.WriteOperation(BlockOperation{Done: true}))
+
+	exp := []map[string]interface{}{
+		{"index": 2.0, "weak": 10.0, "strong": "abcd", "hash": "md5"},
+		{"op": "copy", "offset": 100.0, "index": 3.0, "count": 4.0},
+		{"op": "literal", "size": 5.0},
+		{"op": "error", "error": "boom"},
+		{"op": "done"},
+	}
+
+	var got []map[string]interface{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var v map[string]interface{}
+		assert.Ok(t, json.Unmarshal(scanner.Bytes(), &v))
+		got = append(got, v)
+	}
+	assert.Equals(t, exp, got)
+}
@@ -0,0 +1,127 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"io/fs"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ManifestEntry describes a file of a tree.
+type ManifestEntry struct {
+	// Path identifies the file within the tree.
+	Path string `json:"path"`
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+	// Digest is the SHA-256 digest of the whole file, as calculated by Digest.
+	Digest []byte `json:"digest"`
+	// Mode and ModTime are the permission bits and modification time of the file, if known.
+	// They are not taken into account by ManifestDiff, only when writing archives with ApplyTar.
+	Mode    fs.FileMode `json:"mode,omitempty"`
+	ModTime time.Time   `json:"mtime"`
+}
+
+// Action is what needs to be done to a file to bring a tree up to date.
+type Action uint8
+
+const (
+	// ActionKeep means the file did not change.
+	ActionKeep Action = iota
+	// ActionCreate means the file is new. Its data has to be sent whole, i.e. by calling Sync
+	// without remote signatures and Apply without a cache.
+	ActionCreate
+	// ActionDelete means the file is gone from the new tree.
+	ActionDelete
+	// ActionSync means the file changed, so a delta has to be calculated with Signatures on the
+	// old file, Sync on the new one and applied with Apply, using the options in PlanEntry.Options.
+	ActionSync
+)
+
+var actionNames = [...]string{"keep", "create", "delete", "sync"}
+
+// String returns the name of the action.
+func (a Action) String() string {
+	if int(a) < len(actionNames) {
+		return actionNames[a]
+	}
+	return "unknown"
+}
+
+// PlanEntry is the action to take on a single file.
+type PlanEntry struct {
+	Path   string
+	Action Action
+	// Old and New are the manifest entries of the file, if present in each tree.
+	Old, New *ManifestEntry
+}
+
+// Options returns the options to use with Sync, besides any caller specific ones, to update a
+// changed file. Sync announces the digest of the old file, which Apply verifies before touching
+// anything, and files that grew take the append-only fast path whenever possible.
+func (e PlanEntry) Options() []Option {
+	if e.Action != ActionSync {
+		return nil
+	}
+
+	opts := []Option{WithBaseDigest(e.Old.Digest)}
+	if e.New.Size > e.Old.Size {
+		opts = append(opts, WithAppendOnly(e.Old.Size, e.Old.Digest))
+	}
+	return opts
+}
+
+// ManifestDiff compares the manifests of an old tree, from, and a new one, to, and returns the action to take on
+// every file of either, sorted by path. Files whose size and digest did not change are kept
+// without any signatures being calculated. Paths must be unique within each manifest.
+func ManifestDiff(from, to []ManifestEntry) ([]PlanEntry, error) {
+	olds, err := indexManifest(from)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid old manifest")
+	}
+
+	news, err := indexManifest(to)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid new manifest")
+	}
+
+	plan := make([]PlanEntry, 0, len(news))
+	for path, n := range news {
+		e := PlanEntry{Path: path, New: n, Action: ActionCreate}
+		if o, ok := olds[path]; ok {
+			e.Old = o
+			e.Action = ActionSync
+			if o.Size == n.Size && bytes.Equal(o.Digest, n.Digest) {
+				e.Action = ActionKeep
+			}
+		}
+		plan = append(plan, e)
+	}
+
+	for path, o := range olds {
+		if _, ok := news[path]; !ok {
+			plan = append(plan, PlanEntry{Path: path, Old: o, Action: ActionDelete})
+		}
+	}
+
+	sort.Slice(plan, func(i, j int) bool {
+		return plan[i].Path < plan[j].Path
+	})
+	return plan, nil
+}
+
+func indexManifest(m []ManifestEntry) (map[string]*ManifestEntry, error) {
+	index := make(map[string]*ManifestEntry, len(m))
+	for i := range m {
+		if _, ok := index[m[i].Path]; ok {
+			return nil, errors.Errorf("duplicate path %q", m[i].Path)
+		}
+		index[m[i].Path] = &m[i]
+	}
+	return index, nil
+}
@@ -0,0 +1,50 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestManifestDiff(t *testing.T) {
+	entry := func(path string, data []byte) ManifestEntry {
+		d, err := Digest(bytes.NewReader(data))
+		assert.Ok(t, err)
+		return ManifestEntry{Path: path, Size: int64(len(data)), Digest: d}
+	}
+
+	log := srand(260, 1000)
+	old := []ManifestEntry{
+		entry("a", []byte("same")),
+		entry("b", []byte("gone")),
+		entry("c", []byte("before")),
+		entry("log", log),
+	}
+	next := []ManifestEntry{
+		entry("log", append(log, "more"...)),
+		entry("c", []byte("after")),
+		entry("a", []byte("same")),
+		entry("d", []byte("new")),
+	}
+
+	plan, err := ManifestDiff(old, next)
+	assert.Ok(t, err)
+
+	var got []string
+	for _, e := range plan {
+		got = append(got, e.Path+":"+e.Action.String())
+	}
+	assert.Equals(t, []string{"a:keep", "b:delete", "c:sync", "d:create", "log:sync"}, got)
+
+	assert.Equals(t, 0, len(plan[0].Options()))
+	assert.Equals(t, 1, len(plan[2].Options()))
+	assert.Equals(t, 2, len(plan[4].Options()))
+
+	_, err = ManifestDiff(append(old, old[0]), next)
+	assert.Cond(t, err != nil, "expected duplicate paths to fail")
+}
@@ -0,0 +1,19 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"hash"
+
+	"golang.org/x/crypto/md4"
+)
+
+// NewMD4 returns a new MD4 hash, the strong hash of the rsync protocol and librsync, identified by
+// HashMD4, backed by golang.org/x/crypto/md4. It is only meant for interoperating with them: MD4
+// is broken, so collisions can be crafted at will, making it unsuitable for anything that has to
+// hold against malicious data.
+func NewMD4() hash.Hash {
+	return md4.New()
+}
@@ -0,0 +1,93 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import "unsafe"
+
+// signatureSize is the memory taken by a BlockSignature in a lookup table, besides its strong
+// checksum.
+const signatureSize = int64(unsafe.Sizeof(BlockSignature{}))
+
+// bucketSize approximates the memory taken by every distinct weak checksum in a lookup table: the
+// key, the slice header of the bucket and the map's own overhead per entry.
+const bucketSize = 4 + int64(unsafe.Sizeof([]BlockSignature{})) + 16
+
+// signatureMemory returns the memory taken by sig in a lookup table.
+func signatureMemory(sig BlockSignature) int64 {
+	return signatureSize + int64(cap(sig.Strong))
+}
+
+// TableMemory approximates the memory taken by a lookup table, as accounted by WithMemoryLimit.
+// Buckets are assumed not to have grown beyond their length.
+func TableMemory(table map[uint32][]BlockSignature) int64 {
+	var n int64
+	for _, bs := range table {
+		n += bucketSize
+		for _, b := range bs {
+			n += signatureMemory(b)
+		}
+	}
+	return n
+}
+
+// checkMemory fails with ErrMemoryLimit if n exceeds the limit set by WithMemoryLimit.
+func (o *options) checkMemory(n int64) error {
+	if o.memLimit > 0 && n > o.memLimit {
+		return ErrMemoryLimit
+	}
+	return nil
+}
+
+// signerMemory returns the memory used by Signatures: the block buffer, the read ahead buffer and
+// the coarse group.
+func (o *options) signerMemory() int64 {
+	n := int64(1+o.readAheadBlocks()) * int64(o.size)
+	if o.coarse > 1 {
+		n += int64(o.coarse) * int64(o.size)
+	}
+	return n
+}
+
+// syncerMemory returns the memory used by Sync, besides the coarse window and literal data: the
+// block buffer, the read ahead window, the copies held back by WithMinRun, the dedup dictionary and
+// the index of back references.
+func (o *options) syncerMemory() int64 {
+	n := int64(1+o.readAheadBlocks())*int64(o.size) + int64(o.dedup)
+	if o.backWindow > 0 {
+		n += int64(o.backWindow/o.size) * bucketSize
+	}
+	if o.minRun > 1 {
+		n += int64(o.minRun) * int64(o.size)
+	}
+	return n
+}
+
+// applierMemory returns the memory used by Apply: the block buffer, or one per operation read
+// ahead WithPrefetch, the dedup dictionary and the data remembered for back references.
+func (o *options) applierMemory() int64 {
+	blocks := int64(1)
+	if o.prefetchWorkers > 0 {
+		blocks = int64(o.prefetchWindow)
+	}
+	return blocks*int64(o.size) + int64(o.dedup) + 2*int64(o.backWindow)
+}
+
+// maxDelta returns the amount of literal data to accumulate before flushing it, set by
+// WithMaxDelta and bounded by the memory left by WithMemoryLimit, or 0 if unbounded.
+func (s *Syncer) maxDelta() int {
+	max := s.cfg.maxDelta
+	if s.cfg.memLimit == 0 {
+		return max
+	}
+
+	left := s.cfg.memLimit - s.cfg.syncerMemory() - int64(len(s.window))
+	if left < 1 {
+		left = 1
+	}
+	if max == 0 || int64(max) > left {
+		max = int(left)
+	}
+	return max
+}
@@ -0,0 +1,65 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestMemoryLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(530, 50*DefaultBlockSize)
+	source := srand(531, 20*DefaultBlockSize)
+
+	table := func(opts ...Option) (map[uint32][]BlockSignature, error) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+		assert.Ok(t, err)
+		return LookUpTable(ctx, sigsCh, opts...)
+	}
+
+	// Lookup tables are accounted for as they grow.
+	cacheSigs, err := table()
+	assert.Ok(t, err)
+	size := TableMemory(cacheSigs)
+	assert.Cond(t, size > 50*(signatureSize+32), "unexpected table size %d", size)
+
+	_, err = table(WithMemoryLimit(size))
+	assert.Ok(t, err)
+	_, err = table(WithMemoryLimit(size - 1))
+	assert.Equals(t, ErrMemoryLimit, err)
+
+	// Literal data is flushed before exceeding the limit.
+	cfg := newOptions(nil)
+	limit := cfg.syncerMemory() + 3*DefaultBlockSize
+	ops, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, WithMemoryLimit(limit))
+	assert.Ok(t, err)
+
+	target := new(bytes.Buffer)
+	audit := WithAudit(func(op BlockOperation, offset int64) {
+		assert.Cond(t, len(op.Data) <= 3*DefaultBlockSize, "literal of %d bytes exceeds the limit", len(op.Data))
+	})
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), ops, WithMemoryLimit(limit), audit))
+	assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+
+	// Buffers are checked upfront.
+	_, err = Signatures(ctx, bytes.NewReader(cache), nil, WithMemoryLimit(DefaultBlockSize))
+	assert.Equals(t, ErrMemoryLimit, err)
+	_, err = Sync(ctx, bytes.NewReader(source), nil, cacheSigs, WithMemoryLimit(DefaultBlockSize))
+	assert.Equals(t, ErrMemoryLimit, err)
+	_, err = Sync(ctx, bytes.NewReader(source), nil, cacheSigs, WithMemoryLimit(limit), WithDedup(int(limit)))
+	assert.Equals(t, ErrMemoryLimit, err)
+	err = Apply(ctx, new(bytes.Buffer), nil, nil, WithMemoryLimit(limit), WithPrefetch(4, 64))
+	assert.Equals(t, ErrMemoryLimit, err)
+}
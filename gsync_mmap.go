@@ -0,0 +1,116 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"hash"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// SignaturesMmap is SignaturesAt for the local file at path, which is memory mapped, so that blocks
+// are paged in by the OS as they are hashed instead of being read with a syscall each. On platforms
+// without mmap, or if mapping fails, the file is read with ReadAt instead. The file is unmapped and
+// closed once all signatures are sent or the context is cancelled, and the same restrictions as
+// SignaturesAt apply.
+func SignaturesMmap(ctx context.Context, path string, newHash func() hash.Hash, opts ...Option) (<-chan BlockSignature, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed opening %s", path)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed reading %s", path)
+	}
+
+	r := &mmapReaderAt{f: f}
+	if info.Size() > 0 {
+		r.data, r.unmap, err = mmap(f, info.Size())
+		if err != nil {
+			r.data, r.unmap = nil, nil
+		}
+	}
+
+	sigs, err := SignaturesAt(ctx, r, info.Size(), newHash, opts...)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	c := make(chan BlockSignature, cap(sigs))
+	go func() {
+		defer close(c)
+		// Workers may still be reading when the context is cancelled, Close waits for them.
+		defer r.Close()
+
+		for sig := range sigs {
+			select {
+			case c <- sig:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return c, nil
+}
+
+// mmapReaderAt reads a file from its memory mapping, if any, or with ReadAt otherwise. Closing it
+// waits for reads in progress, so the mapping is never accessed once unmapped.
+type mmapReaderAt struct {
+	mu     sync.RWMutex
+	f      *os.File
+	data   []byte
+	unmap  func() error
+	closed bool
+}
+
+func (m *mmapReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return 0, os.ErrClosed
+	}
+
+	if m.data == nil {
+		return m.f.ReadAt(p, off)
+	}
+
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close unmaps and closes the file.
+func (m *mmapReaderAt) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+
+	if m.unmap != nil {
+		if err := m.unmap(); err != nil {
+			m.f.Close()
+			return err
+		}
+	}
+	return m.f.Close()
+}
@@ -0,0 +1,19 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package gsync
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// mmap is not supported on this platform, so files are read with ReadAt instead.
+func mmap(f *os.File, size int64) ([]byte, func() error, error) {
+	return nil, nil, errors.New("gsync: mmap not supported")
+}
@@ -0,0 +1,59 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+func TestSignaturesMmap(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "gsync")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	collect := func(c <-chan BlockSignature, err error) []BlockSignature {
+		assert.Ok(t, err)
+		var sigs []BlockSignature
+		for sig := range c {
+			assert.Ok(t, sig.Error)
+			sigs = append(sigs, sig)
+		}
+		return sigs
+	}
+
+	for _, size := range []int{0, 100, 100*DefaultBlockSize + 17} {
+		data := srand(620, size)
+		name := filepath.Join(dir, "file")
+		assert.Ok(t, ioutil.WriteFile(name, data, 0644))
+
+		exp := collect(Signatures(ctx, bytes.NewReader(data), nil))
+		got := collect(SignaturesMmap(ctx, name, nil))
+		assert.Equals(t, exp, got)
+	}
+
+	// Abandoning the signatures midway unmaps the file once the workers are done.
+	abandoned, stop := context.WithCancel(ctx)
+	c, err := SignaturesMmap(abandoned, filepath.Join(dir, "file"), nil)
+	assert.Ok(t, err)
+	<-c
+	stop()
+	for range c {
+	}
+
+	_, err = SignaturesMmap(ctx, filepath.Join(dir, "missing"), nil)
+	assert.Cond(t, os.IsNotExist(errors.Cause(err)), "expected a missing file error, got %v", err)
+}
@@ -0,0 +1,783 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"compress/flate"
+	"context"
+	"hash"
+	"sync"
+	"time"
+)
+
+// Option configures optional behavior of Signatures and Sync. The zero set of
+// options reproduces the default rsync behavior.
+type Option func(*options)
+
+type options struct {
+	// size is the block size, see WithBlockSize.
+	size int
+	// hash returns the strong hash used when none is given, see WithHash.
+	hash func() hash.Hash
+	// compress makes Encoder compress literal data at the given level, see WithCompression.
+	compress bool
+	level    int
+	// weak is the function used to calculate weak block checksums.
+	weak WeakHash
+	// aligned disables the byte-by-byte rolling search in Sync and only compares
+	// source blocks starting at multiples of the block size.
+	aligned bool
+	// prefetchWorkers is the number of concurrent cache reads issued by Apply.
+	prefetchWorkers int
+	// prefetchWindow is the maximum number of operations Apply reads ahead.
+	prefetchWindow int
+	// maxDelta is the amount of literal data Sync accumulates before flushing it.
+	maxDelta int
+	// stats collects matching counters during Sync.
+	stats *Stats
+	// digest makes Signer calculate the digest of the whole file.
+	digest bool
+	// baseDigest is the digest of the base file announced by Sync.
+	baseDigest []byte
+	// compare decides whether a source block matches a remote candidate.
+	compare Comparator
+	// coarse is the number of blocks covered by coarse signatures.
+	coarse uint64
+	// requireDone makes Apply and LookUpTable fail if the stream ends without a Done operation
+	// or signature.
+	requireDone bool
+	// appendSize and appendDigest describe the base file for the append-only fast path.
+	appendSize   int64
+	appendDigest []byte
+	// identical is the digest of the base file for the identical source fast path.
+	identical []byte
+	// budgetBytes and budgetTime bound the literal data sent and the time taken by Sync.
+	budgetBytes int64
+	budgetTime  time.Duration
+	// ranged limits signatures, syncs and reconstructions to the range [rangeStart, rangeEnd).
+	ranged               bool
+	rangeStart, rangeEnd int64
+	// channelBuffer is the capacity of the channels returned by Sync and Signatures.
+	channelBuffer int
+	// frameChecksums makes Encoder and Decoder checksum every encoded operation.
+	frameChecksums bool
+	// wireOffsets makes Encoder send operation offsets.
+	wireOffsets bool
+	// audit is called by Apply after every operation applied.
+	audit func(op BlockOperation, offset int64)
+	// copyHashes makes Sync set the strong checksum of copied blocks on copy operations.
+	copyHashes bool
+	// store resolves copy operations carrying a strong checksum in Apply.
+	store BlockStore
+	// memLimit is the memory a single call may use, see WithMemoryLimit.
+	memLimit int64
+	// layout splits files at the boundaries set by WithBoundaries, if any.
+	layout     *blockLayout
+	boundaries []int64
+	// fsync is the amount of data Apply writes between fsyncs, see WithFsync.
+	fsync int64
+	// atomic makes ApplyFile write to a temporary file, see WithAtomicRename.
+	atomic bool
+	// forwardCopies restricts copies to blocks past the last one copied, see WithForwardCopies.
+	forwardCopies bool
+	// maxBucket is the number of signatures kept per weak checksum, see WithMaxBucket.
+	maxBucket int
+	// eofPolicy is how io.ErrUnexpectedEOF is handled, see WithEOFPolicy.
+	eofPolicy EOFPolicy
+	// skipErrors makes Apply skip error operations instead of failing, see WithSkipErrors.
+	skipErrors bool
+	// backWindow is how far back operations can reference reconstructed data, see WithBackRefs.
+	backWindow int
+	// index is queried by Sync instead of the remote lookup table, see WithSignatureIndex.
+	index SignatureIndex
+	// stride is the distance between the windows signed, see WithStride. Zero means blocks do not
+	// overlap.
+	stride int
+	// heartbeat is the interval between heartbeats sent by ServeOverConn and SendOverConn.
+	heartbeat time.Duration
+	// tracer starts spans for Signatures, Sync and Apply calls, see WithTracer.
+	tracer Tracer
+	// follow is the polling interval for data appended to the file being signed.
+	follow time.Duration
+	// limiter throttles literal data emitted by Sync.
+	limiter Limiter
+	// transform normalizes data before hashing.
+	transform Transform
+	// readAhead is the number of blocks read at a time by Sync and Signer.
+	readAhead int
+	// literalChecksums makes Sync attach a checksum to every literal.
+	literalChecksums bool
+	// minRun is the minimum number of consecutive blocks worth copying.
+	minRun uint64
+	// dedup is the maximum amount of literal data remembered for deduplication.
+	dedup int
+	// pool provides block sized buffers.
+	pool *sync.Pool
+	// pauser pauses Sync between operations.
+	pauser Pauser
+	// modulus is the modulus of the rolling checksum and explicitModulus is set when configured.
+	modulus         uint32
+	explicitModulus bool
+	// err holds an invalid option.
+	err error
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		size:    DefaultBlockSize,
+		compare: strongEqual,
+		modulus: mod,
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(o)
+		}
+	}
+
+	// Options depending on the block size are validated once it is known, whatever their order.
+	if o.ranged && o.rangeStart%int64(o.size) != 0 && o.err == nil {
+		o.err = ErrInvalidRange
+	}
+	if o.stride > 0 && o.size%o.stride != 0 && o.err == nil {
+		o.err = ErrInvalidStride
+	}
+	if o.stride >= o.size {
+		o.stride = 0
+	}
+	if o.boundaries != nil && o.err == nil {
+		o.layout, o.err = newBlockLayout(o.boundaries, o.size)
+	}
+
+	if o.layout != nil && o.ranged && o.err == nil {
+		o.err = ErrInvalidBoundaries
+	}
+	if o.stride > 0 && (o.layout != nil || o.ranged || o.coarse > 1 || o.follow > 0) && o.err == nil {
+		o.err = ErrInvalidStride
+	}
+	return o
+}
+
+// maxBlockSize is the largest block size accepted by WithBlockSize, which is the largest literal
+// Decoder accepts.
+const maxBlockSize = maxWireData
+
+// WithBlockSize sets the size of the blocks files are split into, DefaultBlockSize by default.
+// Larger blocks mean fewer signatures and less hashing, but data is matched at a coarser grain,
+// so that a single changed byte costs a whole block of literal data. Sizes must be positive and
+// up to 64 MiB, otherwise ErrInvalidBlockSize is returned.
+//
+// Signatures carry no block size, so every end must be given the same one: Signatures, Sync and
+// Apply, as well as Decoder, which rejects copies of blocks longer than the block size, and
+// anything built on them. Offsets set by WithRange and the stride set by WithStride must be
+// multiples and divisors of it, respectively.
+func WithBlockSize(size int) Option {
+	return func(o *options) {
+		if size <= 0 || size > maxBlockSize {
+			o.err = ErrInvalidBlockSize
+			return
+		}
+		o.size = size
+	}
+}
+
+// WithHash makes Signatures, Sync and the functions built on them use a strong hash returned by
+// newHash whenever they are given a nil one, instead of sha256 for Signatures and the hash of the
+// remote signatures for Sync. Every call gets a hash of its own, so newHash may be shared by
+// concurrent calls, as with SignaturesAt or NewPool. Hashes not known to this package must be
+// registered with RegisterHash for signatures to identify them, see HashID.
+func WithHash(newHash func() hash.Hash) Option {
+	return func(o *options) {
+		o.hash = newHash
+	}
+}
+
+// newHash returns the strong hash set by WithHash, or nil.
+func (o *options) newHash() hash.Hash {
+	if o.hash == nil {
+		return nil
+	}
+	return o.hash()
+}
+
+// WithCompression makes Encoder compress the data of literal operations with DEFLATE at the given
+// level, from flate.HuffmanOnly to flate.BestCompression, which Decoder inflates transparently.
+// Literals are compressed one by one, so that operations can still be decoded and applied as they
+// arrive, which suits the long runs of literal data of new or rewritten files best. Data that does
+// not compress, such as encrypted literals, only costs time. Encoders given an invalid level fail
+// with ErrInvalidCompression. Literals are not compressed by default.
+func WithCompression(level int) Option {
+	return func(o *options) {
+		if level < flate.HuffmanOnly || level > flate.BestCompression {
+			o.err = ErrInvalidCompression
+			return
+		}
+		o.compress, o.level = true, level
+	}
+}
+
+// WithWeakHash sets the weak checksum function used by Signatures and Sync. Both
+// ends must be configured with the same function. Weak hashes that cannot be
+// rolled, such as WeakCRC32C, require WithAligned when used with Sync.
+func WithWeakHash(w WeakHash) Option {
+	return func(o *options) {
+		o.weak = w
+	}
+}
+
+// WithAligned makes Sync compare only source blocks starting at multiples of the
+// block size instead of rolling the weak checksum one byte at a time. Data that moved
+// to an unaligned offset is sent as literals, but matching becomes considerably cheaper.
+// This mode suits files that are updated in place, such as disk images or databases.
+func WithAligned() Option {
+	return func(o *options) {
+		o.aligned = true
+	}
+}
+
+// WithPrefetch makes Apply read cached blocks ahead of time, using up to workers
+// concurrent ReadAt calls and looking ahead at most window operations. Blocks are
+// still written to the destination in order. It is meant for caches with high
+// latency per read, such as object stores, and requires the cache to support
+// concurrent ReadAt calls, as io.ReaderAt implementations are expected to.
+func WithPrefetch(workers, window int) Option {
+	return func(o *options) {
+		if window < workers {
+			window = workers
+		}
+		o.prefetchWorkers = workers
+		o.prefetchWindow = window
+	}
+}
+
+// WithStats makes Sync record matching counters into s. See Stats for details on
+// when it is safe to read them.
+func WithStats(s *Stats) Option {
+	return func(o *options) {
+		o.stats = s
+	}
+}
+
+// WithMaxDelta makes Sync flush literal data as soon as n bytes are pending, instead
+// of holding it until the next matching block or the end of the file. Smaller values
+// let the remote end start receiving data sooner, which suits near real-time mirroring,
+// at the cost of more operations. By default, literal data is only flushed on matches and EOF.
+func WithMaxDelta(n int) Option {
+	return func(o *options) {
+		o.maxDelta = n
+	}
+}
+
+// WithDigest makes Signer calculate the digest of the whole file along with the block
+// signatures, which saves reading the file a second time. See Signer.Digest.
+func WithDigest() Option {
+	return func(o *options) {
+		o.digest = true
+	}
+}
+
+// WithBaseDigest makes Sync start the operation stream announcing the digest of the base
+// file the remote signatures were calculated from, as returned by Digest or Signer.Digest.
+// Apply then reads the whole cache and verifies it matches before reconstructing anything,
+// failing with ErrBaseMismatch otherwise.
+func WithBaseDigest(d []byte) Option {
+	return func(o *options) {
+		o.baseDigest = d
+	}
+}
+
+// WithComparator makes Sync use c to decide whether a source block matches remote block
+// candidates sharing its weak checksum, instead of comparing strong checksums. See Comparator.
+func WithComparator(c Comparator) Option {
+	return func(o *options) {
+		if c != nil {
+			o.compare = c
+		}
+	}
+}
+
+// WithCoarseBlocks makes Signer and Signatures emit, besides the signature of every block, a
+// coarse signature for every k consecutive full blocks. Sync detects coarse signatures in the
+// lookup table and, whenever it is not rolling through changed data, first tries to match a
+// whole coarse window, fast-forwarding over unchanged regions k blocks at a time with a single
+// lookup, strong checksum and operation, a copy of a run of k blocks. Only after a coarse
+// window fails to match does it fall back to the regular block level matching, until k blocks
+// in a row match again. See BlockSignature.Count and BlockOperation.Count.
+//
+// This makes the block size adapt to the data: unchanged spans are skipped at k times the block
+// size, while the region around an edit is searched block by block, rolling byte by byte through
+// the changed data, so small edits only cost the blocks they touch. Coarse and fine matches are
+// sent alike, as copies of Count blocks starting at Index, so neither Apply nor the wire format
+// need to know whether coarse signatures were used.
+func WithCoarseBlocks(k uint64) Option {
+	return func(o *options) {
+		o.coarse = k
+	}
+}
+
+// WithRequireDone makes Apply fail with ErrTruncatedStream if the operations channel is closed
+// before a Done operation was received. Use it when operations come off a network decoder, so a
+// dropped connection is not mistaken for a successful sync. Operation streams not produced by
+// Sync must end with a Done operation themselves. Likewise, it makes LookUpTable fail if the
+// signatures channel is closed before a Done signature was received.
+func WithRequireDone() Option {
+	return func(o *options) {
+		o.requireDone = true
+	}
+}
+
+// WithAppendOnly enables a fast path in Sync for files that only grow at the end, such as logs.
+// Before any rolling, Sync verifies whether the first size bytes of the source have the given
+// digest, as calculated by Digest or Signer.Digest over the whole base file. If they do, a single
+// operation copying the whole base file is sent, followed by the rest of the source as literal
+// data, without rolling over the unchanged data at all. Otherwise, the regular matching takes
+// place, having read the prefix once for nothing.
+func WithAppendOnly(size int64, digest []byte) Option {
+	return func(o *options) {
+		o.appendSize = size
+		o.appendDigest = digest
+	}
+}
+
+// WithIdentical enables a fast path in Sync for sources that did not change at all. Before any
+// rolling, Sync compares the first and last blocks and the size of the source with the remote
+// signatures and, if they agree, verifies whether the whole source has the given digest, as
+// calculated by Digest or Signer.Digest over the base file. If it does, a single operation
+// copying the whole base file is sent and Sync is done. Otherwise, the regular matching takes
+// place, having possibly read the source once for nothing.
+func WithIdentical(digest []byte) Option {
+	return func(o *options) {
+		o.identical = digest
+	}
+}
+
+// WithBudget makes Sync give up with ErrBudgetExceeded once it sent more than bytes of literal
+// data, or took longer than d since it started, so callers can fall back to transferring the
+// whole file instead of waiting on a pathologically slow sync. A zero value disables the
+// respective limit. Unlike the cancellation of the context, the error is sent through the
+// operation channel, which is closed afterwards.
+func WithBudget(bytes int64, d time.Duration) Option {
+	return func(o *options) {
+		o.budgetBytes = bytes
+		o.budgetTime = d
+	}
+}
+
+// WithRange limits Signatures, Sync and Apply to the range [start, end) of the files, such as a
+// region of a large file known to be the only one modified. The range must start at a multiple of
+// the block size, or ErrInvalidRange is returned, so that indices and offsets keep referring to
+// the whole files: signatures are calculated for the blocks of the range only, starting at index
+// start divided by the block size, and operations carry the offsets of the data they describe
+// within the whole source. Block i of the cache is still found at offset i times the block size,
+// except that the last block of the range ends at end. The same range must be set on Signatures,
+// Sync and Apply.
+//
+// Apply reconstructs the range of the source, reading the cache within the range only. If dst is an
+// io.WriterAt, such as *os.File, the range is written at offset start, replacing the data of the
+// range in place when dst is the old file itself and the source range was not resized. Otherwise,
+// it is written sequentially. Not supported by SignaturesAt.
+func WithRange(start, end int64) Option {
+	return func(o *options) {
+		if start < 0 || end < start {
+			o.err = ErrInvalidRange
+			return
+		}
+		o.ranged, o.rangeStart, o.rangeEnd = true, start, end
+	}
+}
+
+// WithChannelBuffer sets the capacity of the channels returned by Sync, Signatures, SignaturesFS,
+// SignaturesAt and Compact, which are unbuffered by default. Buffering lets producers run ahead of
+// slow consumers, smoothing out bursts, at the cost of memory for the operations held. Negative
+// values mean unbuffered.
+func WithChannelBuffer(n int) Option {
+	return func(o *options) {
+		if n < 0 {
+			n = 0
+		}
+		o.channelBuffer = n
+	}
+}
+
+// WithFrameChecksums makes Encoder follow every operation with a CRC-32C of its encoding, which
+// Decoder and Decode verify, failing with ErrFrameCorrupt on mismatches. It catches corruption in
+// transit, such as by faulty proxies, at the cost of 4 bytes and a pass over every operation,
+// which is cheaper than WithLiteralChecksums but does not cover data at rest. Decoders learn about
+// it from the stream header. Given to them, it makes them reject streams without checksums.
+func WithFrameChecksums() Option {
+	return func(o *options) {
+		o.frameChecksums = true
+	}
+}
+
+// WithWireOffsets makes Encoder send the Offset of every operation, which Apply does not need
+// but ApplyAt and WithSkipErrors do, at the cost of a varint per operation. Decoders learn about
+// it from the stream header, so it only has to be given to encoders.
+func WithWireOffsets() Option {
+	return func(o *options) {
+		o.wireOffsets = true
+	}
+}
+
+// WithAudit makes Apply call audit after applying every operation, with the offset in the
+// destination where the data of the operation was written, i.e. to keep a record of which
+// ranges were copied from the cache and which were literal data. It is only called once the
+// data was successfully written, so the record reflects what the destination holds. Calls take
+// place on the goroutine running Apply and block it until they return.
+func WithAudit(audit func(op BlockOperation, offset int64)) Option {
+	return func(o *options) {
+		o.audit = audit
+	}
+}
+
+// WithCopyHashes makes Sync set the strong checksum of the block copied by every copy operation,
+// so Apply can resolve copies against a content-addressed BlockStore, see WithBlockStore. Every
+// copy operation then copies a single block: coarse matching and the fast paths set by
+// WithAppendOnly and WithIdentical, which copy runs of blocks, are disabled.
+func WithCopyHashes() Option {
+	return func(o *options) {
+		o.copyHashes = true
+	}
+}
+
+// WithBlockStore makes Apply look up the blocks of copy operations carrying a strong checksum in
+// store, instead of reading them from the cache by index. Copy operations without one are still
+// read from the cache. See WithCopyHashes.
+func WithBlockStore(store BlockStore) Option {
+	return func(o *options) {
+		o.store = store
+	}
+}
+
+// WithMemoryLimit caps the memory used by a single call, failing with ErrMemoryLimit if it would
+// be exceeded. Limits are not enforced by default, or if n is not positive. The memory accounted for
+// is approximate and only covers the structures growing with the file size or the configuration:
+//
+//   - Signatures: the block and read ahead buffers and the coarse group, see WithReadAhead and
+//     WithCoarseBlocks, which are checked upfront.
+//   - LookUpTable: the table itself, as approximated by TableMemory, checked as it grows.
+//   - Sync: the block buffer, the read ahead and coarse windows, the copies held back by WithMinRun
+//     and the dedup dictionary, see WithDedup, which are checked upfront. Literal data is flushed
+//     early, as with WithMaxDelta, so it fits in the memory left. The lookup table is accounted
+//     for by LookUpTable, not by Sync.
+//   - Apply: the block buffer, or one per operation read ahead WithPrefetch, and the dedup
+//     dictionary, which are checked upfront.
+//
+// Operations in flight, such as those buffered by WithChannelBuffer, are not accounted for.
+func WithMemoryLimit(n int64) Option {
+	return func(o *options) {
+		if n < 0 {
+			n = 0
+		}
+		o.memLimit = n
+	}
+}
+
+// WithBoundaries splits files into blocks at the given offsets, such as those of the records of a
+// container format, rather than only every block size bytes, so blocks line up with the
+// structure of the file. Records longer than a block are still split into blocks, starting over at
+// every boundary. Offsets must be increasing and positive, otherwise ErrInvalidBoundaries is
+// returned. Also, it can not be combined with WithRange.
+//
+// Each end splits its own file: Signatures and Apply take the boundaries of the cache and Sync
+// those of the source. Sync then only matches whole source blocks against cache blocks of the
+// same length and content, as in aligned mode: there is no rolling, since records that moved are
+// found at their boundaries. Coarse matching and the fast paths set by WithIdentical and
+// WithAppendOnly, which assume fixed size blocks, are disabled. Operations can only be applied by
+// Apply given the same boundaries as Signatures.
+func WithBoundaries(offsets []int64) Option {
+	return func(o *options) {
+		o.boundaries = append([]int64{}, offsets...)
+	}
+}
+
+// WithFsync makes Apply flush the destination to stable storage every time it writes the given
+// amount of data, and once done, if the destination has a Sync method, as *os.File does. It bounds
+// the data lost on a crash, at the expense of throughput. Destinations are not flushed by default,
+// or if every is not positive.
+func WithFsync(every int64) Option {
+	return func(o *options) {
+		o.fsync = every
+	}
+}
+
+// WithAtomicRename makes ApplyFile write to a temporary file, renamed over the destination once
+// complete, so the destination never holds partially written data.
+func WithAtomicRename() Option {
+	return func(o *options) {
+		o.atomic = true
+	}
+}
+
+// WithForwardCopies makes Sync only copy blocks at or after the first block of the previous copy,
+// sending any other matching data as literals, so Apply can read the cache as a forward-only
+// stream. See ApplyStream.
+func WithForwardCopies() Option {
+	return func(o *options) {
+		o.forwardCopies = true
+	}
+}
+
+// WithMaxBucket makes LookUpTable keep up to n signatures per weak checksum, those of the first
+// blocks signed, dropping the rest. Sync compares the strong checksum of every block whose weak
+// checksum matches against each signature in its bucket, so files with many blocks sharing weak
+// checksums, i.e. crafted ones, make syncs slow. Capping buckets bounds that cost, at the expense
+// of missing matches with the dropped blocks and therefore sending larger deltas. Buckets are not
+// capped by default, or if n is not positive. See AnalyzeWeakHash to find out bucket sizes.
+func WithMaxBucket(n int) Option {
+	return func(o *options) {
+		o.maxBucket = n
+	}
+}
+
+// WithEOFPolicy sets how Signatures, SignaturesAt, Sync and their Signer and Syncer handle readers
+// failing with io.ErrUnexpectedEOF. It is EOFStrict by default, failing as with any other error.
+func WithEOFPolicy(p EOFPolicy) Option {
+	return func(o *options) {
+		o.eofPolicy = p
+	}
+}
+
+// WithSkipErrors makes Apply and ApplyAt skip error operations instead of failing on the first one,
+// for transports that retransmit the blocks they failed to send. Nothing is written for skipped
+// operations, so Apply resumes writing at the Offset of the operation following them, which
+// requires the destination to be an io.WriterAt. Once all other operations are applied, Apply
+// fails with a *SkippedError listing the skipped operations, whose blocks are to be retried, i.e.
+// with ApplyAt. By default, Apply fails fast.
+//
+// Offsets are set by Sync and only survive the wire format if encoded WithWireOffsets. Without
+// them, Apply can not tell where to resume, and fails with ErrMissingOffset on the operation
+// following a skipped one. That is not detected if the skipped operation is the first one, whose
+// offset is legitimately zero, in which case the operations following it are written too early.
+func WithSkipErrors() Option {
+	return func(o *options) {
+		o.skipErrors = true
+	}
+}
+
+// WithBackRefs makes Sync reference blocks of the source it already processed, up to window bytes
+// back, when no block of the cache matches, so that repeated content is sent once, even without a
+// cache. Such operations carry Back, the distance from the block referenced, which is always at
+// least the block size. Apply must be given the same option to remember the last window bytes it
+// reconstructed, which are the only ones it can resolve back references from.
+//
+// Only blocks at offsets multiple of the block size are referenced, and compared byte by byte
+// before being so. Not supported WithBoundaries or by ApplyAt. Windows smaller than the block size
+// disable back references.
+func WithBackRefs(window int) Option {
+	return func(o *options) {
+		o.backWindow = window
+	}
+}
+
+// WithSignatureIndex makes Sync, and anything built on Syncer, look remote signatures up in idx,
+// such as a DiskIndex opened with OpenSignatureIndex, rather than in the remote lookup table, which
+// is then ignored and can be nil. Every weak checksum rolled through is looked up, so idx must
+// answer lookups of absent checksums fast, without any I/O. Whole file comparisons, which take
+// the complete remote signature set, are not done.
+func WithSignatureIndex(idx SignatureIndex) Option {
+	return func(o *options) {
+		o.index = idx
+	}
+}
+
+// WithStride makes Signatures sign overlapping windows of a block starting every stride bytes,
+// rather than consecutive blocks, so that Sync finds data that moved by less than a block at more
+// positions: with rolling, data shifted from its block boundaries is still matched, but only as a
+// whole block, and runs of data shorter than two blocks may be sent as literals otherwise. It
+// costs the block size divided by stride times as many signatures, and as much hashing. The stride
+// must divide the block size, and equal to it means no overlap, as without the option. Otherwise,
+// or if combined with WithBoundaries, WithRange, WithCoarseBlocks or WithFollow, ErrInvalidStride
+// is returned.
+//
+// Signature indices then count windows, the window at index i starting at offset i*stride, and
+// the last windows are those starting before the end of the file, shorter than the rest. Sync must
+// be given the option as well, which disables the fast paths set by WithIdentical and
+// WithAppendOnly, and matching of the last block of the cache right after the one preceding it,
+// all of which assume blocks do not overlap. Copy operations refer to windows, a copy of Count
+// blocks writing that many consecutive windows in full, so Apply must be given the same stride as
+// Signatures. Read failures end the signatures.
+func WithStride(stride int) Option {
+	return func(o *options) {
+		if stride <= 0 {
+			o.err = ErrInvalidStride
+			return
+		}
+		o.stride = stride
+	}
+}
+
+// WithHeartbeat makes ServeOverConn and SendOverConn send a heartbeat frame every interval, so the
+// other end knows the connection is alive while there is nothing else to send, such as while Sync
+// reads a large unchanged region or Apply writes it. Both ends then consider the connection dead
+// and fail with ErrConnTimeout once no frame is read for heartbeatMisses intervals, and no write
+// completes within as long. Both ends must be configured with it, and with similar intervals. Zero
+// or negative intervals disable heartbeats and timeouts.
+func WithHeartbeat(interval time.Duration) Option {
+	return func(o *options) {
+		if interval < 0 {
+			interval = 0
+		}
+		o.heartbeat = interval
+	}
+}
+
+// WithTracer makes Signatures, Sync and Apply trace every call with a span started by t, named
+// gsync.Signatures, gsync.Sync and gsync.Apply, respectively. Spans end once the call is done,
+// that is, once its channel is closed, and carry the amount of data processed, the time spent
+// reading, hashing, matching and writing, as relevant, and for Sync, the ratio of data matched.
+// Phases are only timed when a Tracer is set.
+func WithTracer(t Tracer) Option {
+	return func(o *options) {
+		o.tracer = t
+	}
+}
+
+// WithFollow makes Signatures and SignaturesFS keep reading once they reach the end of the file,
+// like tail -f, checking every interval for appended data and sending the signatures of new blocks
+// as soon as they are complete, until the context is done. Only whole blocks are signed: a trailing
+// block shorter than the block size may still be written to, so it is held back until it fills
+// up. Hence, the signatures lag up to a block behind the writer, and the stream never ends with a
+// Done signature, since it is only closed when the context is done. Files must only be appended
+// to while followed. Not supported by SignaturesAt.
+func WithFollow(interval time.Duration) Option {
+	return func(o *options) {
+		o.follow = interval
+	}
+}
+
+// Limiter throttles throughput. *rate.Limiter from golang.org/x/time/rate satisfies it.
+type Limiter interface {
+	// WaitN blocks until n bytes are allowed to go through or the context is done.
+	WaitN(ctx context.Context, n int) error
+}
+
+// WithLimiter makes Sync throttle the emission of literal data with l, so background syncs do
+// not saturate shared links. Copy operations do not count against the limit. Since literals are
+// up to a block long, or the size set by WithMaxDelta if smaller, limiters with
+// a maximum burst, such as *rate.Limiter, must allow bursts of at least that size.
+func WithLimiter(l Limiter) Option {
+	return func(o *options) {
+		o.limiter = l
+	}
+}
+
+// WithTransform normalizes data with t before it is hashed or matched, so that files differing
+// only in their representation, such as line endings, produce tiny deltas. It must be set on
+// Signatures, Sync and Apply alike. Apply reads the cache in normalized form and converts the
+// reconstructed data back to native form before writing it. See Transform.
+func WithTransform(t Transform) Option {
+	return func(o *options) {
+		o.transform = t
+	}
+}
+
+// WithReadAhead sets the size of the window of source data Sync reads ahead, in blocks. It
+// defaults to DefaultReadAhead. Sync rolls through the window without reading the source again,
+// and once it runs out of data, moves the pending tail of the window, up to a block, to its front
+// and reads the source after it. Larger windows mean fewer ReadAt calls and refills, at the cost
+// of memory. Refills can be observed through Stats.
+//
+// Signer and Signatures read the file the same number of blocks at a time, decoupling the size of
+// reads from the block size, which saves syscalls when reading files directly. Set it to one to
+// read a single block at a time, i.e. when the reader is already buffered.
+func WithReadAhead(blocks int) Option {
+	return func(o *options) {
+		o.readAhead = blocks
+	}
+}
+
+// WithLiteralChecksums makes Sync attach to every literal operation a checksum of its data, made
+// of its CRC-32C followed by its SHA-256. Apply verifies it before writing the data, failing with
+// ErrCorruptLiteral if it does not match, which pinpoints the literal damaged in transit so it
+// can be sent again. Checksums add 36 bytes and a pass over the data for every literal.
+func WithLiteralChecksums() Option {
+	return func(o *options) {
+		o.literalChecksums = true
+	}
+}
+
+// WithWeakModulus sets the modulus of the rolling checksum, 1<<16 by default, to trade weak checksum
+// collisions for smaller checksums. It must be a power of two, so modulo operations are cheap, between
+// 2 and 1<<16, or Signatures, Signer and Sync fail with ErrInvalidModulus. The modulus is recorded in
+// signatures and Sync uses the one found in the remote signatures, so it only needs to be set on
+// Signatures. If set on Sync as well, both must be the same.
+func WithWeakModulus(m uint32) Option {
+	return func(o *options) {
+		if m < 2 || m > mod || m&(m-1) != 0 {
+			o.err = ErrInvalidModulus
+			return
+		}
+		o.modulus = m
+		o.explicitModulus = true
+	}
+}
+
+// WithPauser makes Sync wait on p before producing every operation, so a running sync can be
+// paused and resumed, i.e. with a Gate, without losing any progress. While paused, no data is
+// read and no operations are sent, but the goroutine started by Sync stays around, until resumed
+// or the context is done.
+func WithPauser(p Pauser) Option {
+	return func(o *options) {
+		o.pauser = p
+	}
+}
+
+// WithDedup makes Sync send literals repeating an earlier literal of the stream as a reference to
+// it, which Apply expands, saving traffic for files with internal repetition, even when there is
+// no cache. Both ends remember up to size bytes of the most recently used literals, so WithDedup
+// must be set on Sync and Apply alike, with the same size. Deduplicated streams must not be
+// passed through Compact, since merging literals changes the identifiers references refer to.
+func WithDedup(size int) Option {
+	return func(o *options) {
+		o.dedup = size
+	}
+}
+
+// WithMinRun makes Sync send runs of fewer than n consecutive matching blocks as literal data
+// instead of copies. On heavily edited files, isolated matches interleaved with literals make for
+// a fragmented operation stream, with many small random cache reads, which can be slower to apply
+// than reading a bit more literal data. Matching blocks are held back until the run is long enough,
+// so the delay of operations grows with n.
+func WithMinRun(n uint64) Option {
+	return func(o *options) {
+		o.minRun = n
+	}
+}
+
+// WithBufferPool makes Signatures and Apply take their block sized buffers from p, instead of the
+// pool shared by the whole package, so callers can keep buffers apart. p.New, if set, must return
+// *[]byte values, and buffers with less capacity than the block size are discarded, so pools should
+// not be shared by calls with different block sizes.
+func WithBufferPool(p *sync.Pool) Option {
+	return func(o *options) {
+		o.pool = p
+	}
+}
+
+// getBuffer takes a block sized buffer from the configured buffer pool.
+func (o *options) getBuffer() *[]byte {
+	pool := o.pool
+	if pool == nil {
+		pool = &bufferPool
+	}
+
+	bfp, _ := pool.Get().(*[]byte)
+	if bfp == nil || cap(*bfp) < o.size {
+		b := make([]byte, o.size)
+		return &b
+	}
+
+	*bfp = (*bfp)[:o.size]
+	return bfp
+}
+
+// putBuffer returns a buffer to the configured buffer pool.
+func (o *options) putBuffer(bfp *[]byte) {
+	if o.pool == nil {
+		bufferPool.Put(bfp)
+		return
+	}
+	o.pool.Put(bfp)
+}
@@ -0,0 +1,145 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"hash"
+	"io"
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+// chunkBlocks is the number of blocks signed by each job of SignaturesAt.
+const chunkBlocks = 16
+
+// signJob is a chunk of the file being signed by SignaturesAt.
+type signJob struct {
+	sigs []BlockSignature
+	done chan struct{}
+}
+
+// SignaturesAt is Signatures for random access sources of the given size, such as local files.
+// Chunks of the file are read and hashed fully in parallel, by as many workers as GOMAXPROCS,
+// each with its own strong hash returned by newHash, or if nil by the factory set WithHash, or
+// sha256. Signatures are still sent ordered by index, just as Signatures would. WithDigest,
+// WithTransform, WithFollow and WithRange are not supported, since they require reading the file
+// sequentially.
+func SignaturesAt(ctx context.Context, r io.ReaderAt, size int64, newHash func() hash.Hash, opts ...Option) (<-chan BlockSignature, error) {
+	if r == nil {
+		return nil, ErrNilReader
+	}
+
+	cfg := newOptions(opts)
+	if cfg.err != nil {
+		return nil, cfg.err
+	}
+
+	if cfg.digest || cfg.transform != nil || cfg.follow > 0 || cfg.ranged || cfg.layout != nil || cfg.stride > 0 {
+		return nil, errors.New("gsync: SignaturesAt does not support WithDigest, WithTransform, WithFollow, WithRange, WithBoundaries or WithStride")
+	}
+
+	if newHash == nil {
+		newHash = func() hash.Hash { return nil }
+	}
+
+	// Chunks hold whole coarse groups, so coarse signatures are calculated as well.
+	chunk := uint64(chunkBlocks)
+	if k := cfg.coarse; k > 1 {
+		chunk = (chunk + k - 1) / k * k
+	}
+	chunkSize := int64(chunk) * int64(cfg.size)
+
+	workers := runtime.GOMAXPROCS(0)
+	queue := make(chan *signJob, workers)
+	sem := make(chan struct{}, workers)
+	signers := make(chan *Signer, workers)
+	for i := 0; i < workers; i++ {
+		signers <- NewSigner(newHash(), opts...)
+	}
+
+	stop := make(chan struct{})
+	c := make(chan BlockSignature, cfg.channelBuffer)
+
+	go func() {
+		defer close(queue)
+
+		for off := int64(0); off < size; off += chunkSize {
+			n := size - off
+			if n > chunkSize {
+				n = chunkSize
+			}
+
+			select {
+			case sem <- struct{}{}:
+			case <-stop:
+				return
+			}
+
+			job := &signJob{done: make(chan struct{})}
+			go func(off, n int64) {
+				defer close(job.done)
+				s := <-signers
+				defer func() {
+					signers <- s
+					<-sem
+				}()
+
+				s.Reset(io.NewSectionReader(r, off, n))
+				s.index = uint64(off / int64(cfg.size))
+				for {
+					sig, err := s.Next(ctx)
+					if err == io.EOF {
+						return
+					}
+
+					sig.Error = err
+					job.sigs = append(job.sigs, sig)
+					if err != nil && err == ctx.Err() {
+						return
+					}
+				}
+			}(off, n)
+
+			select {
+			case queue <- job:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(c)
+		defer close(stop)
+
+		var failed bool
+		for job := range queue {
+			<-job.done
+			for _, sig := range job.sigs {
+				select {
+				case c <- sig:
+				case <-ctx.Done():
+					return
+				}
+
+				failed = failed || sig.Error != nil
+				if sig.Error != nil && sig.Error == ctx.Err() {
+					return
+				}
+			}
+		}
+
+		if !failed {
+			select {
+			case c <- BlockSignature{Done: true}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return c, nil
+}
@@ -0,0 +1,53 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"hash"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestSignaturesAt(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, size := range []int{0, 100, 40 * DefaultBlockSize, 100*DefaultBlockSize + 17} {
+		data := srand(300, size)
+
+		collect := func(c <-chan BlockSignature, err error) []BlockSignature {
+			assert.Ok(t, err)
+			var sigs []BlockSignature
+			for sig := range c {
+				assert.Ok(t, sig.Error)
+				sigs = append(sigs, sig)
+			}
+			return sigs
+		}
+
+		exp := collect(Signatures(ctx, bytes.NewReader(data), md5.New(), WithCoarseBlocks(5)))
+		got := collect(SignaturesAt(ctx, bytes.NewReader(data), int64(size), func() hash.Hash { return md5.New() }, WithCoarseBlocks(5)))
+		assert.Equals(t, exp, got)
+	}
+}
+
+func TestSignaturesAtAbandoned(t *testing.T) {
+	n := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	data := srand(301, 200*DefaultBlockSize)
+	c, err := SignaturesAt(ctx, bytes.NewReader(data), int64(len(data)), nil)
+	assert.Ok(t, err)
+	<-c
+	cancel()
+
+	waitGoroutines(t, n)
+}
@@ -0,0 +1,68 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ApplyParts is Apply handing the reconstructed file over in parts of partSize bytes, in order,
+// instead of writing it to an io.Writer, i.e. to upload it straight to an object store through
+// a multipart upload, without a local temporary file. Parts are numbered from one and all of them
+// are partSize bytes long, except for the last one, which holds the remaining data, if any. The
+// data of a part is only valid during the call to upload. Failures to upload a part are reported
+// as ErrApplyWrite, like failures to write to the destination of Apply.
+func ApplyParts(ctx context.Context, partSize int, upload func(part int, data []byte) error, cache io.ReaderAt, ops <-chan BlockOperation, opts ...Option) error {
+	if partSize <= 0 {
+		return errors.New("gsync: part size must be positive")
+	}
+
+	w := &partWriter{buf: make([]byte, 0, partSize), upload: upload}
+	if err := Apply(ctx, w, cache, ops, opts...); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+// partWriter buffers written data into parts, uploading every part once complete.
+type partWriter struct {
+	buf    []byte
+	part   int
+	upload func(part int, data []byte) error
+}
+
+func (w *partWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+		n += m
+	}
+	return n, nil
+}
+
+// flush uploads the buffered data as the next part, if there is any.
+func (w *partWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	w.part++
+	if err := w.upload(w.part, w.buf); err != nil {
+		return errors.Wrapf(err, "failed uploading part %d", w.part)
+	}
+	w.buf = w.buf[:0]
+	return nil
+}
@@ -0,0 +1,53 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestApplyParts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(420, 50*DefaultBlockSize+10)
+	source := append(srand(421, 1000), cache...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	for _, size := range []int{1000, 5 * 1024 * 1024, len(source)} {
+		opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs)
+		assert.Ok(t, err)
+
+		var parts [][]byte
+		upload := func(part int, data []byte) error {
+			assert.Equals(t, len(parts)+1, part)
+			parts = append(parts, append([]byte(nil), data...))
+			return nil
+		}
+		assert.Ok(t, ApplyParts(ctx, size, upload, bytes.NewReader(cache), opsCh))
+
+		for i, part := range parts[:len(parts)-1] {
+			assert.Cond(t, len(part) == size, "part %d is %d bytes long, expected %d", i+1, len(part), size)
+		}
+		assert.Cond(t, bytes.Equal(source, bytes.Join(parts, nil)), "source and uploaded parts are different")
+	}
+
+	failure := errors.New("failed")
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs)
+	assert.Ok(t, err)
+	err = ApplyParts(ctx, 1000, func(int, []byte) error { return failure }, bytes.NewReader(cache), opsCh)
+	assert.Cond(t, errors.Is(err, ErrApplyWrite), "expected ErrApplyWrite, got %v", err)
+	Drain(opsCh)
+}
@@ -0,0 +1,258 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Patch files start with a header describing what the patch applies to:
+//
+//	magic:      "GPAT"
+//	version:    1 byte, patchVersion
+//	hash:       1 byte, the HashID of the strong hash used to calculate the patch
+//	block size: 4 bytes, the block size used to calculate the patch
+//	digest:     1 byte with its length followed by the SHA-256 digest of the base file
+//	crc:        4 bytes, the CRC-32C of the header up to this field
+//
+// followed by the operations, in the wire format written by Encoder with frame checksums, ending
+// with a Done operation. Integers are big-endian.
+const (
+	patchMagic   = "GPAT"
+	patchVersion = 1
+)
+
+// PatchHeader describes the base file a patch applies to and how the patch was calculated.
+type PatchHeader struct {
+	// Hash identifies the strong hash algorithm the operations were calculated with.
+	Hash HashID
+	// BlockSize is the size of the blocks referenced by the operations, as set on Sync by
+	// WithBlockSize. Zero means DefaultBlockSize.
+	BlockSize int
+	// BaseDigest is the SHA-256 digest of the base file, see Digest.
+	BaseDigest []byte
+}
+
+// PatchWriter writes a patch file, a self-contained delta that can be distributed and applied with
+// ApplyPatchFile, similar to the delta files of rdiff.
+type PatchWriter struct {
+	enc  *Encoder
+	done bool
+}
+
+// NewPatchWriter writes the header of a patch file to w and returns a PatchWriter writing its
+// operations.
+func NewPatchWriter(w io.Writer, h PatchHeader) (*PatchWriter, error) {
+	if h.BlockSize == 0 {
+		h.BlockSize = DefaultBlockSize
+	}
+	if err := validPatch(h); err != nil {
+		return nil, err
+	}
+
+	b := append([]byte(patchMagic), patchVersion, byte(h.Hash), 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], uint32(h.BlockSize))
+	b = append(append(b, byte(len(h.BaseDigest))), h.BaseDigest...)
+	sum := crc32.Checksum(b, crc32cTable)
+	b = append(b, byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum))
+
+	if _, err := w.Write(b); err != nil {
+		return nil, errors.Wrapf(err, "failed writing patch header")
+	}
+	return &PatchWriter{enc: NewEncoder(w, WithFrameChecksums())}, nil
+}
+
+// Encode writes op to the patch. BaseDigest operations are left out, since the header carries the
+// digest, and error operations are returned instead of written, as a patch can not carry them.
+func (p *PatchWriter) Encode(op BlockOperation) error {
+	switch {
+	case op.Error != nil:
+		return op.Error
+	case op.BaseDigest != nil:
+		return nil
+	case p.done:
+		return errors.Wrapf(ErrMalformedPatch, "operation after completion")
+	}
+
+	p.done = op.Done
+	return p.enc.Encode(op)
+}
+
+// Close completes the patch with a Done operation, if not written yet. It does not close the
+// underlying writer.
+func (p *PatchWriter) Close() error {
+	if p.done {
+		return nil
+	}
+	return p.Encode(BlockOperation{Done: true})
+}
+
+// WritePatch writes a patch file to w with the operations read from ops, as returned by Sync, and
+// completes it once the channel is closed. Sync must have been given the strong hash identified by
+// h.Hash and the signatures of the base file whose digest is h.BaseDigest.
+func WritePatch(ctx context.Context, w io.Writer, h PatchHeader, ops <-chan BlockOperation) error {
+	p, err := NewPatchWriter(w, h)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case op, ok := <-ops:
+			if !ok {
+				return p.Close()
+			}
+			if err := p.Encode(op); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// PatchReader reads a patch file written by PatchWriter.
+type PatchReader struct {
+	// Header describes the patch.
+	Header PatchHeader
+	dec    *Decoder
+	// based is set once the digest of the base file was returned as an operation.
+	based bool
+}
+
+// NewPatchReader reads and validates the header of the patch file read from r. It returns
+// ErrMalformedPatch if r does not hold a valid patch file, ErrUnsupportedVersion if it was written
+// with a newer version of the format, and ErrUnsupportedHash if its strong hash is not known.
+func NewPatchReader(r io.Reader) (*PatchReader, error) {
+	br := bufio.NewReader(r)
+
+	var b [len(patchMagic) + 7]byte
+	if _, err := io.ReadFull(br, b[:]); err != nil {
+		return nil, errors.Wrapf(ErrMalformedPatch, "failed reading header: %v", err)
+	}
+	if string(b[:len(patchMagic)]) != patchMagic {
+		return nil, errors.Wrapf(ErrMalformedPatch, "missing patch header")
+	}
+
+	if version := b[len(patchMagic)]; version == 0 || version > patchVersion {
+		return nil, errors.Wrapf(ErrUnsupportedVersion, "patch version %d", version)
+	}
+
+	header := append([]byte(nil), b[:]...)
+	digest := make([]byte, b[len(b)-1])
+	sum := make([]byte, 4)
+	if _, err := io.ReadFull(br, digest); err != nil {
+		return nil, errors.Wrapf(ErrMalformedPatch, "failed reading header: %v", err)
+	}
+	if _, err := io.ReadFull(br, sum); err != nil {
+		return nil, errors.Wrapf(ErrMalformedPatch, "failed reading header: %v", err)
+	}
+	if binary.BigEndian.Uint32(sum) != crc32.Checksum(append(header, digest...), crc32cTable) {
+		return nil, errors.Wrapf(ErrMalformedPatch, "header does not match its checksum")
+	}
+
+	h := PatchHeader{
+		Hash:       HashID(b[len(patchMagic)+1]),
+		BlockSize:  int(binary.BigEndian.Uint32(b[len(patchMagic)+2:])),
+		BaseDigest: digest,
+	}
+	if err := validPatch(h); err != nil {
+		return nil, err
+	}
+
+	return &PatchReader{Header: h, dec: NewDecoder(br, WithFrameChecksums(), WithBlockSize(h.BlockSize))}, nil
+}
+
+// validPatch checks that a patch with header h can be applied.
+func validPatch(h PatchHeader) error {
+	if _, err := NewHash(h.Hash); err != nil {
+		return err
+	}
+	if h.BlockSize <= 0 || h.BlockSize > maxBlockSize {
+		return errors.Wrapf(ErrMalformedPatch, "unsupported block size %d", h.BlockSize)
+	}
+	if len(h.BaseDigest) != sha256.Size {
+		return errors.Wrapf(ErrMalformedPatch, "base digest must be a SHA-256 digest")
+	}
+	return nil
+}
+
+// Decode reads the next operation of the patch. The first one carries the digest of the base file
+// from the header, so Apply verifies it was given the right base before writing anything. It
+// returns the errors of Decoder.Decode, and io.EOF once the patch ends.
+func (p *PatchReader) Decode() (BlockOperation, error) {
+	if !p.based {
+		p.based = true
+		return BlockOperation{BaseDigest: p.Header.BaseDigest}, nil
+	}
+	return p.dec.Decode()
+}
+
+// ApplyPatchFile reconstructs the file at dst by applying the patch file at patch to the base file
+// at base. Everything is validated: the patch header, that base is the file the patch was
+// calculated against, the checksum of every operation and that the patch is complete. The file at
+// dst is replaced atomically, as with WithAtomicRename, so it is left untouched if validation
+// fails. dst and base may be the same path, in which case the file is patched in place as with
+// ApplyInPlace. The block size is taken from the patch header, other options are passed on to
+// Apply.
+func ApplyPatchFile(ctx context.Context, dst, base, patch string, opts ...Option) error {
+	pf, err := os.Open(patch)
+	if err != nil {
+		return errors.Wrapf(err, "failed opening %s", patch)
+	}
+	defer pf.Close()
+
+	p, err := NewPatchReader(pf)
+	if err != nil {
+		return err
+	}
+
+	bf, err := os.Open(base)
+	if err != nil {
+		return errors.Wrapf(err, "failed opening %s", base)
+	}
+	defer bf.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ops := make(chan BlockOperation)
+	go func() {
+		defer close(ops)
+		for {
+			op, err := p.Decode()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				op = BlockOperation{Error: err}
+			}
+
+			select {
+			case ops <- op:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	opts = append(opts, WithRequireDone(), WithBlockSize(p.Header.BlockSize))
+	if filepath.Clean(dst) == filepath.Clean(base) {
+		return ApplyInPlace(ctx, bf, ops, opts...)
+	}
+	return ApplyFile(ctx, dst, bf, ops, append(opts, WithAtomicRename())...)
+}
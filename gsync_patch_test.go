@@ -0,0 +1,125 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+func TestPatchFile(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "gsync")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	cache := srand(510, 20*DefaultBlockSize+300)
+	source := mutate(cache, 511, 6)
+	digest, err := Digest(bytes.NewReader(cache))
+	assert.Ok(t, err)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	ops, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, WithBaseDigest(digest))
+	assert.Ok(t, err)
+	buf := new(bytes.Buffer)
+	assert.Ok(t, WritePatch(ctx, buf, PatchHeader{Hash: HashSHA256, BaseDigest: digest}, ops))
+	patch := buf.Bytes()
+
+	p, err := NewPatchReader(bytes.NewReader(patch))
+	assert.Ok(t, err)
+	assert.Equals(t, PatchHeader{Hash: HashSHA256, BlockSize: DefaultBlockSize, BaseDigest: digest}, p.Header)
+
+	base := filepath.Join(dir, "base")
+	assert.Ok(t, ioutil.WriteFile(base, cache, 0600))
+	patchName := filepath.Join(dir, "patch")
+	assert.Ok(t, ioutil.WriteFile(patchName, patch, 0600))
+
+	dst := filepath.Join(dir, "dst")
+	assert.Ok(t, ApplyPatchFile(ctx, dst, base, patchName))
+	data, err := ioutil.ReadFile(dst)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(source, data), "source and target files are different")
+
+	// Patches are rejected, leaving the destination untouched, when applied to the wrong base, or
+	// when corrupt or incomplete.
+	wrongBase := filepath.Join(dir, "wrong")
+	assert.Ok(t, ioutil.WriteFile(wrongBase, source, 0600))
+
+	corrupt := append([]byte(nil), patch...)
+	corrupt[len(corrupt)-20] ^= 0xff
+	header := append([]byte(nil), patch...)
+	header[5] = byte(HashMD5)
+
+	for _, tt := range []struct {
+		desc  string
+		base  string
+		patch []byte
+		err   error
+	}{
+		{"wrong base", wrongBase, patch, ErrBaseMismatch},
+		{"corrupt operation", base, corrupt, ErrFrameCorrupt},
+		{"truncated", base, patch[:len(patch)-5], ErrTruncatedStream},
+		{"corrupt header", base, header, ErrMalformedPatch},
+		{"not a patch", base, cache[:100], ErrMalformedPatch},
+	} {
+		assert.Ok(t, ioutil.WriteFile(patchName, tt.patch, 0600))
+		err := ApplyPatchFile(ctx, dst, tt.base, patchName)
+		assert.Cond(t, errors.Is(err, tt.err), "%s: unexpected error: %v", tt.desc, err)
+
+		data, err := ioutil.ReadFile(dst)
+		assert.Ok(t, err)
+		assert.Cond(t, bytes.Equal(source, data), "%s: destination modified", tt.desc)
+	}
+
+	// Patching the base file in place.
+	assert.Ok(t, ioutil.WriteFile(patchName, patch, 0600))
+	assert.Ok(t, ApplyPatchFile(ctx, base, base, patchName))
+	data, err = ioutil.ReadFile(base)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(source, data), "source and target files are different")
+}
+
+func TestPatchHeader(t *testing.T) {
+	digest := make([]byte, 32)
+	for _, tt := range []struct {
+		h   PatchHeader
+		err error
+	}{
+		{PatchHeader{Hash: HashSHA1, BaseDigest: digest}, nil},
+		{PatchHeader{Hash: HashID(200), BaseDigest: digest}, ErrUnsupportedHash},
+		{PatchHeader{Hash: HashSHA256, BlockSize: 1024, BaseDigest: digest}, nil},
+		{PatchHeader{Hash: HashSHA256, BlockSize: -1, BaseDigest: digest}, ErrMalformedPatch},
+		{PatchHeader{Hash: HashSHA256}, ErrMalformedPatch},
+	} {
+		_, err := NewPatchWriter(new(bytes.Buffer), tt.h)
+		assert.Cond(t, errors.Is(err, tt.err) || err == tt.err, "unexpected error: %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	p, err := NewPatchWriter(buf, PatchHeader{Hash: HashSHA256, BaseDigest: digest})
+	assert.Ok(t, err)
+	assert.Equals(t, errors.New("boom").Error(), p.Encode(BlockOperation{Error: errors.New("boom")}).Error())
+	assert.Ok(t, p.Close())
+	assert.Cond(t, errors.Is(p.Encode(BlockOperation{Index: 1}), ErrMalformedPatch), "operation accepted after completion")
+
+	patch := buf.Bytes()
+	patch[4] = patchVersion + 1
+	_, err = NewPatchReader(bytes.NewReader(patch))
+	assert.Cond(t, errors.Is(err, ErrUnsupportedVersion), "unexpected error: %v", err)
+}
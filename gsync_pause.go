@@ -0,0 +1,63 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"sync"
+)
+
+// Pauser pauses Sync while operations are being produced. *Gate satisfies it.
+type Pauser interface {
+	// Wait blocks while paused, until resumed or the context is done.
+	Wait(ctx context.Context) error
+}
+
+// Gate is a Pauser controlled by calling Pause and Resume, from any goroutine. The zero
+// value is an open gate.
+type Gate struct {
+	mu sync.Mutex
+	// closed is non-nil while paused, and closed on resume.
+	closed chan struct{}
+}
+
+// Pause makes Wait block until Resume is called.
+func (g *Gate) Pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed == nil {
+		g.closed = make(chan struct{})
+	}
+}
+
+// Resume releases any goroutine blocked in Wait.
+func (g *Gate) Resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed != nil {
+		close(g.closed)
+		g.closed = nil
+	}
+}
+
+// Wait blocks while the gate is paused, until resumed or the context is done.
+func (g *Gate) Wait(ctx context.Context) error {
+	g.mu.Lock()
+	closed := g.closed
+	g.mu.Unlock()
+
+	if closed == nil {
+		return nil
+	}
+
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
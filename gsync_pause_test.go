@@ -0,0 +1,83 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestSyncPause(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(290, 100*1024)
+	source := append(srand(291, 3*DefaultBlockSize), cache...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	gate := new(Gate)
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, WithPauser(gate))
+	assert.Ok(t, err)
+
+	var ops []BlockOperation
+	ops = append(ops, <-opsCh)
+	gate.Pause()
+	// At most the operation already produced before pausing goes through.
+	select {
+	case op := <-opsCh:
+		ops = append(ops, op)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	select {
+	case <-opsCh:
+		t.Fatal("operation sent while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	gate.Resume()
+	for op := range opsCh {
+		ops = append(ops, op)
+	}
+
+	c := make(chan BlockOperation, len(ops))
+	for _, op := range ops {
+		c <- op
+	}
+	close(c)
+
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), c, WithRequireDone()))
+	assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+}
+
+func TestSyncerPauseDeadline(t *testing.T) {
+	gate := new(Gate)
+	gate.Pause()
+
+	s, err := NewSyncer(nil, WithPauser(gate))
+	assert.Ok(t, err)
+	source := srand(292, 1000)
+	s.Reset(bytes.NewReader(source), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = s.Next(ctx)
+	assert.Equals(t, context.DeadlineExceeded, err)
+
+	// Nothing was lost while paused.
+	gate.Resume()
+	op, err := s.Next(context.Background())
+	assert.Ok(t, err)
+	assert.Equals(t, source, op.Data)
+}
@@ -0,0 +1,166 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Plan is the whole list of operations produced by Sync, materialized by SyncToSlice. Literal data
+// beyond a memory limit is spilled to a temporary file and read back as needed. A Plan must be
+// closed once done with it, to remove the temporary file. It is not safe for concurrent use.
+type Plan struct {
+	ops []BlockOperation
+	// spilled locates the data of spilled literals in file, indexed like ops. Operations kept in
+	// memory have empty regions.
+	spilled []spillRegion
+	file    *os.File
+	size    int64
+}
+
+// spillRegion is a region of the spill file.
+type spillRegion struct {
+	off int64
+	n   int
+}
+
+// SyncToSlice runs Sync of r against the remote block signatures and collects all the operations,
+// for batch jobs preferring a materialized plan over streaming. Literal data is kept in memory up to
+// memLimit bytes, and the data of any further literal is spilled to a temporary file created in
+// dir, or in the default directory for temporary files if empty. It takes the same options as Sync,
+// and fails with the first error Sync would send.
+func SyncToSlice(ctx context.Context, r io.ReaderAt, shash hash.Hash, remote map[uint32][]BlockSignature, memLimit int64, dir string, opts ...Option) (*Plan, error) {
+	if r == nil {
+		return nil, ErrNilReader
+	}
+
+	s, err := NewSyncer(shash, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.Reset(r, remote)
+
+	p := new(Plan)
+	var inMemory int64
+	for {
+		op, err := s.Next(ctx)
+		if err == io.EOF {
+			return p, nil
+		}
+
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+
+		var region spillRegion
+		if n := len(op.Data); n > 0 && inMemory+int64(n) > memLimit {
+			if region, err = p.spill(op.Data, dir); err != nil {
+				p.Close()
+				return nil, err
+			}
+			op.Data = nil
+		} else {
+			inMemory += int64(n)
+		}
+
+		p.ops = append(p.ops, op)
+		p.spilled = append(p.spilled, region)
+	}
+}
+
+// spill appends data to the spill file, creating it if needed.
+func (p *Plan) spill(data []byte, dir string) (spillRegion, error) {
+	if p.file == nil {
+		f, err := ioutil.TempFile(dir, "gsync-plan-")
+		if err != nil {
+			return spillRegion{}, errors.Wrapf(err, "failed creating spill file")
+		}
+		p.file = f
+	}
+
+	if _, err := p.file.WriteAt(data, p.size); err != nil {
+		return spillRegion{}, errors.Wrapf(err, "failed spilling literal data")
+	}
+
+	region := spillRegion{off: p.size, n: len(data)}
+	p.size += int64(len(data))
+	return region, nil
+}
+
+// Len returns the number of operations in the plan.
+func (p *Plan) Len() int {
+	return len(p.ops)
+}
+
+// Spilled returns the amount of literal data spilled to disk.
+func (p *Plan) Spilled() int64 {
+	return p.size
+}
+
+// Op returns the i-th operation, reading its data back from disk if it was spilled.
+func (p *Plan) Op(i int) (BlockOperation, error) {
+	op, region := p.ops[i], p.spilled[i]
+	if region.n == 0 {
+		return op, nil
+	}
+
+	op.Data = make([]byte, region.n)
+	if _, err := p.file.ReadAt(op.Data, region.off); err != nil {
+		return BlockOperation{}, errors.Wrapf(err, "failed reading spilled literal data")
+	}
+	return op, nil
+}
+
+// Operations sends all the operations of the plan, in order, on the returned channel, which can be
+// passed on to Apply. Failures reading spilled data back are sent as an operation carrying the error,
+// after which the channel is closed. Like with Sync, the channel is closed once the context is done.
+func (p *Plan) Operations(ctx context.Context) <-chan BlockOperation {
+	o := make(chan BlockOperation)
+
+	go func() {
+		defer close(o)
+
+		for i := range p.ops {
+			op, err := p.Op(i)
+			if err != nil {
+				op = BlockOperation{Error: err}
+			}
+
+			select {
+			case o <- op:
+			case <-ctx.Done():
+				return
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return o
+}
+
+// Close removes the spill file, if any.
+func (p *Plan) Close() error {
+	if p.file == nil {
+		return nil
+	}
+
+	name := p.file.Name()
+	err := p.file.Close()
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+	p.file = nil
+	return errors.Wrapf(err, "failed removing spill file")
+}
@@ -0,0 +1,64 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestSyncToSlice(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "gsync")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	cache := srand(440, 50*DefaultBlockSize)
+	source := append(append(srand(441, 3*DefaultBlockSize), cache[:20*DefaultBlockSize]...), srand(442, 5*DefaultBlockSize+10)...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	for _, limit := range []int64{0, 4 * DefaultBlockSize, 1 << 30} {
+		plan, err := SyncToSlice(ctx, bytes.NewReader(source), nil, cacheSigs, limit, dir)
+		assert.Ok(t, err)
+
+		if limit < 8*DefaultBlockSize+10 {
+			assert.Equals(t, 8*DefaultBlockSize+10-limit, plan.Spilled())
+		} else {
+			assert.Equals(t, int64(0), plan.Spilled())
+		}
+
+		var literal int
+		for i := 0; i < plan.Len(); i++ {
+			op, err := plan.Op(i)
+			assert.Ok(t, err)
+			literal += len(op.Data)
+		}
+		assert.Equals(t, 8*DefaultBlockSize+10, literal)
+
+		// Plans can be applied as many times as needed.
+		for i := 0; i < 2; i++ {
+			target := new(bytes.Buffer)
+			assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), plan.Operations(ctx), WithRequireDone()))
+			assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+		}
+
+		assert.Ok(t, plan.Close())
+		entries, err := ioutil.ReadDir(dir)
+		assert.Ok(t, err)
+		assert.Equals(t, 0, len(entries))
+	}
+}
@@ -0,0 +1,135 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"hash"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// SyncJob describes the sync of a single file run by a Pool.
+type SyncJob struct {
+	// Source is the file to sync and Remote the signatures of its cached version, as with Sync.
+	Source io.ReaderAt
+	Remote map[uint32][]BlockSignature
+	// Emit is called with every operation, in order, on the goroutine of the worker running the
+	// job, i.e. to encode it or hand it over to Apply. The data of operations may be retained.
+	// Returning an error aborts the job.
+	Emit func(op BlockOperation) error
+}
+
+type poolJob struct {
+	ctx    context.Context
+	job    SyncJob
+	result chan error
+}
+
+// Pool runs the syncs of many files with a fixed number of workers, each one reusing its own
+// Syncer, and hence its buffers, from file to file. Memory use is bounded by the number of
+// workers, regardless of the number of files. Submit blocks while all workers are busy, so
+// producers of jobs can never get ahead of the workers.
+type Pool struct {
+	jobs   chan poolJob
+	wg     sync.WaitGroup
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewPool starts a Pool of the given number of workers, whose Syncers use the strong hash returned
+// by newHash, or the one of the remote signatures if nil, and the given options. See NewSyncer.
+func NewPool(workers int, newHash func() hash.Hash, opts ...Option) (*Pool, error) {
+	if workers < 1 {
+		return nil, errors.New("gsync: pool needs at least one worker")
+	}
+
+	if newHash == nil {
+		newHash = func() hash.Hash { return nil }
+	}
+
+	p := &Pool{jobs: make(chan poolJob)}
+	for i := 0; i < workers; i++ {
+		s, err := NewSyncer(newHash(), opts...)
+		if err != nil {
+			close(p.jobs)
+			p.wg.Wait()
+			return nil, err
+		}
+
+		p.wg.Add(1)
+		go p.work(s)
+	}
+	return p, nil
+}
+
+// work runs jobs with s until the pool is closed.
+func (p *Pool) work(s *Syncer) {
+	defer p.wg.Done()
+
+	for j := range p.jobs {
+		j.result <- run(j.ctx, s, j.job)
+	}
+}
+
+// run syncs a single job with s.
+func run(ctx context.Context, s *Syncer, job SyncJob) error {
+	if job.Source == nil {
+		return ErrNilReader
+	}
+
+	s.Reset(job.Source, job.Remote)
+	defer s.Reset(nil, nil)
+
+	for {
+		op, err := s.Next(ctx)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := job.Emit(op); err != nil {
+			return err
+		}
+	}
+}
+
+// Submit hands job over to a worker, blocking until one is available or the context is done.
+// The returned channel receives the result of the job once it finishes, which is nil if the
+// whole file was synced. The context applies to the job as well.
+func (p *Pool) Submit(ctx context.Context, job SyncJob) (<-chan error, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+
+	result := make(chan error, 1)
+	select {
+	case p.jobs <- poolJob{ctx: ctx, job: job, result: result}:
+		return result, nil
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ctx.Err(), "failed submitting job")
+	}
+}
+
+// Close stops the workers once the jobs already submitted finish, and waits for them. Jobs can
+// not be submitted afterwards.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
@@ -0,0 +1,95 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestPool(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	p, err := NewPool(3, nil)
+	assert.Ok(t, err)
+
+	type file struct {
+		source, cache []byte
+		ops           []BlockOperation
+		result        <-chan error
+	}
+
+	files := make([]*file, 20)
+	for i := range files {
+		cache := srand(int64(450+i), 10*DefaultBlockSize+i)
+		f := &file{source: append(srand(int64(500+i), 100), cache...), cache: cache}
+		files[i] = f
+
+		sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+		assert.Ok(t, err)
+		remote, err := LookUpTable(ctx, sigsCh)
+		assert.Ok(t, err)
+
+		f.result, err = p.Submit(ctx, SyncJob{
+			Source: bytes.NewReader(f.source),
+			Remote: remote,
+			Emit: func(op BlockOperation) error {
+				f.ops = append(f.ops, op)
+				return nil
+			},
+		})
+		assert.Ok(t, err)
+	}
+
+	for _, f := range files {
+		assert.Ok(t, <-f.result)
+
+		c := make(chan BlockOperation, len(f.ops))
+		for _, op := range f.ops {
+			c <- op
+		}
+		close(c)
+
+		target := new(bytes.Buffer)
+		assert.Ok(t, Apply(ctx, target, bytes.NewReader(f.cache), c, WithRequireDone()))
+		assert.Cond(t, bytes.Equal(f.source, target.Bytes()), "source and target files are different")
+	}
+
+	p.Close()
+	_, err = p.Submit(ctx, SyncJob{})
+	assert.Equals(t, ErrPoolClosed, err)
+}
+
+func TestPoolBackpressure(t *testing.T) {
+	p, err := NewPool(1, nil)
+	assert.Ok(t, err)
+	defer p.Close()
+
+	release := make(chan struct{})
+	failure := errors.New("failed")
+	result, err := p.Submit(context.Background(), SyncJob{
+		Source: bytes.NewReader(srand(520, 100)),
+		Emit: func(BlockOperation) error {
+			<-release
+			return failure
+		},
+	})
+	assert.Ok(t, err)
+
+	// The only worker is busy, so submitting blocks.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = p.Submit(ctx, SyncJob{Source: bytes.NewReader(nil)})
+	assert.Cond(t, errors.Is(err, context.DeadlineExceeded), "expected the submission to time out, got %v", err)
+
+	close(release)
+	assert.Equals(t, failure, <-result)
+}
@@ -0,0 +1,130 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// prefetched is an operation whose cached block may still be being read.
+type prefetched struct {
+	op BlockOperation
+	// orig is the operation op was split from, which is done once its last block is.
+	orig        BlockOperation
+	first, last bool
+	bfp         *[]byte
+	block       []byte
+	err         error
+	done        chan struct{}
+}
+
+// prefetch is Apply reading cached blocks ahead of time. A dispatcher goroutine
+// reads operations and starts cache reads concurrently, queuing them in order, while
+// the calling goroutine waits for each one and writes it to the destination.
+func (a *applier) prefetch(ctx context.Context, ops <-chan BlockOperation) error {
+	queue := make(chan *prefetched, a.cfg.prefetchWindow)
+	workers := make(chan struct{}, a.cfg.prefetchWorkers)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		defer close(queue)
+
+		enqueue := func(p *prefetched) bool {
+			select {
+			case queue <- p:
+				return true
+			case <-stop:
+				return false
+			}
+		}
+
+		for {
+			var (
+				o  BlockOperation
+				ok bool
+			)
+
+			select {
+			case o, ok = <-ops:
+				if !ok {
+					return
+				}
+			case <-stop:
+				return
+			}
+
+			if !o.copies() {
+				p := &prefetched{op: o, orig: o, first: true, last: true, done: make(chan struct{})}
+				close(p.done)
+
+				if !enqueue(p) {
+					return
+				}
+				continue
+			}
+
+			// Runs of blocks are read ahead one block at a time.
+			for i := uint64(0); i < o.blocks(); i++ {
+				p := &prefetched{
+					op:    BlockOperation{Index: o.Index + i, Strong: o.Strong, Length: lastLength(o, i)},
+					orig:  o,
+					first: i == 0,
+					last:  i == o.blocks()-1,
+					done:  make(chan struct{}),
+				}
+
+				select {
+				case workers <- struct{}{}:
+				case <-stop:
+					return
+				}
+
+				p.bfp = a.cfg.getBuffer()
+				go func() {
+					defer close(p.done)
+					p.block, p.err = a.readBlock(p.op, *p.bfp, p.op.Index)
+					<-workers
+				}()
+
+				if !enqueue(p) {
+					return
+				}
+			}
+		}
+	}()
+
+	var offset int64
+	for p := range queue {
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "failed applying block operations")
+		case <-p.done:
+		}
+
+		if p.err != nil {
+			return p.err
+		}
+
+		if p.first {
+			offset = a.offset
+		}
+
+		if err := a.applyOp(p.op, p.block); err != nil {
+			return err
+		}
+
+		if p.last && a.cfg.audit != nil {
+			a.cfg.audit(p.orig, offset)
+		}
+
+		if p.bfp != nil {
+			a.cfg.putBuffer(p.bfp)
+		}
+	}
+	return a.finish()
+}
@@ -0,0 +1,62 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+// slowReaderAt simulates a high latency cache, such as an object store.
+type slowReaderAt struct {
+	r        io.ReaderAt
+	latency  time.Duration
+	inflight int32
+	peak     int32
+}
+
+func (s *slowReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := atomic.AddInt32(&s.inflight, 1)
+	defer atomic.AddInt32(&s.inflight, -1)
+	for {
+		peak := atomic.LoadInt32(&s.peak)
+		if n <= peak || atomic.CompareAndSwapInt32(&s.peak, peak, n) {
+			break
+		}
+	}
+
+	time.Sleep(s.latency)
+	return s.r.ReadAt(p, off)
+}
+
+func TestApplyPrefetch(t *testing.T) {
+	cache := srand(40, 512*1024)
+	source := append(srand(41, 1000), cache...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs)
+	assert.Ok(t, err)
+
+	slow := &slowReaderAt{r: bytes.NewReader(cache), latency: 5 * time.Millisecond}
+	target := new(bytes.Buffer)
+	err = Apply(ctx, target, slow, opsCh, WithPrefetch(8, 32))
+	assert.Ok(t, err)
+
+	assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+	assert.Cond(t, atomic.LoadInt32(&slow.peak) > 1, "cache reads were not issued concurrently")
+	assert.Cond(t, atomic.LoadInt32(&slow.peak) <= 8, "more concurrent reads than workers: %d", slow.peak)
+}
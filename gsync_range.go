@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+// clipReaderAt is an io.ReaderAt over the data of r before end, addressed with the offsets of r.
+type clipReaderAt struct {
+	r   io.ReaderAt
+	end int64
+}
+
+func (c clipReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= c.end {
+		return 0, io.EOF
+	}
+
+	if max := c.end - off; int64(len(p)) > max {
+		n, err := c.r.ReadAt(p[:max], off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return c.r.ReadAt(p, off)
+}
+
+// rangeReader reads the range [start, end) of r, discarding the data before start on the first
+// read, unless r supports random access.
+type rangeReader struct {
+	r     io.Reader
+	start int64
+}
+
+func newRangeReader(r io.Reader, start, end int64) io.Reader {
+	if ra, ok := r.(io.ReaderAt); ok {
+		return io.NewSectionReader(ra, start, end-start)
+	}
+	return &rangeReader{r: io.LimitReader(r, end), start: start}
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.start > 0 {
+		n, err := io.CopyN(ioutil.Discard, r.r, r.start)
+		r.start -= n
+		if err != nil {
+			return 0, err
+		}
+	}
+	return r.r.Read(p)
+}
+
+// offsetWriter writes sequentially to w, starting at off.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+// Sync flushes the underlying writer to stable storage, if supported. See WithFsync.
+func (o *offsetWriter) Sync() error {
+	if s, ok := o.w.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+// writerAtBuffer is an in-memory io.WriterAt.
+type writerAtBuffer []byte
+
+func (w writerAtBuffer) WriteAt(p []byte, off int64) (int, error) {
+	return copy(w[off:], p), nil
+}
+
+func (w writerAtBuffer) Write(p []byte) (int, error) {
+	panic("sequential write to an io.WriterAt")
+}
+
+func TestSyncRange(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(360, 100*DefaultBlockSize+300)
+	source := append([]byte(nil), cache...)
+	copy(source[42*DefaultBlockSize+10:], srand(361, 3000))
+	// Changes outside of the range are left alone.
+	source[DefaultBlockSize] ^= 1
+
+	for _, end := range []int64{50 * DefaultBlockSize, 50*DefaultBlockSize + 123, int64(len(cache))} {
+		start := int64(40 * DefaultBlockSize)
+		opts := []Option{WithRange(start, end)}
+
+		// Signatures of readers without random access skip to the range too.
+		sigsCh, err := Signatures(ctx, ioutil.NopCloser(bytes.NewReader(cache)), nil, opts...)
+		assert.Ok(t, err)
+		cacheSigs, err := LookUpTable(ctx, sigsCh, WithRequireDone())
+		assert.Ok(t, err)
+
+		for _, bs := range cacheSigs {
+			for _, b := range bs {
+				assert.Cond(t, b.Index >= 40 && int64(b.Index)*DefaultBlockSize < end, "signature of block %d out of range", b.Index)
+			}
+		}
+
+		opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, opts...)
+		assert.Ok(t, err)
+
+		var ops []BlockOperation
+		offset := start
+		for op := range opsCh {
+			assert.Ok(t, op.Error)
+			if !op.Done {
+				assert.Equals(t, offset, op.Offset)
+				if op.Data != nil {
+					offset += int64(len(op.Data))
+				} else {
+					offset += DefaultBlockSize
+				}
+			}
+			ops = append(ops, op)
+		}
+
+		c := make(chan BlockOperation, len(ops))
+		for _, op := range ops {
+			c <- op
+		}
+		close(c)
+
+		target := writerAtBuffer(append([]byte(nil), cache...))
+		assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), c, opts...))
+
+		exp := append(append(append([]byte(nil), cache[:start]...), source[start:end]...), cache[end:]...)
+		assert.Cond(t, bytes.Equal(exp, target), "range was not reconstructed in place")
+	}
+
+	_, err := Signatures(ctx, bytes.NewReader(cache), nil, WithRange(10, 20))
+	assert.Equals(t, ErrInvalidRange, err)
+}
@@ -0,0 +1,112 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import "io"
+
+// DefaultReadAhead is the default number of blocks read at a time by Sync and Signer.
+const DefaultReadAhead = 16
+
+// readAhead is the window of source data Syncer rolls through. It is refilled by moving the
+// unprocessed tail to the front of the window and reading the source right after it, so
+// rolling one byte at a time does not cost a ReadAt call per byte.
+type readAhead struct {
+	buf []byte
+	// off is the source offset of buf[0] and n the amount of valid data in buf.
+	off int64
+	n   int
+	// eof is set once the source ran out of data.
+	eof bool
+}
+
+func (w *readAhead) reset() {
+	w.off, w.n, w.eof = 0, 0, false
+}
+
+// block returns up to size bytes of r starting at off, following io.ReaderAt semantics: if less
+// than size bytes are returned, err explains why. The returned slice is only valid until the
+// next call.
+func (s *Syncer) block(off int64, size int) ([]byte, error) {
+	w := &s.ahead
+	// The window is sized after the largest block of any layout, since with boundaries the
+	// first block requested may be much shorter than the rest.
+	if w.buf == nil || len(w.buf) < size {
+		max := size
+		if max < s.cfg.size {
+			max = s.cfg.size
+		}
+		buf := make([]byte, s.cfg.readAheadBlocks()*max)
+		w.n = copy(buf, w.buf[:w.n])
+		w.buf = buf
+	}
+
+	if off < w.off || off+int64(size) > w.off+int64(w.n) && !w.eof {
+		if err := s.refill(off); err != nil {
+			return nil, err
+		}
+	}
+
+	start := int(off - w.off)
+	if start+size <= w.n {
+		return w.buf[start : start+size], nil
+	}
+	if !w.eof {
+		return nil, io.ErrShortBuffer
+	}
+	return w.buf[start:w.n], io.EOF
+}
+
+// refill moves the window to start at off, keeping any data already read from there on.
+func (s *Syncer) refill(off int64) error {
+	w := &s.ahead
+
+	var kept int
+	if off >= w.off && off < w.off+int64(w.n) {
+		kept = copy(w.buf, w.buf[off-w.off:w.n])
+	}
+	w.off, w.n = off, kept
+
+	start := s.trace.now()
+	n, err := readAtFull(s.r, w.buf[kept:], off+int64(kept))
+	s.trace.add(phaseRead, start)
+	w.n += n
+	s.cfg.stats.refilled(kept)
+
+	if err == io.EOF {
+		w.eof = true
+		return nil
+	}
+	return err
+}
+
+// readAtFull is r.ReadAt retrying short reads, since io.ReaderAt implementations wrapping
+// streams do not always honor its contract. So that the operations produced do not depend on
+// how the source is read, io.EOF is only returned along with less than len(p) bytes.
+func readAtFull(r io.ReaderAt, p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) {
+		m, err := r.ReadAt(p[n:], off+int64(n))
+		n += m
+		if err != nil {
+			if err == io.EOF && n == len(p) {
+				err = nil
+			}
+			return n, err
+		}
+
+		if m == 0 {
+			return n, io.ErrNoProgress
+		}
+	}
+	return n, nil
+}
+
+// readAheadBlocks returns the number of blocks to read at a time, see WithReadAhead.
+func (o *options) readAheadBlocks() int {
+	if o.readAhead < 1 {
+		return DefaultReadAhead
+	}
+	return o.readAhead
+}
@@ -0,0 +1,74 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestReadAhead(t *testing.T) {
+	cache := srand(220, 512*1024)
+	source := append(srand(221, 3000), cache[:200*1024]...)
+	source = append(source, srand(222, 10*DefaultBlockSize)...)
+	source = append(source, cache[300*1024:]...)
+
+	var prev Stats
+	for _, blocks := range []int{1, 4, DefaultReadAhead, 128} {
+		t.Run(fmt.Sprintf("%d blocks", blocks), func(t *testing.T) {
+			stats := new(Stats)
+			target := pipeline(t, source, cache, WithReadAhead(blocks), WithStats(stats))
+			assert.Cond(t, bytes.Equal(source, target), "source and target files are different")
+
+			if prev.Refills > 0 {
+				assert.Cond(t, stats.Refills < prev.Refills, "expected fewer refills than %d, got %d", prev.Refills, stats.Refills)
+				assert.Cond(t, stats.RefillCopied <= prev.RefillCopied, "expected no more than %d bytes copied, got %d", prev.RefillCopied, stats.RefillCopied)
+			}
+			prev = *stats
+		})
+	}
+}
+
+// countingReader counts the Read calls reaching r.
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+func TestSignerReadAhead(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	data := srand(350, 100*DefaultBlockSize+10)
+
+	sign := func(opts ...Option) ([]BlockSignature, int) {
+		r := &countingReader{r: bytes.NewReader(data)}
+		c, err := Signatures(ctx, r, nil, opts...)
+		assert.Ok(t, err)
+
+		var sigs []BlockSignature
+		for sig := range c {
+			assert.Ok(t, sig.Error)
+			sigs = append(sigs, sig)
+		}
+		return sigs, r.reads
+	}
+
+	exp, unbuffered := sign(WithReadAhead(1))
+	got, buffered := sign()
+	assert.Equals(t, exp, got)
+	assert.Cond(t, buffered*DefaultReadAhead/2 < unbuffered, "expected far fewer reads than %d, got %d", unbuffered, buffered)
+}
@@ -0,0 +1,72 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"hash"
+	"io"
+)
+
+// SyncReader is an io.Reader producing the operations to re-construct a file, encoded in the
+// gsync wire format. Operations are calculated lazily as data is read, so copying a SyncReader
+// to a network connection with io.Copy syncs the file at the pace the connection allows, without
+// any goroutines or channels involved. The remote end can feed the stream to Decode and Apply.
+type SyncReader struct {
+	ctx context.Context
+	s   *Syncer
+	buf bytes.Buffer
+	enc *Encoder
+	err error
+}
+
+// NewSyncReader returns a SyncReader syncing r against the remote block signatures, taking the same
+// arguments and options as Sync, as well as those of NewEncoder. ctx is checked on every Read.
+func NewSyncReader(ctx context.Context, r io.ReaderAt, shash hash.Hash, remote map[uint32][]BlockSignature, opts ...Option) (*SyncReader, error) {
+	if r == nil {
+		return nil, ErrNilReader
+	}
+
+	s, err := NewSyncer(shash, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.Reset(r, remote)
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	sr := &SyncReader{ctx: ctx, s: s}
+	sr.enc = NewEncoder(&sr.buf, opts...)
+	return sr, nil
+}
+
+// Read reads encoded operations into p. It returns io.EOF after the Done operation was read. If
+// syncing fails, the error is encoded into the stream, for the remote end to learn about it, and
+// returned once read.
+func (r *SyncReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		op, err := r.s.Next(r.ctx)
+		if err == io.EOF {
+			r.err = io.EOF
+			continue
+		}
+
+		if err != nil {
+			r.err = err
+			op = BlockOperation{Error: err}
+		}
+
+		if err := r.enc.Encode(op); err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
@@ -0,0 +1,58 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"hash"
+	"io"
+	"math"
+)
+
+// ReverseDelta returns the operations reconstructing the older version of a file from its newer
+// version, for backup systems keeping the latest version whole and deltas pointing backward.
+// The newer version is the cache: its signatures are calculated first, and the older version
+// is the source synced against them. Hence, the operations are applied with the newer version
+// as the cache in order to get the older version back:
+//
+//	ops, err := ReverseDelta(ctx, older, newer, nil)
+//	...
+//	err = Apply(ctx, restored, newer, ops)
+//
+// Options are passed to both Signatures and Sync. Failing to calculate the signatures of the
+// newer version is returned right away, other failures are reported through the channel like
+// with Sync.
+func ReverseDelta(ctx context.Context, older, newer io.ReaderAt, shash hash.Hash, opts ...Option) (<-chan BlockOperation, error) {
+	if older == nil || newer == nil {
+		return nil, ErrNilReader
+	}
+
+	// Signatures keeps going after read errors, so it is stopped at the first one.
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sigsCh, err := Signatures(sctx, io.NewSectionReader(newer, 0, math.MaxInt64), shash, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	table := make(map[uint32][]BlockSignature)
+	for sig := range sigsCh {
+		if sig.Error != nil {
+			err = sig.Error
+			break
+		}
+
+		if sig.Done {
+			continue
+		}
+		table[sig.Weak] = append(table[sig.Weak], sig)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return Sync(ctx, older, shash, table, opts...)
+}
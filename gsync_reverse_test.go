@@ -0,0 +1,37 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestReverseDelta(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	older := srand(310, 50*DefaultBlockSize+77)
+	newer := append(append(srand(311, 1000), older[:20*DefaultBlockSize]...), older[25*DefaultBlockSize:]...)
+
+	ops, err := ReverseDelta(ctx, bytes.NewReader(older), bytes.NewReader(newer), nil)
+	assert.Ok(t, err)
+
+	restored := new(bytes.Buffer)
+	assert.Ok(t, Apply(ctx, restored, bytes.NewReader(newer), ops, WithRequireDone()))
+	assert.Cond(t, bytes.Equal(older, restored.Bytes()), "restored and older files are different")
+
+	_, err = ReverseDelta(ctx, nil, bytes.NewReader(newer), nil)
+	assert.Equals(t, ErrNilReader, err)
+
+	failure := errors.New("failed")
+	_, err = ReverseDelta(ctx, bytes.NewReader(older), failingReader{failure}, nil)
+	assert.Cond(t, errors.Is(err, failure), "expected the read error, got %v", err)
+}
@@ -0,0 +1,64 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+// RollingHasher maintains the weak checksum of a sliding window of bytes, the same one Signatures
+// and Sync calculate with WeakAdler and the default modulus, so it can be used for Rabin-Karp style
+// searches or content defined chunking that stay compatible with signatures. It keeps a copy of the
+// window to know which byte rolls out and does not allocate after NewRollingHasher.
+type RollingHasher struct {
+	window []byte
+	// next is the position in window where the next byte is stored.
+	next   int
+	filled int
+	r1, r2 uint32
+}
+
+// NewRollingHasher returns a RollingHasher for windows of size bytes.
+func NewRollingHasher(size int) *RollingHasher {
+	if size <= 0 {
+		size = DefaultBlockSize
+	}
+	return &RollingHasher{window: make([]byte, size)}
+}
+
+// Write appends b to the end of the window. Once the window is full, the byte at its front rolls
+// out.
+func (h *RollingHasher) Write(b byte) {
+	if h.filled < len(h.window) {
+		h.r1 = (h.r1 + uint32(b)) & (mod - 1)
+		h.r2 = (h.r2 + h.r1) & (mod - 1)
+		h.filled++
+	} else {
+		h.r1, h.r2, _ = rollingHash2(mod, uint32(len(h.window)), h.r1, h.r2, uint32(h.window[h.next]), uint32(b))
+	}
+	h.window[h.next] = b
+	h.next++
+	if h.next == len(h.window) {
+		h.next = 0
+	}
+}
+
+// Sum32 returns the weak checksum of the bytes currently in the window. It equals what
+// RollingChecksum returns for them.
+func (h *RollingHasher) Sum32() uint32 {
+	return h.r1 + (mod * h.r2)
+}
+
+// Full reports whether the window holds size bytes, which is when Sum32 can be compared against
+// block signatures.
+func (h *RollingHasher) Full() bool {
+	return h.filled == len(h.window)
+}
+
+// Size returns the size of the window.
+func (h *RollingHasher) Size() int {
+	return len(h.window)
+}
+
+// Reset empties the window.
+func (h *RollingHasher) Reset() {
+	h.next, h.filled, h.r1, h.r2 = 0, 0, 0, 0
+}
@@ -0,0 +1,38 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestRollingHasher(t *testing.T) {
+	data := srand(21, 1024)
+	h := NewRollingHasher(100)
+
+	for i, b := range data {
+		h.Write(b)
+		start := i + 1 - 100
+		if start < 0 {
+			start = 0
+		}
+		_, _, exp := RollingChecksum(data[start : i+1])
+		assert.Equals(t, exp, h.Sum32())
+		assert.Equals(t, i >= 99, h.Full())
+	}
+
+	h.Reset()
+	assert.Cond(t, !h.Full(), "window should be empty after Reset")
+	for _, b := range data[:100] {
+		h.Write(b)
+	}
+	_, _, exp := RollingChecksum(data[:100])
+	assert.Equals(t, exp, h.Sum32())
+
+	allocs := testing.AllocsPerRun(100, func() { h.Write(data[0]) })
+	assert.Equals(t, float64(0), allocs)
+}
@@ -0,0 +1,89 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"hash"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Scrub verifies the blocks of a local replica against the signatures of the authoritative
+// copy, such as for detecting bit rot, and returns the indices of the blocks that do not match
+// their strong checksum, in ascending order, so that only those are fetched again. Blocks past
+// the end of the replica are reported as well. Each block is read once, at the position given
+// by its signature, and hashed with the strong hash the signature was calculated with, so
+// scrubbing is a cheap anti-entropy pass compared with a full Sync. Coarse signatures are
+// ignored, as is any data of the replica past the last authoritative block. It takes
+// WithBlockSize, which must be the one the signatures were calculated with.
+func Scrub(ctx context.Context, local io.ReaderAt, authoritative []BlockSignature, opts ...Option) ([]uint64, error) {
+	if local == nil {
+		return nil, ErrNilReader
+	}
+
+	cfg := newOptions(opts)
+	if cfg.err != nil {
+		return nil, cfg.err
+	}
+
+	hashes := make(map[HashID]hash.Hash)
+	buffer := make([]byte, cfg.size)
+
+	var bad []uint64
+	for _, sig := range authoritative {
+		if sig.Done || sig.Error != nil || sig.blocks() > 1 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "failed scrubbing")
+		default:
+			break
+		}
+
+		id := sig.Hash
+		if id == HashUnknown {
+			id = HashSHA256
+		}
+
+		shash, ok := hashes[id]
+		if !ok {
+			var err error
+			if shash, err = NewHash(id); err != nil {
+				return nil, err
+			}
+			hashes[id] = shash
+		}
+
+		off, err := cfg.blockOffset(sig.Index)
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := readAtFull(local, buffer, off)
+		if err != nil && err != io.EOF {
+			return nil, &BlockError{
+				Index:  sig.Index,
+				Offset: off,
+				Kind:   ErrReadBlock,
+				Err:    err,
+			}
+		}
+
+		shash.Reset()
+		shash.Write(buffer[:n])
+		if n == 0 || !bytes.Equal(shash.Sum(nil), sig.Strong) {
+			bad = append(bad, sig.Index)
+		}
+	}
+
+	sort.Slice(bad, func(i, j int) bool { return bad[i] < bad[j] })
+	return bad, nil
+}
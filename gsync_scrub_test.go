@@ -0,0 +1,47 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestScrub(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	data := srand(340, 10*DefaultBlockSize+500)
+	sigsCh, err := Signatures(ctx, bytes.NewReader(data), md5.New(), WithCoarseBlocks(4))
+	assert.Ok(t, err)
+
+	var sigs []BlockSignature
+	for sig := range sigsCh {
+		assert.Ok(t, sig.Error)
+		sigs = append(sigs, sig)
+	}
+
+	bad, err := Scrub(ctx, bytes.NewReader(data), sigs)
+	assert.Ok(t, err)
+	assert.Equals(t, 0, len(bad))
+
+	replica := append([]byte(nil), data...)
+	replica[7*DefaultBlockSize+3] ^= 1
+	replica[2*DefaultBlockSize] ^= 1
+
+	bad, err = Scrub(ctx, bytes.NewReader(replica), sigs)
+	assert.Ok(t, err)
+	assert.Equals(t, []uint64{2, 7}, bad)
+
+	// Truncated replicas are missing the last blocks.
+	bad, err = Scrub(ctx, bytes.NewReader(data[:9*DefaultBlockSize]), sigs)
+	assert.Ok(t, err)
+	assert.Equals(t, []uint64{9, 10}, bad)
+}
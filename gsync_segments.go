@@ -0,0 +1,99 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"hash"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Segment is a range of the source file, either found in the cache or only present in the source.
+type Segment struct {
+	// Offset and Length delimit the segment within the source file.
+	Offset, Length int64
+	// Literal tells whether the segment is only present in the source, in which case Data holds its
+	// contents. Otherwise, the segment equals the range of the cache starting at CacheOffset.
+	Literal     bool
+	Data        []byte
+	CacheOffset int64
+}
+
+// Segments runs the matching done by Sync of r against the remote block signatures and returns how
+// the source splits into ranges found in the cache and literal ranges, in order and covering the
+// whole source. Adjacent literals are merged, as are copies of contiguous cache ranges. It is meant
+// for feeding encoders of other delta formats, such as bsdiff style copy and add patches. It takes
+// the same options as Sync, except for WithDedup, which is ignored, and WithBoundaries.
+func Segments(ctx context.Context, r io.ReaderAt, shash hash.Hash, remote map[uint32][]BlockSignature, opts ...Option) ([]Segment, error) {
+	if r == nil {
+		return nil, ErrNilReader
+	}
+
+	s, err := NewSyncer(shash, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.layout != nil || s.cfg.stride > 0 {
+		return nil, errors.New("gsync: Segments does not support WithBoundaries or WithStride")
+	}
+	s.cfg.dedup, s.cfg.backWindow = 0, 0
+	s.Reset(r, remote)
+
+	var segs []Segment
+	for {
+		op, err := s.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if op.Done || op.BaseDigest != nil {
+			continue
+		}
+
+		// The length of the previous segment is only known now, since the last block
+		// of the cache may be shorter than the rest.
+		if n := len(segs); n > 0 && !segs[n-1].Literal {
+			segs[n-1].Length = op.Offset - segs[n-1].Offset
+		}
+
+		seg := Segment{Offset: op.Offset, Literal: len(op.Data) > 0, Data: op.Data}
+		if seg.Literal {
+			seg.Length = int64(len(op.Data))
+		} else {
+			off, err := s.cfg.blockOffset(op.Index)
+			if err != nil {
+				return nil, err
+			}
+			seg.CacheOffset = off
+		}
+
+		if n := len(segs); n > 0 && segs[n-1].merges(seg) {
+			segs[n-1].Length += seg.Length
+			segs[n-1].Data = append(segs[n-1].Data, seg.Data...)
+			continue
+		}
+		segs = append(segs, seg)
+	}
+
+	if n := len(segs); n > 0 && !segs[n-1].Literal {
+		segs[n-1].Length = s.offset - segs[n-1].Offset
+	}
+	return segs, nil
+}
+
+// merges reports whether next continues the segment. Copies, whose length is not known yet,
+// continue a previous copy if their cache range follows it.
+func (s Segment) merges(next Segment) bool {
+	if s.Literal != next.Literal {
+		return false
+	}
+	return s.Literal || s.CacheOffset+s.Length == next.CacheOffset
+}
@@ -0,0 +1,39 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestSegments(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(400, 30*DefaultBlockSize+100)
+	source := append(srand(401, 300), cache[:10*DefaultBlockSize]...)
+	source = append(source, srand(402, 40)...)
+	source = append(source, cache[20*DefaultBlockSize:]...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	segs, err := Segments(ctx, bytes.NewReader(source), nil, cacheSigs)
+	assert.Ok(t, err)
+
+	assert.Equals(t, []Segment{
+		{Offset: 0, Length: 300, Literal: true, Data: source[:300]},
+		{Offset: 300, Length: 10 * DefaultBlockSize, CacheOffset: 0},
+		{Offset: 300 + 10*DefaultBlockSize, Length: 40, Literal: true, Data: source[300+10*DefaultBlockSize : 340+10*DefaultBlockSize]},
+		{Offset: 340 + 10*DefaultBlockSize, Length: 10*DefaultBlockSize + 100, CacheOffset: 20 * DefaultBlockSize},
+	}, segs)
+}
@@ -5,9 +5,12 @@
 package gsync
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"hash"
 	"io"
+	"io/ioutil"
 	"os"
 
 	"github.com/minio/sha256-simd"
@@ -16,80 +19,437 @@ import (
 
 // Signatures reads data blocks from reader and pipes out block signatures on the
 // returning channel, closing it when done reading or when the context is cancelled.
+// Cancelling the context always stops the goroutine producing signatures, even if the
+// caller stopped reading from the channel. Callers abandoning the channel without cancelling
+// the context must DrainSignatures it instead.
 // This function does not block and returns immediately. The caller must make sure the concrete
 // reader instance is not nil or this function will panic.
-func Signatures(ctx context.Context, r io.Reader, shash hash.Hash) (<-chan BlockSignature, error) {
-	var index uint64
-	c := make(chan BlockSignature)
-
-	bfp := bufferPool.Get().(*[]byte)
-	buffer := *bfp
-	defer bufferPool.Put(bfp)
-
+func Signatures(ctx context.Context, r io.Reader, shash hash.Hash, opts ...Option) (<-chan BlockSignature, error) {
 	if r == nil {
-		close(c)
-		return nil, errors.New("gsync: reader required")
+		return nil, ErrNilReader
 	}
 
-	if shash == nil {
-		shash = sha256.New()
+	cfg := newOptions(opts)
+	if cfg.err != nil {
+		return nil, cfg.err
 	}
 
+	if err := cfg.checkMemory(cfg.signerMemory()); err != nil {
+		return nil, err
+	}
+
+	s := newSigner(shash, cfg)
+	s.pooled()
+	s.Reset(r)
+
+	return signatures(ctx, s, nil), nil
+}
+
+// signatures runs s on a new goroutine, piping out signatures on the returned channel. The
+// closer, if any, is closed once done, and the buffer of s released.
+func signatures(ctx context.Context, s *Signer, closer io.Closer) <-chan BlockSignature {
+	c := make(chan BlockSignature, s.cfg.channelBuffer)
+
 	go func() {
 		defer close(c)
+		defer s.release()
+		if closer != nil {
+			defer closer.Close()
+		}
+
+		var failure error
+		ctx, s.trace = s.cfg.startTrace(ctx, "gsync.Signatures")
+		defer func() { s.trace.endSignatures(failure) }()
 
 		for {
-			// Allow for cancellation
-			select {
-			case <-ctx.Done():
-				c <- BlockSignature{
-					Index: index,
-					Error: ctx.Err(),
-				}
+			sig, err := s.Next(ctx)
+			if err == io.EOF && failure != nil {
 				return
-			default:
-				// break out of the select block and continue reading
-				break
 			}
 
-			n, err := r.Read(buffer)
 			if err == io.EOF {
-				break
+				sig = BlockSignature{Done: true}
+				err = nil
 			}
 
-			if err != nil {
-				c <- BlockSignature{
-					Index: index,
-					Error: errors.Wrapf(err, "failed reading block"),
-				}
-				index++
-				// let the caller decide whether to interrupt the process or not.
-				continue
+			if failure == nil {
+				failure = err
+			}
+			sig.Error = err
+			select {
+			case c <- sig:
+			case <-ctx.Done():
+				return
 			}
 
-			block := buffer[:n]
-			shash.Reset()
-			shash.Write(block)
-			strong := shash.Sum(nil)
-			_, _, rhash := rollingHash(block)
-
-			c <- BlockSignature{
-				Index:  index,
-				Weak:   rhash,
-				Strong: strong,
+			if sig.Done || err != nil && err == ctx.Err() {
+				return
 			}
-			index++
+			// let the caller decide whether to interrupt the process or not.
 		}
 	}()
 
-	return c, nil
+	return c
+}
+
+// DrainSignatures discards all remaining signatures until the channel is closed, so that the
+// goroutine producing them can finish. It blocks until then.
+func DrainSignatures(sigs <-chan BlockSignature) {
+	for range sigs {
+	}
+}
+
+// CloseAndDrainSignatures abandons sigs, calling cancel, which must cancel the context sigs were
+// produced with, and discarding the signatures sent in the meantime. Once it returns, the
+// goroutine producing them has finished.
+func CloseAndDrainSignatures(cancel context.CancelFunc, sigs <-chan BlockSignature) {
+	cancel()
+	DrainSignatures(sigs)
+}
+
+// Signer calculates block signatures one at a time, on the caller's goroutine. Unlike
+// Signatures, it keeps its read buffer and strong hash across files, so a single Signer
+// can be Reset and reused to amortize allocations when signing many files.
+// A Signer is not safe for concurrent use.
+type Signer struct {
+	r      io.Reader
+	shash  hash.Hash
+	hashID HashID
+	cfg    *options
+	buffer []byte
+	index  uint64
+	digest hash.Hash
+	// bufr reads the file several blocks at a time.
+	bufr *bufio.Reader
+	// bfp is the pooled buffer backing buffer, if any.
+	bfp *[]byte
+	// follow waits for data appended to the file, see WithFollow. partial is the length of
+	// the block being read when the wait was interrupted.
+	follow  *followReader
+	partial int
+	// skip is the amount of data left to discard of the last block that failed to be read.
+	skip int
+
+	// group accumulates blocks for the next coarse signature, which is returned by
+	// Next, when pending, before reading any more blocks.
+	group   []byte
+	pending *BlockSignature
+
+	// window is the length of the window last signed, held in buffer, and windowEnd is set once the
+	// file was read whole, see WithStride.
+	window    int
+	windowEnd bool
+
+	// trace times the reads and hashing of Signatures, see WithTracer.
+	trace *trace
+}
+
+// NewSigner returns a Signer using shash as the strong hash, or if nil the one set by WithHash,
+// or sha256. It must be Reset before calling Next.
+func NewSigner(shash hash.Hash, opts ...Option) *Signer {
+	s := newSigner(shash, newOptions(opts))
+	s.buffer = make([]byte, s.cfg.size)
+	return s
+}
+
+// newSigner returns a Signer without a read buffer.
+func newSigner(shash hash.Hash, cfg *options) *Signer {
+	if shash == nil {
+		shash = cfg.newHash()
+	}
+	if shash == nil {
+		shash = sha256.New()
+	}
+
+	s := &Signer{
+		shash:  shash,
+		hashID: hashIDOf(shash),
+		cfg:    cfg,
+	}
+
+	if s.cfg.digest {
+		s.digest = sha256.New()
+	}
+	return s
+}
+
+// pooled makes the Signer read into a buffer taken from the buffer pool.
+func (s *Signer) pooled() {
+	s.bfp = s.cfg.getBuffer()
+	s.buffer = *s.bfp
+}
+
+// release returns the read buffer to the buffer pool, if taken from it.
+func (s *Signer) release() {
+	if s.bfp != nil {
+		s.cfg.putBuffer(s.bfp)
+		s.bfp, s.buffer = nil, nil
+	}
+}
+
+// Reset prepares the Signer to calculate the signatures of r, starting over from block index zero.
+func (s *Signer) Reset(r io.Reader) {
+	s.index = 0
+	if r != nil && s.cfg.eofPolicy == EOFLenient {
+		r = lenientReader{r: r}
+	}
+
+	if r != nil && s.cfg.ranged {
+		r = newRangeReader(r, s.cfg.rangeStart, s.cfg.rangeEnd)
+		s.index = uint64(s.cfg.rangeStart / int64(s.cfg.size))
+	}
+
+	s.follow, s.partial, s.skip = nil, 0, 0
+	s.window, s.windowEnd = 0, false
+	if r != nil && s.cfg.follow > 0 {
+		s.follow = &followReader{r: r, interval: s.cfg.follow}
+		r = s.follow
+	}
+
+	// Reads are done in bulk, several blocks at a time, regardless of the block size.
+	if blocks := s.cfg.readAheadBlocks(); r != nil && blocks > 1 {
+		if s.bufr == nil {
+			s.bufr = bufio.NewReaderSize(r, blocks*len(s.buffer))
+		} else {
+			s.bufr.Reset(r)
+		}
+		r = s.bufr
+	}
+
+	if r != nil && s.cfg.transform != nil {
+		r = s.cfg.transform.Normalize(r)
+	}
+
+	s.r = r
+	s.group = s.group[:0]
+	s.pending = nil
+	if s.digest != nil {
+		s.digest.Reset()
+	}
+}
+
+// Digest returns the digest of all data signed since the last Reset, which equals the result
+// of Digest once Next returned io.EOF. It returns nil unless the Signer was created WithDigest.
+func (s *Signer) Digest() []byte {
+	if s.digest == nil {
+		return nil
+	}
+	return s.digest.Sum(nil)
+}
+
+// Next returns the signature of the next block, or io.EOF when there are no more blocks. Read
+// errors are returned as a *BlockError along with the index of the failed block, after which the
+// Signer moves on to the next block. Cancelling the context makes Next return the context error.
+//
+// To keep the signatures of the following blocks aligned with their indices, the next call first
+// reads and discards the rest of the failed block, assuming the reader did not consume any data
+// beyond what it returned before failing. Failures doing so are reported for the failed block
+// again, and the rest of it is skipped by the next call. Hence, readers failing transiently, such
+// as those retrying network requests, only cost the signatures of the blocks they failed on.
+func (s *Signer) Next(ctx context.Context) (BlockSignature, error) {
+	if s.r == nil {
+		return BlockSignature{}, ErrNilReader
+	}
+
+	if s.cfg.err != nil {
+		return BlockSignature{}, s.cfg.err
+	}
+
+	index := s.index
+	if index > s.cfg.maxIndex() {
+		return BlockSignature{Index: index}, &BlockError{Index: index, Kind: ErrOffsetOverflow}
+	}
+
+	// Allow for cancellation
+	select {
+	case <-ctx.Done():
+		return BlockSignature{Index: index}, ctx.Err()
+	default:
+		// break out of the select block and continue reading
+		break
+	}
+
+	if s.pending != nil {
+		sig := *s.pending
+		s.pending = nil
+		return sig, nil
+	}
+
+	if s.cfg.stride > 0 {
+		return s.nextWindow(index)
+	}
+
+	if s.follow != nil {
+		s.follow.ctx = ctx
+	}
+
+	if s.skip > 0 {
+		if err := s.skipFailed(); err == io.EOF {
+			return BlockSignature{}, err
+		} else if err != nil {
+			return BlockSignature{Index: index - 1}, err
+		}
+	}
+
+	// Blocks must be read whole, regardless of how r chunks its data.
+	buffer := s.buffer[:s.cfg.blockSize(index)]
+	start := s.trace.now()
+	n, err := readFull(s.r, buffer[s.partial:])
+	n, s.partial = n+s.partial, 0
+	s.trace.add(phaseRead, start)
+
+	// The block read so far is kept, so it can be completed by the next call.
+	if s.follow != nil && err != nil && err == ctx.Err() {
+		s.partial = n
+		return BlockSignature{Index: index}, err
+	}
+
+	if err != nil && err != io.EOF {
+		s.index++
+		s.skip = len(buffer) - n
+		s.group = s.group[:0]
+		return BlockSignature{Index: index}, s.readError(index, err)
+	}
+
+	// Empty blocks are never signed, they would match any other empty block.
+	if n == 0 {
+		return BlockSignature{}, io.EOF
+	}
+
+	block := s.buffer[:n]
+	start = s.trace.now()
+	s.trace.processed(n)
+
+	if s.digest != nil {
+		s.digest.Write(block)
+	}
+
+	s.shash.Reset()
+	s.shash.Write(block)
+	strong := s.shash.Sum(nil)
+	rhash := s.cfg.weak.sum(block, s.cfg.modulus)
+	s.addCoarse(block, index)
+	s.trace.add(phaseHash, start)
+
+	var length int
+	if n < len(s.buffer) {
+		length = n
+	}
+
+	s.index++
+	return BlockSignature{
+		Index:   index,
+		Weak:    rhash,
+		Modulus: s.modulus(),
+		Strong:  strong,
+		Hash:    s.hashID,
+		Length:  length,
+	}, nil
+}
+
+// skipFailed discards the rest of the last block that failed to be read.
+func (s *Signer) skipFailed() error {
+	n, err := io.CopyN(ioutil.Discard, s.r, int64(s.skip))
+	s.skip -= int(n)
+	if err == io.EOF {
+		s.skip = 0
+		return io.EOF
+	}
+
+	if err != nil {
+		return s.readError(s.index-1, err)
+	}
+	return nil
+}
+
+// readError describes a failure reading the block at index.
+func (s *Signer) readError(index uint64, err error) error {
+	return &BlockError{
+		Index:  index,
+		Offset: int64(index) * int64(s.cfg.size),
+		Kind:   ErrReadBlock,
+		Err:    err,
+	}
+}
+
+// modulus returns the modulus to record in signatures, if any.
+func (s *Signer) modulus() uint32 {
+	if !s.cfg.weak.rollable() {
+		return 0
+	}
+	return s.cfg.modulus
 }
 
 // Apply reconstructs a file given a set of operations. The caller must close the ops channel or the context when done or there will be a deadlock.
-func Apply(ctx context.Context, dst io.Writer, cache io.ReaderAt, ops <-chan BlockOperation) error {
-	bfp := bufferPool.Get().(*[]byte)
-	buffer := *bfp
-	defer bufferPool.Put(bfp)
+func Apply(ctx context.Context, dst io.Writer, cache io.ReaderAt, ops <-chan BlockOperation, opts ...Option) error {
+	return applyWith(ctx, dst, cache, nil, ops, opts)
+}
+
+// applyWith runs Apply and ApplyFunc, reading the cached blocks copied from fetch, if given, or
+// from cache otherwise. Either one is adapted into the blockReader all reads go through.
+func applyWith(ctx context.Context, dst io.Writer, cache io.ReaderAt, fetch func(index uint64) ([]byte, error), ops <-chan BlockOperation, opts []Option) error {
+	cfg := newOptions(opts)
+	if cfg.err != nil {
+		return cfg.err
+	}
+
+	if err := cfg.checkMemory(cfg.applierMemory()); err != nil {
+		return err
+	}
+
+	if cfg.skipErrors {
+		if _, ok := dst.(io.WriterAt); !ok {
+			return errors.New("gsync: WithSkipErrors requires an io.WriterAt destination")
+		}
+	}
+
+	// Skipping errors repositions the destination, but only ranges limit the cache.
+	if cfg.ranged || cfg.skipErrors {
+		if w, ok := dst.(io.WriterAt); ok {
+			dst = &offsetWriter{w: w, off: cfg.rangeStart}
+		}
+	}
+	if cfg.ranged && cache != nil {
+		cache = clipReaderAt{r: cache, end: cfg.rangeEnd}
+	}
+
+	if cfg.transform != nil {
+		if fetch != nil {
+			return errors.New("gsync: ApplyFunc does not support WithTransform")
+		}
+		return applyTransform(ctx, dst, cache, ops, cfg)
+	}
+
+	read := readFrom(cache, cfg)
+	if fetch != nil {
+		read = fetchFrom(fetch, cfg)
+	}
+	return apply(ctx, dst, cache, read, ops, cfg)
+}
+
+// ApplyMulti is Apply reconstructing the same file into several destinations in a single pass,
+// i.e. to replicate it to several local paths. Cache reads and operations are processed once, and
+// every block is written to each destination in turn. It fails on the first write error, leaving
+// the destinations in an undefined state.
+func ApplyMulti(ctx context.Context, dsts []io.Writer, cache io.ReaderAt, ops <-chan BlockOperation, opts ...Option) error {
+	return Apply(ctx, io.MultiWriter(dsts...), cache, ops, opts...)
+}
+
+func apply(ctx context.Context, dst io.Writer, cache io.ReaderAt, read blockReader, ops <-chan BlockOperation, cfg *options) (err error) {
+	a := &applier{dst: dst, cache: cache, read: read, cfg: cfg}
+	ctx, a.trace = cfg.startTrace(ctx, "gsync.Apply")
+	defer func() { a.trace.endApply(a.offset, err) }()
+	if cfg.dedup > 0 {
+		a.dict = newLiteralDict(cfg.dedup, false)
+	}
+
+	if cfg.prefetchWorkers > 0 {
+		return a.prefetch(ctx, ops)
+	}
+
+	bfp := cfg.getBuffer()
+	a.buffer = *bfp
+	defer cfg.putBuffer(bfp)
 
 	for o := range ops {
 		// Allows for cancellation.
@@ -101,32 +461,207 @@ func Apply(ctx context.Context, dst io.Writer, cache io.ReaderAt, ops <-chan Blo
 			break
 		}
 
-		if o.Error != nil {
-			return errors.Wrapf(o.Error, "failed applying operation")
+		if err := a.apply(o, nil); err != nil {
+			return err
 		}
+	}
+	return a.finish()
+}
 
-		var block []byte
+// applier holds the state of a file reconstruction.
+type applier struct {
+	dst   io.Writer
+	cache io.ReaderAt
+	// read reads the cached blocks copied, cache being only read directly to verify base digests.
+	read   blockReader
+	cfg    *options
+	buffer []byte
+	// done is set once the Done operation was received.
+	done bool
+	// literals is the number of literals applied and offset the amount of data written.
+	literals uint64
+	offset   int64
+	// dict holds recent literals when deduplicating them.
+	dict *literalDict
+	// unsynced is the amount of data written since the last fsync, see WithFsync.
+	unsynced int64
+	// skipped holds the error operations skipped, see WithSkipErrors. resume is set after
+	// skipping one, until the next operation repositions the destination.
+	skipped []*BlockError
+	resume  bool
+	// trace times cache reads and writes, see WithTracer.
+	trace *trace
+	// history holds the data last written, for back references, see WithBackRefs.
+	history []byte
+}
 
-		if len(o.Data) > 0 {
-			block = o.Data
-		} else {
-			if f, ok := cache.(*os.File); ok && f == nil {
-				return errors.New("index operation, but cached file was not found")
-			}
+// apply executes a single operation, reporting it to the audit function, if any, once done.
+func (a *applier) apply(o BlockOperation, cached []byte) error {
+	offset := a.offset
+	if err := a.applyOp(o, cached); err != nil {
+		return err
+	}
 
-			index := int64(o.Index)
-			n, err := cache.ReadAt(buffer, (index * DefaultBlockSize))
-			if err != nil && err != io.EOF {
-				return errors.Wrapf(err, "failed reading cached block")
-			}
+	if a.cfg.audit != nil {
+		a.cfg.audit(o, offset)
+	}
+	return nil
+}
+
+// applyOp executes a single operation. The blocks of copy operations are read from the cache,
+// unless a single block was already read ahead of time and passed in as cached.
+func (a *applier) applyOp(o BlockOperation, cached []byte) error {
+	if o.Error != nil && a.cfg.skipErrors {
+		a.skip(o)
+		return nil
+	}
+
+	if o.Error != nil {
+		return errors.Wrapf(o.Error, "failed applying operation")
+	}
+
+	if o.BaseDigest != nil {
+		return verifyBase(a.cache, o.BaseDigest)
+	}
+
+	if o.Done {
+		a.done = true
+		return nil
+	}
 
-			block = buffer[:n]
+	if a.resume {
+		if err := a.seek(o.Offset); err != nil {
+			return err
 		}
+	}
+
+	if o.Ref != 0 {
+		data, ok := a.dict.get(o.Ref)
+		if !ok {
+			return &BlockError{Index: o.Ref, Offset: a.offset, Kind: ErrUnknownRef}
+		}
+		return a.write(o.Index, data)
+	}
+
+	if o.Back != 0 {
+		return a.applyBack(o)
+	}
+
+	if !o.copies() {
+		seq := a.literals
+		a.literals++
+		if o.Checksum != nil && !bytes.Equal(literalChecksum(o.Data), o.Checksum) {
+			return &BlockError{Index: seq, Offset: a.offset, Kind: ErrCorruptLiteral}
+		}
+
+		if a.dict != nil {
+			a.dict.add(&dictEntry{data: o.Data, size: len(o.Data)})
+		}
+		a.trace.sent(len(o.Data))
+		return a.write(o.Index, o.Data)
+	}
+
+	if cached != nil {
+		return a.write(o.Index, cached)
+	}
 
-		_, err := dst.Write(block)
+	if o.Index+o.blocks()-1 < o.Index {
+		return &BlockError{Index: o.Index, Offset: a.offset, Kind: ErrOffsetOverflow}
+	}
+
+	for i := uint64(0); i < o.blocks(); i++ {
+		start := a.trace.now()
+		block, err := a.readBlock(o, a.buffer, o.Index+i)
+		a.trace.add(phaseRead, start)
 		if err != nil {
-			return errors.Wrapf(err, "failed writing block to destination")
+			return err
+		}
+
+		if err := a.write(o.Index+i, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish verifies the operation stream was complete.
+func (a *applier) finish() error {
+	if a.cfg.requireDone && !a.done {
+		return ErrTruncatedStream
+	}
+
+	if a.cfg.fsync > 0 && a.unsynced > 0 {
+		if err := a.fsync(); err != nil {
+			return err
+		}
+	}
+
+	if len(a.skipped) > 0 {
+		return &SkippedError{Failed: a.skipped}
+	}
+	return nil
+}
+
+// write writes a block to the destination.
+func (a *applier) write(index uint64, block []byte) error {
+	start := a.trace.now()
+	n, err := a.dst.Write(block)
+	a.trace.add(phaseWrite, start)
+	if a.cfg.backWindow > 0 {
+		a.remember(block[:n])
+	}
+	a.offset += int64(n)
+	if err != nil {
+		return &BlockError{Index: index, Kind: ErrApplyWrite, Err: err}
+	}
+
+	if a.cfg.fsync > 0 {
+		a.unsynced += int64(n)
+		if a.unsynced >= a.cfg.fsync {
+			return a.fsync()
 		}
 	}
 	return nil
 }
+
+// blockReader reads the cached block at index, into buffer if it needs one. The block returned is
+// only valid until the buffer is reused.
+type blockReader func(buffer []byte, index uint64) ([]byte, error)
+
+// readFrom returns a blockReader reading blocks from cache, see readCached.
+func readFrom(cache io.ReaderAt, cfg *options) blockReader {
+	return func(buffer []byte, index uint64) ([]byte, error) {
+		return readCached(cache, buffer, index, cfg)
+	}
+}
+
+// readCached reads the cached block at index into buffer, where the block layout of cfg places it.
+func readCached(cache io.ReaderAt, buffer []byte, index uint64, cfg *options) ([]byte, error) {
+	if f, ok := cache.(*os.File); cache == nil || (ok && f == nil) {
+		return nil, &BlockError{Index: index, Kind: ErrMissingCache}
+	}
+
+	offset, err := cfg.blockOffset(index)
+	if cfg.stride > 0 {
+		offset, err = cfg.windowOffset(index)
+	}
+	if layout := cfg.layout; layout != nil {
+		var size int
+		offset, size = layout.block(index)
+		buffer, err = buffer[:size], nil
+		if offset < 0 {
+			err = &BlockError{Index: index, Kind: ErrOffsetOverflow}
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := cache.ReadAt(buffer, offset)
+	if err != nil && err != io.EOF {
+		return nil, &BlockError{Index: index, Offset: offset, Kind: ErrReadCache, Err: err}
+	}
+
+	return buffer[:n], nil
+}
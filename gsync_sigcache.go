@@ -0,0 +1,137 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// SignatureStore persists the signature sets of a SignatureCache, i.e. in memory, on disk or in
+// a shared key-value store. It must be safe for concurrent use.
+type SignatureStore interface {
+	// Load returns the signatures stored under key, and whether there were any.
+	Load(key string) ([]BlockSignature, bool, error)
+	// Store saves the signatures under key, replacing any previous ones.
+	Store(key string, sigs []BlockSignature) error
+}
+
+// MemoryStore is a SignatureStore keeping signatures in memory, without any eviction. The zero
+// value is ready to use.
+type MemoryStore struct {
+	mu   sync.RWMutex
+	sigs map[string][]BlockSignature
+}
+
+// Load implements SignatureStore.
+func (m *MemoryStore) Load(key string) ([]BlockSignature, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sigs, ok := m.sigs[key]
+	return sigs, ok, nil
+}
+
+// Store implements SignatureStore.
+func (m *MemoryStore) Store(key string, sigs []BlockSignature) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.sigs == nil {
+		m.sigs = make(map[string][]BlockSignature)
+	}
+	m.sigs[key] = sigs
+	return nil
+}
+
+// SignatureCache saves servers from calculating the signatures of the same files over and over.
+// Signature sets are stored under a key identifying the content of a file, such as the one
+// returned by FileKey or the file Digest, and only calculated when not found. Whenever the file
+// changes, so must its key. A SignatureCache is safe for concurrent use, although concurrent
+// misses of the same key may calculate its signatures more than once.
+type SignatureCache struct {
+	store   SignatureStore
+	newHash func() hash.Hash
+	opts    []Option
+}
+
+// NewSignatureCache returns a SignatureCache saving signatures to store, or to a new MemoryStore if
+// nil. Signatures are calculated as Signatures would, with the strong hash returned by newHash, or
+// sha256 if nil, and the given options.
+func NewSignatureCache(store SignatureStore, newHash func() hash.Hash, opts ...Option) *SignatureCache {
+	if store == nil {
+		store = new(MemoryStore)
+	}
+
+	if newHash == nil {
+		newHash = func() hash.Hash { return nil }
+	}
+
+	return &SignatureCache{store: store, newHash: newHash, opts: opts}
+}
+
+// Get returns the signatures stored under key or, if there are none, calculates the signatures of
+// the file returned by open, which is closed afterwards if it is an io.Closer, and stores them.
+// The signatures are in index order and do not include the Done signature. They are shared with
+// other callers and must not be modified. Failing to read the file fails the whole set, which is
+// not stored.
+func (c *SignatureCache) Get(ctx context.Context, key string, open func() io.Reader) ([]BlockSignature, error) {
+	sigs, ok, err := c.store.Load(key)
+	if err != nil || ok {
+		return sigs, err
+	}
+
+	r := open()
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	// Signatures keeps going after read errors, so it is stopped at the first one.
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sigsCh, err := Signatures(sctx, r, c.newHash(), c.opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var done bool
+	for sig := range sigsCh {
+		if sig.Error != nil {
+			err = sig.Error
+			break
+		}
+
+		if sig.Done {
+			done = true
+			continue
+		}
+		sigs = append(sigs, sig)
+	}
+
+	if err == nil && !done {
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.store.Store(key, sigs); err != nil {
+		return nil, err
+	}
+	return sigs, nil
+}
+
+// FileKey returns a key identifying the content of the file at path through its size and
+// modification time, as rsync does by default, for use with SignatureCache. It is cheap, but
+// misses changes preserving both; use the file Digest as key when that is a concern.
+func FileKey(path string, info fs.FileInfo) string {
+	return fmt.Sprintf("%s:%d:%d", path, info.Size(), info.ModTime().UnixNano())
+}
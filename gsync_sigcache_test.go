@@ -0,0 +1,59 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestSignatureCache(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	data := srand(370, 10*DefaultBlockSize+50)
+	var opened int
+	open := func() io.Reader {
+		opened++
+		return bytes.NewReader(data)
+	}
+
+	store := new(MemoryStore)
+	c := NewSignatureCache(store, nil)
+
+	sigs, err := c.Get(ctx, "a", open)
+	assert.Ok(t, err)
+	assert.Equals(t, 11, len(sigs))
+	assert.Equals(t, 1, opened)
+
+	cached, err := c.Get(ctx, "a", open)
+	assert.Ok(t, err)
+	assert.Equals(t, sigs, cached)
+	assert.Equals(t, 1, opened)
+
+	// Signatures are shared across caches using the same store.
+	cached, err = NewSignatureCache(store, nil).Get(ctx, "a", open)
+	assert.Ok(t, err)
+	assert.Equals(t, sigs, cached)
+	assert.Equals(t, 1, opened)
+
+	_, err = c.Get(ctx, "b", open)
+	assert.Ok(t, err)
+	assert.Equals(t, 2, opened)
+
+	// Failed sets are not stored.
+	failure := errors.New("failed")
+	_, err = c.Get(ctx, "c", func() io.Reader { return failingReader{failure} })
+	assert.Cond(t, errors.Is(err, failure), "expected the read error, got %v", err)
+	_, ok, err := store.Load("c")
+	assert.Ok(t, err)
+	assert.Equals(t, false, ok)
+}
@@ -0,0 +1,324 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/minio/sha256-simd"
+	"github.com/pkg/errors"
+)
+
+// SignatureDelta describes how the signature set of a file changed between two versions of it,
+// so that whoever holds the signatures of the old version can update them to the new one without
+// receiving them all again. It suits large files that change slowly and are synced often.
+//
+// Signatures are identified by their position, the Index and Count of the blocks they cover, so
+// the delta holds the signatures at positions whose content changed or that are new, and the
+// positions no longer signed, such as those past the end of a file that shrank. Edits shifting
+// data by less than a block change all signatures after them, and so are as expensive as sending
+// all of them. Done and failed signatures are not part of signature sets.
+type SignatureDelta struct {
+	// Base is the fingerprint of the signature set the delta applies to.
+	Base []byte
+	// Changed holds the signatures new or changed, in position order.
+	Changed []BlockSignature
+	// Removed holds the positions of the signatures removed, as signatures with only Index and
+	// Count set, in position order.
+	Removed []BlockSignature
+}
+
+// NewSignatureDelta returns the delta updating the signature set old to next. Both sets must be
+// calculated with the same options and strong hash.
+func NewSignatureDelta(old, next []BlockSignature) *SignatureDelta {
+	olds := signaturePositions(old)
+	news := signaturePositions(next)
+
+	d := &SignatureDelta{Base: signatureFingerprint(old)}
+	for pos, sig := range news {
+		if prev, ok := olds[pos]; !ok || !sameSignature(prev, sig) {
+			d.Changed = append(d.Changed, sig)
+		}
+	}
+	for pos := range olds {
+		if _, ok := news[pos]; !ok {
+			d.Removed = append(d.Removed, BlockSignature{Index: pos.index, Count: pos.count})
+		}
+	}
+
+	sortPositions(d.Changed)
+	sortPositions(d.Removed)
+	return d
+}
+
+// Apply returns the signature set resulting from applying the delta to sigs, in position order,
+// leaving sigs untouched. It fails with ErrBaseMismatch if sigs is not the set the delta was
+// calculated from.
+func (d *SignatureDelta) Apply(sigs []BlockSignature) ([]BlockSignature, error) {
+	if !bytes.Equal(signatureFingerprint(sigs), d.Base) {
+		return nil, ErrBaseMismatch
+	}
+
+	set := signaturePositions(sigs)
+	for _, sig := range d.Removed {
+		delete(set, positionOf(sig))
+	}
+	for _, sig := range d.Changed {
+		set[positionOf(sig)] = sig
+	}
+
+	result := make([]BlockSignature, 0, len(set))
+	for _, sig := range set {
+		result = append(result, sig)
+	}
+	sortPositions(result)
+	return result, nil
+}
+
+// position identifies a signature by the blocks it covers.
+type position struct {
+	index, count uint64
+}
+
+func positionOf(sig BlockSignature) position {
+	return position{index: sig.Index, count: sig.blocks()}
+}
+
+// signaturePositions returns the signatures of sigs by position, leaving out Done and failed ones.
+func signaturePositions(sigs []BlockSignature) map[position]BlockSignature {
+	set := make(map[position]BlockSignature, len(sigs))
+	for _, sig := range sigs {
+		if !sig.Done && sig.Error == nil {
+			set[positionOf(sig)] = sig
+		}
+	}
+	return set
+}
+
+// sameSignature reports whether a and b sign the same content in the same way.
+func sameSignature(a, b BlockSignature) bool {
+	return a.Weak == b.Weak && a.Modulus == b.Modulus && a.Hash == b.Hash && a.Length == b.Length &&
+		bytes.Equal(a.Strong, b.Strong)
+}
+
+// sortPositions sorts signatures by position.
+func sortPositions(sigs []BlockSignature) {
+	sort.Slice(sigs, func(i, j int) bool {
+		if sigs[i].Index != sigs[j].Index {
+			return sigs[i].Index < sigs[j].Index
+		}
+		return sigs[i].blocks() < sigs[j].blocks()
+	})
+}
+
+// signatureFingerprint returns the SHA-256 digest of the encoding of sigs in position order, which
+// identifies a signature set regardless of the order of its signatures.
+func signatureFingerprint(sigs []BlockSignature) []byte {
+	set := signaturePositions(sigs)
+	sorted := make([]BlockSignature, 0, len(set))
+	for _, sig := range set {
+		sorted = append(sorted, sig)
+	}
+	sortPositions(sorted)
+
+	h := sha256.New()
+	var b []byte
+	for _, sig := range sorted {
+		b = appendSignature(b[:0], sig)
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+// Signature deltas are encoded as:
+//
+//	magic:    "GSDL"
+//	version:  1 byte, deltaVersion
+//	base:     len fingerprint
+//	changed:  count, followed by that many signatures
+//	removed:  count, followed by that many index count pairs
+//	crc:      4 bytes, the CRC-32C of all the above
+//
+// with signatures encoded as index count length weak modulus hash len strong, weak being 4 bytes
+// and hash 1 byte. Other integers are unsigned varints, byte strings are prefixed by their length
+// and the checksum is big-endian.
+const (
+	deltaMagic   = "GSDL"
+	deltaVersion = 1
+)
+
+// appendSignature appends the encoding of sig to b.
+func appendSignature(b []byte, sig BlockSignature) []byte {
+	b = appendUvarint(b, sig.Index)
+	b = appendUvarint(b, sig.Count)
+	b = appendUvarint(b, uint64(sig.Length))
+	b = append(b, byte(sig.Weak>>24), byte(sig.Weak>>16), byte(sig.Weak>>8), byte(sig.Weak))
+	b = appendUvarint(b, uint64(sig.Modulus))
+	b = append(b, byte(sig.Hash))
+	return appendBytes(b, sig.Strong)
+}
+
+// WriteTo writes the encoding of the delta to w.
+func (d *SignatureDelta) WriteTo(w io.Writer) (int64, error) {
+	b := append([]byte(deltaMagic), deltaVersion)
+	b = appendBytes(b, d.Base)
+	b = appendUvarint(b, uint64(len(d.Changed)))
+	for _, sig := range d.Changed {
+		b = appendSignature(b, sig)
+	}
+	b = appendUvarint(b, uint64(len(d.Removed)))
+	for _, sig := range d.Removed {
+		b = appendUvarint(appendUvarint(b, sig.Index), sig.blocks())
+	}
+
+	sum := crc32.Checksum(b, crc32cTable)
+	b = append(b, byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum))
+
+	n, err := w.Write(b)
+	return int64(n), errors.Wrapf(err, "failed writing signature delta")
+}
+
+// ReadSignatureDelta reads a delta written by SignatureDelta.WriteTo off r. It returns
+// ErrMalformedDelta if the data read is not a valid delta and ErrUnsupportedVersion if it was
+// written with a newer version of the format. Reads are buffered, so r may be read past the end of
+// the delta.
+func ReadSignatureDelta(r io.Reader) (*SignatureDelta, error) {
+	dr := &deltaReader{r: bufio.NewReader(r)}
+	d, err := dr.delta()
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errors.Wrapf(ErrMalformedDelta, "truncated")
+	}
+	return d, err
+}
+
+// deltaReader decodes a signature delta, calculating the checksum of the data read.
+type deltaReader struct {
+	r   *bufio.Reader
+	crc uint32
+}
+
+func (r *deltaReader) ReadByte() (byte, error) {
+	c, err := r.r.ReadByte()
+	if err == nil {
+		r.crc = crc32.Update(r.crc, crc32cTable, []byte{c})
+	}
+	return c, err
+}
+
+func (r *deltaReader) full(p []byte) error {
+	_, err := io.ReadFull(r.r, p)
+	r.crc = crc32.Update(r.crc, crc32cTable, p)
+	return err
+}
+
+func (r *deltaReader) uvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(r)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		err = errors.Wrapf(ErrMalformedDelta, "%v", err)
+	}
+	return v, err
+}
+
+func (r *deltaReader) bytes() ([]byte, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > 255 {
+		return nil, errors.Wrapf(ErrMalformedDelta, "checksum of %d bytes", n)
+	}
+	b := make([]byte, n)
+	return b, r.full(b)
+}
+
+func (r *deltaReader) delta() (*SignatureDelta, error) {
+	header := make([]byte, len(deltaMagic)+1)
+	if err := r.full(header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(deltaMagic)]) != deltaMagic {
+		return nil, errors.Wrapf(ErrMalformedDelta, "missing header")
+	}
+	if v := header[len(deltaMagic)]; v == 0 || v > deltaVersion {
+		return nil, errors.Wrapf(ErrUnsupportedVersion, "signature delta version %d", v)
+	}
+
+	d := new(SignatureDelta)
+	var err error
+	if d.Base, err = r.bytes(); err != nil {
+		return nil, err
+	}
+
+	n, err := r.uvarint()
+	for i := uint64(0); err == nil && i < n; i++ {
+		var sig BlockSignature
+		sig, err = r.signature()
+		d.Changed = append(d.Changed, sig)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	n, err = r.uvarint()
+	for i := uint64(0); err == nil && i < n; i++ {
+		var sig BlockSignature
+		if sig.Index, err = r.uvarint(); err == nil {
+			sig.Count, err = r.uvarint()
+		}
+		d.Removed = append(d.Removed, sig)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	crc := r.crc
+	var sum [4]byte
+	if err := r.full(sum[:]); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(sum[:]) != crc {
+		return nil, errors.Wrapf(ErrMalformedDelta, "checksum mismatch")
+	}
+	return d, nil
+}
+
+// signature decodes a signature encoded by appendSignature.
+func (r *deltaReader) signature() (BlockSignature, error) {
+	var sig BlockSignature
+	var length, modulus uint64
+	var err error
+	for _, v := range []*uint64{&sig.Index, &sig.Count, &length} {
+		if *v, err = r.uvarint(); err != nil {
+			return sig, err
+		}
+	}
+	if length > maxBlockSize {
+		return sig, errors.Wrapf(ErrMalformedDelta, "block length %d", length)
+	}
+
+	var weak [4]byte
+	if err := r.full(weak[:]); err != nil {
+		return sig, err
+	}
+	if modulus, err = r.uvarint(); err != nil {
+		return sig, err
+	}
+	if modulus > 1<<16 {
+		return sig, errors.Wrapf(ErrMalformedDelta, "modulus %d", modulus)
+	}
+	hash, err := r.ReadByte()
+	if err != nil {
+		return sig, err
+	}
+
+	sig.Length, sig.Weak, sig.Modulus, sig.Hash = int(length), binary.BigEndian.Uint32(weak[:]), uint32(modulus), HashID(hash)
+	sig.Strong, err = r.bytes()
+	return sig, err
+}
@@ -0,0 +1,91 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+func TestSignatureDelta(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	signatures := func(data []byte, opts ...Option) []BlockSignature {
+		sigsCh, err := Signatures(ctx, bytes.NewReader(data), nil, opts...)
+		assert.Ok(t, err)
+		var sigs []BlockSignature
+		for sig := range sigsCh {
+			assert.Ok(t, sig.Error)
+			if !sig.Done {
+				sigs = append(sigs, sig)
+			}
+		}
+		return sigs
+	}
+
+	// Blocks overwritten in place, and the file growing or shrinking.
+	old := srand(540, 30*DefaultBlockSize+100)
+	edited := append([]byte(nil), old...)
+	copy(edited[3*DefaultBlockSize+10:], "changed")
+	copy(edited[17*DefaultBlockSize:], "changed too")
+
+	for _, tt := range []struct {
+		desc    string
+		next    []byte
+		opts    []Option
+		changed int
+		removed int
+	}{
+		{"unchanged", old, nil, 0, 0},
+		{"edited", edited, nil, 2, 0},
+		{"grown", append(append([]byte(nil), edited...), srand(541, 2*DefaultBlockSize)...), nil, 5, 0},
+		{"shrunk", edited[:20*DefaultBlockSize], nil, 2, 11},
+		{"coarse", edited, []Option{WithCoarseBlocks(4)}, 4, 0},
+	} {
+		oldSigs, nextSigs := signatures(old, tt.opts...), signatures(tt.next, tt.opts...)
+		d := NewSignatureDelta(oldSigs, nextSigs)
+		assert.Equals(t, tt.changed, len(d.Changed))
+		assert.Equals(t, tt.removed, len(d.Removed))
+
+		buf := new(bytes.Buffer)
+		_, err := d.WriteTo(buf)
+		assert.Ok(t, err)
+		decoded, err := ReadSignatureDelta(bytes.NewReader(buf.Bytes()))
+		assert.Ok(t, err)
+
+		updated, err := decoded.Apply(oldSigs)
+		assert.Ok(t, err)
+		sortPositions(nextSigs)
+		assert.Equals(t, nextSigs, updated)
+	}
+
+	// Deltas only apply to the set they were calculated from, and corruption is detected.
+	d := NewSignatureDelta(signatures(old), signatures(edited))
+	_, err := d.Apply(signatures(edited))
+	assert.Equals(t, ErrBaseMismatch, err)
+
+	buf := new(bytes.Buffer)
+	_, err = d.WriteTo(buf)
+	assert.Ok(t, err)
+	encoded := buf.Bytes()
+
+	corrupt := append([]byte(nil), encoded...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	for _, b := range [][]byte{corrupt, encoded[:len(encoded)-3], []byte("GSYN")} {
+		_, err = ReadSignatureDelta(bytes.NewReader(b))
+		assert.Cond(t, errors.Is(err, ErrMalformedDelta), "unexpected error: %v", err)
+	}
+
+	newer := append([]byte(nil), encoded...)
+	newer[4] = deltaVersion + 1
+	_, err = ReadSignatureDelta(bytes.NewReader(newer))
+	assert.Cond(t, errors.Is(err, ErrUnsupportedVersion), "unexpected error: %v", err)
+}
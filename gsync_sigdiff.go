@@ -0,0 +1,65 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import "sort"
+
+// DiffSignatures compares the signatures of two versions of a file by strong checksum, telling
+// which blocks changed when only their signatures are at hand. It returns the indices of the new
+// blocks whose content is not found in any old block, added, the indices of the old blocks whose
+// content is not found in any new block, removed, and the indices of the new blocks whose content
+// is found in some old block, common, all in ascending order.
+//
+// Blocks are matched by content regardless of their position, so blocks that shifted by whole
+// blocks are common. However, signatures only cover blocks at multiples of the block size, so
+// data inserted or removed anywhere else shifts all the blocks after it off their boundaries,
+// turning them into added blocks, while Sync would still find them. Done, failed and coarse
+// signatures are ignored. Both sets must be calculated with the same strong hash.
+func DiffSignatures(old, next []BlockSignature) (added, removed, common []uint64) {
+	olds := signatureSet(old)
+	news := signatureSet(next)
+
+	for _, sig := range next {
+		if !sig.diffable() {
+			continue
+		}
+		if olds[string(sig.Strong)] {
+			common = append(common, sig.Index)
+		} else {
+			added = append(added, sig.Index)
+		}
+	}
+
+	for _, sig := range old {
+		if sig.diffable() && !news[string(sig.Strong)] {
+			removed = append(removed, sig.Index)
+		}
+	}
+
+	sortIndices(added)
+	sortIndices(removed)
+	sortIndices(common)
+	return added, removed, common
+}
+
+// diffable reports whether b is the signature of a single block, see DiffSignatures.
+func (b BlockSignature) diffable() bool {
+	return !b.Done && b.Error == nil && b.blocks() == 1
+}
+
+// signatureSet returns the set of strong checksums of the blocks signed by sigs.
+func signatureSet(sigs []BlockSignature) map[string]bool {
+	set := make(map[string]bool, len(sigs))
+	for _, sig := range sigs {
+		if sig.diffable() {
+			set[string(sig.Strong)] = true
+		}
+	}
+	return set
+}
+
+func sortIndices(s []uint64) {
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+}
@@ -0,0 +1,57 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestDiffSignatures(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	sign := func(data []byte) []BlockSignature {
+		sigsCh, err := Signatures(ctx, bytes.NewReader(data), nil, WithCoarseBlocks(2))
+		assert.Ok(t, err)
+
+		var sigs []BlockSignature
+		for sig := range sigsCh {
+			assert.Ok(t, sig.Error)
+			sigs = append(sigs, sig)
+		}
+		return sigs
+	}
+
+	old := srand(313, 10*DefaultBlockSize)
+	block := func(i int) []byte {
+		return old[i*DefaultBlockSize : (i+1)*DefaultBlockSize]
+	}
+
+	// Blocks move around by whole blocks, two are gone and two are next.
+	var next []byte
+	for i := 5; i < 10; i++ {
+		next = append(next, block(i)...)
+	}
+	next = append(next, srand(314, DefaultBlockSize)...)
+	for i := 0; i < 3; i++ {
+		next = append(next, block(i)...)
+	}
+	next = append(next, block(1)[:100]...)
+
+	added, removed, common := DiffSignatures(sign(old), sign(next))
+	assert.Equals(t, []uint64{5, 9}, added)
+	assert.Equals(t, []uint64{3, 4}, removed)
+	assert.Equals(t, []uint64{0, 1, 2, 3, 4, 6, 7, 8}, common)
+
+	added, removed, common = DiffSignatures(sign(old), sign(old))
+	assert.Equals(t, 0, len(added))
+	assert.Equals(t, 0, len(removed))
+	assert.Equals(t, 10, len(common))
+}
@@ -0,0 +1,372 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// SignatureIndex looks up remote block signatures by weak checksum, for Sync to match against
+// signature sets that do not fit in memory. See WithSignatureIndex and OpenSignatureIndex.
+type SignatureIndex interface {
+	// Lookup returns the signatures whose weak checksum is weak, if any.
+	Lookup(weak uint32) ([]BlockSignature, error)
+	// Summary describes the signatures indexed.
+	Summary() IndexSummary
+}
+
+// IndexSummary describes the signatures of a SignatureIndex, so Sync can validate them without
+// going through all of them.
+type IndexSummary struct {
+	// Count is the number of signatures indexed.
+	Count uint64
+	// Hash identifies the strong hash all signatures were calculated with and StrongSize is the
+	// length of their strong checksums.
+	Hash       HashID
+	StrongSize int
+	// Modulus is the modulus of the rolling checksum of all signatures, or zero for the default.
+	Modulus uint32
+	// Coarse is the number of blocks covered by coarse signatures, if any. See WithCoarseBlocks.
+	Coarse uint64
+	// Tail is the signature of the last block of the file, if shorter than the rest.
+	Tail *BlockSignature
+}
+
+// remote returns a lookup table holding a single signature with the properties shared by all
+// signatures in the index, for the validations Sync does on whole lookup tables.
+func (s IndexSummary) remote() map[uint32][]BlockSignature {
+	if s.Count == 0 {
+		return nil
+	}
+
+	sample := BlockSignature{Hash: s.Hash, Strong: make([]byte, s.StrongSize), Modulus: s.Modulus, Count: s.Coarse}
+	remote := map[uint32][]BlockSignature{0: {sample}}
+	if s.Tail != nil {
+		remote[1] = []BlockSignature{*s.Tail}
+	}
+	return remote
+}
+
+// The on-disk signature index starts with a header of indexHeaderSize bytes, all integers being
+// big-endian:
+//
+//	magic:       "GSIX"
+//	version:     1 byte, indexVersion
+//	hash:        1 byte, the HashID of all signatures
+//	strong size: 1 byte, the length of all strong checksums
+//	bits:        1 byte, the number of buckets is 1<<bits
+//	modulus:     4 bytes, the rolling checksum modulus, or zero for the default
+//	filter bits: 1 byte, the filter holds 1<<filter bits bits
+//	reserved:    3 bytes, zero
+//	count:       8 bytes, the number of records
+//	coarse:      8 bytes, the blocks covered by coarse signatures, if any
+//	tail:        8 bytes, one plus the number of the record of the tail signature, if any
+//
+// It is followed by a Bloom filter of the weak checksums indexed, 1<<filter bits bits, the most
+// significant bit of the first byte being bit zero, and by the bucket directory, 1<<bits + 1 record
+// numbers of 8 bytes, bucket i holding the records from entry i up to entry i+1. Records come
+// last, sorted by bucket, each of indexRecordSize plus strong size bytes:
+//
+//	weak:   4 bytes
+//	length: 4 bytes
+//	index:  8 bytes
+//	count:  8 bytes
+//	strong: strong size bytes
+//
+// Signatures are assigned to buckets by a multiplicative hash of their weak checksum. Lookups
+// test the filter, which is kept in memory, and only read the directory entries and records of
+// the bucket of weak checksums passing it, which are about one record long, so every lookup of a
+// weak checksum present in the index takes two reads. The filter takes indexFilterRatio bits per
+// signature, and sets indexFilterHashes bits per weak checksum, so about one in four hundred
+// absent weak checksums pass it, and every byte rolled through by Sync costs 0.005 reads.
+const (
+	indexMagic      = "GSIX"
+	indexVersion    = 2
+	indexHeaderSize = 40
+	indexRecordSize = 24
+	// indexMinBits and indexMaxBits bound the number of buckets, which is otherwise the number of
+	// signatures rounded up to a power of two.
+	indexMinBits = 8
+	indexMaxBits = 28
+	// indexFilterRatio and indexFilterHashes set the false positive rate of the filter, whose
+	// size is bounded by indexMinBits and indexMaxFilterBits.
+	indexFilterRatio   = 16
+	indexFilterHashes  = 4
+	indexMaxFilterBits = indexMaxBits + 4
+)
+
+// indexBucket returns the bucket of a weak checksum, given the number of bucket bits.
+func indexBucket(weak uint32, bits uint8) uint32 {
+	return (weak * 2654435761) >> (32 - bits)
+}
+
+// indexFilter calls fn with the bits of the filter set for a weak checksum, given the number of
+// filter bits, until fn returns false. The bits are derived from two halves of a 64-bit mix of
+// the weak checksum, by double hashing.
+func indexFilter(weak uint32, bits uint8, fn func(bit uint64) bool) {
+	x := uint64(weak)
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	h1, h2 := x&0xffffffff, x>>32|1
+	mask := uint64(1)<<bits - 1
+	for i := uint64(0); i < indexFilterHashes; i++ {
+		if !fn((h1 + i*h2) & mask) {
+			return
+		}
+	}
+}
+
+// WriteSignatureIndex writes the signatures read from sigs to w as a signature index, which
+// OpenSignatureIndex opens for Sync to query from disk. Done and coarse signatures are handled as
+// by LookUpTable, and the first signature carrying an error is returned. Signatures are held in
+// memory until all of them are read, since they are written sorted, so indices of large files are
+// best written once, next to the file they describe, and then reused.
+func WriteSignatureIndex(w io.WriteSeeker, sigs <-chan BlockSignature) error {
+	var (
+		all []BlockSignature
+		sum IndexSummary
+	)
+	for sig := range sigs {
+		if sig.Error != nil {
+			return sig.Error
+		}
+
+		if sig.Done {
+			continue
+		}
+
+		if len(all) == 0 {
+			sum.Hash, sum.StrongSize, sum.Modulus = sig.Hash, len(sig.Strong), sig.Modulus
+		}
+
+		switch {
+		case sig.Hash != sum.Hash || len(sig.Strong) != sum.StrongSize || sum.StrongSize > 255:
+			return &BlockError{Index: sig.Index, Kind: ErrHashMismatch}
+		case sig.Modulus != sum.Modulus:
+			return &BlockError{Index: sig.Index, Kind: ErrModulusMismatch}
+		}
+
+		if sig.blocks() > sum.Coarse && sig.blocks() > 1 {
+			sum.Coarse = sig.blocks()
+		}
+		all = append(all, sig)
+	}
+
+	bits := uint8(indexMinBits)
+	for bits < indexMaxBits && uint64(1)<<bits < uint64(len(all)) {
+		bits++
+	}
+	filterBits := uint8(indexMinBits)
+	for filterBits < indexMaxFilterBits && uint64(1)<<filterBits < indexFilterRatio*uint64(len(all)) {
+		filterBits++
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return indexBucket(all[i].Weak, bits) < indexBucket(all[j].Weak, bits)
+	})
+
+	buckets := uint64(1) << bits
+	filter := make([]byte, uint64(1)<<filterBits/8)
+	dir := make([]byte, 8*(buckets+1))
+	records := make([]byte, 0, len(all)*(indexRecordSize+sum.StrongSize))
+
+	var tail uint64
+	next := uint64(0)
+	for i, sig := range all {
+		indexFilter(sig.Weak, filterBits, func(bit uint64) bool {
+			filter[bit/8] |= 0x80 >> (bit % 8)
+			return true
+		})
+
+		b := uint64(indexBucket(sig.Weak, bits))
+		for ; next <= b; next++ {
+			binary.BigEndian.PutUint64(dir[8*next:], uint64(i))
+		}
+
+		if tail == 0 && sig.Length > 0 && sig.blocks() == 1 {
+			tail = uint64(i) + 1
+		}
+
+		var rec [indexRecordSize]byte
+		binary.BigEndian.PutUint32(rec[0:], sig.Weak)
+		binary.BigEndian.PutUint32(rec[4:], uint32(sig.Length))
+		binary.BigEndian.PutUint64(rec[8:], sig.Index)
+		binary.BigEndian.PutUint64(rec[16:], sig.Count)
+		records = append(append(records, rec[:]...), sig.Strong...)
+	}
+	for ; next <= buckets; next++ {
+		binary.BigEndian.PutUint64(dir[8*next:], uint64(len(all)))
+	}
+
+	header := make([]byte, indexHeaderSize)
+	copy(header, indexMagic)
+	header[4], header[5], header[6], header[7] = indexVersion, byte(sum.Hash), byte(sum.StrongSize), bits
+	binary.BigEndian.PutUint32(header[8:], sum.Modulus)
+	header[12] = filterBits
+	binary.BigEndian.PutUint64(header[16:], uint64(len(all)))
+	binary.BigEndian.PutUint64(header[24:], sum.Coarse)
+	binary.BigEndian.PutUint64(header[32:], tail)
+
+	if _, err := w.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "failed writing signature index")
+	}
+
+	for _, b := range [][]byte{header, filter, dir, records} {
+		if _, err := w.Write(b); err != nil {
+			return errors.Wrapf(err, "failed writing signature index")
+		}
+	}
+	return nil
+}
+
+// DiskIndex is a SignatureIndex read from disk, see WriteSignatureIndex for its layout. It is safe
+// for concurrent use, as long as its reader is.
+type DiskIndex struct {
+	r          io.ReaderAt
+	bits       uint8
+	filterBits uint8
+	filter     []byte
+	summary    IndexSummary
+	// records is the offset of the first record, and size the size of every record.
+	records int64
+	size    int
+}
+
+// OpenSignatureIndex opens a signature index written by WriteSignatureIndex, reading its header
+// and filter into memory, which takes two bytes per signature rounded up to a power of two.
+func OpenSignatureIndex(r io.ReaderAt) (*DiskIndex, error) {
+	header := make([]byte, indexHeaderSize)
+	if _, err := readAtFull(r, header, 0); err != nil {
+		return nil, errors.Wrapf(ErrMalformedIndex, "failed reading header: %v", err)
+	}
+
+	if string(header[:4]) != indexMagic {
+		return nil, errors.Wrapf(ErrMalformedIndex, "bad magic %q", header[:4])
+	}
+
+	if header[4] != indexVersion {
+		return nil, errors.Wrapf(ErrMalformedIndex, "unsupported version %d", header[4])
+	}
+
+	bits := header[7]
+	if bits < indexMinBits || bits > indexMaxBits {
+		return nil, errors.Wrapf(ErrMalformedIndex, "bad bucket bits %d", bits)
+	}
+
+	filterBits := header[12]
+	if filterBits < indexMinBits || filterBits > indexMaxFilterBits {
+		return nil, errors.Wrapf(ErrMalformedIndex, "bad filter bits %d", filterBits)
+	}
+
+	d := &DiskIndex{
+		r:          r,
+		bits:       bits,
+		filterBits: filterBits,
+		summary: IndexSummary{
+			Count:      binary.BigEndian.Uint64(header[16:]),
+			Hash:       HashID(header[5]),
+			StrongSize: int(header[6]),
+			Modulus:    binary.BigEndian.Uint32(header[8:]),
+			Coarse:     binary.BigEndian.Uint64(header[24:]),
+		},
+		size: indexRecordSize + int(header[6]),
+	}
+
+	buckets := int64(1) << bits
+	d.filter = make([]byte, int64(1)<<filterBits/8)
+	if _, err := readAtFull(r, d.filter, indexHeaderSize); err != nil {
+		return nil, errors.Wrapf(ErrMalformedIndex, "failed reading filter: %v", err)
+	}
+	d.records = indexHeaderSize + int64(len(d.filter)) + 8*(buckets+1)
+
+	if tail := binary.BigEndian.Uint64(header[32:]); tail > 0 {
+		sigs, err := d.read(tail-1, tail)
+		if err != nil {
+			return nil, err
+		}
+		d.summary.Tail = &sigs[0]
+	}
+	return d, nil
+}
+
+// Lookup implements SignatureIndex.
+func (d *DiskIndex) Lookup(weak uint32) ([]BlockSignature, error) {
+	present := true
+	indexFilter(weak, d.filterBits, func(bit uint64) bool {
+		present = d.filter[bit/8]&(0x80>>(bit%8)) != 0
+		return present
+	})
+	if !present {
+		return nil, nil
+	}
+
+	b := indexBucket(weak, d.bits)
+	var dir [16]byte
+	if _, err := readAtFull(d.r, dir[:], indexHeaderSize+int64(len(d.filter))+8*int64(b)); err != nil {
+		return nil, errors.Wrapf(ErrMalformedIndex, "failed reading bucket %d: %v", b, err)
+	}
+
+	sigs, err := d.read(binary.BigEndian.Uint64(dir[:]), binary.BigEndian.Uint64(dir[8:]))
+	if err != nil {
+		return nil, err
+	}
+
+	// Buckets hold several weak checksums.
+	matches := sigs[:0]
+	for _, sig := range sigs {
+		if sig.Weak == weak {
+			matches = append(matches, sig)
+		}
+	}
+	return matches, nil
+}
+
+// Summary implements SignatureIndex.
+func (d *DiskIndex) Summary() IndexSummary {
+	return d.summary
+}
+
+// read reads the records numbered from start up to end.
+func (d *DiskIndex) read(start, end uint64) ([]BlockSignature, error) {
+	if start > end || end > d.summary.Count {
+		return nil, errors.Wrapf(ErrMalformedIndex, "bad records %d to %d", start, end)
+	}
+
+	buf := make([]byte, int(end-start)*d.size)
+	if _, err := readAtFull(d.r, buf, d.records+int64(start)*int64(d.size)); err != nil {
+		return nil, errors.Wrapf(ErrMalformedIndex, "failed reading records %d to %d: %v", start, end, err)
+	}
+
+	sigs := make([]BlockSignature, end-start)
+	for i := range sigs {
+		rec := buf[i*d.size : (i+1)*d.size]
+		sigs[i] = BlockSignature{
+			Weak:    binary.BigEndian.Uint32(rec[0:]),
+			Length:  int(binary.BigEndian.Uint32(rec[4:])),
+			Index:   binary.BigEndian.Uint64(rec[8:]),
+			Count:   binary.BigEndian.Uint64(rec[16:]),
+			Strong:  rec[indexRecordSize:],
+			Hash:    d.summary.Hash,
+			Modulus: d.summary.Modulus,
+		}
+	}
+	return sigs, nil
+}
+
+// lookup returns the remote signatures whose weak checksum is weak.
+func (s *Syncer) lookup(weak uint32) ([]BlockSignature, error) {
+	if s.cfg.index == nil {
+		return s.remote[weak], nil
+	}
+	return s.cfg.index.Lookup(weak)
+}
@@ -0,0 +1,128 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+func TestSignatureIndex(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	f, err := ioutil.TempFile("", "gsync")
+	assert.Ok(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	cache := srand(670, 300*DefaultBlockSize+500)
+	source := mutate(cache, 671, 10)
+	opts := []Option{WithCoarseBlocks(4)}
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil, opts...)
+	assert.Ok(t, err)
+	assert.Ok(t, WriteSignatureIndex(f, sigsCh))
+
+	idx, err := OpenSignatureIndex(f)
+	assert.Ok(t, err)
+
+	sum := idx.Summary()
+	assert.Equals(t, uint64(301+300/4), sum.Count)
+	assert.Equals(t, HashSHA256, sum.Hash)
+	assert.Equals(t, uint64(4), sum.Coarse)
+	assert.Equals(t, uint64(300), sum.Tail.Index)
+	assert.Equals(t, 500, sum.Tail.Length)
+
+	sigsCh, err = Signatures(ctx, bytes.NewReader(cache), nil, opts...)
+	assert.Ok(t, err)
+	table, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	for weak, bs := range table {
+		found, err := idx.Lookup(weak)
+		assert.Ok(t, err)
+		assert.Equals(t, len(bs), len(found))
+	}
+
+	collect := func(c <-chan BlockOperation, err error) []BlockOperation {
+		assert.Ok(t, err)
+		var ops []BlockOperation
+		for op := range c {
+			assert.Ok(t, op.Error)
+			ops = append(ops, op)
+		}
+		return ops
+	}
+
+	// Matching against the index gives the same operations as against the lookup table.
+	exp := collect(Sync(ctx, bytes.NewReader(source), nil, table, opts...))
+	got := collect(Sync(ctx, bytes.NewReader(source), nil, nil, append(opts, WithSignatureIndex(idx))...))
+	assert.Equals(t, exp, got)
+
+	target := new(bytes.Buffer)
+	c := make(chan BlockOperation, len(got))
+	for _, op := range got {
+		c <- op
+	}
+	close(c)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), c))
+	assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+
+	_, err = OpenSignatureIndex(bytes.NewReader([]byte("GSYN not an index, but long enough to read")))
+	assert.Cond(t, errors.Is(err, ErrMalformedIndex), "expected ErrMalformedIndex, got %v", err)
+}
+
+// countingReaderAt counts the ReadAt calls reaching r.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.r.ReadAt(p, off)
+}
+
+func TestSignatureIndexAbsent(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	f, err := ioutil.TempFile("", "gsync")
+	assert.Ok(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(srand(672, 2000*DefaultBlockSize)), nil)
+	assert.Ok(t, err)
+	assert.Ok(t, WriteSignatureIndex(f, sigsCh))
+
+	counter := &countingReaderAt{r: f}
+	idx, err := OpenSignatureIndex(counter)
+	assert.Ok(t, err)
+	opened := counter.reads
+
+	// Rolling through a source sharing nothing with the indexed file barely reads the index.
+	source := srand(673, 200*DefaultBlockSize)
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, nil, WithSignatureIndex(idx))
+	assert.Ok(t, err)
+	var literal int
+	for op := range opsCh {
+		assert.Ok(t, op.Error)
+		literal += len(op.Data)
+	}
+	assert.Equals(t, len(source), literal)
+
+	reads := counter.reads - opened
+	assert.Cond(t, reads < len(source)/100, "%d index reads for %d source bytes", reads, len(source))
+}
@@ -0,0 +1,24 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+// skip records an error operation skipped, see WithSkipErrors.
+func (a *applier) skip(o BlockOperation) {
+	a.skipped = append(a.skipped, &BlockError{Index: o.Index, Offset: o.Offset, Kind: ErrSkipped, Err: o.Error})
+	a.resume = true
+}
+
+// seek makes the destination resume writing at offset, after skipping an error operation. Offsets
+// before the skipped operation can only mean offsets were lost, so nowhere is safe to resume at.
+func (a *applier) seek(offset int64) error {
+	a.resume = false
+	if offset < a.offset {
+		return &BlockError{Offset: offset, Kind: ErrMissingOffset}
+	}
+	if w, ok := a.dst.(*offsetWriter); ok {
+		w.off, a.offset = offset, offset
+	}
+	return nil
+}
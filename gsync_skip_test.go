@@ -0,0 +1,127 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+func TestApplySkipErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	source := srand(610, 10*DefaultBlockSize)
+	failure := errors.New("connection reset")
+
+	// The operations of blocks 3 and 7 fail in transit.
+	var sent []BlockOperation
+	for i := 0; i < 10; i++ {
+		off := int64(i) * DefaultBlockSize
+		op := BlockOperation{Index: uint64(i), Offset: off, Data: source[off : off+DefaultBlockSize]}
+		if i == 3 || i == 7 {
+			op.Data, op.Error = nil, failure
+		}
+		sent = append(sent, op)
+	}
+
+	ops := make(chan BlockOperation, len(sent))
+	for _, op := range sent {
+		ops <- op
+	}
+	close(ops)
+
+	dst := make(writerAtBuffer, len(source))
+	err := Apply(ctx, dst, nil, ops, WithSkipErrors())
+	assert.Cond(t, errors.Is(err, ErrSkipped), "expected skipped operations, got %v", err)
+
+	var serr *SkippedError
+	assert.Cond(t, errors.As(err, &serr), "expected a *SkippedError")
+	assert.Equals(t, []uint64{3, 7}, serr.Indices())
+	assert.Equals(t, failure, serr.Failed[1].Err)
+	assert.Equals(t, int64(7*DefaultBlockSize), serr.Failed[1].Offset)
+
+	// Retrying the skipped blocks completes the file.
+	retry := make(chan BlockOperation, 2)
+	for _, i := range serr.Indices() {
+		off := int64(i) * DefaultBlockSize
+		retry <- BlockOperation{Offset: off, Data: source[off : off+DefaultBlockSize]}
+	}
+	close(retry)
+	assert.Ok(t, ApplyAt(ctx, dst, nil, retry, 2))
+	assert.Cond(t, bytes.Equal(source, dst), "source and target files are different")
+
+	// Offsets lost on the wire are detected, and kept WithWireOffsets.
+	for _, opts := range [][]Option{nil, {WithWireOffsets()}} {
+		buf := new(bytes.Buffer)
+		enc := NewEncoder(buf, opts...)
+		for _, op := range sent {
+			assert.Ok(t, enc.Encode(op))
+		}
+		decoded, err := Decode(ctx, buf)
+		assert.Ok(t, err)
+
+		dst := make(writerAtBuffer, len(source))
+		err = Apply(ctx, dst, nil, decoded, WithSkipErrors())
+		if opts == nil {
+			assert.Cond(t, errors.Is(err, ErrMissingOffset), "expected ErrMissingOffset, got %v", err)
+			continue
+		}
+		assert.Cond(t, errors.As(err, &serr), "expected a *SkippedError, got %v", err)
+		assert.Equals(t, int64(7*DefaultBlockSize), serr.Failed[1].Offset)
+	}
+
+	// Fails fast by default, and skipping requires random writes.
+	ops = make(chan BlockOperation, 1)
+	ops <- BlockOperation{Error: failure}
+	close(ops)
+	err = Apply(ctx, new(bytes.Buffer), nil, ops)
+	assert.Equals(t, failure, errors.Cause(err))
+
+	err = Apply(ctx, new(bytes.Buffer), nil, nil, WithSkipErrors())
+	assert.Cond(t, err != nil, "expected sequential destinations to be rejected")
+}
+
+func TestApplySkipErrorsCache(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(611, 8*DefaultBlockSize)
+	source := append([]byte(nil), cache...)
+	copy(source[2*DefaultBlockSize:], srand(612, DefaultBlockSize))
+	copy(source[5*DefaultBlockSize:], srand(613, DefaultBlockSize))
+
+	// Blocks 2 and 5 changed, block 4 fails in transit and the rest are copied from the cache.
+	failure := errors.New("connection reset")
+	ops := make(chan BlockOperation, 9)
+	for i := 0; i < 8; i++ {
+		off := int64(i) * DefaultBlockSize
+		op := BlockOperation{Index: uint64(i), Offset: off}
+		switch i {
+		case 2, 5:
+			op.Data = source[off : off+DefaultBlockSize]
+		case 4:
+			op.Error = failure
+		}
+		ops <- op
+	}
+	ops <- BlockOperation{Done: true}
+	close(ops)
+
+	dst := make(writerAtBuffer, len(source))
+	err := Apply(ctx, dst, bytes.NewReader(cache), ops, WithSkipErrors())
+	var serr *SkippedError
+	assert.Cond(t, errors.As(err, &serr), "expected a *SkippedError, got %v", err)
+	assert.Equals(t, []uint64{4}, serr.Indices())
+
+	expected := append([]byte(nil), source...)
+	copy(expected[4*DefaultBlockSize:5*DefaultBlockSize], make([]byte, DefaultBlockSize))
+	assert.Cond(t, bytes.Equal(expected, dst), "target differs from source outside of skipped blocks")
+}
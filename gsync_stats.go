@@ -0,0 +1,82 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+// Stats collects counters about the matching done by Sync. They are useful to
+// empirically tune the weak and strong hashes for a given data set, for instance,
+// to find out whether a truncated strong hash is still long enough.
+//
+// Every weak hit costs a strong checksum of the window, which is wasted whenever no
+// candidate matches, as counted by WeakOnlyHits. If WeakOnlyHits is a sizable fraction of
+// WeakHits, the weak checksum space is too small for the data set, which shows as slow syncs
+// of large files. Widen it with WithWeakModulus, if it was narrowed, or switch to WeakCRC32C
+// with WithAligned, if data is updated in place.
+//
+// Stats are updated by the goroutine started by Sync without any synchronization,
+// so they must only be read once the operations channel has been closed.
+type Stats struct {
+	// WeakHits is the number of windows whose weak checksum was found in the lookup table.
+	WeakHits uint64
+	// WeakOnlyHits is the number of weak hits where no candidate matched the strong checksum,
+	// that is, fruitless strong checksum calculations caused by weak checksum collisions.
+	WeakOnlyHits uint64
+	// StrongComparisons is the number of strong checksums compared against candidates
+	// found in weak checksum buckets.
+	StrongComparisons uint64
+	// StrongRejections is the number of candidates whose strong checksum did not match,
+	// in other words, how many times the strong hash disambiguated a weak hash collision.
+	StrongRejections uint64
+	// BucketDepth is the distribution of weak checksum bucket sizes found on weak hits,
+	// keyed by the number of candidate signatures in the bucket.
+	BucketDepth map[int]uint64
+	// Refills is the number of times the read-ahead window was refilled from the source.
+	Refills uint64
+	// RefillCopied is the number of bytes moved within the read-ahead window by refills.
+	// See WithReadAhead.
+	RefillCopied uint64
+}
+
+// weakHit records a weak checksum hit on a bucket with the given number of candidates.
+func (s *Stats) weakHit(depth int) {
+	if s == nil {
+		return
+	}
+
+	s.WeakHits++
+	if s.BucketDepth == nil {
+		s.BucketDepth = make(map[int]uint64)
+	}
+	s.BucketDepth[depth]++
+}
+
+// strongCompared records the result of comparing a strong checksum against a candidate.
+func (s *Stats) strongCompared(match bool) {
+	if s == nil {
+		return
+	}
+
+	s.StrongComparisons++
+	if !match {
+		s.StrongRejections++
+	}
+}
+
+// refilled records a refill of the read-ahead window that kept the given number of bytes.
+func (s *Stats) refilled(kept int) {
+	if s == nil {
+		return
+	}
+
+	s.Refills++
+	s.RefillCopied += uint64(kept)
+}
+
+// weakOnlyHit records a weak hit where no candidate matched.
+func (s *Stats) weakOnlyHit() {
+	if s == nil {
+		return
+	}
+	s.WeakOnlyHits++
+}
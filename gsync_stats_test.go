@@ -0,0 +1,45 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestStats(t *testing.T) {
+	// Identical blocks land on the same weak checksum bucket and only one of them
+	// can be matched by the strong checksum.
+	cache := bytes.Repeat([]byte("a"), 4*DefaultBlockSize)
+	cache = append(cache, srand(60, 4*DefaultBlockSize)...)
+	source := append(srand(61, 100), cache...)
+
+	stats := new(Stats)
+	target := pipeline(t, source, cache, WithStats(stats))
+	assert.Cond(t, bytes.Equal(source, target), "source and target files are different")
+
+	assert.Cond(t, stats.WeakHits >= 8, "expected at least 8 weak hits, got %d", stats.WeakHits)
+	assert.Cond(t, stats.BucketDepth[4] > 0, "expected a bucket with 4 candidates: %v", stats.BucketDepth)
+	assert.Equals(t, stats.StrongComparisons-stats.StrongRejections, uint64(8))
+}
+
+func TestStatsWeakOnlyHits(t *testing.T) {
+	cache := srand(280, 20*DefaultBlockSize)
+	source := append(srand(281, 2*DefaultBlockSize), cache...)
+
+	// A tiny weak checksum space makes almost every window a weak hit.
+	stats := new(Stats)
+	target := pipeline(t, source, cache, WithWeakModulus(4), WithStats(stats))
+	assert.Cond(t, bytes.Equal(source, target), "source and target files are different")
+
+	assert.Cond(t, stats.WeakOnlyHits > DefaultBlockSize, "expected many weak only hits, got %d", stats.WeakOnlyHits)
+	assert.Equals(t, stats.WeakHits-stats.WeakOnlyHits, uint64(20))
+
+	stats = new(Stats)
+	pipeline(t, source, cache, WithStats(stats))
+	assert.Cond(t, stats.WeakOnlyHits < 10, "expected few weak only hits, got %d", stats.WeakOnlyHits)
+}
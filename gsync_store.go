@@ -0,0 +1,59 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import "io"
+
+// BlockStore is a content-addressed store of blocks, such as a deduplicating storage backend,
+// holding the blocks of the base data by their strong checksum. See WithBlockStore.
+type BlockStore interface {
+	// Get returns the block with the given strong checksum. Apply does not modify the block nor
+	// retain it once written. It may be called concurrently when prefetching, see WithPrefetch.
+	Get(strong []byte) ([]byte, error)
+}
+
+// copyHash returns the strong checksum to set on copy operations of the block signed by b, if any.
+func (s *Syncer) copyHash(b BlockSignature) []byte {
+	if !s.cfg.copyHashes {
+		return nil
+	}
+	return b.Strong
+}
+
+// readBlock reads the block at index copied by o, cut to o.Length if it is the last one of o.
+func (a *applier) readBlock(o BlockOperation, buffer []byte, index uint64) ([]byte, error) {
+	block, err := a.lookupBlock(o, buffer, index)
+	if err != nil || o.Length == 0 || index != o.Index+o.blocks()-1 {
+		return block, err
+	}
+
+	if len(block) < o.Length {
+		return nil, &BlockError{Index: index, Kind: ErrReadCache, Err: io.ErrUnexpectedEOF}
+	}
+	return block[:o.Length], nil
+}
+
+// lastLength returns the length of block i of the copy operation o, as a copy operation of its
+// own: o.Length for the last block and zero for the others.
+func lastLength(o BlockOperation, i uint64) int {
+	if i == o.blocks()-1 {
+		return o.Length
+	}
+	return 0
+}
+
+// lookupBlock reads the block at index copied by o, from the block store if o carries a strong
+// checksum and there is one, or from the cache into buffer otherwise.
+func (a *applier) lookupBlock(o BlockOperation, buffer []byte, index uint64) ([]byte, error) {
+	if a.cfg.store == nil || o.Strong == nil || o.blocks() > 1 {
+		return a.read(buffer, index)
+	}
+
+	block, err := a.cfg.store.Get(o.Strong)
+	if err != nil {
+		return nil, &BlockError{Index: index, Kind: ErrReadCache, Err: err}
+	}
+	return block, nil
+}
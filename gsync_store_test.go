@@ -0,0 +1,75 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+type mapStore map[string][]byte
+
+func (m mapStore) Get(strong []byte) ([]byte, error) {
+	block, ok := m[string(strong)]
+	if !ok {
+		return nil, errors.New("block not found")
+	}
+	return block, nil
+}
+
+func TestBlockStore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(450, 20*DefaultBlockSize+30)
+	source := append(append(srand(451, 2*DefaultBlockSize), cache[:12*DefaultBlockSize]...), cache[15*DefaultBlockSize:]...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+
+	store := make(mapStore)
+	var sigs []BlockSignature
+	for sig := range sigsCh {
+		assert.Ok(t, sig.Error)
+		if !sig.Done {
+			store[string(sig.Strong)] = cachedBlock(cache, sig.Index)
+		}
+		sigs = append(sigs, sig)
+	}
+	cacheSigs, err := LookUpTable(ctx, sliceSigs(sigs))
+	assert.Ok(t, err)
+
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, WithCopyHashes())
+	assert.Ok(t, err)
+
+	// Copies survive the wire format block by block, with their strong checksums.
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	var copies int
+	for op := range Compact(ctx, opsCh) {
+		assert.Ok(t, op.Error)
+		if op.copies() {
+			assert.Equals(t, uint64(1), op.blocks())
+			assert.Cond(t, op.Strong != nil, "copy operation without strong checksum")
+			copies++
+		}
+		assert.Ok(t, enc.Encode(op))
+	}
+	assert.Equals(t, 18, copies)
+
+	for _, opts := range [][]Option{nil, {WithPrefetch(4, 8)}} {
+		ops, err := Decode(ctx, bytes.NewReader(buf.Bytes()))
+		assert.Ok(t, err)
+
+		target := new(bytes.Buffer)
+		assert.Ok(t, Apply(ctx, target, nil, ops, append(opts, WithBlockStore(store))...))
+		assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+	}
+}
@@ -0,0 +1,110 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"hash"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// SyncStream is Sync for a source that can only be read forward once, such as a pipe or a network
+// stream. Only the data within reach of the rolling window is kept in memory. Signatures reads
+// streams already, so deltas between two streams can be calculated by signing the old one first,
+// and applied by replaying it to ApplyStream if Sync was given WithForwardCopies.
+//
+// WithIdentical and WithAppendOnly are not supported, since they may read the source twice.
+func SyncStream(ctx context.Context, r io.Reader, shash hash.Hash, remote map[uint32][]BlockSignature, opts ...Option) (<-chan BlockOperation, error) {
+	if r == nil {
+		return nil, ErrNilReader
+	}
+
+	cfg := newOptions(opts)
+	if cfg.err != nil {
+		return nil, cfg.err
+	}
+
+	if cfg.identical != nil || cfg.appendSize > 0 {
+		return nil, errors.New("gsync: SyncStream does not support WithIdentical or WithAppendOnly")
+	}
+	return Sync(ctx, &streamReaderAt{r: r}, shash, remote, opts...)
+}
+
+// ApplyStream is Apply for a cache that can only be read forward once, such as a pipe or a network
+// stream. Operations must have been calculated WithForwardCopies, otherwise copies of blocks
+// before the last one copied fail with ErrBackwardRead. Only the cached blocks being copied are
+// kept in memory. Operations must not announce a base digest either, since it can only be
+// verified by reading the whole cache beforehand.
+//
+// WithPrefetch and WithRange are not supported, since they read the cache out of order.
+func ApplyStream(ctx context.Context, dst io.Writer, cache io.Reader, ops <-chan BlockOperation, opts ...Option) error {
+	cfg := newOptions(opts)
+	if cfg.err != nil {
+		return cfg.err
+	}
+
+	if cfg.prefetchWorkers > 0 || cfg.ranged {
+		return errors.New("gsync: ApplyStream does not support WithPrefetch or WithRange")
+	}
+
+	var at io.ReaderAt
+	if cache != nil {
+		at = &streamReaderAt{r: cache}
+	}
+	return Apply(ctx, dst, at, ops, opts...)
+}
+
+// copyable reports whether the block signed by b can be copied, see WithForwardCopies.
+func (s *Syncer) copyable(b BlockSignature) bool {
+	return !s.cfg.forwardCopies || b.Index >= s.lastCopy
+}
+
+// streamReaderAt is an io.ReaderAt reading from a forward-only stream. It keeps the data from the
+// offset of the last read on, so reads must never start before the previous one did.
+type streamReaderAt struct {
+	r io.Reader
+	// buf holds the data read off r from off on.
+	buf []byte
+	off int64
+	// err is the error r failed with, if any.
+	err error
+}
+
+func (s *streamReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < s.off {
+		return 0, ErrBackwardRead
+	}
+
+	// Drop the data before off, skipping whatever was not read yet.
+	if skip := off - s.off; skip > int64(len(s.buf)) {
+		if s.err == nil {
+			_, s.err = io.CopyN(ioutil.Discard, s.r, skip-int64(len(s.buf)))
+		}
+		s.buf = s.buf[:0]
+	} else {
+		s.buf = s.buf[:copy(s.buf, s.buf[skip:])]
+	}
+	s.off = off
+
+	if cap(s.buf) < len(p) {
+		buf := make([]byte, len(s.buf), len(p))
+		s.buf = buf[:copy(buf, s.buf)]
+	}
+
+	for len(s.buf) < len(p) && s.err == nil {
+		var n int
+		n, s.err = s.r.Read(s.buf[len(s.buf):len(p)])
+		s.buf = s.buf[:len(s.buf)+n]
+	}
+
+	n := copy(p, s.buf)
+	if n < len(p) {
+		return n, s.err
+	}
+	return n, nil
+}
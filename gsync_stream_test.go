@@ -0,0 +1,93 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+// stream hides any other interface implemented by r, such as io.ReaderAt.
+type stream struct {
+	io.Reader
+}
+
+func TestSyncStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(480, 30*DefaultBlockSize+50)
+	// Moves the middle of the cache to the front, so some of its blocks come out of order.
+	source := append(append(append([]byte(nil), cache[10*DefaultBlockSize:20*DefaultBlockSize]...), srand(481, 700)...), cache[:10*DefaultBlockSize]...)
+	source = append(source, cache[20*DefaultBlockSize:]...)
+
+	for _, opts := range [][]Option{nil, {WithCoarseBlocks(4)}, {WithMinRun(3)}} {
+		sigsCh, err := Signatures(ctx, stream{bytes.NewReader(cache)}, nil, opts...)
+		assert.Ok(t, err)
+		cacheSigs, err := LookUpTable(ctx, sigsCh)
+		assert.Ok(t, err)
+
+		ops, err := SyncStream(ctx, stream{bytes.NewReader(source)}, nil, cacheSigs, append(opts, WithForwardCopies())...)
+		assert.Ok(t, err)
+
+		var literal int
+		target := new(bytes.Buffer)
+		audit := WithAudit(func(op BlockOperation, offset int64) {
+			literal += len(op.Data)
+		})
+		assert.Ok(t, ApplyStream(ctx, target, stream{bytes.NewReader(cache)}, ops, WithRequireDone(), audit))
+		assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+
+		// The blocks moved to the front are copied, those left behind are sent again.
+		assert.Cond(t, literal >= 10*DefaultBlockSize && literal < 11*DefaultBlockSize, "unexpected literal data: %d bytes", literal)
+	}
+
+	// Copies going backwards can not be applied.
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	ops, err := SyncStream(ctx, stream{bytes.NewReader(source)}, nil, cacheSigs)
+	assert.Ok(t, err)
+	err = ApplyStream(ctx, new(bytes.Buffer), stream{bytes.NewReader(cache)}, ops)
+	assert.Cond(t, errors.Is(err, ErrBackwardRead), "expected ErrBackwardRead, got %v", err)
+	Drain(ops)
+
+	_, err = SyncStream(ctx, stream{bytes.NewReader(source)}, nil, cacheSigs, WithIdentical([]byte("digest")))
+	assert.Cond(t, err != nil, "expected WithIdentical to be rejected")
+	err = ApplyStream(ctx, new(bytes.Buffer), stream{bytes.NewReader(cache)}, nil, WithPrefetch(2, 2))
+	assert.Cond(t, err != nil, "expected WithPrefetch to be rejected")
+}
+
+func TestStreamReaderAt(t *testing.T) {
+	data := srand(482, 1000)
+	r := &streamReaderAt{r: stream{bytes.NewReader(data)}}
+
+	for _, read := range []struct {
+		off, size int64
+	}{
+		{0, 100}, {0, 200}, {50, 10}, {500, 100}, {550, 450},
+	} {
+		p := make([]byte, read.size)
+		n, err := r.ReadAt(p, read.off)
+		assert.Ok(t, err)
+		assert.Equals(t, data[read.off:read.off+read.size], p[:n])
+	}
+
+	p := make([]byte, 100)
+	n, err := r.ReadAt(p, 950)
+	assert.Equals(t, io.EOF, err)
+	assert.Equals(t, data[950:], p[:n])
+
+	_, err = r.ReadAt(p, 900)
+	assert.Equals(t, ErrBackwardRead, err)
+}
@@ -0,0 +1,79 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import "io"
+
+// windowOffset returns the offset of the window at index, see WithStride.
+func (o *options) windowOffset(index uint64) (int64, error) {
+	if index > o.maxIndex()*uint64(o.size/o.stride) {
+		return 0, &BlockError{Index: index, Kind: ErrOffsetOverflow}
+	}
+	return int64(index) * int64(o.stride), nil
+}
+
+// nextWindow returns the signature of the window at index, which overlaps the previous one but for
+// its first stride bytes, see WithStride.
+func (s *Signer) nextWindow(index uint64) (BlockSignature, error) {
+	// Read failures can not be skipped over as with blocks, since the windows after the failure
+	// overlap the data lost, so they end the signatures.
+	if s.windowEnd && s.window <= s.cfg.stride {
+		return BlockSignature{}, io.EOF
+	}
+
+	window := s.buffer[:s.cfg.size]
+	keep := 0
+	if index > 0 {
+		keep = copy(window, window[s.cfg.stride:s.window])
+	}
+
+	start := s.trace.now()
+	n := 0
+	var err error
+	if !s.windowEnd {
+		n, err = readFull(s.r, window[keep:])
+	}
+	s.trace.add(phaseRead, start)
+
+	if err != nil && err != io.EOF {
+		s.window, s.windowEnd = 0, true
+		return BlockSignature{Index: index}, &BlockError{
+			Index:  index,
+			Offset: int64(index)*int64(s.cfg.stride) + int64(keep),
+			Kind:   ErrReadBlock,
+			Err:    err,
+		}
+	}
+
+	s.window, s.windowEnd = keep+n, s.windowEnd || err == io.EOF
+	if s.window == 0 {
+		return BlockSignature{}, io.EOF
+	}
+
+	block := window[:s.window]
+	start = s.trace.now()
+	s.trace.processed(n)
+	if s.digest != nil {
+		s.digest.Write(block[keep:])
+	}
+
+	s.shash.Reset()
+	s.shash.Write(block)
+	sig := BlockSignature{
+		Index:   index,
+		Weak:    s.cfg.weak.sum(block, s.cfg.modulus),
+		Modulus: s.modulus(),
+		Strong:  s.shash.Sum(nil),
+		Hash:    s.hashID,
+	}
+	s.trace.add(phaseHash, start)
+
+	if len(block) < s.cfg.size {
+		sig.Length = len(block)
+	}
+
+	s.index++
+	return sig, nil
+}
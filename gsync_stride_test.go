@@ -0,0 +1,123 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+func TestStrideSignatures(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	const stride = DefaultBlockSize / 4
+	data := srand(530, 10*DefaultBlockSize+100)
+	s := NewSigner(nil, WithStride(stride), WithDigest())
+	s.Reset(bytes.NewReader(data))
+
+	var sigs []BlockSignature
+	for {
+		sig, err := s.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		assert.Ok(t, err)
+		sigs = append(sigs, sig)
+	}
+
+	// Windows start every stride bytes until the end of the data, the last ones shorter.
+	assert.Equals(t, 41, len(sigs))
+	for i, sig := range sigs {
+		off := i * stride
+		end := off + DefaultBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		assert.Equals(t, uint64(i), sig.Index)
+		assert.Cond(t, s.cfg.weak.sum(data[off:end], mod) == sig.Weak, "window %d: weak checksum mismatch", i)
+		if end-off < DefaultBlockSize {
+			assert.Equals(t, end-off, sig.Length)
+		} else {
+			assert.Equals(t, 0, sig.Length)
+		}
+	}
+
+	digest, err := Digest(bytes.NewReader(data))
+	assert.Ok(t, err)
+	assert.Equals(t, digest, s.Digest())
+
+	for _, opts := range [][]Option{
+		{WithStride(5)},
+		{WithStride(0)},
+		{WithStride(stride), WithCoarseBlocks(4)},
+		{WithStride(stride), WithBoundaries([]int64{100})},
+	} {
+		_, err := Signatures(ctx, bytes.NewReader(data), nil, opts...)
+		assert.Equals(t, ErrInvalidStride, err)
+	}
+}
+
+func TestStrideSync(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// The source is made of blocks of the cache found at offsets that are not block boundaries,
+	// each one straddling two blocks of the cache, separated by new data shorter than a block.
+	const stride = DefaultBlockSize / 8
+	cache := srand(531, 20*DefaultBlockSize+300)
+	var source []byte
+	for i, off := range []int{3 * stride, 5*DefaultBlockSize + stride, 9*DefaultBlockSize + 7*stride, 2 * stride, 18*DefaultBlockSize + stride} {
+		source = append(source, srand(int64(532+i), 100)...)
+		source = append(source, cache[off:off+DefaultBlockSize]...)
+	}
+
+	for _, tt := range []struct {
+		opts    []Option
+		literal int
+	}{
+		{nil, len(source)},
+		{[]Option{WithStride(stride)}, 500},
+	} {
+		sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil, tt.opts...)
+		assert.Ok(t, err)
+		cacheSigs, err := LookUpTable(ctx, sigsCh)
+		assert.Ok(t, err)
+
+		ops, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, tt.opts...)
+		assert.Ok(t, err)
+
+		var collected []BlockOperation
+		var literal int
+		for op := range ops {
+			assert.Ok(t, op.Error)
+			literal += len(op.Data)
+			collected = append(collected, op)
+		}
+		assert.Equals(t, tt.literal, literal)
+
+		for _, opts := range [][]Option{tt.opts, append(tt.opts, WithPrefetch(2, 4))} {
+			c := make(chan BlockOperation, len(collected))
+			for _, op := range collected {
+				c <- op
+			}
+			close(c)
+
+			target := new(bytes.Buffer)
+			assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), c, opts...))
+			assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+		}
+	}
+
+	_, err := Segments(ctx, bytes.NewReader(source), nil, nil, WithStride(stride))
+	assert.Cond(t, err != nil && !errors.Is(err, ErrInvalidStride), "expected Segments to reject WithStride")
+}
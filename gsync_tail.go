@@ -0,0 +1,67 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import "io"
+
+// tailBlock returns the signature of the last block of the cache if it is shorter than the rest,
+// or nil.
+func tailBlock(remote map[uint32][]BlockSignature) *BlockSignature {
+	for _, bs := range remote {
+		for i, b := range bs {
+			if b.Length > 0 && b.blocks() == 1 {
+				return &bs[i]
+			}
+		}
+	}
+	return nil
+}
+
+// stepTail tries to match the last block of the cache, which is shorter than the rest, right
+// after the block preceding it was matched. The rolling window is always a whole block long
+// while there is enough data left, so the last block would otherwise only match at the very end
+// of the source, and be sent again by every sync of a file growing by less than a block at a
+// time.
+func (s *Syncer) stepTail() (bool, error) {
+	s.atTail = false
+
+	block := s.buffer[:s.tail.Length]
+	n, err := readAtFull(s.r, block, s.offset)
+	if err != nil && err != io.EOF {
+		return false, s.readError(err)
+	}
+
+	if n < len(block) || !s.matches(block, *s.tail) {
+		return false, nil
+	}
+
+	s.emitCopy(BlockOperation{Index: s.tail.Index, Strong: s.copyHash(*s.tail), Length: s.tail.Length}, block)
+	s.offset += int64(len(block))
+	s.rolling = false
+	s.old, s.rhash, s.r1, s.r2 = 0, 0, 0, 0
+	return true, nil
+}
+
+// stepShort handles a window shorter than a block, at the end of the source, that did not match.
+// As the window only shrinks from there on, it can only match the last block of the cache, if
+// shorter than the window. Instead of rolling over the data in between one byte at a time, it is
+// sent as literal data and the window moved right to where it is as long as that block. In
+// aligned mode, the window can not be moved, so all of it is sent.
+func (s *Syncer) stepShort(block []byte) {
+	n := len(block)
+	if s.tail == nil || s.tail.Length >= n || s.cfg.aligned {
+		s.addDelta(block)
+		s.offset += int64(n)
+		s.flush()
+		s.done = true
+		return
+	}
+
+	skip := n - s.tail.Length
+	s.addDelta(block[:skip])
+	s.offset += int64(skip)
+	s.rolling = false
+	s.old, s.rhash, s.r1, s.r2 = 0, 0, 0, 0
+}
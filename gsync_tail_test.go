@@ -0,0 +1,62 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestSyncGrowingTail(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, size := range []int{300, 10*DefaultBlockSize + 300} {
+		cache := srand(430, size)
+		source := append(append([]byte(nil), cache...), srand(431, 50)...)
+
+		sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+		assert.Ok(t, err)
+
+		var sigs []BlockSignature
+		for sig := range sigsCh {
+			assert.Ok(t, sig.Error)
+			sigs = append(sigs, sig)
+		}
+		for _, sig := range sigs[:len(sigs)-2] {
+			assert.Equals(t, 0, sig.Length)
+		}
+		assert.Equals(t, 300, sigs[len(sigs)-2].Length)
+
+		cacheSigs, err := LookUpTable(ctx, sliceSigs(sigs))
+		assert.Ok(t, err)
+		opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs)
+		assert.Ok(t, err)
+
+		var ops []BlockOperation
+		var literal int
+		for op := range opsCh {
+			assert.Ok(t, op.Error)
+			literal += len(op.Data)
+			ops = append(ops, op)
+		}
+		// Only the appended data is sent.
+		assert.Equals(t, 50, literal)
+
+		c := make(chan BlockOperation, len(ops))
+		for _, op := range ops {
+			c <- op
+		}
+		close(c)
+
+		target := new(bytes.Buffer)
+		assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), c))
+		assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+	}
+}
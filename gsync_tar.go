@@ -0,0 +1,63 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// defaultTarMode is the mode of archived files whose manifest entry does not have one.
+const defaultTarMode = 0644
+
+// ApplyTar reconstructs the files of a manifest in order, writing them as regular files of a tar
+// archive to w, i.e. to package a synced tree for transport. For every entry, open returns the
+// cache and operations to reconstruct the file with, as Apply takes them. The cache may be nil
+// for files sent whole. Headers are filled in from the entries: the size must be the size of the
+// reconstructed file, and files without a mode get 0644. To write a tar.gz archive, pass a
+// gzip.Writer as w and close it afterwards. Options are handed over to Apply.
+//
+// As with Apply, the caller must close the ops channels or the context when done or there will
+// be a deadlock. The archive is finished unless an error occurs, in which case it must be
+// discarded.
+func ApplyTar(ctx context.Context, w io.Writer, manifest []ManifestEntry, open func(e ManifestEntry) (io.ReaderAt, <-chan BlockOperation, error), opts ...Option) error {
+	tw := tar.NewWriter(w)
+	for _, e := range manifest {
+		mode := e.Mode.Perm()
+		if mode == 0 {
+			mode = defaultTarMode
+		}
+
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path.Clean(e.Path),
+			Size:     e.Size,
+			Mode:     int64(mode),
+			ModTime:  e.ModTime,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "failed writing header of %s", e.Path)
+		}
+
+		cache, ops, err := open(e)
+		if err != nil {
+			return errors.Wrapf(err, "failed opening %s", e.Path)
+		}
+
+		if err := Apply(ctx, tw, cache, ops, opts...); err != nil {
+			return errors.Wrapf(err, "failed reconstructing %s", e.Path)
+		}
+
+		// Flushing catches files shorter than their manifest size.
+		if err := tw.Flush(); err != nil {
+			return errors.Wrapf(err, "failed reconstructing %s", e.Path)
+		}
+	}
+	return errors.Wrapf(tw.Close(), "failed finishing archive")
+}
@@ -0,0 +1,74 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestApplyTar(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(460, 10*DefaultBlockSize)
+	files := map[string][]byte{
+		"dir/synced": append(append([]byte{}, cache[:6*DefaultBlockSize]...), srand(461, 100)...),
+		"created":    srand(462, DefaultBlockSize+7),
+	}
+	mtime := time.Unix(1500000000, 0)
+	manifest := []ManifestEntry{
+		{Path: "dir/synced", Size: int64(len(files["dir/synced"])), Mode: 0600, ModTime: mtime},
+		{Path: "created", Size: int64(len(files["created"])), ModTime: mtime},
+	}
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	open := func(e ManifestEntry) (io.ReaderAt, <-chan BlockOperation, error) {
+		if e.Path == "created" {
+			ops, err := Sync(ctx, bytes.NewReader(files[e.Path]), nil, nil)
+			return nil, ops, err
+		}
+		ops, err := Sync(ctx, bytes.NewReader(files[e.Path]), nil, cacheSigs)
+		return bytes.NewReader(cache), ops, err
+	}
+
+	buf := new(bytes.Buffer)
+	assert.Ok(t, ApplyTar(ctx, buf, manifest, open))
+
+	tr := tar.NewReader(buf)
+	for i, e := range manifest {
+		hdr, err := tr.Next()
+		assert.Ok(t, err)
+		assert.Equals(t, e.Path, hdr.Name)
+		assert.Equals(t, e.Size, hdr.Size)
+		assert.Equals(t, []int64{0600, 0644}[i], hdr.Mode)
+		assert.Cond(t, hdr.ModTime.Equal(mtime), "unexpected modification time")
+
+		data, err := ioutil.ReadAll(tr)
+		assert.Ok(t, err)
+		assert.Cond(t, bytes.Equal(files[e.Path], data), "source and archived files are different")
+	}
+	_, err = tr.Next()
+	assert.Equals(t, io.EOF, err)
+
+	// Manifest sizes not matching the reconstructed files fail.
+	for _, delta := range []int64{-1, 1} {
+		bad := []ManifestEntry{manifest[1]}
+		bad[0].Size += delta
+		err = ApplyTar(ctx, ioutil.Discard, bad, open)
+		assert.Cond(t, err != nil, "expected size mismatch to fail")
+	}
+}
@@ -6,24 +6,33 @@ package gsync
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/md5"
+	"crypto/sha512"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/hooklift/assert"
+	"github.com/minio/sha256-simd"
 	"github.com/pkg/profile"
 )
 
 // TestRollingHash tests that incrementally calculated signatures arrive to the same
 // value as the full block signature.
 func TestRollingHash(t *testing.T) {
-	_, _, target := rollingHash([]byte("abcd"))          // file's content in server
+	_, _, target := rollingHash([]byte("abcd"), mod)     // file's content in server
 	reader := bytes.NewReader([]byte("aaabcdbbabcdddf")) // new file's content in client
 
 	var (
@@ -40,9 +49,9 @@ func TestRollingHash(t *testing.T) {
 		block := buffer[:n]
 		if rolling {
 			new := uint32(block[n-1])
-			r1, r2, r = rollingHash2(uint32(n), r1, r2, old, new)
+			r1, r2, r = rollingHash2(mod, uint32(n), r1, r2, old, new)
 		} else {
-			r1, r2, r = rollingHash(block)
+			r1, r2, r = rollingHash(block, mod)
 		}
 
 		if r == target {
@@ -73,6 +82,161 @@ func TestRollingHash(t *testing.T) {
 	assert.Equals(t, []byte("aabbddf"), delta)
 }
 
+// TestRollChecksum rolls windows of several sizes across a whole buffer, checking every step
+// against the checksum of the window calculated from scratch.
+func TestRollChecksum(t *testing.T) {
+	// Runs of 0xff make the halves wrap around the modulus.
+	data := append(srand(391, 3*DefaultBlockSize), bytes.Repeat([]byte{0xff}, DefaultBlockSize)...)
+	for _, l := range []int{1, 100, DefaultBlockSize, len(data) - 1} {
+		r1, r2, _ := RollingChecksum(data[:l])
+		for i := 0; i+l < len(data); i++ {
+			var r uint32
+			r1, r2, r = RollChecksum(uint32(l), r1, r2, data[i], data[i+l])
+
+			e1, e2, exp := RollingChecksum(data[i+1 : i+1+l])
+			assert.Equals(t, []uint32{e1, e2, exp}, []uint32{r1, r2, r})
+			assert.Equals(t, r1+r2<<16, r)
+			assert.Equals(t, WeakAdler.sum(data[i+1:i+1+l], mod), r)
+		}
+	}
+}
+
+func TestRollingShrink(t *testing.T) {
+	data := srand(390, 100)
+	r1, r2, _ := rollingHash(data, mod)
+	for i := 0; i < len(data)-1; i++ {
+		var r uint32
+		r1, r2, r = rollingShrink(mod, uint32(len(data)-i), r1, r2, uint32(data[i]))
+
+		_, _, exp := rollingHash(data[i+1:], mod)
+		assert.Equals(t, exp, r)
+	}
+}
+
+// referenceRollingHash is rollingHash as defined in the paper, weighing every byte explicitly.
+func referenceRollingHash(block []byte, m uint32) (uint32, uint32, uint32) {
+	var a, b uint32
+	l := uint32(len(block))
+	for index, value := range block {
+		a += uint32(value)
+		b += (l - uint32(index)) * uint32(value)
+	}
+	r1 := a & (m - 1)
+	r2 := b & (m - 1)
+	return r1, r2, r1 + (m * r2)
+}
+
+func TestRollingHashReference(t *testing.T) {
+	for i, size := range []int{0, 1, 2, 100, DefaultBlockSize, 1 << 20} {
+		block := srand(int64(400+i), size)
+		for _, m := range []uint32{2, 1 << 8, mod} {
+			r1, r2, r := rollingHash(block, m)
+			e1, e2, e := referenceRollingHash(block, m)
+			assert.Equals(t, []uint32{e1, e2, e}, []uint32{r1, r2, r})
+		}
+	}
+
+	// Overflows of the sums must not matter either.
+	block := bytes.Repeat([]byte{0xff}, 1<<20)
+	r1, r2, r := rollingHash(block, mod)
+	e1, e2, e := referenceRollingHash(block, mod)
+	assert.Equals(t, []uint32{e1, e2, e}, []uint32{r1, r2, r})
+}
+
+// TestSyncTail tests that the last block of the cache, which is shorter than the rest, is
+// matched even if it is not preceded by a matching block in the source.
+func TestSyncTail(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(391, 10*DefaultBlockSize+100)
+	tail := cache[10*DefaultBlockSize:]
+	source := append(append(append([]byte(nil), cache[:5*DefaultBlockSize]...), srand(392, 50)...), tail...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs)
+	assert.Ok(t, err)
+
+	var ops []BlockOperation
+	var literal int
+	for op := range opsCh {
+		assert.Ok(t, op.Error)
+		literal += len(op.Data)
+		ops = append(ops, op)
+	}
+	assert.Equals(t, 50, literal)
+	assert.Equals(t, BlockOperation{Index: 10, Offset: int64(len(source) - len(tail)), Length: len(tail)}, ops[len(ops)-2])
+
+	c := make(chan BlockOperation, len(ops))
+	for _, op := range ops {
+		c <- op
+	}
+	close(c)
+
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), c))
+	assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+}
+
+// TestCopyLength tests that copies of the last block of the cache, shorter than the rest, carry its
+// length, so Apply reads exactly that block wherever it is copied to, even if the cache grew or
+// shrank since its signatures were calculated.
+func TestCopyLength(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(393, 10*DefaultBlockSize+100)
+	tail := cache[10*DefaultBlockSize:]
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	// The last block is matched right after the one preceding it, here followed by more data.
+	moved := append(append(append([]byte(nil), tail...), cache[8*DefaultBlockSize:]...), cache[:2*DefaultBlockSize]...)
+	grown := append(append([]byte(nil), cache...), srand(394, 500)...)
+	for _, tt := range []struct {
+		desc   string
+		source []byte
+		cache  []byte
+		opts   []Option
+		err    error
+	}{
+		{"tail last", cache, cache, nil, nil},
+		{"tail in between", moved, cache, nil, nil},
+		{"grown cache", moved, grown, nil, nil},
+		{"grown cache prefetched", moved, grown, []Option{WithPrefetch(2, 4)}, nil},
+		{"shrunk cache", cache, cache[:len(cache)-10], nil, ErrReadCache},
+	} {
+		ops, err := Sync(ctx, bytes.NewReader(tt.source), nil, cacheSigs)
+		assert.Ok(t, err)
+
+		// Operations go through the wire and Compact, which keeps the length of the last block of
+		// merged runs.
+		buf := new(bytes.Buffer)
+		enc := NewEncoder(buf)
+		for op := range Compact(ctx, ops) {
+			assert.Ok(t, op.Error)
+			assert.Ok(t, enc.Encode(op))
+		}
+		decoded, err := Decode(ctx, buf)
+		assert.Ok(t, err)
+
+		target := new(bytes.Buffer)
+		err = Apply(ctx, target, bytes.NewReader(tt.cache), decoded, tt.opts...)
+		if tt.err != nil {
+			assert.Cond(t, errors.Is(err, tt.err), "%s: unexpected error: %v", tt.desc, err)
+			continue
+		}
+		assert.Ok(t, err)
+		assert.Cond(t, bytes.Equal(tt.source, target.Bytes()), "%s: source and target files are different", tt.desc)
+	}
+}
+
 var alpha = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789\n"
 
 // srand generates a random string of fixed size.
@@ -85,6 +249,69 @@ func srand(seed int64, size int) []byte {
 	return buf
 }
 
+// mutate returns a copy of src with the given number of random edits applied: inserts, deletes
+// and overwrites of up to two blocks each, at random offsets. Edits land anywhere, including
+// across block boundaries and at either end, so the result shares some but not all blocks with
+// src.
+func mutate(src []byte, seed int64, edits int) []byte {
+	r := rand.New(rand.NewSource(seed))
+	dst := append([]byte(nil), src...)
+	for i := 0; i < edits; i++ {
+		off := r.Intn(len(dst) + 1)
+		size := 1 + r.Intn(2*DefaultBlockSize)
+		data := make([]byte, size)
+		for j := range data {
+			data[j] = alpha[r.Intn(len(alpha))]
+		}
+
+		switch r.Intn(3) {
+		case 0:
+			dst = append(dst[:off], append(data, dst[off:]...)...)
+		case 1:
+			if off+size > len(dst) {
+				size = len(dst) - off
+			}
+			dst = append(dst[:off], dst[off+size:]...)
+		case 2:
+			copy(dst[off:], data)
+		}
+	}
+	return dst
+}
+
+// pipeline runs Signatures, LookUpTable, Sync and Apply over source and cache,
+// returning the reconstructed file. All stages are configured with the given options.
+func pipeline(t *testing.T, source, cache []byte, opts ...Option) []byte {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil, opts...)
+	assert.Ok(t, err)
+
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, opts...)
+	assert.Ok(t, err)
+
+	target := new(bytes.Buffer)
+	err = Apply(ctx, target, bytes.NewReader(cache), opsCh, opts...)
+	assert.Ok(t, err)
+
+	return target.Bytes()
+}
+
+// cachedBlock returns the block at index from cache.
+func cachedBlock(cache []byte, index uint64) []byte {
+	end := (index + 1) * DefaultBlockSize
+	if end > uint64(len(cache)) {
+		end = uint64(len(cache))
+	}
+	return cache[index*DefaultBlockSize : end]
+}
+
 func TestSync(t *testing.T) {
 	defer profile.Start().Stop()
 	tests := []struct {
@@ -148,13 +375,1209 @@ func TestSync(t *testing.T) {
 	}
 }
 
+// TestSyncMutated tests files with random edits scattered all over, which match some of the
+// cached blocks but not others.
+func TestSyncMutated(t *testing.T) {
+	cache := srand(190, 40*DefaultBlockSize+321)
+
+	for seed := int64(0); seed < 8; seed++ {
+		for _, edits := range []int{1, 5, 30} {
+			source := mutate(cache, seed, edits)
+			for _, opts := range [][]Option{nil, {WithMinRun(2)}, {WithCopyHashes()}} {
+				target := pipeline(t, source, cache, opts...)
+				assert.Cond(t, bytes.Equal(source, target), "seed %d, %d edits: source and target files are different", seed, edits)
+			}
+		}
+	}
+
+	// Edits on files smaller than a block.
+	small := srand(191, 100)
+	for seed := int64(0); seed < 8; seed++ {
+		source := mutate(small, seed, 3)
+		assert.Cond(t, bytes.Equal(source, pipeline(t, source, small)), "seed %d: source and target files are different", seed)
+	}
+}
+
+// TestSyncShortSource tests sources no longer than a block, which are sent as a single literal
+// unless they match a whole block of the cache.
+func TestSyncShortSource(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, size := range []int{1, DefaultBlockSize - 1, DefaultBlockSize} {
+		source := srand(192, size)
+		// Whether the source is a whole block, and whether its first half is not empty.
+		whole, half := 0, 1
+		if size == DefaultBlockSize {
+			whole = 1
+		}
+		if size == 1 {
+			half = 0
+		}
+
+		tests := []struct {
+			desc             string
+			cache            []byte
+			copies, literals int
+		}{
+			{"no cache", nil, 0, 1},
+			{"same", source, 1, 0},
+			{"different", srand(193, size), 0, 1},
+			{"prefix of cache", append(append([]byte(nil), source...), srand(194, 3*DefaultBlockSize)...), whole, 1 - whole},
+			{"longer cache tail", append(srand(195, DefaultBlockSize), srand(196, size+1)...), 0, 1},
+			{"cache tail", append(srand(197, 2*DefaultBlockSize), source...), 1, 0},
+			// The second half of the source matches the tail of the cache.
+			{"source tail", append(srand(198, DefaultBlockSize), source[size/2:]...), 1, half},
+		}
+
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%d bytes/%s", size, tt.desc), func(t *testing.T) {
+				sigsCh, err := Signatures(ctx, bytes.NewReader(tt.cache), nil)
+				assert.Ok(t, err)
+				cacheSigs, err := LookUpTable(ctx, sigsCh)
+				assert.Ok(t, err)
+
+				ops, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs)
+				assert.Ok(t, err)
+
+				var copies, literals int
+				target := new(bytes.Buffer)
+				audit := WithAudit(func(op BlockOperation, offset int64) {
+					if op.copies() {
+						copies++
+					} else if len(op.Data) > 0 {
+						literals++
+					}
+				})
+				assert.Ok(t, Apply(ctx, target, bytes.NewReader(tt.cache), ops, WithRequireDone(), audit))
+				assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+				assert.Equals(t, tt.copies, copies)
+				assert.Equals(t, tt.literals, literals)
+			})
+		}
+	}
+}
+
+// stalledReader never returns any data nor error.
+type stalledReader struct{}
+
+func (stalledReader) Read(p []byte) (int, error) {
+	return 0, nil
+}
+
+// TestEmptyBlocks tests that empty blocks are never signed nor matched, since any two of them would
+// match.
+func TestEmptyBlocks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Empty files and readers making no progress yield no signatures.
+	sigsCh, err := Signatures(ctx, bytes.NewReader(nil), nil)
+	assert.Ok(t, err)
+	sigs, err := LookUpTable(ctx, sigsCh, WithRequireDone())
+	assert.Ok(t, err)
+	assert.Equals(t, 0, len(sigs))
+
+	s := NewSigner(nil)
+	s.Reset(stalledReader{})
+	_, err = s.Next(ctx)
+	assert.Cond(t, errors.Is(err, io.ErrNoProgress), "unexpected error: %v", err)
+
+	// Signatures without a strong checksum are not indexed, and rejected if given anyway rather than
+	// matched, even by comparators accepting anything.
+	source := srand(395, DefaultBlockSize)
+	_, _, weak := RollingChecksum(source)
+	bc := make(chan BlockSignature, 1)
+	bc <- BlockSignature{Index: 0, Weak: weak}
+	close(bc)
+	sigs, err = LookUpTable(ctx, bc)
+	assert.Ok(t, err)
+	assert.Equals(t, 0, len(sigs))
+
+	remote := map[uint32][]BlockSignature{weak: {{Index: 0, Weak: weak}}}
+	always := func(block, strong []byte, candidate BlockSignature) bool { return true }
+	_, err = Sync(ctx, bytes.NewReader(source), nil, remote, WithComparator(always))
+	assert.Cond(t, errors.Is(err, ErrHashMismatch), "unexpected error: %v", err)
+}
+
+// TestSyncShrinking tests that sources shorter than the cache are reconstructed exactly, without
+// any stale data of the cache past their end.
+func TestSyncShrinking(t *testing.T) {
+	cache := srand(183, 50*DefaultBlockSize+700)
+
+	tests := []struct {
+		desc   string
+		source []byte
+	}{
+		{"truncated within the last block", cache[:len(cache)-300]},
+		{"truncated at a block boundary", cache[:40*DefaultBlockSize]},
+		{"truncated within a block", cache[:40*DefaultBlockSize+10]},
+		{"first blocks deleted", cache[10*DefaultBlockSize:]},
+		{"middle deleted", append(append([]byte(nil), cache[:10*DefaultBlockSize+5]...), cache[30*DefaultBlockSize:]...)},
+		{"single byte left", cache[:1]},
+		{"empty", []byte{}},
+	}
+
+	for _, tt := range tests {
+		for _, opts := range [][]Option{nil, {WithAligned()}, {WithCoarseBlocks(4)}} {
+			target := pipeline(t, tt.source, cache, opts...)
+			assert.Cond(t, bytes.Equal(tt.source, target), "%s: expected %d bytes, got %d", tt.desc, len(tt.source), len(target))
+		}
+	}
+}
+
+func TestSyncAlignedCRC32C(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(30, 512*1024)
+	source := append([]byte(nil), cache...)
+	// Overwrites a region in place, the way databases and disk images get updated.
+	copy(source[100*1024:], srand(31, 10*1024))
+	source = append(source, srand(32, 1000)...)
+
+	opts := []Option{WithWeakHash(WeakCRC32C), WithAligned()}
+
+	_, err := Sync(ctx, bytes.NewReader(source), nil, nil, WithWeakHash(WeakCRC32C))
+	assert.Cond(t, err != nil, "rolling sync with a non-rollable weak hash should fail")
+
+	target := pipeline(t, source, cache, opts...)
+	assert.Cond(t, bytes.Equal(source, target), "source and target files are different")
+}
+
+func TestSyncMaxDelta(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(70, 64*1024)
+	source := append(srand(71, 10*1024), cache...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, WithMaxDelta(100))
+	assert.Ok(t, err)
+
+	var literals int
+	target := new(bytes.Buffer)
+	for op := range opsCh {
+		assert.Ok(t, op.Error)
+		if op.Done {
+			continue
+		}
+
+		if len(op.Data) > 0 {
+			literals++
+			assert.Cond(t, len(op.Data) <= 100, "literal operation too large: %d bytes", len(op.Data))
+			target.Write(op.Data)
+			continue
+		}
+		target.Write(cachedBlock(cache, op.Index))
+	}
+
+	assert.Cond(t, literals >= 10*1024/100, "expected literal data to be flushed eagerly")
+	assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+}
+
+func TestSignerSyncerReuse(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	signer := NewSigner(md5.New())
+	syncer, err := NewSyncer(md5.New())
+	assert.Ok(t, err)
+
+	for i := int64(0); i < 3; i++ {
+		cache := srand(80+i, 100*1024)
+		source := append(srand(90+i, 500), cache[DefaultBlockSize:]...)
+
+		table := make(map[uint32][]BlockSignature)
+		signer.Reset(bytes.NewReader(cache))
+		for {
+			sig, err := signer.Next(ctx)
+			if err == io.EOF {
+				break
+			}
+			assert.Ok(t, err)
+			table[sig.Weak] = append(table[sig.Weak], sig)
+		}
+
+		target := new(bytes.Buffer)
+		syncer.Reset(bytes.NewReader(source), table)
+		for {
+			op, err := syncer.Next(ctx)
+			if err == io.EOF {
+				break
+			}
+			assert.Ok(t, err)
+			if op.Done {
+				continue
+			}
+
+			if len(op.Data) > 0 {
+				target.Write(op.Data)
+				continue
+			}
+			target.Write(cachedBlock(cache, op.Index))
+		}
+
+		assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+	}
+}
+
+func TestSyncComparator(t *testing.T) {
+	cache := srand(150, 64*1024)
+	source := append(srand(151, 1000), cache...)
+
+	var calls int
+	exact := func(block, strong []byte, candidate BlockSignature) bool {
+		calls++
+		return bytes.Equal(strong, candidate.Strong)
+	}
+	target := pipeline(t, source, cache, WithComparator(exact))
+	assert.Cond(t, bytes.Equal(source, target), "source and target files are different")
+	assert.Cond(t, calls > 0, "comparator was not called")
+
+	// Rejecting every candidate turns the whole file into literal data.
+	never := func(block, strong []byte, candidate BlockSignature) bool {
+		return false
+	}
+	stats := new(Stats)
+	target = pipeline(t, source, cache, WithComparator(never), WithStats(stats))
+	assert.Cond(t, bytes.Equal(source, target), "source and target files are different")
+	assert.Equals(t, stats.StrongComparisons, stats.StrongRejections)
+}
+
+func TestApplyMulti(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(340, 100*1024)
+	source := append(srand(341, 1000), cache[:80*1024]...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs)
+	assert.Ok(t, err)
+
+	targets := []*bytes.Buffer{new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)}
+	assert.Ok(t, ApplyMulti(ctx, []io.Writer{targets[0], targets[1], targets[2]}, bytes.NewReader(cache), opsCh))
+	for _, target := range targets {
+		assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+	}
+}
+
+func TestSyncMinRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Isolated matching blocks between edits, followed by a long run of them.
+	cache := srand(360, 40*DefaultBlockSize)
+	var source []byte
+	for i := uint64(0); i < 5; i++ {
+		source = append(source, srand(int64(361+i), 100)...)
+		source = append(source, cachedBlock(cache, i*2)...)
+	}
+	source = append(source, srand(370, 100)...)
+	source = append(source, cache[20*DefaultBlockSize:30*DefaultBlockSize]...)
+	source = append(source, cachedBlock(cache, 35)...)
+
+	for _, tt := range []struct {
+		minRun uint64
+		copies int
+	}{
+		{0, 16},
+		// The last block is copied right after the run, so it belongs to it.
+		{2, 11},
+		{11, 11},
+		{12, 0},
+	} {
+		sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+		assert.Ok(t, err)
+		cacheSigs, err := LookUpTable(ctx, sigsCh)
+		assert.Ok(t, err)
+
+		opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, WithMinRun(tt.minRun))
+		assert.Ok(t, err)
+
+		var ops []BlockOperation
+		var copies int
+		for op := range opsCh {
+			assert.Ok(t, op.Error)
+			if op.copies() {
+				copies++
+			}
+			ops = append(ops, op)
+		}
+		assert.Equals(t, tt.copies, copies)
+
+		c := make(chan BlockOperation, len(ops))
+		for _, op := range ops {
+			c <- op
+		}
+		close(c)
+
+		target := new(bytes.Buffer)
+		assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), c))
+		assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+	}
+}
+
+// TestOperationOffsets tests that operations describe where their data lands in the source.
+func TestOperationOffsets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(380, 60*DefaultBlockSize+100)
+	source := append(srand(381, 500), cache[:20*DefaultBlockSize]...)
+	source = append(source, srand(382, 3*DefaultBlockSize)...)
+	source = append(source, cachedBlock(cache, 30)...)
+	source = append(source, srand(383, 7)...)
+	source = append(source, cache[40*DefaultBlockSize:]...)
+
+	for _, opts := range [][]Option{nil, {WithMinRun(3)}, {WithCoarseBlocks(4)}, {WithMaxDelta(1000)}} {
+		sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil, opts...)
+		assert.Ok(t, err)
+		cacheSigs, err := LookUpTable(ctx, sigsCh)
+		assert.Ok(t, err)
+
+		opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, opts...)
+		assert.Ok(t, err)
+
+		var offset int64
+		for op := range opsCh {
+			assert.Ok(t, op.Error)
+			if op.Done {
+				continue
+			}
+			assert.Equals(t, offset, op.Offset)
+
+			data := op.Data
+			if op.copies() {
+				start := op.Index * DefaultBlockSize
+				end := start + op.blocks()*DefaultBlockSize
+				if end > uint64(len(cache)) {
+					end = uint64(len(cache))
+				}
+				data = cache[start:end]
+			}
+			assert.Cond(t, bytes.Equal(source[offset:offset+int64(len(data))], data), "unexpected data at offset %d", offset)
+			offset += int64(len(data))
+		}
+		assert.Equals(t, int64(len(source)), offset)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	var allocs int32
+	pool := &sync.Pool{
+		New: func() interface{} {
+			atomic.AddInt32(&allocs, 1)
+			b := make([]byte, 2*DefaultBlockSize)
+			return &b
+		},
+	}
+
+	cache := srand(410, 50*1024)
+	source := append(srand(411, 100), cache...)
+	target := pipeline(t, source, cache, WithBufferPool(pool))
+	assert.Cond(t, bytes.Equal(source, target), "source and target files are different")
+	assert.Cond(t, atomic.LoadInt32(&allocs) > 0, "expected buffers to come from the pool")
+}
+
+func TestApplyRequireDone(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	source := srand(180, 64*1024)
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, nil)
+	assert.Ok(t, err)
+
+	var ops []BlockOperation
+	for op := range opsCh {
+		ops = append(ops, op)
+	}
+	assert.Cond(t, ops[len(ops)-1].Done, "expected the stream to end with a Done operation")
+
+	apply := func(ops []BlockOperation) error {
+		c := make(chan BlockOperation, len(ops))
+		for _, op := range ops {
+			c <- op
+		}
+		close(c)
+		return Apply(ctx, new(bytes.Buffer), nil, c, WithRequireDone())
+	}
+
+	assert.Ok(t, apply(ops))
+
+	// Simulates a connection dropped before the end of the stream.
+	err = apply(ops[:len(ops)-2])
+	assert.Cond(t, errors.Is(err, ErrTruncatedStream), "expected ErrTruncatedStream, got %v", err)
+}
+
+func TestChannelBuffer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(182, 20*DefaultBlockSize)
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil, WithChannelBuffer(8))
+	assert.Ok(t, err)
+	assert.Equals(t, 8, cap(sigsCh))
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	opsCh, err := Sync(ctx, bytes.NewReader(cache), nil, cacheSigs, WithChannelBuffer(4))
+	assert.Ok(t, err)
+	assert.Equals(t, 4, cap(opsCh))
+
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), opsCh, WithRequireDone()))
+	assert.Cond(t, bytes.Equal(cache, target.Bytes()), "source and target files are different")
+
+	sigsCh, err = Signatures(ctx, bytes.NewReader(cache), nil, WithChannelBuffer(-1))
+	assert.Ok(t, err)
+	assert.Equals(t, 0, cap(sigsCh))
+	for range sigsCh {
+	}
+}
+
+// TestBlockSize tests that files are split into blocks of the size set WithBlockSize, from signing
+// to applying operations received over the wire, along with the options depending on it.
+func TestBlockSize(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(183, 300*1024+17)
+	edited := mutate(cache, 184, 5)
+	prepended := append(srand(185, 100), cache...)
+	for _, size := range []int{512, 64 * 1024} {
+		for _, opts := range [][]Option{
+			nil,
+			{WithAligned()},
+			{WithPrefetch(4, 16)},
+			{WithStride(size / 4)},
+			{WithBackRefs(8 * size)},
+			{WithCoarseBlocks(4)},
+			{WithBoundaries([]int64{100, 5000})},
+		} {
+			opts = append(opts, WithBlockSize(size))
+			target := pipeline(t, edited, cache, opts...)
+			assert.Cond(t, bytes.Equal(edited, target), "%d: source and target files are different", size)
+		}
+
+		sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil, WithBlockSize(size))
+		assert.Ok(t, err)
+		var sigs []BlockSignature
+		for sig := range sigsCh {
+			assert.Ok(t, sig.Error)
+			if !sig.Done {
+				sigs = append(sigs, sig)
+			}
+		}
+		assert.Equals(t, (len(cache)+size-1)/size, len(sigs))
+		assert.Equals(t, len(cache)%size, sigs[len(sigs)-1].Length)
+
+		cacheSigs, err := LookUpTable(ctx, sliceSigs(sigs))
+		assert.Ok(t, err)
+		opsCh, err := Sync(ctx, bytes.NewReader(prepended), nil, cacheSigs, WithBlockSize(size))
+		assert.Ok(t, err)
+
+		var literal int
+		stream := new(bytes.Buffer)
+		enc := NewEncoder(stream)
+		for op := range opsCh {
+			literal += len(op.Data)
+			assert.Ok(t, enc.Encode(op))
+		}
+		assert.Equals(t, 100, literal)
+
+		decoded, err := Decode(ctx, bytes.NewReader(stream.Bytes()), WithBlockSize(size))
+		assert.Ok(t, err)
+		target := new(bytes.Buffer)
+		assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), decoded, WithBlockSize(size), WithRequireDone()))
+		assert.Cond(t, bytes.Equal(prepended, target.Bytes()), "%d: source and target files are different", size)
+
+		// Copies of a last block longer than the default are only accepted given the block size.
+		decoded, err = Decode(ctx, bytes.NewReader(stream.Bytes()))
+		assert.Ok(t, err)
+		err = Apply(ctx, new(bytes.Buffer), bytes.NewReader(cache), decoded)
+		if len(cache)%size > DefaultBlockSize {
+			assert.Cond(t, errors.Is(err, ErrMalformedStream), "expected ErrMalformedStream, got %v", err)
+		}
+	}
+
+	// Options depending on the block size are validated once it is known, whatever their order.
+	for _, tt := range []struct {
+		opts []Option
+		err  error
+	}{
+		{[]Option{WithBlockSize(0)}, ErrInvalidBlockSize},
+		{[]Option{WithBlockSize(maxBlockSize + 1)}, ErrInvalidBlockSize},
+		{[]Option{WithRange(1024, 4096), WithBlockSize(1000)}, ErrInvalidRange},
+		{[]Option{WithRange(1000, 4096), WithBlockSize(1000)}, nil},
+		{[]Option{WithStride(1024), WithBlockSize(3000)}, ErrInvalidStride},
+		{[]Option{WithStride(1000), WithBlockSize(3000)}, nil},
+	} {
+		sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil, tt.opts...)
+		assert.Equals(t, tt.err, err)
+		if err == nil {
+			for range sigsCh {
+			}
+		}
+	}
+}
+
+// TestWithHash tests that the strong hash set WithHash is used when no hash is given, and that
+// Sync still rejects signatures calculated with another one.
+func TestWithHash(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(186, 20*DefaultBlockSize)
+	source := mutate(cache, 187, 2)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil, WithHash(sha512.New))
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+	for _, bs := range cacheSigs {
+		for _, b := range bs {
+			assert.Equals(t, HashSHA512, b.Hash)
+			assert.Equals(t, sha512.Size, len(b.Strong))
+		}
+	}
+
+	target := pipeline(t, source, cache, WithHash(sha512.New))
+	assert.Cond(t, bytes.Equal(source, target), "source and target files are different")
+
+	// A hash given explicitly takes precedence.
+	_, err = Sync(ctx, bytes.NewReader(source), sha256.New(), cacheSigs, WithHash(sha512.New))
+	assert.Cond(t, errors.Is(err, ErrHashMismatch), "expected ErrHashMismatch, got %v", err)
+
+	_, err = Sync(ctx, bytes.NewReader(source), nil, cacheSigs, WithHash(md5.New))
+	assert.Cond(t, errors.Is(err, ErrHashMismatch), "expected ErrHashMismatch, got %v", err)
+}
+
+func TestLookUpTableMaxBucket(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Every repeated block lands in the same bucket.
+	block := srand(184, DefaultBlockSize)
+	cache := append(srand(185, 4*DefaultBlockSize), bytes.Repeat(block, 30)...)
+	source := append(bytes.Repeat(block, 10), cache[:4*DefaultBlockSize]...)
+
+	for _, max := range []int{0, -1, 3} {
+		sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+		assert.Ok(t, err)
+		cacheSigs, err := LookUpTable(ctx, sigsCh, WithMaxBucket(max))
+		assert.Ok(t, err)
+
+		largest := 0
+		for _, bs := range cacheSigs {
+			if len(bs) > largest {
+				largest = len(bs)
+			}
+		}
+		if max > 0 {
+			assert.Equals(t, max, largest)
+		} else {
+			assert.Equals(t, 30, largest)
+		}
+
+		opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs)
+		assert.Ok(t, err)
+		target := new(bytes.Buffer)
+		assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), opsCh, WithRequireDone()))
+		assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+	}
+}
+
+func TestLookUpTableRequireDone(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, sigsCh := range []func() (<-chan BlockSignature, error){
+		func() (<-chan BlockSignature, error) {
+			return Signatures(ctx, bytes.NewReader(srand(181, 10*DefaultBlockSize)), nil)
+		},
+		func() (<-chan BlockSignature, error) {
+			return SignaturesAt(ctx, bytes.NewReader(srand(181, 10*DefaultBlockSize)), 10*DefaultBlockSize, md5.New)
+		},
+	} {
+		c, err := sigsCh()
+		assert.Ok(t, err)
+
+		var sigs []BlockSignature
+		for sig := range c {
+			assert.Ok(t, sig.Error)
+			sigs = append(sigs, sig)
+		}
+		assert.Equals(t, 11, len(sigs))
+		assert.Equals(t, BlockSignature{Done: true}, sigs[10])
+
+		table, err := LookUpTable(ctx, sliceSigs(sigs), WithRequireDone())
+		assert.Ok(t, err)
+		assert.Equals(t, 10, len(table))
+
+		// Simulates a connection dropped before the end of the stream.
+		_, err = LookUpTable(ctx, sliceSigs(sigs[:5]), WithRequireDone())
+		assert.Equals(t, ErrTruncatedStream, err)
+	}
+}
+
+// countingLimiter records the amount of bytes let through.
+// oneByteReaderAt returns at most one byte per ReadAt call, without reporting short reads.
+type oneByteReaderAt struct {
+	r io.ReaderAt
+}
+
+func (o oneByteReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return o.r.ReadAt(p, off)
+}
+
+// TestSyncDeterministic tests that the operations produced do not depend on how the
+// source and the cache are read.
+func TestSyncDeterministic(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(240, 200*1024)
+	source := append(srand(241, 777), cache[:90*1024]...)
+	source = append(source, srand(242, 3*DefaultBlockSize+5)...)
+	source = append(source, cache[120*1024:]...)
+
+	syncOps := func(cacheR io.Reader, sourceR io.ReaderAt) []BlockOperation {
+		sigsCh, err := Signatures(ctx, cacheR, nil, WithCoarseBlocks(4))
+		assert.Ok(t, err)
+		cacheSigs, err := LookUpTable(ctx, sigsCh)
+		assert.Ok(t, err)
+
+		opsCh, err := Sync(ctx, sourceR, nil, cacheSigs, WithMaxDelta(DefaultBlockSize/2))
+		assert.Ok(t, err)
+
+		var ops []BlockOperation
+		for op := range opsCh {
+			assert.Ok(t, op.Error)
+			ops = append(ops, op)
+		}
+		return ops
+	}
+
+	exp := syncOps(bytes.NewReader(cache), bytes.NewReader(source))
+	got := syncOps(iotest.OneByteReader(bytes.NewReader(cache)), oneByteReaderAt{bytes.NewReader(source)})
+	assert.Equals(t, exp, got)
+}
+
+type countingLimiter struct {
+	waits, bytes int
+}
+
+func (c *countingLimiter) WaitN(ctx context.Context, n int) error {
+	c.waits++
+	c.bytes += n
+	return ctx.Err()
+}
+
+func TestSyncLimiter(t *testing.T) {
+	cache := srand(200, 64*1024)
+	source := append(srand(201, 10000), cache...)
+
+	limiter := new(countingLimiter)
+	target := pipeline(t, source, cache, WithLimiter(limiter))
+	assert.Cond(t, bytes.Equal(source, target), "source and target files are different")
+	assert.Equals(t, 10000, limiter.bytes)
+	assert.Equals(t, 2, limiter.waits)
+}
+
+// waitGoroutines waits for the number of running goroutines to go back to n, failing
+// the test if they leaked.
+func waitGoroutines(t *testing.T, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("leaked goroutines:\n%s", buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSyncAbandoned(t *testing.T) {
+	source := srand(140, 1024*1024)
+	goroutines := runtime.NumGoroutine()
+
+	// Cancelling the context stops Sync even if nobody reads operations anymore.
+	ctx, cancel := context.WithCancel(context.Background())
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, nil)
+	assert.Ok(t, err)
+	<-opsCh
+	cancel()
+	waitGoroutines(t, goroutines)
+
+	// Draining lets it run to completion.
+	opsCh, err = Sync(context.Background(), bytes.NewReader(source), nil, nil)
+	assert.Ok(t, err)
+	<-opsCh
+	Drain(opsCh)
+	waitGoroutines(t, goroutines)
+}
+
+func TestSignaturesAbandoned(t *testing.T) {
+	cache := srand(141, 1024*1024)
+
+	tests := []struct {
+		r    io.Reader
+		opts []Option
+		read int
+	}{
+		{bytes.NewReader(cache), nil, 1},
+		// The producer is blocked sending the Done signature.
+		{bytes.NewReader(cache[:100]), nil, 1},
+		// The producer is blocked waiting for appended data.
+		{bytes.NewReader(cache[:100]), []Option{WithFollow(time.Hour)}, 0},
+	}
+
+	for _, tt := range tests {
+		goroutines := runtime.NumGoroutine()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sigsCh, err := Signatures(ctx, tt.r, nil, tt.opts...)
+		assert.Ok(t, err)
+		for i := 0; i < tt.read; i++ {
+			<-sigsCh
+		}
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		waitGoroutines(t, goroutines)
+	}
+}
+
+func TestCloseAndDrain(t *testing.T) {
+	cache := srand(142, 1024*1024)
+	source := mutate(cache, 143, 50)
+	goroutines := runtime.NumGoroutine()
+
+	// Producers blocked sending, while following a file, and in a pipeline of stages.
+	ctx, cancel := context.WithCancel(context.Background())
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	<-sigsCh
+	time.Sleep(10 * time.Millisecond)
+	CloseAndDrainSignatures(cancel, sigsCh)
+	waitGoroutines(t, goroutines)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	sigsCh, err = Signatures(ctx, bytes.NewReader(cache[:100]), nil, WithFollow(time.Hour))
+	assert.Ok(t, err)
+	CloseAndDrainSignatures(cancel, sigsCh)
+	waitGoroutines(t, goroutines)
+
+	sigsCh, err = Signatures(context.Background(), bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	table, err := LookUpTable(context.Background(), sigsCh)
+	assert.Ok(t, err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, table)
+	assert.Ok(t, err)
+	opsCh = Compact(ctx, opsCh)
+	<-opsCh
+	time.Sleep(10 * time.Millisecond)
+	CloseAndDrain(cancel, opsCh)
+	waitGoroutines(t, goroutines)
+
+	// Draining without cancelling runs producers to completion.
+	sigsCh, err = Signatures(context.Background(), bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	<-sigsCh
+	DrainSignatures(sigsCh)
+	waitGoroutines(t, goroutines)
+}
+
+// failingReader fails every read with err.
+type failingReader struct {
+	err error
+}
+
+func (f failingReader) Read(p []byte) (int, error)              { return 0, f.err }
+func (f failingReader) ReadAt(p []byte, off int64) (int, error) { return 0, f.err }
+func (f failingReader) Write(p []byte) (int, error)             { return 0, f.err }
+
+func TestErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := Signatures(ctx, nil, nil)
+	assert.Cond(t, errors.Is(err, ErrNilReader), "expected ErrNilReader, got %v", err)
+
+	_, err = Sync(ctx, nil, nil, nil)
+	assert.Cond(t, errors.Is(err, ErrNilReader), "expected ErrNilReader, got %v", err)
+
+	// A failing read is reported with the index of the block involved.
+	ioErr := errors.New("disk on fire")
+	sigsCh, err := Signatures(ctx, io.LimitReader(failingReader{ioErr}, 1), nil)
+	assert.Ok(t, err)
+	sig := <-sigsCh
+	cancel()
+	for range sigsCh {
+	}
+
+	var berr *BlockError
+	assert.Cond(t, errors.Is(sig.Error, ErrReadBlock), "expected ErrReadBlock, got %v", sig.Error)
+	assert.Cond(t, errors.Is(sig.Error, ioErr), "expected underlying error to be preserved")
+	assert.Cond(t, errors.As(sig.Error, &berr), "expected a *BlockError")
+	assert.Equals(t, uint64(0), berr.Index)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	ops := make(chan BlockOperation, 1)
+	ops <- BlockOperation{Index: 2}
+	close(ops)
+	err = Apply(ctx, new(bytes.Buffer), nil, ops)
+	assert.Cond(t, errors.Is(err, ErrMissingCache), "expected ErrMissingCache, got %v", err)
+
+	ops = make(chan BlockOperation, 1)
+	ops <- BlockOperation{Data: []byte("foo")}
+	close(ops)
+	err = Apply(ctx, failingReader{ioErr}, nil, ops)
+	assert.Cond(t, errors.Is(err, ErrApplyWrite), "expected ErrApplyWrite, got %v", err)
+	assert.Cond(t, !errors.Is(err, ErrReadCache), "unexpected ErrReadCache")
+}
+
 func Benchmark6kbBlockSize(b *testing.B)    {}
 func Benchmark128kbBlockSize(b *testing.B)  {}
 func Benchmark512kbBlockSize(b *testing.B)  {}
 func Benchmark1024kbBlockSize(b *testing.B) {}
 
-func BenchmarkMD5(b *testing.B)     {}
-func BenchmarkSHA256(b *testing.B)  {}
-func BenchmarkSHA512(b *testing.B)  {}
+func BenchmarkRollingHash(b *testing.B) {
+	block := srand(410, DefaultBlockSize)
+
+	for _, bench := range []struct {
+		name string
+		hash func([]byte, uint32) (uint32, uint32, uint32)
+	}{
+		{"reference", referenceRollingHash},
+		{"running", rollingHash},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(int64(len(block)))
+			for i := 0; i < b.N; i++ {
+				bench.hash(block, mod)
+			}
+		})
+	}
+}
+
+func BenchmarkMD5(b *testing.B)    {}
+func BenchmarkSHA256(b *testing.B) { benchmarkHash(b, func(p []byte) { sha256.Sum256(p) }) }
+func BenchmarkSHA512(b *testing.B) {}
+func BenchmarkBLAKE3(b *testing.B) {
+	h := NewBLAKE3()
+	benchmarkHash(b, func(p []byte) {
+		h.Reset()
+		h.Write(p)
+		h.Sum(nil)
+	})
+}
 func BenchmarkMurmur3(b *testing.B) {}
-func BenchmarkXXHash(b *testing.B)  {}
+func BenchmarkXXHash(b *testing.B)  { benchmarkHash(b, func(p []byte) { xxhash.Sum64(p) }) }
+
+// benchmarkHash measures sum hashing blocks of the default size.
+func benchmarkHash(b *testing.B, sum func(p []byte)) {
+	block := srand(411, DefaultBlockSize)
+	b.SetBytes(int64(len(block)))
+	for i := 0; i < b.N; i++ {
+		sum(block)
+	}
+}
+
+// editPatterns returns representative edits of base, keyed by name.
+func editPatterns(base []byte) map[string][]byte {
+	scattered := append([]byte(nil), base...)
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 100; i++ {
+		copy(scattered[r.Intn(len(base)-16):], srand(int64(i), 16))
+	}
+
+	return map[string][]byte{
+		"append":    append(append([]byte(nil), base...), srand(43, 64*1024)...),
+		"prepend":   append(srand(44, 64*1024), base...),
+		"scattered": scattered,
+		"rewrite":   srand(45, len(base)),
+		"edited":    mutate(base, 47, 100),
+	}
+}
+
+// BenchmarkEndToEnd compares the bytes sent and the time taken to bring an 8mb file up to date
+// after several kinds of edits, syncing it, copying it whole or sending it gzipped. Bytes sent by
+// gsync include the block signatures, at 48 bytes each, and the encoded operations.
+func BenchmarkEndToEnd(b *testing.B) {
+	base := srand(46, 8*1024*1024)
+	patterns := editPatterns(base)
+
+	for _, name := range []string{"append", "prepend", "scattered", "edited", "rewrite"} {
+		source := patterns[name]
+
+		b.Run(name+"/gsync", func(b *testing.B) {
+			ctx := context.Background()
+			b.SetBytes(int64(len(source)))
+
+			var sent int
+			for i := 0; i < b.N; i++ {
+				sigsCh, err := Signatures(ctx, bytes.NewReader(base), nil)
+				assert.Ok(b, err)
+				cacheSigs, err := LookUpTable(ctx, sigsCh)
+				assert.Ok(b, err)
+
+				sr, err := NewSyncReader(ctx, bytes.NewReader(source), nil, cacheSigs)
+				assert.Ok(b, err)
+				wire := new(bytes.Buffer)
+				_, err = io.Copy(wire, sr)
+				assert.Ok(b, err)
+				sent = wire.Len() + (len(base)+DefaultBlockSize-1)/DefaultBlockSize*48
+
+				opsCh, err := Decode(ctx, wire)
+				assert.Ok(b, err)
+				assert.Ok(b, Apply(ctx, ioutil.Discard, bytes.NewReader(base), opsCh))
+			}
+			b.ReportMetric(float64(sent), "sent-bytes")
+		})
+
+		b.Run(name+"/copy", func(b *testing.B) {
+			b.SetBytes(int64(len(source)))
+			for i := 0; i < b.N; i++ {
+				_, err := io.Copy(ioutil.Discard, bytes.NewReader(source))
+				assert.Ok(b, err)
+			}
+			b.ReportMetric(float64(len(source)), "sent-bytes")
+		})
+
+		b.Run(name+"/gzip", func(b *testing.B) {
+			b.SetBytes(int64(len(source)))
+
+			var sent int
+			for i := 0; i < b.N; i++ {
+				compressed := new(bytes.Buffer)
+				w := gzip.NewWriter(compressed)
+				_, err := w.Write(source)
+				assert.Ok(b, err)
+				assert.Ok(b, w.Close())
+				sent = compressed.Len()
+
+				r, err := gzip.NewReader(compressed)
+				assert.Ok(b, err)
+				_, err = io.Copy(ioutil.Discard, r)
+				assert.Ok(b, err)
+			}
+			b.ReportMetric(float64(sent), "sent-bytes")
+		})
+	}
+}
+
+func TestSyncBudget(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(300, 100*DefaultBlockSize)
+	source := append(srand(301, 10*DefaultBlockSize), cache...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	tests := []struct {
+		bytes    int64
+		d        time.Duration
+		exceeded bool
+	}{
+		{0, 0, false},
+		{10 * DefaultBlockSize, 0, false},
+		{10*DefaultBlockSize - 1, 0, true},
+		{0, time.Nanosecond, true},
+		{0, time.Minute, false},
+	}
+
+	for _, tt := range tests {
+		opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, WithBudget(tt.bytes, tt.d))
+		assert.Ok(t, err)
+
+		var ops []BlockOperation
+		var literal int64
+		for op := range opsCh {
+			ops = append(ops, op)
+			literal += int64(len(op.Data))
+		}
+
+		last := ops[len(ops)-1]
+		if !tt.exceeded {
+			assert.Equals(t, true, last.Done)
+			continue
+		}
+
+		assert.Cond(t, errors.Is(last.Error, ErrBudgetExceeded), "expected ErrBudgetExceeded, got %v", last.Error)
+		if tt.bytes > 0 {
+			assert.Cond(t, literal <= tt.bytes, "sent %d bytes of literal data over a budget of %d", literal, tt.bytes)
+		}
+	}
+}
+
+func TestApplyAudit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(185, 20*DefaultBlockSize+5)
+	source := append(srand(186, 100), cache...)
+
+	type entry struct {
+		op     BlockOperation
+		offset int64
+	}
+
+	for _, opts := range [][]Option{nil, {WithPrefetch(4, 8)}} {
+		var log []entry
+		audit := WithAudit(func(op BlockOperation, offset int64) {
+			log = append(log, entry{op, offset})
+		})
+
+		// Coarse signatures make for runs of blocks, which are split up when prefetching.
+		sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil, WithCoarseBlocks(4))
+		assert.Ok(t, err)
+		cacheSigs, err := LookUpTable(ctx, sigsCh)
+		assert.Ok(t, err)
+		opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs)
+		assert.Ok(t, err)
+
+		target := new(bytes.Buffer)
+		assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), opsCh, append(opts, audit)...))
+
+		// Every operation is written where the source data it describes was.
+		var runs int
+		for _, e := range log {
+			if e.op.Count > 1 {
+				runs++
+			}
+			if !e.op.Done {
+				assert.Equals(t, e.op.Offset, e.offset)
+			}
+		}
+		assert.Cond(t, runs > 0, "expected runs of blocks")
+		assert.Equals(t, true, log[len(log)-1].op.Done)
+		assert.Equals(t, int64(len(source)), log[len(log)-1].offset)
+		assert.Equals(t, 100, len(log[0].op.Data))
+		assert.Equals(t, int64(0), log[0].offset)
+	}
+}
+
+// flakyReader fails a single read once it gets to offset failAt, without consuming any data.
+type flakyReader struct {
+	data   []byte
+	off    int
+	failAt int
+	failed bool
+}
+
+func (f *flakyReader) Read(p []byte) (int, error) {
+	if f.off == len(f.data) {
+		return 0, io.EOF
+	}
+
+	if !f.failed && f.off == f.failAt {
+		f.failed = true
+		return 0, errors.New("transient failure")
+	}
+
+	end := len(f.data)
+	if !f.failed && f.failAt < end {
+		end = f.failAt
+	}
+
+	n := copy(p, f.data[f.off:end])
+	f.off += n
+	return n, nil
+}
+
+// TestSignaturesTransientError tests that signatures after a read error stay aligned with
+// their blocks.
+func TestSignaturesTransientError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	data := srand(187, 20*DefaultBlockSize+10)
+	sigsCh, err := Signatures(ctx, bytes.NewReader(data), nil)
+	assert.Ok(t, err)
+	var exp []BlockSignature
+	for sig := range sigsCh {
+		exp = append(exp, sig)
+	}
+
+	for _, failAt := range []int{0, 3 * DefaultBlockSize, 3*DefaultBlockSize + 100, 20*DefaultBlockSize + 5} {
+		for _, opts := range [][]Option{nil, {WithReadAhead(1)}} {
+			sigsCh, err := Signatures(ctx, &flakyReader{data: data, failAt: failAt}, nil, opts...)
+			assert.Ok(t, err)
+
+			failed := uint64(failAt / DefaultBlockSize)
+			var i int
+			for sig := range sigsCh {
+				if sig.Error != nil {
+					assert.Equals(t, failed, sig.Index)
+					assert.Cond(t, errors.Is(sig.Error, ErrReadBlock), "expected ErrReadBlock, got %v", sig.Error)
+					i++
+					continue
+				}
+
+				assert.Cond(t, sig.Index != failed, "unexpected signature of the failed block %d", failed)
+				assert.Equals(t, exp[i], sig)
+				i++
+			}
+			// No Done signature is sent after errors.
+			assert.Equals(t, len(exp)-1, i)
+		}
+	}
+}
+
+func TestOffsetOverflow(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := bytes.NewReader(srand(650, 4*DefaultBlockSize))
+	maxIndex := newOptions(nil).maxIndex()
+	for _, tt := range []struct {
+		op   BlockOperation
+		opts []Option
+	}{
+		{BlockOperation{Index: maxIndex + 1}, nil},
+		{BlockOperation{Index: 1<<64 - 1}, nil},
+		// Counts wrapping around the index space.
+		{BlockOperation{Index: 1<<64 - 2, Count: 4}, nil},
+		{BlockOperation{Index: 1<<64 - 1}, []Option{WithBoundaries([]int64{100, 200})}},
+	} {
+		ops := make(chan BlockOperation, 1)
+		ops <- tt.op
+		close(ops)
+
+		err := Apply(ctx, new(bytes.Buffer), cache, ops, tt.opts...)
+		assert.Cond(t, errors.Is(err, ErrOffsetOverflow), "expected an offset overflow for %+v, got %v", tt.op, err)
+	}
+
+	// Signatures of crafted indices can not be used to locate blocks.
+	_, err := Scrub(ctx, cache, []BlockSignature{{Index: maxIndex + 1, Strong: make([]byte, 32)}})
+	assert.Cond(t, errors.Is(err, ErrOffsetOverflow), "expected an offset overflow, got %v", err)
+
+	s := NewSigner(nil)
+	s.Reset(cache)
+	s.index = maxIndex + 1
+	_, err = s.Next(ctx)
+	assert.Cond(t, errors.Is(err, ErrOffsetOverflow), "expected an offset overflow, got %v", err)
+}
@@ -0,0 +1,150 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"time"
+)
+
+// Tracer starts spans for distributed tracing, so Signatures, Sync and Apply calls can be
+// followed across services. It is trivially adapted to OpenTelemetry or any other tracing
+// library, which this package does not depend on. See WithTracer.
+type Tracer interface {
+	// Start starts a span with the given name, as a child of any span in ctx, returning a context
+	// carrying it.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute records an attribute of the span, whose value is an int64, a float64 or a
+	// time.Duration.
+	SetAttribute(key string, value interface{})
+	// End ends the span, with the error the call failed with, if any.
+	End(err error)
+}
+
+// Phases of a call timed while traced.
+const (
+	phaseRead = iota
+	phaseHash
+	phaseWrite
+	phaseCount
+)
+
+// trace accumulates the attributes of the span of a call, once the call is done. A nil trace
+// records nothing, so calls without a Tracer do not pay for timing their phases.
+type trace struct {
+	span    Span
+	started time.Time
+	phases  [phaseCount]time.Duration
+	// bytes is the amount of data processed, blocks the number of blocks and literal the amount
+	// of literal data sent.
+	bytes, blocks, literal int64
+}
+
+// startTrace starts the span of a call if a Tracer was set, returning a context carrying it.
+func (o *options) startTrace(ctx context.Context, name string) (context.Context, *trace) {
+	if o.tracer == nil {
+		return ctx, nil
+	}
+
+	ctx, span := o.tracer.Start(ctx, name)
+	span.SetAttribute("gsync.block_size", int64(o.size))
+	return ctx, &trace{span: span, started: time.Now()}
+}
+
+// now returns the start time of a phase.
+func (t *trace) now() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// add accounts the time since start to phase.
+func (t *trace) add(phase int, start time.Time) {
+	if t == nil {
+		return
+	}
+	t.phases[phase] += time.Since(start)
+}
+
+// processed accounts for a block of n bytes processed.
+func (t *trace) processed(n int) {
+	if t == nil {
+		return
+	}
+	t.bytes += int64(n)
+	t.blocks++
+}
+
+// sent accounts for n bytes of literal data sent.
+func (t *trace) sent(n int) {
+	if t == nil {
+		return
+	}
+	t.literal += int64(n)
+}
+
+// endSignatures ends the span of a Signatures call.
+func (t *trace) endSignatures(err error) {
+	if t == nil {
+		return
+	}
+
+	t.span.SetAttribute("gsync.bytes", t.bytes)
+	t.span.SetAttribute("gsync.blocks", t.blocks)
+	t.span.SetAttribute("gsync.read_time", t.phases[phaseRead])
+	t.span.SetAttribute("gsync.hash_time", t.phases[phaseHash])
+	t.span.End(err)
+}
+
+// endSync ends the span of a Sync call, which processed the given amount of source data.
+func (t *trace) endSync(processed int64, err error) {
+	if t == nil {
+		return
+	}
+
+	copied := processed - t.literal
+	if copied < 0 {
+		copied = 0
+	}
+
+	var ratio float64
+	if processed > 0 {
+		ratio = float64(copied) / float64(processed)
+	}
+
+	t.span.SetAttribute("gsync.bytes", processed)
+	t.span.SetAttribute("gsync.literal_bytes", t.literal)
+	t.span.SetAttribute("gsync.copied_bytes", copied)
+	t.span.SetAttribute("gsync.match_ratio", ratio)
+	t.span.SetAttribute("gsync.read_time", t.phases[phaseRead])
+	t.span.SetAttribute("gsync.match_time", time.Since(t.started)-t.phases[phaseRead])
+	t.span.End(err)
+}
+
+// processed returns the amount of source data processed by the Syncer.
+func (s *Syncer) processed() int64 {
+	if s.cfg.ranged {
+		return s.offset - s.cfg.rangeStart
+	}
+	return s.offset
+}
+
+// endApply ends the span of an Apply call.
+func (t *trace) endApply(written int64, err error) {
+	if t == nil {
+		return
+	}
+
+	t.span.SetAttribute("gsync.bytes", written)
+	t.span.SetAttribute("gsync.literal_bytes", t.literal)
+	t.span.SetAttribute("gsync.read_time", t.phases[phaseRead])
+	t.span.SetAttribute("gsync.write_time", t.phases[phaseWrite])
+	t.span.End(err)
+}
@@ -0,0 +1,68 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+// recorder is a Tracer recording the attributes of the spans ended, by span name.
+type recorder struct {
+	mu    sync.Mutex
+	spans map[string]map[string]interface{}
+}
+
+type recordedSpan struct {
+	r     *recorder
+	name  string
+	attrs map[string]interface{}
+}
+
+func (r *recorder) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, &recordedSpan{r: r, name: name, attrs: make(map[string]interface{})}
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.attrs[key] = value
+}
+
+func (s *recordedSpan) End(err error) {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	s.r.spans[s.name] = s.attrs
+}
+
+func TestTracer(t *testing.T) {
+	cache := srand(630, 50*DefaultBlockSize+300)
+	source := mutate(cache, 631, 5)
+
+	r := &recorder{spans: make(map[string]map[string]interface{})}
+	target := pipeline(t, source, cache, WithTracer(r))
+	assert.Cond(t, bytes.Equal(source, target), "source and target files are different")
+
+	sigs := r.spans["gsync.Signatures"]
+	assert.Equals(t, int64(len(cache)), sigs["gsync.bytes"])
+	assert.Equals(t, int64(51), sigs["gsync.blocks"])
+	assert.Equals(t, int64(DefaultBlockSize), sigs["gsync.block_size"])
+
+	syn := r.spans["gsync.Sync"]
+	assert.Equals(t, int64(len(source)), syn["gsync.bytes"])
+	literal := syn["gsync.literal_bytes"].(int64)
+	assert.Cond(t, literal > 0 && literal < int64(len(source)), "unexpected literal bytes %d", literal)
+	assert.Equals(t, int64(len(source))-literal, syn["gsync.copied_bytes"])
+	ratio := syn["gsync.match_ratio"].(float64)
+	assert.Cond(t, ratio > 0.5 && ratio < 1, "unexpected match ratio %f", ratio)
+	assert.Cond(t, syn["gsync.match_time"].(time.Duration) > 0, "expected the matching to be timed")
+
+	app := r.spans["gsync.Apply"]
+	assert.Equals(t, int64(len(source)), app["gsync.bytes"])
+	assert.Equals(t, literal, app["gsync.literal_bytes"])
+}
@@ -0,0 +1,136 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Transform converts data between its native form and a normalized form used for matching.
+// Signatures and Sync only ever see normalized data, and so do the operations they produce,
+// while Apply converts the reconstructed data back into native form.
+//
+// Since Sync and Apply need random access to the source and the cache, those are normalized
+// whole into memory, so transforms are best suited for text files of moderate size.
+type Transform interface {
+	// Normalize returns a reader producing the normalized form of the data in r.
+	Normalize(r io.Reader) io.Reader
+	// Denormalize returns a writer converting normalized data into native form before writing
+	// it to w. It is closed once all data was written, so it can flush any pending data.
+	Denormalize(w io.Writer) io.WriteCloser
+}
+
+// CRLF is a Transform for text files using Windows line endings. It normalizes CRLF line
+// endings into LF, and turns every LF back into CRLF when denormalizing. Text files that
+// only differ in their line endings across systems match entirely.
+var CRLF Transform = crlf{}
+
+type crlf struct{}
+
+func (crlf) Normalize(r io.Reader) io.Reader {
+	return crlfReader{bufio.NewReader(r)}
+}
+
+func (crlf) Denormalize(w io.Writer) io.WriteCloser {
+	return crlfWriter{w}
+}
+
+// crlfReader turns CRLF line endings into LF.
+type crlfReader struct {
+	r *bufio.Reader
+}
+
+func (c crlfReader) Read(p []byte) (int, error) {
+	var n int
+	for n < len(p) {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+
+		if b == '\r' {
+			if next, err := c.r.Peek(1); err == nil && next[0] == '\n' {
+				continue
+			}
+		}
+
+		p[n] = b
+		n++
+	}
+	return n, nil
+}
+
+// crlfWriter turns LF line endings into CRLF.
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			n, err := c.w.Write(p)
+			return written + n, err
+		}
+
+		n, err := c.w.Write(p[:i])
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		if _, err := c.w.Write([]byte("\r\n")); err != nil {
+			return written, err
+		}
+		written++
+		p = p[i+1:]
+	}
+	return written, nil
+}
+
+func (c crlfWriter) Close() error {
+	return nil
+}
+
+// normalizeAt loads the normalized form of r into memory.
+func normalizeAt(r io.ReaderAt, t Transform) (io.ReaderAt, error) {
+	data, err := ioutil.ReadAll(t.Normalize(io.NewSectionReader(r, 0, math.MaxInt64)))
+	if err != nil {
+		return nil, &BlockError{Kind: ErrReadBlock, Err: err}
+	}
+	return bytes.NewReader(data), nil
+}
+
+// applyTransform is Apply for a normalized operation stream.
+func applyTransform(ctx context.Context, dst io.Writer, cache io.ReaderAt, ops <-chan BlockOperation, cfg *options) error {
+	if cache != nil {
+		var err error
+		if cache, err = normalizeAt(cache, cfg.transform); err != nil {
+			return errors.Wrapf(err, "failed normalizing cache")
+		}
+	}
+
+	w := cfg.transform.Denormalize(dst)
+	if err := apply(ctx, w, cache, readFrom(cache, cfg), ops, cfg); err != nil {
+		w.Close()
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return &BlockError{Kind: ErrApplyWrite, Err: err}
+	}
+	return nil
+}
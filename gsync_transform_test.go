@@ -0,0 +1,67 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestCRLF(t *testing.T) {
+	native := []byte("a\r\nb\rc\n\r\n\r")
+	normalized, err := ioutil.ReadAll(CRLF.Normalize(iotest.OneByteReader(bytes.NewReader(native))))
+	assert.Ok(t, err)
+	assert.Equals(t, []byte("a\nb\rc\n\n\r"), normalized)
+
+	out := new(bytes.Buffer)
+	w := CRLF.Denormalize(out)
+	_, err = w.Write([]byte("a\nb\n"))
+	assert.Ok(t, err)
+	assert.Ok(t, w.Close())
+	assert.Equals(t, []byte("a\r\nb\r\n"), out.Bytes())
+}
+
+func TestSyncTransform(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// The cache lives on a Windows machine, while the source was edited on Linux.
+	lf := srand(210, 256*1024)
+	cache := bytes.ReplaceAll(lf, []byte("\n"), []byte("\r\n"))
+	source := append(append([]byte(nil), lf...), []byte("one more line\n")...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil, WithTransform(CRLF))
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, cacheSigs, WithTransform(CRLF))
+	assert.Ok(t, err)
+
+	var literal int
+	var ops []BlockOperation
+	for op := range opsCh {
+		assert.Ok(t, op.Error)
+		literal += len(op.Data)
+		ops = append(ops, op)
+	}
+	assert.Cond(t, literal < DefaultBlockSize, "expected a tiny delta, got %d literal bytes", literal)
+
+	c := make(chan BlockOperation, len(ops))
+	for _, op := range ops {
+		c <- op
+	}
+	close(c)
+
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), c, WithTransform(CRLF)))
+	assert.Cond(t, bytes.Equal(bytes.ReplaceAll(source, []byte("\n"), []byte("\r\n")), target.Bytes()), "unexpected reconstruction")
+}
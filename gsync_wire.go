@@ -0,0 +1,560 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Streams start with a header made of the magic string "GSYN", a version byte and a flags byte:
+//
+//	header:      "GSYN" version flags
+//
+// Flag 0x01 means frames carry checksums, flag 0x02 that operations carry their offsets and flag
+// 0x04 that literal data is compressed, see below. Encoders write the current version, wireVersion. Decoders accept streams of any version up to their own, and reject newer
+// versions or unknown flags with ErrUnsupportedVersion rather than misreading them. Therefore,
+// the version is bumped whenever tags or flags are added or their encoding changes, and mixed
+// deployments must upgrade the decoding end first.
+//
+// Operations are encoded on the wire as a tag byte followed by the fields of the operation, with
+// integers encoded as unsigned varints and byte strings prefixed by their length:
+//
+//	copy:        0x01 index count
+//	literal:     0x02 len data
+//	base digest: 0x03 len digest
+//	done:        0x04
+//	error:       0x05 len message
+//	checked:     0x06 len data len checksum
+//	reference:   0x07 ref
+//	hashed copy: 0x08 index len strong
+//	back ref:    0x09 distance
+//	sized copy:  0x0a index count length len strong
+//	heartbeat:   0x0b
+//
+// With WithWireOffsets, the tag of every operation is followed by its Offset, as an unsigned
+// varint, before its other fields. Offsets are not sent otherwise, since Apply does not need them.
+//
+// With WithCompression, the data of literals, checked or not, is compressed with DEFLATE, each
+// literal on its own, and its length prefix is that of the compressed data. Checksums are still
+// those of the uncompressed data.
+//
+// Copy operations carrying the length of their last block are sent as sized copies, with or
+// without a strong checksum. Heartbeats carry no operation and are skipped by Decoder. They are
+// sent to show the sending end is alive while it has nothing else to send, see WithHeartbeat.
+//
+// With WithFrameChecksums, every operation is followed by the CRC-32C of its encoding, tag
+// included, as 4 big-endian bytes.
+const (
+	tagCopy byte = iota + 1
+	tagData
+	tagBaseDigest
+	tagDone
+	tagError
+	tagCheckedData
+	tagRef
+	tagHashedCopy
+	tagBack
+	tagSizedCopy
+	tagHeartbeat
+)
+
+// wireMagic starts every stream, followed by the version and flags bytes.
+const wireMagic = "GSYN"
+
+// wireVersion is the version of the wire format written by Encoder.
+const wireVersion = 6
+
+// Flags set in the header of streams whose frames carry checksums, whose operations carry their
+// offsets and whose literal data is compressed.
+const (
+	flagChecksums  = 0x01
+	flagOffsets    = 0x02
+	flagCompressed = 0x04
+)
+
+// maxWireData is the largest byte string accepted by Decoder, so a corrupt length does not make
+// it allocate arbitrary amounts of memory.
+const maxWireData = 64 << 20
+
+// Encoder writes block operations to a stream in the gsync wire format.
+type Encoder struct {
+	w         io.Writer
+	scratch   []byte
+	checksums bool
+	offsets   bool
+	// deflate compresses literal data into compressed, if enabled.
+	deflate    *flate.Writer
+	compressed bytes.Buffer
+	// started is set once the header was written, err is the error of an invalid option, if any.
+	started bool
+	err     error
+}
+
+// NewEncoder returns an Encoder writing to w. Every operation is written with a single Write call,
+// the first one preceded by the stream header. It takes WithFrameChecksums, WithWireOffsets and
+// WithCompression. Encoders given invalid options fail on every call with the option error.
+func NewEncoder(w io.Writer, opts ...Option) *Encoder {
+	cfg := newOptions(opts)
+	e := &Encoder{w: w, checksums: cfg.frameChecksums, offsets: cfg.wireOffsets, err: cfg.err}
+	if cfg.compress && e.err == nil {
+		e.deflate, e.err = flate.NewWriter(&e.compressed, cfg.level)
+	}
+	return e
+}
+
+// Encode writes op to the stream. Errors carried by operations are sent as their message.
+func (e *Encoder) Encode(op BlockOperation) error {
+	if e.err != nil {
+		return e.err
+	}
+
+	b, frame := e.start()
+	switch {
+	case op.Error != nil:
+		b = appendBytes(e.tag(b, tagError, op), []byte(op.Error.Error()))
+	case op.BaseDigest != nil:
+		b = appendBytes(e.tag(b, tagBaseDigest, op), op.BaseDigest)
+	case op.Done:
+		b = e.tag(b, tagDone, op)
+	case op.Ref != 0:
+		b = appendUvarint(e.tag(b, tagRef, op), op.Ref)
+	case op.Back != 0:
+		b = appendUvarint(e.tag(b, tagBack, op), op.Back)
+	case len(op.Data) > 0 && op.Checksum != nil:
+		b = appendBytes(e.tag(b, tagCheckedData, op), e.literal(op.Data))
+		b = appendBytes(b, op.Checksum)
+	case len(op.Data) > 0:
+		b = appendBytes(e.tag(b, tagData, op), e.literal(op.Data))
+	case op.Length > 0:
+		b = appendUvarint(e.tag(b, tagSizedCopy, op), op.Index)
+		b = appendUvarint(b, op.Count)
+		b = appendUvarint(b, uint64(op.Length))
+		b = appendBytes(b, op.Strong)
+	case op.Strong != nil && op.blocks() == 1:
+		b = appendUvarint(e.tag(b, tagHashedCopy, op), op.Index)
+		b = appendBytes(b, op.Strong)
+	default:
+		b = appendUvarint(e.tag(b, tagCopy, op), op.Index)
+		b = appendUvarint(b, op.Count)
+	}
+	return errors.Wrapf(e.write(b, frame), "failed encoding block operation")
+}
+
+// tag appends the tag of an operation, followed by its offset if enabled.
+func (e *Encoder) tag(b []byte, tag byte, op BlockOperation) []byte {
+	b = append(b, tag)
+	if e.offsets {
+		b = appendUvarint(b, uint64(op.Offset))
+	}
+	return b
+}
+
+// literal returns the data of a literal as sent, compressed if enabled. The returned slice is only
+// valid until the next call.
+func (e *Encoder) literal(data []byte) []byte {
+	if e.deflate == nil {
+		return data
+	}
+
+	// Writes to a bytes.Buffer never fail.
+	e.compressed.Reset()
+	e.deflate.Reset(&e.compressed)
+	e.deflate.Write(data)
+	e.deflate.Close()
+	return e.compressed.Bytes()
+}
+
+// Heartbeat writes a heartbeat frame, which Decoder skips, to show the stream is alive.
+func (e *Encoder) Heartbeat() error {
+	if e.err != nil {
+		return e.err
+	}
+
+	b, frame := e.start()
+	return errors.Wrapf(e.write(append(b, tagHeartbeat), frame), "failed encoding heartbeat")
+}
+
+// start returns the scratch buffer to encode the next frame into, holding the stream header if
+// not written yet, and the position where the frame starts.
+func (e *Encoder) start() ([]byte, int) {
+	b := e.scratch[:0]
+	if !e.started {
+		var flags byte
+		if e.checksums {
+			flags |= flagChecksums
+		}
+		if e.offsets {
+			flags |= flagOffsets
+		}
+		if e.deflate != nil {
+			flags |= flagCompressed
+		}
+		b = append(append(b, wireMagic...), wireVersion, flags)
+	}
+	return b, len(b)
+}
+
+// write checksums the frame starting at b[frame:], if enabled, and writes b.
+func (e *Encoder) write(b []byte, frame int) error {
+	if e.checksums {
+		var sum [4]byte
+		binary.BigEndian.PutUint32(sum[:], crc32.Checksum(b[frame:], crc32cTable))
+		b = append(b, sum[:]...)
+	}
+	e.scratch = b
+
+	_, err := e.w.Write(b)
+	e.started = e.started || err == nil
+	return err
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendBytes(b, data []byte) []byte {
+	return append(appendUvarint(b, uint64(len(data))), data...)
+}
+
+// Decoder reads block operations off a stream in the gsync wire format.
+type Decoder struct {
+	src *bufio.Reader
+	r   *frameReader
+	// require is set to reject streams without frame checksums, see WithFrameChecksums.
+	require bool
+	// offsets is set if operations carry their offsets, see WithWireOffsets.
+	offsets bool
+	// inflate decompresses literal data, if compressed, see WithCompression.
+	inflate io.ReadCloser
+	// size is the block size, which copied blocks can not be longer than.
+	size int
+	// started is set once the header was read, err is the error reading it, if any.
+	started bool
+	err     error
+}
+
+// NewDecoder returns a Decoder reading from r. Whether frames carry checksums, and whether literal
+// data is compressed, is read from the stream header. With WithFrameChecksums, streams without
+// checksums are rejected. Streams calculated WithBlockSize must be decoded with the same option.
+func NewDecoder(r io.Reader, opts ...Option) *Decoder {
+	cfg := newOptions(opts)
+	d := &Decoder{src: bufio.NewReader(r), require: cfg.frameChecksums, size: cfg.size}
+	d.r = &frameReader{r: d.src}
+	d.started, d.err = cfg.err != nil, cfg.err
+	return d
+}
+
+// Decode reads the next operation from the stream. It returns io.EOF if the stream ends cleanly
+// between operations, io.ErrUnexpectedEOF if it ends in the middle of one and ErrMalformedStream
+// if the data read is not a valid operation. It returns ErrUnsupportedVersion if the stream was
+// written with a newer version of the wire format. If frames carry checksums, it returns
+// ErrFrameCorrupt if the operation read does not match its checksum. Error operations are decoded
+// into an error carrying the remote message. Heartbeats are skipped.
+func (d *Decoder) Decode() (BlockOperation, error) {
+	if !d.started {
+		d.started, d.err = true, d.header()
+	}
+	if d.err != nil {
+		return BlockOperation{}, d.err
+	}
+
+	for {
+		op, err := d.frame()
+		if err != errHeartbeat {
+			return op, err
+		}
+	}
+}
+
+// errHeartbeat is returned by frame for heartbeats.
+var errHeartbeat = errors.New("gsync: heartbeat")
+
+// frame reads the next frame from the stream, verifying its checksum if enabled.
+func (d *Decoder) frame() (BlockOperation, error) {
+	d.r.crc = 0
+	op, err := d.decode()
+	if (err != nil && err != errHeartbeat) || !d.r.checksums {
+		return op, err
+	}
+	beat := err
+
+	var sum [4]byte
+	if _, err := io.ReadFull(d.src, sum[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return BlockOperation{}, err
+	}
+
+	if binary.BigEndian.Uint32(sum[:]) != d.r.crc {
+		return BlockOperation{}, ErrFrameCorrupt
+	}
+	return op, beat
+}
+
+// header reads and validates the stream header.
+func (d *Decoder) header() error {
+	var h [len(wireMagic) + 2]byte
+	if _, err := io.ReadFull(d.src, h[:]); err != nil {
+		return err
+	}
+
+	if string(h[:len(wireMagic)]) != wireMagic {
+		return errors.Wrapf(ErrMalformedStream, "missing stream header")
+	}
+
+	version, flags := h[len(wireMagic)], h[len(wireMagic)+1]
+	if version == 0 || version > wireVersion {
+		return errors.Wrapf(ErrUnsupportedVersion, "version %d", version)
+	}
+	if flags&^(flagChecksums|flagOffsets|flagCompressed) != 0 {
+		return errors.Wrapf(ErrUnsupportedVersion, "unknown flags %#x", flags)
+	}
+
+	d.r.checksums = flags&flagChecksums != 0
+	d.offsets = flags&flagOffsets != 0
+	if flags&flagCompressed != 0 {
+		d.inflate = flate.NewReader(bytes.NewReader(nil))
+	}
+	if d.require && !d.r.checksums {
+		return errors.Wrapf(ErrMalformedStream, "stream without frame checksums")
+	}
+	return nil
+}
+
+// decode reads the next operation.
+func (d *Decoder) decode() (BlockOperation, error) {
+	tag, err := d.r.ReadByte()
+	if err != nil {
+		return BlockOperation{}, err
+	}
+	if !d.offsets || tag == tagHeartbeat {
+		return d.fields(tag)
+	}
+
+	offset, err := d.uvarint()
+	if err != nil {
+		return BlockOperation{}, err
+	}
+	if offset > math.MaxInt64 {
+		return BlockOperation{}, errors.Wrapf(ErrMalformedStream, "invalid offset %d", offset)
+	}
+
+	op, err := d.fields(tag)
+	op.Offset = int64(offset)
+	return op, err
+}
+
+// fields reads the fields of an operation with the given tag.
+func (d *Decoder) fields(tag byte) (BlockOperation, error) {
+	switch tag {
+	case tagCopy:
+		index, err := d.uvarint()
+		if err != nil {
+			return BlockOperation{}, err
+		}
+		count, err := d.uvarint()
+		if err != nil {
+			return BlockOperation{}, err
+		}
+		return BlockOperation{Index: index, Count: count}, nil
+	case tagData:
+		data, err := d.literal()
+		return BlockOperation{Data: data}, err
+	case tagCheckedData:
+		data, err := d.literal()
+		if err != nil {
+			return BlockOperation{}, err
+		}
+		checksum, err := d.bytes()
+		return BlockOperation{Data: data, Checksum: checksum}, err
+	case tagBaseDigest:
+		digest, err := d.bytes()
+		return BlockOperation{BaseDigest: digest}, err
+	case tagDone:
+		return BlockOperation{Done: true}, nil
+	case tagRef:
+		ref, err := d.uvarint()
+		return BlockOperation{Ref: ref}, err
+	case tagBack:
+		back, err := d.uvarint()
+		if err == nil && back == 0 {
+			err = errors.Wrapf(ErrMalformedStream, "back reference of zero bytes")
+		}
+		return BlockOperation{Back: back}, err
+	case tagHashedCopy:
+		index, err := d.uvarint()
+		if err != nil {
+			return BlockOperation{}, err
+		}
+		strong, err := d.bytes()
+		return BlockOperation{Index: index, Strong: strong}, err
+	case tagSizedCopy:
+		return d.sizedCopy()
+	case tagHeartbeat:
+		return BlockOperation{}, errHeartbeat
+	case tagError:
+		msg, err := d.bytes()
+		if err != nil {
+			return BlockOperation{}, err
+		}
+		return BlockOperation{Error: errors.New(string(msg))}, nil
+	}
+	return BlockOperation{}, errors.Wrapf(ErrMalformedStream, "unknown operation tag %#x", tag)
+}
+
+// sizedCopy reads the fields of a copy operation carrying the length of its last block.
+func (d *Decoder) sizedCopy() (BlockOperation, error) {
+	var op BlockOperation
+	var err error
+	if op.Index, err = d.uvarint(); err != nil {
+		return op, err
+	}
+	if op.Count, err = d.uvarint(); err != nil {
+		return op, err
+	}
+
+	length, err := d.uvarint()
+	if err != nil {
+		return op, err
+	}
+	if length == 0 || length > uint64(d.size) {
+		return op, errors.Wrapf(ErrMalformedStream, "invalid block length %d", length)
+	}
+	op.Length = int(length)
+
+	if op.Strong, err = d.bytes(); len(op.Strong) == 0 {
+		op.Strong = nil
+	}
+	return op, err
+}
+
+// frameReader reads from r, calculating the checksum of the data read if checksums are enabled.
+type frameReader struct {
+	r         *bufio.Reader
+	checksums bool
+	crc       uint32
+	b         [1]byte
+}
+
+func (f *frameReader) ReadByte() (byte, error) {
+	c, err := f.r.ReadByte()
+	if err == nil && f.checksums {
+		f.b[0] = c
+		f.crc = crc32.Update(f.crc, crc32cTable, f.b[:])
+	}
+	return c, err
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if f.checksums {
+		f.crc = crc32.Update(f.crc, crc32cTable, p[:n])
+	}
+	return n, err
+}
+
+func (d *Decoder) uvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(d.r)
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, errors.Wrapf(ErrMalformedStream, "%v", err)
+	}
+	return v, err
+}
+
+func (d *Decoder) bytes() ([]byte, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	if n > maxWireData {
+		return nil, errors.Wrapf(ErrMalformedStream, "byte string of %d bytes is too long", n)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// literal reads the data of a literal, decompressing it if compressed.
+func (d *Decoder) literal() ([]byte, error) {
+	data, err := d.bytes()
+	if err != nil || d.inflate == nil {
+		return data, err
+	}
+
+	if err := d.inflate.(flate.Resetter).Reset(bytes.NewReader(data), nil); err != nil {
+		return nil, errors.Wrapf(ErrMalformedStream, "%v", err)
+	}
+	// Literals inflating past maxWireData are rejected as any other byte string that long.
+	data, err = io.ReadAll(io.LimitReader(d.inflate, maxWireData+1))
+	if err == nil && len(data) > maxWireData {
+		err = errors.Errorf("literal of more than %d bytes", maxWireData)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(ErrMalformedStream, "failed decompressing literal: %v", err)
+	}
+	return data, nil
+}
+
+// Decode reads block operations off r into a channel that can be passed on to Apply. Failures
+// decoding the stream are sent as an operation carrying the error, after which the channel is
+// closed. The channel is also closed once the stream ends, use WithRequireDone on Apply to tell
+// apart a complete stream from one cut short between operations. It takes WithFrameChecksums and
+// WithBlockSize, as NewDecoder does.
+func Decode(ctx context.Context, r io.Reader, opts ...Option) (<-chan BlockOperation, error) {
+	if r == nil {
+		return nil, ErrNilReader
+	}
+
+	d := NewDecoder(r, opts...)
+	o := make(chan BlockOperation)
+
+	go func() {
+		defer close(o)
+
+		for {
+			op, err := d.Decode()
+			if err == io.EOF {
+				return
+			}
+
+			if err != nil {
+				op = BlockOperation{Error: err}
+			}
+
+			select {
+			case o <- op:
+			case <-ctx.Done():
+				return
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return o, nil
+}
@@ -0,0 +1,289 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	ops := []BlockOperation{
+		{BaseDigest: []byte("digest")},
+		{Index: 3},
+		{Index: 1 << 40, Count: 16},
+		{Data: srand(230, 100)},
+		{Data: []byte("checked"), Checksum: literalChecksum([]byte("checked"))},
+		{Ref: 7},
+		{Index: 5, Strong: []byte("strong")},
+		{Index: 4, Count: 2, Length: 100},
+		{Index: 6, Length: 7, Strong: []byte("strong")},
+		{Back: 2 * DefaultBlockSize},
+		{Done: true},
+	}
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	for _, op := range ops {
+		assert.Ok(t, enc.Encode(op))
+	}
+	assert.Ok(t, enc.Encode(BlockOperation{Error: errors.New("boom")}))
+	encoded := buf.Bytes()
+
+	dec := NewDecoder(bytes.NewReader(encoded))
+	for _, exp := range ops {
+		op, err := dec.Decode()
+		assert.Ok(t, err)
+		assert.Equals(t, exp, op)
+	}
+
+	op, err := dec.Decode()
+	assert.Ok(t, err)
+	assert.Equals(t, "boom", op.Error.Error())
+
+	_, err = dec.Decode()
+	assert.Equals(t, io.EOF, err)
+
+	// Streams cut short in the middle of an operation are detected.
+	dec = NewDecoder(bytes.NewReader(encoded[:26]))
+	for i := 0; i < 3; i++ {
+		_, err = dec.Decode()
+		assert.Ok(t, err)
+	}
+	_, err = dec.Decode()
+	assert.Equals(t, io.ErrUnexpectedEOF, err)
+
+	_, err = NewDecoder(bytes.NewReader(append(encoded[:6:6], 0xff))).Decode()
+	assert.Cond(t, errors.Is(err, ErrMalformedStream), "expected ErrMalformedStream, got %v", err)
+}
+
+func TestWireHeader(t *testing.T) {
+	buf := new(bytes.Buffer)
+	assert.Ok(t, NewEncoder(buf).Encode(BlockOperation{Done: true}))
+	assert.Equals(t, []byte{'G', 'S', 'Y', 'N', wireVersion, 0, tagDone}, buf.Bytes())
+
+	_, err := NewDecoder(new(bytes.Buffer)).Decode()
+	assert.Equals(t, io.EOF, err)
+
+	tests := []struct {
+		desc   string
+		stream []byte
+		err    error
+	}{
+		{"no header", []byte{tagDone}, io.ErrUnexpectedEOF},
+		{"bad magic", []byte{'R', 'S', 'Y', 'N', wireVersion, 0, tagDone}, ErrMalformedStream},
+		{"version zero", []byte{'G', 'S', 'Y', 'N', 0, 0, tagDone}, ErrUnsupportedVersion},
+		{"newer version", []byte{'G', 'S', 'Y', 'N', wireVersion + 1, 0, tagDone}, ErrUnsupportedVersion},
+		{"unknown flags", []byte{'G', 'S', 'Y', 'N', wireVersion, 0x80, tagDone}, ErrUnsupportedVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			dec := NewDecoder(bytes.NewReader(tt.stream))
+			for i := 0; i < 2; i++ {
+				_, err := dec.Decode()
+				assert.Cond(t, errors.Is(err, tt.err), "expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+// TestWireOffsets tests that operations keep their offsets across the wire WithWireOffsets, and
+// only then.
+func TestWireOffsets(t *testing.T) {
+	ops := []BlockOperation{
+		{BaseDigest: []byte("digest")},
+		{Index: 3, Offset: 0},
+		{Data: []byte("literal"), Offset: DefaultBlockSize},
+		{Index: 4, Count: 2, Length: 100, Offset: DefaultBlockSize + 7},
+		{Index: 1 << 40, Offset: 1 << 50},
+		{Done: true, Offset: 1<<50 + DefaultBlockSize},
+	}
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf, WithWireOffsets(), WithFrameChecksums())
+	for _, op := range ops {
+		assert.Ok(t, enc.Encode(op))
+		assert.Ok(t, enc.Heartbeat())
+	}
+	assert.Equals(t, byte(flagChecksums|flagOffsets), buf.Bytes()[len(wireMagic)+1])
+
+	dec := NewDecoder(bytes.NewReader(buf.Bytes()))
+	for _, exp := range ops {
+		op, err := dec.Decode()
+		assert.Ok(t, err)
+		assert.Equals(t, exp, op)
+	}
+	_, err := dec.Decode()
+	assert.Equals(t, io.EOF, err)
+
+	buf.Reset()
+	assert.Ok(t, NewEncoder(buf).Encode(ops[2]))
+	op, err := NewDecoder(buf).Decode()
+	assert.Ok(t, err)
+	assert.Equals(t, int64(0), op.Offset)
+
+	// Offsets not fitting an int64 are rejected.
+	stream := []byte{'G', 'S', 'Y', 'N', wireVersion, flagOffsets, tagDone}
+	stream = appendUvarint(stream, math.MaxUint64)
+	_, err = NewDecoder(bytes.NewReader(stream)).Decode()
+	assert.Cond(t, errors.Is(err, ErrMalformedStream), "expected ErrMalformedStream, got %v", err)
+}
+
+// TestWireCompression tests that literal data is compressed WithCompression, and inflated back by
+// Decoder transparently.
+func TestWireCompression(t *testing.T) {
+	text := bytes.Repeat([]byte("compressible literal data\n"), 1000)
+	ops := []BlockOperation{
+		{Index: 3},
+		{Data: text},
+		{Data: text[:100], Checksum: literalChecksum(text[:100])},
+		{Data: srand(231, 100)},
+		{Done: true},
+	}
+
+	encode := func(opts ...Option) []byte {
+		buf := new(bytes.Buffer)
+		enc := NewEncoder(buf, opts...)
+		for _, op := range ops {
+			assert.Ok(t, enc.Encode(op))
+		}
+		return buf.Bytes()
+	}
+	plain, compressed := encode(), encode(WithCompression(flate.BestSpeed), WithFrameChecksums())
+	assert.Equals(t, byte(flagChecksums|flagCompressed), compressed[len(wireMagic)+1])
+	assert.Cond(t, len(compressed) < len(plain)/10, "expected a compressed stream, got %d bytes out of %d", len(compressed), len(plain))
+
+	dec := NewDecoder(bytes.NewReader(compressed))
+	for _, exp := range ops {
+		op, err := dec.Decode()
+		assert.Ok(t, err)
+		assert.Equals(t, exp, op)
+	}
+	_, err := dec.Decode()
+	assert.Equals(t, io.EOF, err)
+
+	// Literals that do not inflate are rejected.
+	stream := []byte{'G', 'S', 'Y', 'N', wireVersion, flagCompressed, tagData}
+	stream = appendBytes(stream, []byte("not deflated"))
+	_, err = NewDecoder(bytes.NewReader(stream)).Decode()
+	assert.Cond(t, errors.Is(err, ErrMalformedStream), "expected ErrMalformedStream, got %v", err)
+
+	err = NewEncoder(new(bytes.Buffer), WithCompression(flate.BestCompression+1)).Encode(ops[0])
+	assert.Equals(t, ErrInvalidCompression, err)
+}
+
+func TestFrameChecksums(t *testing.T) {
+	ops := []BlockOperation{
+		{Index: 3},
+		{Data: srand(234, 100)},
+		{Done: true},
+	}
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf, WithFrameChecksums())
+	for _, op := range ops {
+		assert.Ok(t, enc.Encode(op))
+	}
+	encoded := buf.Bytes()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	opsCh, err := Decode(ctx, bytes.NewReader(encoded), WithFrameChecksums())
+	assert.Ok(t, err)
+	var got []BlockOperation
+	for op := range opsCh {
+		assert.Ok(t, op.Error)
+		got = append(got, op)
+	}
+	assert.Equals(t, ops, got)
+
+	// Flips a byte of the literal, which still decodes as a valid operation.
+	corrupt := append([]byte(nil), encoded...)
+	corrupt[26] ^= 1
+
+	dec := NewDecoder(bytes.NewReader(corrupt), WithFrameChecksums())
+	_, err = dec.Decode()
+	assert.Ok(t, err)
+	_, err = dec.Decode()
+	assert.Equals(t, ErrFrameCorrupt, err)
+
+	// Streams cut short before the checksum are detected.
+	_, err = NewDecoder(bytes.NewReader(encoded[:10]), WithFrameChecksums()).Decode()
+	assert.Equals(t, io.ErrUnexpectedEOF, err)
+
+	// Decoders learn about checksums from the header, but can require them.
+	dec = NewDecoder(bytes.NewReader(corrupt))
+	_, err = dec.Decode()
+	assert.Ok(t, err)
+	_, err = dec.Decode()
+	assert.Equals(t, ErrFrameCorrupt, err)
+
+	plain := new(bytes.Buffer)
+	assert.Ok(t, NewEncoder(plain).Encode(BlockOperation{Done: true}))
+	_, err = NewDecoder(plain, WithFrameChecksums()).Decode()
+	assert.Cond(t, errors.Is(err, ErrMalformedStream), "expected ErrMalformedStream, got %v", err)
+}
+
+func TestSyncReader(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(231, 512*1024)
+	source := append(srand(232, 1000), cache[:300*1024]...)
+	source = append(source, srand(233, 5000)...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	sr, err := NewSyncReader(ctx, bytes.NewReader(source), nil, cacheSigs)
+	assert.Ok(t, err)
+
+	conn := new(bytes.Buffer)
+	_, err = io.Copy(conn, sr)
+	assert.Ok(t, err)
+	assert.Cond(t, conn.Len() < 10*1024, "expected a small stream, got %d bytes", conn.Len())
+
+	opsCh, err := Decode(ctx, conn)
+	assert.Ok(t, err)
+
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), opsCh, WithRequireDone()))
+	assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+}
+
+func TestHeartbeat(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithFrameChecksums()}} {
+		buf := new(bytes.Buffer)
+		enc := NewEncoder(buf, opts...)
+		assert.Ok(t, enc.Heartbeat())
+		assert.Ok(t, enc.Encode(BlockOperation{Index: 1}))
+		assert.Ok(t, enc.Heartbeat())
+		assert.Ok(t, enc.Heartbeat())
+		assert.Ok(t, enc.Encode(BlockOperation{Done: true}))
+		assert.Ok(t, enc.Heartbeat())
+
+		// Heartbeats are skipped, including one before the first operation, right after the header.
+		dec := NewDecoder(bytes.NewReader(buf.Bytes()), opts...)
+		for _, exp := range []BlockOperation{{Index: 1}, {Done: true}} {
+			op, err := dec.Decode()
+			assert.Ok(t, err)
+			assert.Equals(t, exp, op)
+		}
+		_, err := dec.Decode()
+		assert.Equals(t, io.EOF, err)
+	}
+}
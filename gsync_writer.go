@@ -0,0 +1,109 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// SyncWriter reconstructs a file from operations added one at a time on the caller's goroutine,
+// as Apply does from a channel. It suits loops pulling operations themselves, such as off a
+// Decoder reading the stream of a SyncReader, which would otherwise need a goroutine to feed
+// Apply. A SyncWriter is not safe for concurrent use.
+type SyncWriter struct {
+	a   *applier
+	bfp *[]byte
+	// denormalize finishes writing the data, see WithTransform.
+	denormalize io.WriteCloser
+	err         error
+	closed      bool
+}
+
+// NewSyncWriter returns a SyncWriter reconstructing a file into dst, taking the same arguments and
+// options as Apply, except for WithPrefetch. It must be closed once done.
+func NewSyncWriter(dst io.Writer, cache io.ReaderAt, opts ...Option) (*SyncWriter, error) {
+	cfg := newOptions(opts)
+	if cfg.err != nil {
+		return nil, cfg.err
+	}
+
+	if cfg.prefetchWorkers > 0 {
+		return nil, errors.New("gsync: SyncWriter does not support WithPrefetch")
+	}
+
+	if cfg.ranged {
+		if w, ok := dst.(io.WriterAt); ok {
+			dst = &offsetWriter{w: w, off: cfg.rangeStart}
+		}
+		if cache != nil {
+			cache = clipReaderAt{r: cache, end: cfg.rangeEnd}
+		}
+	}
+
+	w := &SyncWriter{}
+	if cfg.transform != nil {
+		if cache != nil {
+			var err error
+			if cache, err = normalizeAt(cache, cfg.transform); err != nil {
+				return nil, errors.Wrapf(err, "failed normalizing cache")
+			}
+		}
+		w.denormalize = cfg.transform.Denormalize(dst)
+		dst = w.denormalize
+	}
+
+	w.a = &applier{dst: dst, cache: cache, read: readFrom(cache, cfg), cfg: cfg}
+	if cfg.dedup > 0 {
+		w.a.dict = newLiteralDict(cfg.dedup, false)
+	}
+
+	w.bfp = cfg.getBuffer()
+	w.a.buffer = *w.bfp
+	return w, nil
+}
+
+// Add applies op. Once an operation fails, Add keeps returning the same error.
+func (w *SyncWriter) Add(op BlockOperation) error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+
+	if w.err == nil {
+		w.err = w.a.apply(op, nil)
+	}
+	return w.err
+}
+
+// Written returns the amount of data written to the destination so far.
+func (w *SyncWriter) Written() int64 {
+	return w.a.offset
+}
+
+// Close finishes the reconstruction and releases the resources of w. It returns the error Add
+// failed with, if any, or ErrTruncatedStream if configured WithRequireDone and no Done operation
+// was added.
+func (w *SyncWriter) Close() error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	w.closed = true
+
+	w.a.cfg.putBuffer(w.bfp)
+	w.a.buffer, w.bfp = nil, nil
+
+	err := w.err
+	if err == nil {
+		err = w.a.finish()
+	}
+
+	if w.denormalize != nil {
+		if cerr := w.denormalize.Close(); err == nil && cerr != nil {
+			err = &BlockError{Kind: ErrApplyWrite, Err: cerr}
+		}
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+func TestSyncWriter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cache := srand(490, 40*DefaultBlockSize+10)
+	source := mutate(cache, 491, 10)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	cacheSigs, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	sr, err := NewSyncReader(ctx, bytes.NewReader(source), nil, cacheSigs)
+	assert.Ok(t, err)
+
+	target := new(bytes.Buffer)
+	w, err := NewSyncWriter(target, bytes.NewReader(cache), WithRequireDone())
+	assert.Ok(t, err)
+
+	dec := NewDecoder(sr)
+	for {
+		op, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		assert.Ok(t, err)
+		assert.Ok(t, w.Add(op))
+	}
+	assert.Equals(t, int64(len(source)), w.Written())
+	assert.Ok(t, w.Close())
+	assert.Cond(t, bytes.Equal(source, target.Bytes()), "source and target files are different")
+
+	assert.Equals(t, ErrWriterClosed, w.Add(BlockOperation{Done: true}))
+	assert.Equals(t, ErrWriterClosed, w.Close())
+
+	// Streams without a Done operation are incomplete.
+	w, err = NewSyncWriter(new(bytes.Buffer), nil, WithRequireDone())
+	assert.Ok(t, err)
+	assert.Ok(t, w.Add(BlockOperation{Data: []byte("data")}))
+	assert.Equals(t, ErrTruncatedStream, w.Close())
+
+	// Failures stick.
+	w, err = NewSyncWriter(new(bytes.Buffer), nil)
+	assert.Ok(t, err)
+	err = w.Add(BlockOperation{Index: 1})
+	assert.Cond(t, errors.Is(err, ErrMissingCache), "expected ErrMissingCache, got %v", err)
+	assert.Equals(t, err, w.Add(BlockOperation{Data: []byte("data")}))
+	assert.Equals(t, err, w.Close())
+	assert.Equals(t, int64(0), w.Written())
+
+	_, err = NewSyncWriter(new(bytes.Buffer), nil, WithPrefetch(2, 2))
+	assert.Cond(t, err != nil, "expected WithPrefetch to be rejected")
+}